@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ACK 是接收方对一个 key 的确认，payload 为该 key；同一个 key 的多次传输按顺序依次确认
+const ACK = "ACK0"
+
+// ErrStreamNotFinished 表示 writer 尚未以 StatusOK Close 就等待确认，或者 reader 尚未读到 io.EOF 就发送确认
+var ErrStreamNotFinished = errors.New("stream not finished")
+
+// ErrAckLost 表示连接在收到确认之前已经断开或被关闭
+var ErrAckLost = errors.New("connection lost before ack")
+
+// ErrAckDropped 表示等待确认的 writer 超过了 maxAwaitingAcks 个，最早结束的那个不再等待对端的确认
+var ErrAckDropped = errors.New("ack no longer awaited")
+
+// maxAwaitingAcks 是一个连接上同时等待确认的 writer 的上限；对端从不 Ack 时，登记的等待不会无限增长
+const maxAwaitingAcks = 1024
+
+// Ack 告知发送者该 key 的数据已经被完整读取，发送者的 WaitAck 随即返回；只能在 reader 返回 io.EOF 之后调用，
+// 否则返回 ErrStreamNotFinished；重复调用不会再次发送
+func (c *ConnReader) Ack() error {
+	c.conn.rdmu.Lock()
+	finished := c.finished && c.finErr == io.EOF
+	acked := c.acked
+	c.acked = true
+	c.conn.rdmu.Unlock()
+	if !finished {
+		return ErrStreamNotFinished
+	}
+	if acked {
+		return nil
+	}
+	return c.conn.writeControl(FrameAck, []byte(c.key))
+}
+
+// WaitAck 等待接收方通过 Ack 确认已经完整读取该 key，只能在 Close 成功之后调用，否则返回 ErrStreamNotFinished；
+// 与 Ping 一样，ACK 由正在读取该连接的 goroutine 处理，因此等待期间需要有 goroutine 在读取该连接；
+// 连接断开或被关闭时返回包装了 ErrAckLost 的错误，ctx 结束时返回 ctx.Err()；对端已经完成过该传输（见 SendWithID）时立即返回 nil；
+// 之后又有超过 maxAwaitingAcks 个 writer 结束而该 key 仍未被确认时返回 ErrAckDropped
+func (c *ConnWriter) WaitAck(ctx context.Context) error {
+	if c.acked == nil {
+		return ErrStreamNotFinished
+	}
+	select {
+	case <-c.acked:
+		return c.ackErr
+	default:
+	}
+	select {
+	case <-c.acked:
+		return c.ackErr
+	case <-c.conn.lostCh():
+		// an ACK read right before the connection went away still counts
+		select {
+		case <-c.acked:
+			return c.ackErr
+		default:
+		}
+		return fmt.Errorf("%w: %v", ErrAckLost, c.conn.lostError())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// expectAck 在写出 FIN 之前登记该 writer 等待的确认；已经有 maxAwaitingAcks 个 writer 在等待时放弃最早的那个，
+// 连接已经断开时不再登记，WaitAck 会从 lostCh 得知
+func (c *ConnWriter) expectAck() {
+	c.acked = make(chan struct{})
+	if c.discard {
+		// the receiver won't see this stream again, it already has it
+		close(c.acked)
+		return
+	}
+	conn := c.conn
+	conn.amu.Lock()
+	defer conn.amu.Unlock()
+	if conn.lostErr != nil {
+		return
+	}
+	if len(conn.awaiting) == maxAwaitingAcks {
+		oldest := conn.awaiting[0]
+		oldest.ackErr = ErrAckDropped
+		close(oldest.acked)
+		conn.awaiting = slices.Delete(conn.awaiting, 0, 1)
+	}
+	conn.awaiting = append(conn.awaiting, c)
+}
+
+// acceptAck 处理对端的 ACK，唤醒最早结束的、等待该 key 确认的 writer
+func (conn *Conn) acceptAck(key string) {
+	conn.amu.Lock()
+	defer conn.amu.Unlock()
+	i := slices.IndexFunc(conn.awaiting, func(w *ConnWriter) bool { return w.key == key })
+	if i < 0 {
+		return
+	}
+	close(conn.awaiting[i].acked)
+	conn.awaiting = slices.Delete(conn.awaiting, i, i+1)
+}
+
+// lostCh 返回连接不再能收到任何帧时关闭的 channel
+func (conn *Conn) lostCh() <-chan struct{} {
+	conn.amu.Lock()
+	defer conn.amu.Unlock()
+	if conn.lost == nil {
+		conn.lost = make(chan struct{})
+	}
+	return conn.lost
+}
+
+// lose 记录连接因 err 不再能收到任何帧，只有第一次调用生效
+func (conn *Conn) lose(err error) {
+	conn.amu.Lock()
+	defer conn.amu.Unlock()
+	if conn.lostErr != nil {
+		return
+	}
+	conn.lostErr = err
+	// no ACK can arrive any more, the waiters learn that from lost
+	conn.awaiting = nil
+	if conn.lost == nil {
+		conn.lost = make(chan struct{})
+	}
+	close(conn.lost)
+	if conn.endLife != nil {
+		conn.endLife()
+	}
+}
+
+// lostError 返回连接不再能收到帧的原因，连接仍然正常时为 nil
+func (conn *Conn) lostError() error {
+	conn.amu.Lock()
+	defer conn.amu.Unlock()
+	return conn.lostErr
+}
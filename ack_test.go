@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// receiveAll 读完对端发来的每一个 key，ack 为 true 时逐个确认，直到连接断开
+func receiveAll(conn *Conn, ack bool) {
+	for {
+		_, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, r)
+		if ack {
+			r.(*ConnReader).Ack()
+		}
+	}
+}
+
+func TestWaitAck(t *testing.T) {
+	client, server := pipeConns(t)
+	go receiveAll(server, true)
+	// ACKs are handled by whoever reads the connection
+	go client.Receive()
+	w, err := client.Send("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.(*ConnWriter).WaitAck(context.Background()); !errors.Is(err, ErrStreamNotFinished) {
+		t.Fatalf("before Close: %v", err)
+	}
+	w.Write([]byte("data"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = w.(*ConnWriter).WaitAck(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitAckConnectionLost(t *testing.T) {
+	client, server := pipeConns(t)
+	go receiveAll(server, false)
+	go client.Receive()
+	w, _ := client.Send("k")
+	w.Write([]byte("data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(10*time.Millisecond, server.Close)
+	if err := w.(*ConnWriter).WaitAck(context.Background()); !errors.Is(err, ErrAckLost) {
+		t.Fatalf("got %v, want ErrAckLost", err)
+	}
+}
+
+func TestAwaitingAcksBounded(t *testing.T) {
+	client, server := pipeConns(t)
+	go receiveAll(server, false)
+	var first *ConnWriter
+	for i := 0; i <= maxAwaitingAcks; i++ {
+		w, err := client.Send("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = w.(*ConnWriter)
+		}
+	}
+	client.amu.Lock()
+	n := len(client.awaiting)
+	client.amu.Unlock()
+	if n != maxAwaitingAcks {
+		t.Fatalf("%d writers awaiting an ACK, want %d", n, maxAwaitingAcks)
+	}
+	if err := first.WaitAck(context.Background()); !errors.Is(err, ErrAckDropped) {
+		t.Fatalf("got %v, want ErrAckDropped", err)
+	}
+	client.Close()
+	client.amu.Lock()
+	n = len(client.awaiting)
+	client.amu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d writers still registered after Close", n)
+	}
+}
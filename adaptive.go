@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+const (
+	defaultAdaptiveMinSize  = 4 << 10
+	defaultAdaptiveMaxRatio = 0.9
+)
+
+// AdaptiveCompression 让 Send 只在压缩确实有效时才压缩：一个 key 的前 MinSize 字节先被缓存，
+// 不足 MinSize 的 key 不压缩；否则试压缩这部分数据，压缩后与压缩前的长度之比不超过 MaxRatio 时整个 key 以 Codec 压缩，
+// 否则整个 key 不压缩；决定通过 key 帧的类型（HEAD 或 CMP0）告知接收方，因此 key 帧要等到做出决定时才发送
+type AdaptiveCompression struct {
+	Codec    Compression
+	MinSize  int     // 为 0 时使用 4KiB
+	MaxRatio float64 // 为 0 时使用 0.9
+}
+
+func (a *AdaptiveCompression) minSize() int {
+	if a.MinSize <= 0 {
+		return defaultAdaptiveMinSize
+	}
+	return a.MinSize
+}
+
+func (a *AdaptiveCompression) maxRatio() float64 {
+	if a.MaxRatio <= 0 {
+		return defaultAdaptiveMaxRatio
+	}
+	return a.MaxRatio
+}
+
+// compresses 试以 codec 压缩 block，报告压缩效果是否达到 MaxRatio
+func (a *AdaptiveCompression) compresses(codec Compressor, block []byte) bool {
+	if len(block) < a.minSize() {
+		return false
+	}
+	var trial bytes.Buffer
+	z := codec.NewWriter(&trial)
+	if _, err := z.Write(block); err != nil {
+		return false
+	}
+	if err := z.Close(); err != nil {
+		return false
+	}
+	return float64(trial.Len()) <= a.maxRatio()*float64(len(block))
+}
+
+// hold 在做出是否压缩的决定之前缓存 p，缓存满 MinSize 字节时做出决定
+func (c *ConnWriter) hold(p []byte) (int, error) {
+	c.held = append(c.held, p...)
+	if len(c.held) >= c.adaptive.minSize() {
+		if err := c.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide 根据缓存的数据决定该 key 是否压缩，随后发送 key 帧与缓存的数据；
+// 在 Close 时仍未做出决定的 key 数据不足 MinSize，总是不压缩
+func (c *ConnWriter) decide() error {
+	a, held := c.adaptive, c.held
+	c.adaptive, c.held = nil, nil
+	// send only took this path because a.Codec resolves to something both sides support
+	codec := c.conn.streamCodec(a.Codec)
+	if a.compresses(c.conn.compressor(codec), held) {
+		c.conn.stats.compressedStreams.Add(1)
+	} else {
+		codec = CompressionNone
+		c.conn.stats.compressionSkipped.Add(1)
+	}
+	if err := c.writeFrame(keyFrame(c.key, codec)); err != nil {
+		err = fmt.Errorf("send key %q: %w", c.key, err)
+		log.Println(c.conn, "send key to receiver error:", err)
+		return err
+	}
+	if codec != CompressionNone {
+		c.compressor = c.conn.newCompressor(codec, frameSink{c})
+		_, err := c.compressor.Write(held)
+		return err
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	_, err := c.writeFrames(held)
+	return err
+}
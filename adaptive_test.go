@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestAdaptiveCompression(t *testing.T) {
+	random := make([]byte, 64<<10)
+	rand.Read(random)
+	tests := []struct {
+		name string
+		data []byte
+		want Compression
+	}{
+		{"repetitive", jsonLines(2000), CompressionGzip},
+		{"random", random, CompressionNone},
+		{"below the threshold", jsonLines(10), CompressionNone},
+		{"empty", nil, CompressionNone},
+	}
+	client, server := pipeConns(t, WithAdaptiveCompression(AdaptiveCompression{Codec: CompressionGzip}))
+	var compressed, skipped uint64
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			go func() {
+				w, err := client.Send("k")
+				if err != nil {
+					return
+				}
+				// in small pieces, the decision waits for MinSize bytes
+				for p := tt.data; len(p) > 0; p = p[min(1000, len(p)):] {
+					w.Write(p[:min(1000, len(p))])
+				}
+				w.Close()
+			}()
+			_, r, err := server.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.(*ConnReader).codec; got != tt.want {
+				t.Fatalf("sent with %v, want %v", got, tt.want)
+			}
+			if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, tt.data) {
+				t.Fatalf("read %d of %d bytes, %v", len(got), len(tt.data), err)
+			}
+			if tt.want == CompressionNone {
+				skipped++
+			} else {
+				compressed++
+			}
+			stats := client.Stats()
+			if stats.CompressedStreams != compressed || stats.CompressionSkipped != skipped {
+				t.Fatalf("%d compressed and %d skipped, want %d and %d",
+					stats.CompressedStreams, stats.CompressionSkipped, compressed, skipped)
+			}
+		})
+	}
+}
+
+func TestAdaptiveCompressionRatio(t *testing.T) {
+	// JSON compresses well, but not to a hundredth of its size
+	client, server := pipeConns(t, WithAdaptiveCompression(AdaptiveCompression{Codec: CompressionGzip, MaxRatio: 0.01}))
+	data := jsonLines(100)
+	go sendAll(client, "k", data)
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.(*ConnReader).codec; got != CompressionNone {
+		t.Fatalf("sent with %v under a 1%% cutoff", got)
+	}
+	io.ReadAll(r)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	// ErrTooManyConns 表示该远端 IP 的连接数已经达到 Server.MaxConnsPerIP
+	ErrTooManyConns = errors.New("too many connections from address")
+	// ErrAcceptRateLimited 表示接受连接的速度超过了 Server.AcceptLimit 或 Server.PerIPAcceptLimit
+	ErrAcceptRateLimited = errors.New("accept rate limited")
+)
+
+// ipSweepInterval 是清理不再需要的按 IP 记录的最短间隔
+const ipSweepInterval = time.Minute
+
+// RateLimit 是令牌桶限速：每秒补充 Rate 个令牌，最多积攒 Burst 个，每接受一个连接消耗一个
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// tokenBucket 是 RateLimit 的运行状态
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take 在 now 时刻按 l 补充令牌并尝试取走一个；新建的桶是满的
+func (b *tokenBucket) take(l *RateLimit, now time.Time) bool {
+	b.refill(l, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(l *RateLimit, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(l.Burst)
+	} else if b.tokens += now.Sub(b.last).Seconds() * l.Rate; b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+}
+
+// full 报告桶在 now 时刻是否已经补满，补满的桶与新建的桶没有区别
+func (b *tokenBucket) full(l *RateLimit, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	b.refill(l, now)
+	return b.tokens >= float64(l.Burst)
+}
+
+// ipState 是一个远端 IP 的连接数与限速状态
+type ipState struct {
+	conns  int
+	bucket tokenBucket
+}
+
+// admit 决定是否处理刚接受的连接，接受时返回用于 release 的 IP，拒绝时返回原因
+func (s *Server) admit(raw net.Conn) (ip string, err error) {
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	now := time.Now()
+	if s.AcceptLimit != nil && !s.acceptBucket.take(s.AcceptLimit, now) {
+		return "", ErrAcceptRateLimited
+	}
+	if s.MaxConnsPerIP <= 0 && s.PerIPAcceptLimit == nil {
+		return "", nil
+	}
+	if ip = remoteIP(raw.RemoteAddr()); ip == "" {
+		// e.g. unix sockets, there is no address to limit
+		return "", nil
+	}
+	s.sweepIPs(now)
+	if s.ips == nil {
+		s.ips = map[string]*ipState{}
+	}
+	st := s.ips[ip]
+	if st == nil {
+		st = &ipState{}
+		s.ips[ip] = st
+	}
+	if s.MaxConnsPerIP > 0 && st.conns >= s.MaxConnsPerIP {
+		return "", ErrTooManyConns
+	}
+	if s.PerIPAcceptLimit != nil && !st.bucket.take(s.PerIPAcceptLimit, now) {
+		return "", ErrAcceptRateLimited
+	}
+	st.conns++
+	return ip, nil
+}
+
+// release 在 admit 接受的连接结束时归还其 IP 的连接数
+func (s *Server) release(ip string) {
+	if ip == "" {
+		return
+	}
+	s.amu.Lock()
+	defer s.amu.Unlock()
+	if st := s.ips[ip]; st != nil {
+		st.conns--
+	}
+}
+
+// sweepIPs 每隔 ipSweepInterval 删除没有连接且令牌桶已满的记录，调用者需持有 amu
+func (s *Server) sweepIPs(now time.Time) {
+	if now.Sub(s.lastSweep) < ipSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for ip, st := range s.ips {
+		if st.conns == 0 && st.bucket.full(s.PerIPAcceptLimit, now) {
+			delete(s.ips, ip)
+		}
+	}
+}
+
+// reject 关闭被拒绝的连接并报告给 OnReject
+func (s *Server) reject(raw net.Conn, reason error) {
+	addr := raw.RemoteAddr()
+	raw.Close()
+	if s.OnReject != nil {
+		s.OnReject(addr, reason)
+	}
+}
+
+// remoteIP 返回 addr 中的 IP，没有 IP 时返回空字符串
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// rejection 是 OnReject 的一次调用
+type rejection struct {
+	ip     string
+	reason error
+}
+
+// admissionServer 以 configure 配置一个 Server 并运行，返回地址与 OnReject 报告的拒绝
+func admissionServer(t *testing.T, configure func(*Server)) (string, <-chan rejection) {
+	t.Helper()
+	rejected := make(chan rejection, 10)
+	s := &Server{
+		Handler: func(conn *Conn) { conn.Receive() },
+		OnReject: func(addr net.Addr, reason error) {
+			rejected <- rejection{remoteIP(addr), reason}
+		},
+	}
+	configure(s)
+	addr, _ := serveOn(t, s)
+	return addr, rejected
+}
+
+// dialFrom 从本地地址 ip 连接 addr 并完成握手，返回握手的错误
+func dialFrom(t *testing.T, ip, addr string) (*Conn, error) {
+	t.Helper()
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}, Timeout: time.Second}
+	raw, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Skipf("can't dial from %s: %v", ip, err)
+	}
+	conn := NewConn(raw, WithHelloTimeout(time.Second))
+	t.Cleanup(conn.Close)
+	return conn, conn.Handshake()
+}
+
+// expectRejection 等待 OnReject 报告一次来自 ip 的 reason
+func expectRejection(t *testing.T, rejected <-chan rejection, ip string, reason error) {
+	t.Helper()
+	select {
+	case r := <-rejected:
+		if r.ip != ip || r.reason != reason {
+			t.Fatalf("rejected %s for %v, want %s for %v", r.ip, r.reason, ip, reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s wasn't rejected", ip)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	const limit = 2
+	addr, rejected := admissionServer(t, func(s *Server) { s.MaxConnsPerIP = limit })
+	var conns []*Conn
+	for i := 0; i < limit; i++ {
+		conn, err := dialFrom(t, "127.0.0.1", addr)
+		if err != nil {
+			t.Fatalf("connection %d of %d: %v", i+1, limit, err)
+		}
+		conns = append(conns, conn)
+	}
+	if _, err := dialFrom(t, "127.0.0.1", addr); err == nil {
+		t.Fatalf("connection %d was admitted", limit+1)
+	}
+	expectRejection(t, rejected, "127.0.0.1", ErrTooManyConns)
+	// the cap is per address
+	if _, err := dialFrom(t, "127.0.0.2", addr); err != nil {
+		t.Fatalf("another address was refused: %v", err)
+	}
+	// closing one frees its slot once the handler returns
+	conns[0].Close()
+	eventually(t, "the slot to be freed", func() bool {
+		conn, err := dialFrom(t, "127.0.0.1", addr)
+		if err != nil {
+			<-rejected
+			return false
+		}
+		conns[0] = conn
+		return true
+	})
+}
+
+func TestPerIPAcceptLimit(t *testing.T) {
+	addr, rejected := admissionServer(t, func(s *Server) {
+		// practically no refill during the test
+		s.PerIPAcceptLimit = &RateLimit{Rate: 0.001, Burst: 2}
+	})
+	for i := 0; i < 2; i++ {
+		// closed right away, only the rate counts
+		conn, err := dialFrom(t, "127.0.0.1", addr)
+		if err != nil {
+			t.Fatalf("connection %d: %v", i+1, err)
+		}
+		conn.Close()
+	}
+	if _, err := dialFrom(t, "127.0.0.1", addr); err == nil {
+		t.Fatal("a connection over the burst was admitted")
+	}
+	expectRejection(t, rejected, "127.0.0.1", ErrAcceptRateLimited)
+	if _, err := dialFrom(t, "127.0.0.2", addr); err != nil {
+		t.Fatalf("another address was refused: %v", err)
+	}
+}
+
+func TestAcceptLimit(t *testing.T) {
+	addr, rejected := admissionServer(t, func(s *Server) {
+		s.AcceptLimit = &RateLimit{Rate: 0.001, Burst: 1}
+	})
+	if _, err := dialFrom(t, "127.0.0.1", addr); err != nil {
+		t.Fatal(err)
+	}
+	// global, so other addresses are refused as well
+	if _, err := dialFrom(t, "127.0.0.2", addr); err == nil {
+		t.Fatal("a connection over the global burst was admitted")
+	}
+	expectRejection(t, rejected, "127.0.0.2", ErrAcceptRateLimited)
+}
+
+func TestTokenBucket(t *testing.T) {
+	l := &RateLimit{Rate: 10, Burst: 3}
+	var b tokenBucket
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !b.take(l, now) {
+			t.Fatalf("a new bucket ran out after %d tokens", i)
+		}
+	}
+	if b.take(l, now) {
+		t.Fatal("took a token over the burst")
+	}
+	// a token every 100ms
+	if !b.take(l, now.Add(100*time.Millisecond)) || b.take(l, now.Add(150*time.Millisecond)) {
+		t.Fatal("the bucket didn't refill at Rate")
+	}
+	// never more than Burst
+	if !b.full(l, now.Add(time.Hour)) || b.tokens != 3 {
+		t.Fatalf("%v tokens after an hour, want 3", b.tokens)
+	}
+}
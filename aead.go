@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ENC 是密钥帧，payload 为 32 字节随机 salt；发送方用预共享密钥（或握手得到的会话密钥）和 salt 派生出该方向上的帧密钥，
+// 此后直到下一个密钥帧为止，所有帧的 payload 都以 AES-256-GCM 加密，nonce 为该方向上的帧序号；
+// 密钥帧本身以当前的帧密钥加密，第一个密钥帧之前的帧密钥直接由基础密钥派生；帧序号在换用密钥后继续递增，
+// 接收方也不接受用过的 salt，因此重放的密钥帧及其后的帧都无法通过认证
+const ENC = "ENC0"
+
+const (
+	pskLen    = 32
+	saltLen   = 32
+	gcmTagLen = 16 // AES-GCM overhead added to every sealed payload
+
+	// defaultMaxBytesPerKey 是一个帧密钥默认最多加密的字节数，超过后发送方会换用新的 salt
+	defaultMaxBytesPerKey = 1 << 36
+	// maxFramesPerKey 是一个帧密钥最多加密的帧数
+	maxFramesPerKey = 1 << 32
+)
+
+// ErrDecryptFailed 表示收到的帧未能通过认证，可能被篡改或双方密钥不一致；该错误会使连接不可再用
+var ErrDecryptFailed = errors.New("frame authentication failed")
+
+// errSaltReused 表示对端的密钥帧使用了本连接上已经用过的 salt
+var errSaltReused = errors.New("key frame reuses an earlier salt")
+
+// ErrEncryptionMismatch 表示通信双方只有一方启用了加密
+var ErrEncryptionMismatch = errors.New("encryption enabled on only one side")
+
+// NON 是使用共享密钥时握手中交换的随机数，payload 为 1 字节模式 + 32 字节随机数；双方从共享密钥与两端的随机数
+// 派生出每个方向各自的密钥，因此帧既不能在另一个连接上重放，也不能被反射回发送方
+const NON = "NON0"
+
+// connNonceLen 是 NON 帧中随机数的长度
+const connNonceLen = 32
+
+// 共享密钥模式，写在 NON 帧的第一个字节
+const (
+	sharedKeyPSK byte = 1 // frames are sealed with keys derived from the PSK
+	sharedKeyMAC byte = 2 // frames carry an HMAC keyed from the MACKey
+)
+
+// sharedKeyMode 返回需要在握手时按方向派生密钥的共享密钥模式，不需要时为 0；启用 KeyExchange 时会话密钥已经区分方向
+func (conn *Conn) sharedKeyMode() byte {
+	switch {
+	case conn.cfg.PSK != nil && !conn.cfg.KeyExchange:
+		return sharedKeyPSK
+	case conn.macEnabled():
+		return sharedKeyMAC
+	}
+	return 0
+}
+
+// deriveDirectionKeys 与对端交换随机数，并从共享密钥派生出本端发送与接收各自的密钥，调用者需持有 hmu
+func (conn *Conn) deriveDirectionKeys() error {
+	mode := conn.sharedKeyMode()
+	if mode == sharedKeyPSK && len(conn.cfg.PSK) != pskLen {
+		return errors.New("pre-shared key must be 32 bytes")
+	}
+	mine := make([]byte, 1+connNonceLen)
+	mine[0] = mode
+	if _, err := rand.Read(mine[1:]); err != nil {
+		return err
+	}
+	theirs, err := conn.exchange(NON, mine)
+	if errors.Is(err, errUnexpectedFrame) {
+		// the peer went on without a shared key
+		return fmt.Errorf("%w: %w", sharedKeyMismatch(mode), err)
+	}
+	if err != nil {
+		return err
+	}
+	if len(theirs) != len(mine) {
+		return errors.New("invalid nonce frame")
+	}
+	if theirs[0] != mode {
+		return ErrEncryptionMismatch
+	}
+	if bytes.Equal(theirs[1:], mine[1:]) {
+		return errors.New("peer echoed our nonce, frames are being reflected")
+	}
+	// HKDF-style extraction bound to the sender's nonce first, the receiver derives the same key in reverse
+	if mode == sharedKeyMAC {
+		conn.rekeyMAC(hmacSum(conn.cfg.MACKey, []byte("zhuozhuo mac key"), mine[1:], theirs[1:]),
+			hmacSum(conn.cfg.MACKey, []byte("zhuozhuo mac key"), theirs[1:], mine[1:]))
+		return nil
+	}
+	conn.sendKey = hmacSum(conn.cfg.PSK, []byte("zhuozhuo psk key"), mine[1:], theirs[1:])
+	conn.recvKey = hmacSum(conn.cfg.PSK, []byte("zhuozhuo psk key"), theirs[1:], mine[1:])
+	return nil
+}
+
+// sharedKeyMismatch 返回只有一方使用 mode 模式的共享密钥时的错误
+func sharedKeyMismatch(mode byte) error {
+	if mode == sharedKeyMAC {
+		return ErrFrameMAC
+	}
+	return ErrEncryptionMismatch
+}
+
+// NewEncryptedConn 与 NewConn 相同，但使用 32 字节的共享密钥 key 以 AES-256-GCM 加密认证每个帧，
+// 等同于 NewConn(raw, WithPSK(key))；被篡改的帧会使读取返回 ErrDecryptFailed；
+func NewEncryptedConn(raw net.Conn, key []byte, opts ...Option) (*Conn, error) {
+	if len(key) != pskLen {
+		return nil, errors.New("pre-shared key must be 32 bytes")
+	}
+	// don't let append write into the caller's backing array
+	return NewConn(raw, append(opts[:len(opts):len(opts)], WithPSK(key))...), nil
+}
+
+// frameCipher 是一个方向上的帧加密状态
+type frameCipher struct {
+	aead   cipher.AEAD
+	seq    uint64 // frames sealed/opened in this direction under any key, used as the nonce
+	frames uint64 // frames sealed with this key
+	bytes  int64  // plaintext bytes sealed with this key
+}
+
+// newFrameCipher 从基础密钥 key 与 salt 派生帧密钥，salt 为 nil 时得到第一个密钥帧之前使用的密钥
+func newFrameCipher(key, salt []byte) (*frameCipher, error) {
+	if len(key) != pskLen {
+		return nil, errors.New("pre-shared key must be 32 bytes")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("zhuozhuo frame key"))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &frameCipher{aead: aead}, nil
+}
+
+func (c *frameCipher) nonce() []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], c.seq)
+	return nonce
+}
+
+// seal 加密一个帧的 payload，帧的 tag 作为附加认证数据，防止帧类型被替换
+func (c *frameCipher) seal(tag string, payload []byte) []byte {
+	out := c.aead.Seal(nil, c.nonce(), payload, []byte(tag))
+	c.seq++
+	c.frames++
+	c.bytes += int64(len(payload))
+	return out
+}
+
+func (c *frameCipher) open(tag string, payload []byte) ([]byte, error) {
+	out, err := c.aead.Open(nil, c.nonce(), payload, []byte(tag))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	c.seq++
+	return out, nil
+}
+
+// sealLocked 在启用加密时加密 payload；首次加密或当前密钥用量达到上限时，
+// 先向 buf 写入一个携带新 salt 的密钥帧；调用者需持有 wmu
+func (conn *Conn) sealLocked(buf *bytes.Buffer, tag string, payload []byte) ([]byte, error) {
+	if conn.sendKey == nil {
+		return payload, nil
+	}
+	limit := conn.cfg.MaxBytesPerKey
+	if limit <= 0 {
+		limit = defaultMaxBytesPerKey
+	}
+	if c := conn.sealer; c == nil || c.frames >= maxFramesPerKey || c.bytes+int64(len(payload)) > limit {
+		if err := conn.rekeyLocked(buf); err != nil {
+			return nil, err
+		}
+	}
+	return conn.sealer.seal(tag, payload), nil
+}
+
+// rekeyLocked 向 buf 写入一个以当前帧密钥加密的密钥帧，并换用由新 salt 派生的帧密钥；调用者需持有 wmu
+func (conn *Conn) rekeyLocked(buf *bytes.Buffer) error {
+	current := conn.sealer
+	if current == nil {
+		var err error
+		if current, err = newFrameCipher(conn.sendKey, nil); err != nil {
+			return err
+		}
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	next, err := newFrameCipher(conn.sendKey, salt)
+	if err != nil {
+		return err
+	}
+	sealed := current.seal(ENC, salt)
+	// the nonce keeps counting, a frame sealed under an earlier key can't take the place of a later one
+	next.seq = current.seq
+	buf.Write(conn.frameHeader(nil, ENC, sealed))
+	buf.Write(sealed)
+	conn.sealer = next
+	return nil
+}
+
+// open 在启用加密时解密 tag 帧的 payload，失败后连接不再可用
+func (conn *Conn) open(tag string, payload []byte) ([]byte, error) {
+	if conn.recvKey == nil {
+		return payload, nil
+	}
+	if conn.opener == nil {
+		if tag != ENC {
+			// an encrypting peer starts with a key frame
+			conn.readErr = ErrEncryptionMismatch
+			return nil, conn.readErr
+		}
+		c, err := newFrameCipher(conn.recvKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		conn.opener = c
+	}
+	out, err := conn.opener.open(tag, payload)
+	if err != nil {
+		conn.readErr = err
+		return nil, err
+	}
+	return out, nil
+}
+
+// acceptKey 处理对端已经解密的密钥帧，换用新的帧密钥解密之后的帧，帧序号继续递增
+func (conn *Conn) acceptKey(salt []byte) error {
+	if conn.recvKey == nil {
+		return ErrEncryptionMismatch
+	}
+	if len(salt) != saltLen {
+		return errors.New("invalid key frame")
+	}
+	if _, ok := conn.salts[string(salt)]; ok {
+		conn.readErr = errSaltReused
+		return errSaltReused
+	}
+	c, err := newFrameCipher(conn.recvKey, salt)
+	if err != nil {
+		return err
+	}
+	if conn.salts == nil {
+		conn.salts = make(map[string]struct{})
+	}
+	conn.salts[string(salt)] = struct{}{}
+	c.seq = conn.opener.seq
+	conn.opener = c
+	return nil
+}
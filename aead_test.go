@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var testPSK = bytes.Repeat([]byte{0x42}, pskLen)
+
+// tamperConn 在 armed 置位后翻转每次写出的最后一个字节
+type tamperConn struct {
+	net.Conn
+	armed atomic.Bool
+}
+
+func (c *tamperConn) Write(p []byte) (int, error) {
+	if c.armed.Load() && len(p) > 0 {
+		p = bytes.Clone(p)
+		p[len(p)-1] ^= 1
+	}
+	return c.Conn.Write(p)
+}
+
+// handshakeBoth 让两端同时完成握手
+func handshakeBoth(t testing.TB, client, server *Conn) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPSKRoundTrip(t *testing.T) {
+	client, server := pipeConns(t, WithPSK(testPSK))
+	go sendAll(client, "secret", []byte("payload"))
+	key, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || key != "secret" || string(data) != "payload" {
+		t.Fatalf("got %q %q %v", key, data, err)
+	}
+}
+
+func TestPSKDirectionKeys(t *testing.T) {
+	client, server := pipeConns(t, WithPSK(testPSK))
+	handshakeBoth(t, client, server)
+	if !bytes.Equal(client.sendKey, server.recvKey) || !bytes.Equal(client.recvKey, server.sendKey) {
+		t.Fatal("the two ends derived different keys")
+	}
+	if bytes.Equal(client.sendKey, client.recvKey) || bytes.Equal(client.sendKey, testPSK) {
+		t.Fatal("both directions use the same key")
+	}
+
+	// a new connection with the same PSK gets fresh keys
+	again, other := pipeConns(t, WithPSK(testPSK))
+	handshakeBoth(t, again, other)
+	if bytes.Equal(again.sendKey, client.sendKey) {
+		t.Fatal("keys repeat across connections")
+	}
+}
+
+func TestPSKTamperedFrame(t *testing.T) {
+	a, b := net.Pipe()
+	tc := &tamperConn{Conn: a}
+	client, server := NewConn(tc, WithPSK(testPSK)), NewConn(b, WithPSK(testPSK))
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	tc.armed.Store(true)
+	go sendAll(client, "k", []byte("payload"))
+	_, _, err := server.Receive()
+	if !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("got %v, want ErrDecryptFailed", err)
+	}
+}
+
+func TestPSKOnOneSide(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithPSK(testPSK)), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- sendAll(client, "k", []byte("payload")) }()
+	_, _, err := server.Receive()
+	if !errors.Is(err, ErrEncryptionMismatch) {
+		t.Fatalf("receiver: got %v, want ErrEncryptionMismatch", err)
+	}
+	server.Close()
+	<-errc
+
+	a, b = net.Pipe()
+	client, server = NewConn(a), NewConn(b, WithPSK(testPSK))
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "k", []byte("payload"))
+	if _, _, err = server.Receive(); !errors.Is(err, ErrEncryptionMismatch) {
+		t.Fatalf("receiver with a PSK: got %v, want ErrEncryptionMismatch", err)
+	}
+}
+
+func TestPSKReflectedHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	conn := NewConn(a, WithPSK(testPSK))
+	defer conn.Close()
+	defer b.Close()
+	// everything the connection writes comes straight back to it
+	go io.Copy(b, b)
+	if err := conn.Handshake(); err == nil || !strings.Contains(err.Error(), "reflected") {
+		t.Fatalf("got %v, want the reflection to be detected", err)
+	}
+}
+
+func TestEncryptedConnRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	rc := &recordingConn{Conn: a}
+	client, err := NewEncryptedConn(rc, testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewEncryptedConn(b, testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "secret key", []byte("secret payload"))
+	key, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || key != "secret key" || string(data) != "secret payload" {
+		t.Fatalf("got %q %q %v", key, data, err)
+	}
+	if wire := rc.bytes(); bytes.Contains(wire, []byte("secret")) {
+		t.Fatal("plaintext on the wire")
+	}
+}
+
+func TestEncryptedConnTamperedData(t *testing.T) {
+	a, b := net.Pipe()
+	tc := &tamperConn{Conn: a}
+	client, _ := NewEncryptedConn(tc, testPSK)
+	server, _ := NewEncryptedConn(b, testPSK)
+	defer client.Close()
+	defer server.Close()
+	received := make(chan struct{})
+	go func() {
+		w, err := client.Send("k")
+		if err != nil {
+			return
+		}
+		<-received
+		// flips the last byte of the sealed data frame, i.e. its GCM tag
+		tc.armed.Store(true)
+		w.Write([]byte("payload"))
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(received)
+	if _, err = io.ReadAll(r); !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("got %v, want ErrDecryptFailed", err)
+	}
+}
+
+func TestEncryptedConnKeySize(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := NewEncryptedConn(a, testPSK[:16]); err == nil {
+		t.Fatal("accepted a 16 byte key")
+	}
+	// the caller's options keep their backing array to themselves
+	opts := make([]Option, 1, 2)
+	opts[0] = WithChecksum()
+	NewEncryptedConn(a, testPSK, opts...)
+	if opts[:2][1] != nil {
+		t.Fatal("NewEncryptedConn wrote into the caller's slice")
+	}
+}
+
+func TestPSKReplayedKeyFrame(t *testing.T) {
+	a, b := net.Pipe()
+	rc := &recordingConn{Conn: a}
+	client, server := NewConn(rc, WithPSK(testPSK)), NewConn(b, WithPSK(testPSK))
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	mark := len(rc.bytes())
+	go sendAll(client, "pay", []byte("once"))
+	if err := checkBatch(server, []BatchItem{{Key: "pay", Data: []byte("once")}}); err != nil {
+		t.Fatal(err)
+	}
+	// an attacker on the path sends the key frame and everything after it again
+	replay := rc.bytes()[mark:]
+	if !strings.HasPrefix(string(replay), ENC) {
+		t.Fatalf("the transfer starts with %q, want a key frame", replay[:4])
+	}
+	go a.Write(replay)
+	if _, _, err := server.Receive(); !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("got %v, want ErrDecryptFailed", err)
+	}
+}
+
+func TestPSKRekey(t *testing.T) {
+	var trace frameTrace
+	rekeyEvery := func(c *Config) { c.MaxBytesPerKey = 1000 }
+	a, b := net.Pipe()
+	client := NewConn(a, WithPSK(testPSK), rekeyEvery, WithFrameObserver(trace.observe))
+	server := NewConn(b, WithPSK(testPSK))
+	defer client.Close()
+	defer server.Close()
+	items := batchItems(3)
+	for i := range items {
+		items[i].Data = patterned(2500)
+	}
+	go func() {
+		for _, item := range items {
+			// written in pieces so the key changes in the middle of a stream
+			w, err := client.Send(item.Key)
+			if err != nil {
+				return
+			}
+			for p := item.Data; len(p) > 0; p = p[500:] {
+				w.Write(p[:500])
+			}
+			w.Close()
+		}
+	}()
+	if err := checkBatch(server, items); err != nil {
+		t.Fatal(err)
+	}
+	keyFrames := 0
+	for _, e := range trace.get(DirectionOut, 0) {
+		if e.typ == FrameKey {
+			keyFrames++
+		}
+	}
+	if keyFrames < 7 {
+		t.Fatalf("%d key frames for 7500 bytes at 1000 bytes per key", keyFrames)
+	}
+	if len(server.salts) != keyFrames {
+		t.Fatalf("the receiver remembers %d salts of %d key frames", len(server.salts), keyFrames)
+	}
+}
+
+func TestPSKReusedSalt(t *testing.T) {
+	client, server := pipeConns(t, WithPSK(testPSK))
+	go sendAll(client, "first", nil)
+	if err := checkBatch(server, []BatchItem{{Key: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+	var salt []byte
+	for s := range server.salts {
+		salt = []byte(s)
+	}
+	// sealed under the current key, so only the salt gives it away
+	go client.writeFrame(ENC, salt)
+	if _, _, err := server.Receive(); !errors.Is(err, errSaltReused) {
+		t.Fatalf("got %v, want errSaltReused", err)
+	}
+}
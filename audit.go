@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// AuditEvent 是交给 Config.Audit 的审计事件，具体类型为 ConnectionOpened、StreamSent、StreamReceived、AuthFailed、ConnectionLeaked 或 ConnectionClosed
+type AuditEvent interface {
+	auditEvent()
+}
+
+// ConnectionOpened 在握手成功完成时产生
+type ConnectionOpened struct {
+	Peer Identity // 对端的地址以及 TLS、凭证等身份
+}
+
+// StreamSent 在本端发送的一个 key 结束时产生：writer 被 Close 或 Abort、写入失败，或者连接在 writer 结束之前被关闭
+type StreamSent struct {
+	Key      string
+	Bytes    int64         // 应用写入的字节数，未完成时为已经写入的部分
+	Duration time.Duration // 从发出 key 到结束
+	Digest   []byte        // 配置了 Digest 且正常结束时为整个数据流的摘要
+	Err      error         // 正常结束时为 nil，Abort 时为 *StreamError
+}
+
+// StreamReceived 在对端发来的一个 key 结束时产生：读到 FIN、读取失败，或者连接在读完之前被关闭
+type StreamReceived struct {
+	Key      string
+	Bytes    int64         // 交付给应用的字节数，未完成时为已经读到的部分
+	Duration time.Duration // 从收到 key 到结束
+	Digest   []byte        // 配置了 Digest 且正常结束时为整个数据流的摘要
+	Err      error         // 正常结束时为 nil，发送者 Abort 时为 *StreamError
+}
+
+// AuthFailed 在握手认证失败时产生，ByPeer 为 true 表示对端拒绝了本端的凭证，否则是本端拒绝了对端
+type AuthFailed struct {
+	Reason string
+	ByPeer bool
+}
+
+// ConnectionLeaked 在从 Pool 取出的连接超过 LeaseTimeout 既没有归还也没有关闭、被 Pool 回收时产生，随后连接被关闭
+type ConnectionLeaked struct {
+	Held time.Duration // 从取出到被回收
+}
+
+// ConnectionClosed 在连接第一次被 Close 时产生，Cause 是导致连接结束的第一个错误，本端主动关闭时为 nil
+type ConnectionClosed struct {
+	Cause error
+}
+
+func (ConnectionOpened) auditEvent() {}
+func (StreamSent) auditEvent()       {}
+func (StreamReceived) auditEvent()   {}
+func (AuthFailed) auditEvent()       {}
+func (ConnectionLeaked) auditEvent() {}
+func (ConnectionClosed) auditEvent() {}
+
+// audit 在配置了 Audit 时同步地交出 ev
+func (conn *Conn) audit(ev AuditEvent) {
+	if conn.cfg.Audit != nil {
+		conn.cfg.Audit(conn, ev)
+	}
+}
+
+// fail 记录导致连接结束的错误，只保留第一个
+func (conn *Conn) fail(err error) {
+	if err == nil || err == io.EOF {
+		return
+	}
+	conn.emu.Lock()
+	defer conn.emu.Unlock()
+	if conn.cause == nil {
+		conn.cause = err
+	}
+}
+
+// auditClose 在 Close 时为尚未结束的数据流补上事件，然后产生 ConnectionClosed
+func (conn *Conn) auditClose() {
+	if conn.cfg.Audit == nil {
+		return
+	}
+	conn.omu.Lock()
+	writers := append([]*ConnWriter(nil), conn.writers...)
+	conn.omu.Unlock()
+	for _, w := range writers {
+		w.audit(ErrConnClosed)
+	}
+	// a reader in the middle of Read reports for itself once the read fails
+	if conn.rdmu.TryLock() {
+		if cr := conn.active; cr != nil && !cr.finished {
+			cr.audit(ErrConnClosed)
+		}
+		conn.rdmu.Unlock()
+	}
+	conn.emu.Lock()
+	cause := conn.cause
+	conn.emu.Unlock()
+	conn.audit(ConnectionClosed{Cause: cause})
+}
+
+// audit 产生该 writer 的 StreamSent，只产生一次；err 为 nil 或 io.EOF 表示正常结束
+func (c *ConnWriter) audit(err error) {
+	if c.conn.cfg.Audit == nil || !c.audited.CompareAndSwap(false, true) {
+		return
+	}
+	ev := StreamSent{
+		Key:      c.key,
+		Bytes:    c.written.Load(),
+		Duration: time.Since(c.start),
+	}
+	if err == nil || err == io.EOF {
+		if c.digest != nil {
+			ev.Digest = c.digest.Sum(nil)
+		}
+	} else {
+		ev.Err = err
+	}
+	c.conn.audit(ev)
+}
+
+// audit 产生该 reader 的 StreamReceived，只产生一次；err 为 nil 或 io.EOF 表示正常结束；调用者需持有 rdmu
+func (c *ConnReader) audit(err error) {
+	if c.conn.cfg.Audit == nil || c.audited {
+		return
+	}
+	c.audited = true
+	ev := StreamReceived{
+		Key:      c.key,
+		Bytes:    c.read,
+		Duration: time.Since(c.start),
+	}
+	if err == nil || err == io.EOF {
+		if c.digest != nil {
+			ev.Digest = c.digest.Sum(nil)
+		}
+	} else {
+		ev.Err = err
+	}
+	c.conn.audit(ev)
+}
+
+// sent 记录应用写入的 n 字节并处理写入的错误 err，每条写入路径都经过这里，StreamSent 才能报告正确的字节数
+func (c *ConnWriter) sent(n int64, err error) {
+	c.conn.stats.bytesSent.Add(uint64(n))
+	c.written.Add(n)
+	c.writeFailed(err)
+}
+
+// writeFailed 处理 writer 写入数据帧时的错误：被对端拒绝之外的错误意味着连接已经不可用
+func (c *ConnWriter) writeFailed(err error) {
+	var rejected *RejectedError
+	if err == nil || errors.As(err, &rejected) {
+		return
+	}
+	c.conn.fail(err)
+	c.audit(err)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// auditLog 依次记录 Audit 收到的事件
+type auditLog struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (l *auditLog) record(conn *Conn, ev AuditEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, ev)
+}
+
+func (l *auditLog) get() []AuditEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]AuditEvent(nil), l.events...)
+}
+
+// kinds 返回事件类型的序列，例如 "ConnectionOpened StreamSent ConnectionClosed"
+func (l *auditLog) kinds() string {
+	var names []string
+	for _, ev := range l.get() {
+		names = append(names, strings.TrimPrefix(fmt.Sprintf("%T", ev), "main."))
+	}
+	return strings.Join(names, " ")
+}
+
+func TestAuditSession(t *testing.T) {
+	var sent, received auditLog
+	a, b := net.Pipe()
+	client := NewConn(a, WithToken("alice", testSecret), WithDigest(sha256.New), WithAudit(sent.record))
+	server := NewConn(b, WithAuthenticator(lookupToken), WithDigest(sha256.New), WithAudit(received.record))
+	defer client.Close()
+	defer server.Close()
+	data := patterned(1000)
+	done := make(chan error, 1)
+	go func() {
+		if err := sendAll(client, "whole", data); err != nil {
+			done <- err
+			return
+		}
+		w, err := client.Send("partial")
+		if err != nil {
+			done <- err
+			return
+		}
+		if _, err = w.Write(data[:300]); err != nil {
+			done <- err
+			return
+		}
+		done <- w.(*ConnWriter).Abort("changed my mind")
+	}()
+	if err := checkBatch(server, []BatchItem{{Key: "whole", Data: data}}); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aborted *StreamError
+	if got, err := io.ReadAll(r); !errors.As(err, &aborted) || len(got) != 300 {
+		t.Fatalf("read %d bytes of the aborted key, %v", len(got), err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if _, _, err = server.Receive(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	server.Close()
+
+	sum := sha256.Sum256(data)
+	for _, side := range []struct {
+		name string
+		log  *auditLog
+		want string
+	}{
+		{"client", &sent, "ConnectionOpened StreamSent StreamSent ConnectionClosed"},
+		{"server", &received, "ConnectionOpened StreamReceived StreamReceived ConnectionClosed"},
+	} {
+		if got := side.log.kinds(); got != side.want {
+			t.Fatalf("%s: events %s, want %s", side.name, got, side.want)
+		}
+		events := side.log.get()
+		// the stream events of both sides carry the same fields
+		var streams [2]StreamReceived
+		for i, ev := range events[1:3] {
+			switch ev := ev.(type) {
+			case StreamSent:
+				streams[i] = StreamReceived(ev)
+			case StreamReceived:
+				streams[i] = ev
+			}
+			if streams[i].Duration <= 0 {
+				t.Fatalf("%s: %+v has no duration", side.name, ev)
+			}
+		}
+		whole, partial := streams[0], streams[1]
+		if whole.Key != "whole" || whole.Bytes != 1000 || !bytes.Equal(whole.Digest, sum[:]) || whole.Err != nil {
+			t.Fatalf("%s: %+v", side.name, whole)
+		}
+		if !errors.As(partial.Err, &aborted) || aborted.Status != StatusAborted || aborted.Message != "changed my mind" {
+			t.Fatalf("%s: %+v, want an aborted stream", side.name, partial)
+		}
+		if partial.Key != "partial" || partial.Bytes != 300 || partial.Digest != nil {
+			t.Fatalf("%s: %+v", side.name, partial)
+		}
+		// a clean close on both ends
+		if closed := events[3].(ConnectionClosed); closed.Cause != nil {
+			t.Fatalf("%s: closed by %v", side.name, closed.Cause)
+		}
+	}
+	if opened := received.get()[0].(ConnectionOpened); opened.Peer.TokenID != "alice" || opened.Peer.Addr == nil {
+		t.Fatalf("server saw %+v", opened.Peer)
+	}
+}
+
+func TestAuditConnectionDies(t *testing.T) {
+	var sent, received auditLog
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithAudit(sent.record)), NewConn(b, WithAudit(received.record))
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	go func() {
+		w, err := client.Send("k")
+		if err != nil {
+			return
+		}
+		w.Write(patterned(500))
+		// gone mid-transfer, the writer never closed
+		a.Close()
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read keeps io.EOF bare, only the audit trail tells the stream was cut short
+	if got, _ := io.ReadAll(r); len(got) != 500 {
+		t.Fatalf("read %d bytes", len(got))
+	}
+	server.Close()
+	client.Close()
+
+	if got, want := received.kinds(), "ConnectionOpened StreamReceived ConnectionClosed"; got != want {
+		t.Fatalf("server: events %s, want %s", got, want)
+	}
+	events := received.get()
+	if ev := events[1].(StreamReceived); ev.Key != "k" || ev.Bytes != 500 || ev.Err != io.ErrUnexpectedEOF {
+		t.Fatalf("server: %+v, want the partial count and io.ErrUnexpectedEOF", ev)
+	}
+	if ev := events[2].(ConnectionClosed); ev.Cause != io.ErrUnexpectedEOF {
+		t.Fatalf("server: closed by %v, want io.ErrUnexpectedEOF", ev.Cause)
+	}
+	if got, want := sent.kinds(), "ConnectionOpened StreamSent ConnectionClosed"; got != want {
+		t.Fatalf("client: events %s, want %s", got, want)
+	}
+	if ev := sent.get()[1].(StreamSent); ev.Bytes != 500 || !errors.Is(ev.Err, ErrConnClosed) {
+		t.Fatalf("client: %+v, want the open writer reported as cut off", ev)
+	}
+}
+
+func TestAuditAuthFailed(t *testing.T) {
+	var sent, received auditLog
+	clientErr, serverErr, _, _ := authenticatedSend(t,
+		[]Option{WithToken("alice", []byte("wrong")), WithAudit(sent.record)},
+		[]Option{WithAuthenticator(lookupToken), WithAudit(received.record)})
+	if !errors.Is(clientErr, ErrAuthFailed) || !errors.Is(serverErr, ErrAuthFailed) {
+		t.Fatalf("client: %v, server: %v", clientErr, serverErr)
+	}
+	// never opened, so no ConnectionOpened
+	if got, want := received.kinds(), "AuthFailed ConnectionClosed"; got != want {
+		t.Fatalf("server: events %s, want %s", got, want)
+	}
+	events := received.get()
+	if ev := events[0].(AuthFailed); ev.ByPeer || ev.Reason == "" {
+		t.Fatalf("server: %+v", ev)
+	}
+	if ev := events[1].(ConnectionClosed); !errors.Is(ev.Cause, ErrAuthFailed) {
+		t.Fatalf("server: closed by %v, want ErrAuthFailed", ev.Cause)
+	}
+	eventually(t, "the client to hear about it", func() bool { return strings.HasPrefix(sent.kinds(), "AuthFailed") })
+	if ev := sent.get()[0].(AuthFailed); !ev.ByPeer || ev.Reason != events[0].(AuthFailed).Reason {
+		t.Fatalf("client: %+v", ev)
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	var log auditLog
+	handled := make(chan struct{})
+	s := &Server{Audit: log.record, Handler: func(conn *Conn) {
+		defer close(handled)
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		io.ReadAll(r)
+		sendAll(conn, key, []byte("back"))
+	}}
+	addr, _ := serveOn(t, s)
+	client := dial(addr)
+	go sendAll(client, "k", []byte("there"))
+	if _, r, err := client.Receive(); err != nil {
+		t.Fatal(err)
+	} else {
+		io.ReadAll(r)
+	}
+	client.Close()
+	<-handled
+	eventually(t, "the server to close the connection", func() bool { return strings.HasSuffix(log.kinds(), "ConnectionClosed") })
+	if got, want := log.kinds(), "ConnectionOpened StreamReceived StreamSent ConnectionClosed"; got != want {
+		t.Fatalf("events %s, want %s", got, want)
+	}
+	events := log.get()
+	if ev := events[0].(ConnectionOpened); ev.Peer.Addr.String() != client.LocalAddr().String() {
+		t.Fatalf("opened by %v, want %v", ev.Peer.Addr, client.LocalAddr())
+	}
+	if ev := events[1].(StreamReceived); ev.Key != "k" || ev.Bytes != 5 {
+		t.Fatalf("%+v", ev)
+	}
+	if ev := events[2].(StreamSent); ev.Key != "k" || ev.Bytes != 4 {
+		t.Fatalf("%+v", ev)
+	}
+}
+
+func TestAuditSendSized(t *testing.T) {
+	// the first goes straight from the reader to the connection, a checksum needs the whole frame first
+	for _, opts := range [][]Option{nil, {WithChecksum()}} {
+		var sent auditLog
+		a, b := net.Pipe()
+		client, server := NewConn(a, append(opts, WithAudit(sent.record))...), NewConn(b, opts...)
+		data := patterned(5000)
+		done := make(chan error, 1)
+		go func() { done <- client.SendSized("sized", bytes.NewReader(data), int64(len(data))) }()
+		if err := checkBatch(server, []BatchItem{{Key: "sized", Data: data}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		server.Close()
+		if got, want := sent.kinds(), "ConnectionOpened StreamSent ConnectionClosed"; got != want {
+			t.Fatalf("events %s, want %s", got, want)
+		}
+		if ev := sent.get()[1].(StreamSent); ev.Key != "sized" || ev.Bytes != 5000 || ev.Err != nil {
+			t.Fatalf("%+v", ev)
+		}
+		if n := client.Stats().BytesSent; n != 5000 {
+			t.Fatalf("Stats().BytesSent = %d", n)
+		}
+	}
+}
+
+func TestAuditSendBatch(t *testing.T) {
+	var sent auditLog
+	a, b := net.Pipe()
+	client := NewConn(a, WithDigest(sha256.New), WithAudit(sent.record))
+	server := NewConn(b, WithDigest(sha256.New))
+	defer client.Close()
+	defer server.Close()
+	items := batchItems(3)
+	items[1].Data = nil
+	done := make(chan error, 1)
+	go func() { done <- client.SendBatch(items) }()
+	if err := checkBatch(server, items); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sent.kinds(), "ConnectionOpened StreamSent StreamSent StreamSent"; got != want {
+		t.Fatalf("events %s, want %s", got, want)
+	}
+	for i, ev := range sent.get()[1:] {
+		ev := ev.(StreamSent)
+		sum := sha256.Sum256(items[i].Data)
+		if ev.Key != items[i].Key || ev.Bytes != int64(len(items[i].Data)) || !bytes.Equal(ev.Digest, sum[:]) || ev.Err != nil {
+			t.Fatalf("%+v, want the key, size and digest of %q", ev, items[i].Key)
+		}
+	}
+	// the batch is over, Close has no open writer left to report
+	client.Close()
+	if got, want := sent.kinds(), "ConnectionOpened StreamSent StreamSent StreamSent ConnectionClosed"; got != want {
+		t.Fatalf("events %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ACH 是校验凭证的一方发出的随机挑战；AUT 携带本端凭证的名称及其对挑战的证明；
+// AOK 与 AFL 是对端的认证结果，AFL 的 payload 为拒绝原因，发出后连接随即被关闭
+const (
+	ACH = "ACH0"
+	AUT = "AUT0"
+	AOK = "AOK0"
+	AFL = "AFL0"
+)
+
+// ErrAuthFailed 表示对端拒绝了本端的凭证，或者本端没有出示对端要求的凭证
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrReplayed 表示对端的认证已经过期，或者其 nonce 已经被 ReplayCache 见过
+var ErrReplayed = errors.New("stale or replayed credentials")
+
+// ErrBadCredentials 表示对端的认证无法通过校验：凭证错误，或者认证不是为本次连接的挑战生成的
+var ErrBadCredentials = errors.New("invalid credentials")
+
+// errMissingToken 是对端没有出示凭证时发送给它的拒绝原因
+var errMissingToken = errors.New("missing credentials")
+
+const (
+	// authNonceLen 是 ACH 帧中的挑战以及 AUT 帧中随机 nonce 的长度
+	authNonceLen = 16
+	// defaultAuthWindow 是没有设置 ReplayCache 时认证的时间戳与本地时间允许相差的范围
+	defaultAuthWindow = time.Minute
+)
+
+// needAuth 报告握手时是否需要进行令牌认证
+func (conn *Conn) needAuth() bool {
+	return conn.cfg.Token != nil || conn.cfg.Authenticate != nil
+}
+
+// authenticate 向对端发出挑战、用本端的凭证回答对端的挑战并校验对端的回答，调用者需持有 hmu；
+// 双方可能同时认证对方，因此各个握手帧都在另一个 goroutine 中写出，但仍按顺序写出
+func (conn *Conn) authenticate() error {
+	var sent <-chan error
+	send := func(tag string, payload []byte) error {
+		if sent != nil {
+			if err := <-sent; err != nil {
+				return err
+			}
+		}
+		sent = conn.sendHandshake(tag, payload)
+		return nil
+	}
+	var challenge []byte
+	if conn.cfg.Authenticate != nil {
+		challenge = make([]byte, authNonceLen)
+		if _, err := rand.Read(challenge); err != nil {
+			return err
+		}
+		if err := send(ACH, challenge); err != nil {
+			return err
+		}
+	}
+	if conn.cfg.Token != nil {
+		peerChallenge, err := conn.readHandshake(ACH)
+		if err != nil {
+			return err
+		}
+		proof, err := conn.tokenProof(peerChallenge)
+		if err != nil {
+			return err
+		}
+		if err = send(AUT, proof); err != nil {
+			return err
+		}
+	}
+	if conn.cfg.Authenticate != nil {
+		if err := conn.checkToken(challenge); err != nil {
+			return err
+		}
+		if err := send(AOK, nil); err != nil {
+			return err
+		}
+	}
+	if conn.cfg.Token != nil {
+		// a rejection arrives as AFL, which nextFrame turns into an error
+		tag, _, err := conn.nextFrame()
+		if err != nil {
+			return err
+		}
+		if tag != AOK {
+			return fmt.Errorf("unexpected frame %q, want %q", tag, AOK)
+		}
+	}
+	if sent != nil {
+		return <-sent
+	}
+	return nil
+}
+
+// tokenProof 构造 AUT 帧的 payload：[8 字节时间戳][16 字节随机 nonce][32 字节 HMAC][凭证名称]；
+// HMAC 以凭证为密钥，覆盖对端的挑战、时间戳、nonce、凭证名称以及密钥交换的握手摘要，凭证本身不会发送给对端，
+// 录制下来的 AUT 帧也无法回答其他连接上的挑战
+func (conn *Conn) tokenProof(challenge []byte) ([]byte, error) {
+	payload := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+	nonce := make([]byte, authNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	payload = append(payload, nonce...)
+	id := []byte(conn.cfg.TokenID)
+	payload = append(payload, conn.proofMAC(conn.cfg.Token, challenge, payload, id)...)
+	return append(payload, id...), nil
+}
+
+// proofMAC 计算凭证对挑战、时间戳、nonce 与凭证名称的 HMAC
+func (conn *Conn) proofMAC(token, challenge, stamp, id []byte) []byte {
+	return hmacSum(token, []byte("zhuozhuo auth"), challenge, conn.transcript, stamp, id)
+}
+
+// checkToken 读取对端对 challenge 的回答并校验，失败时先告知对端原因
+func (conn *Conn) checkToken(challenge []byte) error {
+	tag, payload, err := conn.nextFrame()
+	if err != nil {
+		return err
+	}
+	var id string
+	if tag != AUT {
+		err = errMissingToken
+	} else {
+		id, err = conn.verifyProof(challenge, payload)
+	}
+	if err != nil {
+		conn.audit(AuthFailed{Reason: err.Error()})
+		// best effort, the connection is closed right after
+		conn.putFrame(AFL, []byte(err.Error()))
+		return fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	conn.peerTokenID = id
+	return nil
+}
+
+// verifyProof 向 Authenticate 查询 AUT 帧中凭证名称对应的凭证，校验 HMAC 与时间戳，返回凭证名称；
+// 配置了 ReplayCache 时还会拒绝重复使用的 nonce
+func (conn *Conn) verifyProof(challenge, payload []byte) (string, error) {
+	const stampLen = 8 + authNonceLen
+	if len(payload) < stampLen+sha256.Size {
+		return "", errors.New("invalid auth frame")
+	}
+	stamp, mac, id := payload[:stampLen], payload[stampLen:stampLen+sha256.Size], payload[stampLen+sha256.Size:]
+	token, err := conn.cfg.Authenticate(string(id))
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(mac, conn.proofMAC(token, challenge, stamp, id)) {
+		return "", ErrBadCredentials
+	}
+	at := time.Unix(0, int64(binary.LittleEndian.Uint64(stamp)))
+	if cache := conn.cfg.ReplayCache; cache != nil {
+		return string(id), cache.check(at, stamp[8:])
+	}
+	if !withinWindow(at, time.Now(), defaultAuthWindow) {
+		return "", ErrReplayed
+	}
+	return string(id), nil
+}
+
+// withinWindow 报告 at 与 now 相差是否不超过 window
+func withinWindow(at, now time.Time, window time.Duration) bool {
+	return !at.Before(now.Add(-window)) && !at.After(now.Add(window))
+}
+
+// ReplayCache 记录一段时间窗口内见过的认证 nonce，用于拒绝被录制后重放的认证；
+// 应在同一个服务端的所有 Conn 之间共享
+type ReplayCache struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time // nonce -> when it stops mattering
+}
+
+// NewReplayCache 创建一个 ReplayCache，时间戳与本地时间相差超过 window 的认证会被拒绝
+func NewReplayCache(window time.Duration) *ReplayCache {
+	return &ReplayCache{
+		window: window,
+		seen:   map[string]time.Time{},
+	}
+}
+
+func (c *ReplayCache) check(at time.Time, nonce []byte) error {
+	now := time.Now()
+	if !withinWindow(at, now, c.window) {
+		return ErrReplayed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, expire := range c.seen {
+		if now.After(expire) {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[string(nonce)]; ok {
+		return ErrReplayed
+	}
+	// a nonce older than the window is rejected by its timestamp, no need to remember it longer
+	c.seen[string(nonce)] = at.Add(c.window)
+	return nil
+}
+
+// authFailed 将对端发来的 AFL 转换为错误
+func authFailed(reason []byte) error {
+	return fmt.Errorf("%w: %s", ErrAuthFailed, reason)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenAuthReplay(t *testing.T) {
+	clientErr, serverErr, _, wire := authenticatedSend(t,
+		[]Option{WithToken("alice", testSecret)},
+		[]Option{WithAuthenticator(lookupToken)})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+
+	// play the recorded client byte for byte against a fresh server, which sends a new challenge
+	a, b := net.Pipe()
+	server := NewConn(b, WithAuthenticator(lookupToken))
+	defer server.Close()
+	go io.Copy(io.Discard, a)
+	go a.Write(wire)
+	_, _, err := server.Receive()
+	// the recorded proof answers the old challenge, not this one
+	if !errors.Is(err, ErrAuthFailed) || !errors.Is(err, ErrBadCredentials) {
+		t.Fatalf("got %v, want ErrBadCredentials", err)
+	}
+	a.Close()
+}
+
+func TestTokenAuthStaleTimestamp(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := NewConn(a, WithToken("alice", testSecret))
+	server := NewConn(b, WithAuthenticator(lookupToken))
+	challenge := bytes.Repeat([]byte{7}, authNonceLen)
+	if _, err := server.verifyProof(challenge, tokenProof(client, challenge, time.Now(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	// no ReplayCache is configured, the default window still applies
+	stale := tokenProof(client, challenge, time.Now().Add(-2*defaultAuthWindow), 2)
+	if _, err := server.verifyProof(challenge, stale); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("got %v, want ErrReplayed", err)
+	}
+}
+
+// tokenProof 返回 client 在 at 时刻以填满 nonce 的 nonce 回应 challenge 的 AUT 负载
+func tokenProof(client *Conn, challenge []byte, at time.Time, nonce byte) []byte {
+	stamp := binary.LittleEndian.AppendUint64(nil, uint64(at.UnixNano()))
+	stamp = append(stamp, bytes.Repeat([]byte{nonce}, authNonceLen)...)
+	return append(append(stamp, client.proofMAC(testSecret, challenge, stamp, []byte("alice"))...), "alice"...)
+}
+
+func TestTokenAuthReplayCache(t *testing.T) {
+	cache := NewReplayCache(time.Minute)
+	challenge := bytes.Repeat([]byte{7}, authNonceLen)
+	newConn := func(opts ...Option) *Conn {
+		a, b := net.Pipe()
+		t.Cleanup(func() {
+			a.Close()
+			b.Close()
+		})
+		return NewConn(a, opts...)
+	}
+	client := newConn(WithToken("alice", testSecret))
+	first := newConn(WithAuthenticator(lookupToken), WithReplayCache(cache))
+	second := newConn(WithAuthenticator(lookupToken), WithReplayCache(cache))
+
+	// one recorded payload, good on the connection it was made for
+	recorded := tokenProof(client, challenge, time.Now(), 1)
+	if _, err := first.verifyProof(challenge, recorded); err != nil {
+		t.Fatal(err)
+	}
+	// the same payload on another connection sharing the cache
+	if _, err := second.verifyProof(challenge, recorded); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("got %v, want ErrReplayed", err)
+	}
+	// a fresh nonce still gets through
+	if _, err := second.verifyProof(challenge, tokenProof(client, challenge, time.Now(), 2)); err != nil {
+		t.Fatal(err)
+	}
+}
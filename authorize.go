@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// RST 是接收方拒绝一个 key 的控制帧，payload 为 2 字节 key 长度 + key + 拒绝原因；
+// 被拒绝的 key 的数据会被接收方丢弃
+const RST = "RST0"
+
+// Direction 表示一个 key 的传输方向
+type Direction uint8
+
+const (
+	DirectionIn  Direction = iota + 1 // 对端向本端发送该 key
+	DirectionOut                      // 本端向对端发送该 key
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionIn:
+		return "in"
+	case DirectionOut:
+		return "out"
+	}
+	return fmt.Sprintf("direction(%d)", uint8(d))
+}
+
+// Identity 是对端在连接上经过认证的身份，Authorize 据此决定是否允许传输某个 key
+type Identity struct {
+	TLS     *PeerIdentity // 对端的 TLS 证书，底层不是 TLS 或对端没有出示证书时为 nil
+	TokenID string        // 对端在握手时证明持有的凭证的名称，没有进行令牌认证时为空
+	Unix    *PeerCred     // unix socket 对端进程的凭证，底层不是 unix socket 或平台不支持时为 nil
+	Addr    net.Addr
+}
+
+// RejectedError 表示对端通过 Authorize 拒绝了该 key，发送者之后的写入都会返回该错误
+type RejectedError struct {
+	Key    string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("key %q rejected by peer: %s", e.Key, e.Reason)
+}
+
+// Peer 返回对端经过认证的身份
+func (conn *Conn) Peer() Identity {
+	id := Identity{
+		TokenID: conn.peerTokenID,
+		Addr:    conn.n.RemoteAddr(),
+	}
+	if tls, err := conn.PeerIdentity(); err == nil {
+		id.TLS = tls
+	}
+	if uc, ok := conn.n.(*net.UnixConn); ok {
+		if cred, err := PeerCredentials(uc); err == nil {
+			id.Unix = cred
+		}
+	}
+	return id
+}
+
+// authorize 在配置了 Authorize 时询问是否允许在 dir 方向上传输 key
+func (conn *Conn) authorize(key string, dir Direction) error {
+	if conn.cfg.Authorize == nil {
+		return nil
+	}
+	return conn.cfg.Authorize(conn.Peer(), key, dir)
+}
+
+// Reject 告知发送者正在接收的 key 被拒绝，发送者之后的写入会得到 *RejectedError；
+// 已经在路上的数据仍需读完或 Drain，Serve 与 ServeMux 会在 handler 返回后自动丢弃；
+func (conn *Conn) Reject(key string, reason error) error {
+	return conn.reject(key, reason)
+}
+
+// StreamInfo 是对端在 key 帧中随 key 一起发来的信息
+type StreamInfo struct {
+	TransferID  string      // SendWithID 附带的传输 ID，没有时为空
+	Offset      int64       // SendResume 续传时接收方已持有的字节数
+	Compression Compression // 该 key 的数据使用的压缩算法
+}
+
+// streamOpen 在配置了 OnStreamOpen 时询问是否接收 cr 对应的 key
+func (conn *Conn) streamOpen(key string, cr *ConnReader) error {
+	if conn.cfg.OnStreamOpen == nil {
+		return nil
+	}
+	return conn.cfg.OnStreamOpen(conn, key, StreamInfo{
+		TransferID:  cr.id,
+		Offset:      cr.offset,
+		Compression: cr.codec,
+	})
+}
+
+// reject 告知发送者 key 被拒绝
+func (conn *Conn) reject(key string, reason error) error {
+	payload := binary.LittleEndian.AppendUint16(nil, uint16(len(key)))
+	payload = append(payload, key...)
+	payload = append(payload, reason.Error()...)
+	return conn.writeFrame(RST, payload)
+}
+
+// acceptReject 记录对端拒绝了本端正在发送的 key
+func (conn *Conn) acceptReject(payload []byte) error {
+	if len(payload) < 2 || len(payload) < 2+int(binary.LittleEndian.Uint16(payload)) {
+		return errors.New("invalid reject frame")
+	}
+	keyLen := int(binary.LittleEndian.Uint16(payload))
+	key := string(payload[2 : 2+keyLen])
+	conn.rmu.Lock()
+	defer conn.rmu.Unlock()
+	if conn.rejected == nil {
+		conn.rejected = map[string]*RejectedError{}
+	}
+	conn.rejected[key] = &RejectedError{Key: key, Reason: string(payload[2+keyLen:])}
+	return nil
+}
+
+// rejection 返回对端对 key 的拒绝，没有被拒绝时返回 nil
+func (conn *Conn) rejection(key string) error {
+	conn.rmu.Lock()
+	defer conn.rmu.Unlock()
+	if err, ok := conn.rejected[key]; ok {
+		return err
+	}
+	return nil
+}
+
+// clearRejection 在重新发送 key 时忘记此前的拒绝
+func (conn *Conn) clearRejection(key string) {
+	conn.rmu.Lock()
+	defer conn.rmu.Unlock()
+	delete(conn.rejected, key)
+}
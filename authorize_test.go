@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+var errPayrollDenied = errors.New("payroll is for alice only")
+
+// payrollPolicy 只允许 alice 发来 payroll，其他 key 谁都可以发
+func payrollPolicy(peer Identity, key string, dir Direction) error {
+	if dir == DirectionIn && key == "payroll" && peer.TokenID != "alice" {
+		return errPayrollDenied
+	}
+	return nil
+}
+
+// authorizedSend 让持有 id 凭证的客户端依次发送 payroll 和 public，返回服务端收到的 key 和发送 payroll 的错误
+func authorizedSend(t *testing.T, id string) (received []string, sendErr error) {
+	t.Helper()
+	tokens := map[string][]byte{"alice": []byte("alice's token"), "bob": []byte("bob's token")}
+	a, b := net.Pipe()
+	client := NewConn(a, WithToken(id, tokens[id]))
+	server := NewConn(b,
+		WithAuthenticator(func(id string) ([]byte, error) { return tokens[id], nil }),
+		WithAuthorizer(payrollPolicy))
+	defer client.Close()
+	defer server.Close()
+	// reads the server's RST
+	go client.Receive()
+	done := make(chan []string, 1)
+	go func() {
+		var keys []string
+		for {
+			key, r, err := server.Receive()
+			if err != nil {
+				done <- keys
+				return
+			}
+			io.ReadAll(r)
+			keys = append(keys, key)
+		}
+	}()
+
+	w, err := client.Send("payroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("salaries"))
+	if id != "alice" {
+		eventually(t, "the rejection to arrive", func() bool { return client.rejection("payroll") != nil })
+	}
+	sendErr = w.Close()
+	if err = sendAll(client, "public", []byte("menu")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return <-done, sendErr
+}
+
+func TestAuthorizeAllowed(t *testing.T) {
+	keys, err := authorizedSend(t, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, []string{"payroll", "public"}) {
+		t.Fatalf("the server received %q", keys)
+	}
+}
+
+func TestAuthorizeDenied(t *testing.T) {
+	keys, err := authorizedSend(t, "bob")
+	var rerr *RejectedError
+	if !errors.As(err, &rerr) || rerr.Key != "payroll" || rerr.Reason != errPayrollDenied.Error() {
+		t.Fatalf("got %v, want the payroll rejection", err)
+	}
+	// the rejected key never reached the application, the next one did
+	if !slices.Equal(keys, []string{"public"}) {
+		t.Fatalf("the server received %q", keys)
+	}
+}
+
+func TestAuthorizeOutgoing(t *testing.T) {
+	client, _ := pipeConns(t, WithAuthorizer(func(peer Identity, key string, dir Direction) error {
+		if dir == DirectionOut && key == "secret" {
+			return errPayrollDenied
+		}
+		return nil
+	}))
+	if _, err := client.Send("secret"); !errors.Is(err, errPayrollDenied) {
+		t.Fatalf("got %v, want the authorizer's error", err)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxFailures   = 3
+	defaultProbeInterval = 5 * time.Second
+)
+
+// ErrNoHealthyEndpoints 表示 Balancer 中没有可用的地址：没有添加任何地址，或者所有地址都被标记为不健康，
+// 或者这一次 Send 尝试过的地址全部失败
+var ErrNoHealthyEndpoints = errors.New("no healthy endpoints")
+
+// BalancePolicy 决定 Balancer 为每次 Send 选择哪个地址
+type BalancePolicy uint8
+
+const (
+	RoundRobin       BalancePolicy = iota // 依次轮流使用各个健康的地址
+	LeastOutstanding                      // 使用尚未 Close 的 writer 最少的地址，相同时轮流使用
+)
+
+// Balancer 把 Send 分散到多个接收方地址上，每个地址各有一个 Pool；
+// 某个地址连续失败 MaxFailures 次（拨号失败或连接在传输中断开）后被标记为不健康，不再被选中，
+// 此后每隔 ProbeInterval 尝试取得一个连接（拨号或 Ping 空闲连接），成功后恢复；
+// 地址可以在运行时 Add 或 Remove；可以被多个 goroutine 同时使用，用完后需要 Close 以停止探测
+type Balancer struct {
+	// Options 是拨号时使用的 Option
+	Options []Option
+	// Policy 是选择地址的方式
+	Policy BalancePolicy
+	// MaxConns、IdleTimeout 与 HealthCheck 用于每个地址的 Pool，含义与 Pool 的同名字段相同
+	MaxConns    int
+	IdleTimeout time.Duration
+	HealthCheck time.Duration
+	// MaxFailures 是地址被标记为不健康之前允许的连续失败次数，为 0 时使用 3
+	MaxFailures int
+	// ProbeInterval 是探测不健康地址的间隔，为 0 时使用 5s
+	ProbeInterval time.Duration
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	next      int           // where the next pick starts
+	stop      chan struct{} // stops the probe loop, nil until the first Add
+	closed    bool
+}
+
+// endpoint 是 Balancer 中的一个地址
+type endpoint struct {
+	addr        string
+	pool        *Pool
+	outstanding atomic.Int64 // writers handed out and not closed yet
+	failures    int          // consecutive failures, guarded by Balancer.mu
+	down        bool         // guarded by Balancer.mu
+}
+
+// EndpointStatus 是 Balancer 中一个地址的状态
+type EndpointStatus struct {
+	Addr        string
+	Healthy     bool
+	Outstanding int // 尚未 Close 的 writer 数
+	Conns       int // 该地址的 Pool 中的连接数，包括空闲的和正在使用的
+}
+
+// Add 添加一个地址，它已经存在时什么都不做；新地址被视为健康
+func (b *Balancer) Add(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.find(addr) >= 0 {
+		return
+	}
+	ep := &endpoint{addr: addr}
+	ep.pool = &Pool{
+		Dial: func(ctx context.Context) (*Conn, error) {
+			return Dial(ctx, addr, b.Options...)
+		},
+		MaxSize:     b.MaxConns,
+		IdleTimeout: b.IdleTimeout,
+		HealthCheck: b.HealthCheck,
+	}
+	b.endpoints = append(b.endpoints, ep)
+	if b.stop == nil {
+		b.stop = make(chan struct{})
+		go b.probeLoop(b.stop)
+	}
+}
+
+// Remove 移除一个地址并关闭它的空闲连接，正在使用的连接在其 writer Close 后关闭
+func (b *Balancer) Remove(addr string) {
+	b.mu.Lock()
+	i := b.find(addr)
+	if i < 0 {
+		b.mu.Unlock()
+		return
+	}
+	ep := b.endpoints[i]
+	b.endpoints = slices.Delete(b.endpoints, i, i+1)
+	b.mu.Unlock()
+	ep.pool.Close()
+}
+
+// Endpoints 返回各个地址的状态
+func (b *Balancer) Endpoints() []EndpointStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]EndpointStatus, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		total, _ := ep.pool.Len()
+		out = append(out, EndpointStatus{
+			Addr:        ep.addr,
+			Healthy:     !ep.down,
+			Outstanding: int(ep.outstanding.Load()),
+			Conns:       total,
+		})
+	}
+	return out
+}
+
+// Close 停止探测并关闭所有地址的空闲连接，此后 Send 返回 ErrNoHealthyEndpoints
+func (b *Balancer) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	endpoints := b.endpoints
+	b.endpoints = nil
+	if b.stop != nil {
+		close(b.stop)
+	}
+	b.mu.Unlock()
+	for _, ep := range endpoints {
+		ep.pool.Close()
+	}
+}
+
+// Send 选择一个健康的地址，从它的 Pool 中取得连接并发送 key；取得连接或发送 key 失败时换一个地址重试，
+// 每个地址至多尝试一次；返回的 writer Close 后连接被归还；全部失败时返回的错误包含 ErrNoHealthyEndpoints 与各个地址的错误
+func (b *Balancer) Send(ctx context.Context, key string) (io.WriteCloser, error) {
+	tried := map[*endpoint]bool{}
+	var errs []error
+	for {
+		ep := b.pick(tried)
+		if ep == nil {
+			if len(errs) == 0 {
+				return nil, ErrNoHealthyEndpoints
+			}
+			return nil, fmt.Errorf("%w: %w", ErrNoHealthyEndpoints, errors.Join(errs...))
+		}
+		tried[ep] = true
+		w, err := b.send(ctx, ep, key)
+		if err == nil {
+			return w, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", ep.addr, err))
+	}
+}
+
+// send 从 ep 取得连接并发送 key
+func (b *Balancer) send(ctx context.Context, ep *endpoint, key string) (io.WriteCloser, error) {
+	ep.outstanding.Add(1)
+	conn, err := ep.pool.Get(ctx)
+	if err != nil {
+		ep.outstanding.Add(-1)
+		if ctx.Err() == nil {
+			b.report(ep, false)
+		}
+		return nil, err
+	}
+	w, err := conn.Send(key)
+	if err != nil {
+		b.finish(ep, conn, err)
+		return nil, err
+	}
+	return &balancedWriter{WriteCloser: w, b: b, ep: ep, conn: conn}, nil
+}
+
+// finish 在一次传输结束后归还或关闭连接，并根据 err 更新 ep 的健康状态
+func (b *Balancer) finish(ep *endpoint, conn *Conn, err error) {
+	ep.outstanding.Add(-1)
+	if broken(conn, err) {
+		conn.Close()
+		b.report(ep, false)
+		return
+	}
+	ep.pool.Put(conn)
+	b.report(ep, true)
+}
+
+// broken 报告以 err 结束的传输是否说明连接或对端出了问题，而不只是这一个 key 失败（例如被对端拒绝）
+func broken(conn *Conn, err error) bool {
+	if err == nil {
+		return false
+	}
+	var ne net.Error
+	return conn.lostError() != nil || conn.closed.Load() || errors.As(err, &ne) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// report 记录 ep 的一次成功或失败，连续失败达到 MaxFailures 次时将其标记为不健康
+func (b *Balancer) report(ep *endpoint, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		ep.failures, ep.down = 0, false
+		return
+	}
+	ep.failures++
+	max := b.MaxFailures
+	if max <= 0 {
+		max = defaultMaxFailures
+	}
+	if ep.failures >= max {
+		ep.down = true
+	}
+}
+
+// pick 按 Policy 选择一个健康且不在 tried 中的地址，没有时返回 nil
+func (b *Balancer) pick(tried map[*endpoint]bool) *endpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.endpoints)
+	var best *endpoint
+	bestAt := 0
+	for i := 0; i < n; i++ {
+		at := (b.next + i) % n
+		ep := b.endpoints[at]
+		if ep.down || tried[ep] {
+			continue
+		}
+		if best == nil || b.Policy == LeastOutstanding && ep.outstanding.Load() < best.outstanding.Load() {
+			best, bestAt = ep, at
+		}
+		if b.Policy == RoundRobin {
+			break
+		}
+	}
+	if best != nil {
+		b.next = bestAt + 1
+	}
+	return best
+}
+
+// find 返回 addr 在 endpoints 中的位置，不存在时返回 -1；调用者需持有 mu
+func (b *Balancer) find(addr string) int {
+	return slices.IndexFunc(b.endpoints, func(ep *endpoint) bool {
+		return ep.addr == addr
+	})
+}
+
+// probeLoop 每隔 ProbeInterval 探测一次不健康的地址，直到 stop 被关闭
+func (b *Balancer) probeLoop(stop <-chan struct{}) {
+	interval := b.ProbeInterval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		b.mu.Lock()
+		var down []*endpoint
+		for _, ep := range b.endpoints {
+			if ep.down {
+				down = append(down, ep)
+			}
+		}
+		b.mu.Unlock()
+		for _, ep := range down {
+			b.probe(ep, interval)
+		}
+	}
+}
+
+// probe 尝试从不健康的 ep 取得一个连接，成功时把连接归还并恢复 ep
+func (b *Balancer) probe(ep *endpoint, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := ep.pool.Get(ctx)
+	if err != nil {
+		return
+	}
+	ep.pool.Put(conn)
+	b.report(ep, true)
+}
+
+// balancedWriter 在 Close 时把连接归还给它所属的地址
+type balancedWriter struct {
+	io.WriteCloser
+	b    *Balancer
+	ep   *endpoint
+	conn *Conn
+	done atomic.Bool
+}
+
+func (w *balancedWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if w.done.CompareAndSwap(false, true) {
+		w.b.finish(w.ep, w.conn, err)
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fleetNode 是一个可以被停止并在同一地址上重新启动的接收方，keys 统计它收到的完整 key
+type fleetNode struct {
+	addr string
+	s    *Server
+	keys atomic.Int64
+}
+
+// start 在 n.addr（第一次启动时为随机端口）上运行接收方
+func (n *fleetNode) start(t *testing.T) {
+	t.Helper()
+	addr := n.addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.addr = ln.Addr().String()
+	s := &Server{Handler: func(conn *Conn) {
+		for {
+			_, r, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			if _, err = io.ReadAll(r); err == nil {
+				n.keys.Add(1)
+			}
+		}
+	}}
+	n.s = s
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+}
+
+// fleet 启动 n 个接收方
+func fleet(t *testing.T, n int) []*fleetNode {
+	nodes := make([]*fleetNode, n)
+	for i := range nodes {
+		nodes[i] = &fleetNode{}
+		nodes[i].start(t)
+	}
+	return nodes
+}
+
+// balancedSend 经由 b 发送 count 个 key，返回失败的次数
+func balancedSend(b *Balancer, count int) (failed int) {
+	for i := 0; i < count; i++ {
+		w, err := b.Send(context.Background(), "k")
+		if err == nil {
+			_, err = w.Write([]byte("data"))
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// expectKeys 等到各个接收方累计收到 want 中的 key 数
+func expectKeys(t *testing.T, nodes []*fleetNode, want ...int64) {
+	t.Helper()
+	eventually(t, "the keys to arrive", func() bool {
+		for i, n := range nodes {
+			if n.keys.Load() != want[i] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func healthy(b *Balancer, addr string) bool {
+	for _, ep := range b.Endpoints() {
+		if ep.Addr == addr {
+			return ep.Healthy
+		}
+	}
+	return false
+}
+
+func TestBalancerFailover(t *testing.T) {
+	nodes := fleet(t, 3)
+	// a dead idle connection is noticed by the ping before it is handed out
+	b := &Balancer{MaxFailures: 1, ProbeInterval: 20 * time.Millisecond, HealthCheck: time.Nanosecond}
+	defer b.Close()
+	for _, n := range nodes {
+		b.Add(n.addr)
+	}
+	if failed := balancedSend(b, 30); failed != 0 {
+		t.Fatalf("%d sends failed with every node up", failed)
+	}
+	expectKeys(t, nodes, 10, 10, 10)
+
+	nodes[1].s.Close()
+	// the pooled connection to the dead node fails, then dialing it does
+	if failed := balancedSend(b, 30); failed != 0 {
+		t.Fatalf("%d sends failed though two nodes are up", failed)
+	}
+	expectKeys(t, nodes, 25, 10, 25)
+	if healthy(b, nodes[1].addr) || !healthy(b, nodes[0].addr) || !healthy(b, nodes[2].addr) {
+		t.Fatalf("endpoints %+v", b.Endpoints())
+	}
+
+	nodes[1].start(t)
+	eventually(t, "the probe to bring the node back", func() bool { return healthy(b, nodes[1].addr) })
+	if failed := balancedSend(b, 30); failed != 0 {
+		t.Fatalf("%d sends failed after the node came back", failed)
+	}
+	expectKeys(t, nodes, 35, 20, 35)
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	nodes := fleet(t, 2)
+	b := &Balancer{Policy: LeastOutstanding}
+	defer b.Close()
+	for _, n := range nodes {
+		b.Add(n.addr)
+	}
+	// a long transfer holds the first node
+	long, err := b.Send(context.Background(), "long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := balancedSend(b, 5); failed != 0 {
+		t.Fatalf("%d sends failed", failed)
+	}
+	// the short ones all went to the idle node
+	expectKeys(t, nodes, 0, 5)
+	status := b.Endpoints()
+	if status[0].Outstanding != 1 || status[1].Outstanding != 0 {
+		t.Fatalf("endpoints %+v", status)
+	}
+	long.Close()
+	expectKeys(t, nodes, 1, 5)
+	if n := b.Endpoints()[0].Outstanding; n != 0 {
+		t.Fatalf("%d outstanding after Close", n)
+	}
+}
+
+func TestBalancerAddRemove(t *testing.T) {
+	nodes := fleet(t, 2)
+	b := &Balancer{}
+	defer b.Close()
+	if _, err := b.Send(context.Background(), "k"); !errors.Is(err, ErrNoHealthyEndpoints) {
+		t.Fatalf("got %v with no endpoints, want ErrNoHealthyEndpoints", err)
+	}
+	b.Add(nodes[0].addr)
+	b.Add(nodes[0].addr)
+	if n := len(b.Endpoints()); n != 1 {
+		t.Fatalf("%d endpoints after adding the same address twice", n)
+	}
+	balancedSend(b, 4)
+	expectKeys(t, nodes, 4, 0)
+
+	b.Add(nodes[1].addr)
+	balancedSend(b, 4)
+	expectKeys(t, nodes, 6, 2)
+
+	b.Remove(nodes[0].addr)
+	b.Remove("127.0.0.1:1")
+	balancedSend(b, 4)
+	expectKeys(t, nodes, 6, 6)
+
+	b.Close()
+	if _, err := b.Send(context.Background(), "k"); !errors.Is(err, ErrNoHealthyEndpoints) {
+		t.Fatalf("got %v after Close, want ErrNoHealthyEndpoints", err)
+	}
+}
+
+func TestBalancerAllDown(t *testing.T) {
+	b := &Balancer{MaxFailures: 2, ProbeInterval: time.Hour}
+	defer b.Close()
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	for _, addr := range addrs {
+		b.Add(addr)
+	}
+	// each Send tries both nodes once
+	for i := 0; i < 2; i++ {
+		_, err := b.Send(context.Background(), "k")
+		if !errors.Is(err, ErrNoHealthyEndpoints) || !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("got %v, want ErrNoHealthyEndpoints with the refusals", err)
+		}
+	}
+	for _, ep := range b.Endpoints() {
+		if ep.Healthy {
+			t.Fatalf("%s is healthy after 2 failures", ep.Addr)
+		}
+	}
+	// nothing left to try
+	if _, err := b.Send(context.Background(), "k"); err != ErrNoHealthyEndpoints {
+		t.Fatalf("got %v, want a bare ErrNoHealthyEndpoints", err)
+	}
+}
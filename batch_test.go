@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// batchItems 返回 n 个 key 与数据各不相同的 BatchItem
+func batchItems(n int) []BatchItem {
+	items := make([]BatchItem, n)
+	for i := range items {
+		items[i] = BatchItem{Key: fmt.Sprintf("key-%03d", i), Data: []byte(fmt.Sprintf("value of %d", i))}
+	}
+	return items
+}
+
+// checkBatch 依次 Receive 并核对 items 中的每一项
+func checkBatch(conn *Conn, items []BatchItem) error {
+	for _, item := range items {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if key != item.Key || string(data) != string(item.Data) {
+			return fmt.Errorf("got %q %q, want %q %q", key, data, item.Key, item.Data)
+		}
+	}
+	return nil
+}
+
+func TestSendBatchHundredPairs(t *testing.T) {
+	items := batchItems(100)
+	client, server := pipeConns(t)
+	errc := make(chan error, 1)
+	go func() { errc <- client.SendBatch(items) }()
+	if err := checkBatch(server, items); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if s := client.Stats(); s.BytesSent != server.Stats().BytesReceived {
+		t.Fatalf("sent %d bytes, received %d", s.BytesSent, server.Stats().BytesReceived)
+	}
+}
+
+func TestSendBatchOverTCP(t *testing.T) {
+	items := batchItems(100)
+	done := make(chan error, 1)
+	ln := startServer(func(conn *Conn) { done <- checkBatch(conn, items) })
+	defer ln.Close()
+	client := dial(ln.Addr().String())
+	defer client.Close()
+	if err := client.SendBatch(items); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendBatchWithDigest(t *testing.T) {
+	items := batchItems(10)
+	client, server := pipeConns(t, WithDigest(sha256.New))
+	go client.SendBatch(items)
+	// a wrong digest would fail the read at the end of each key
+	if err := checkBatch(server, items); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkBatch(b *testing.B, send func(*Conn, []BatchItem) error) {
+	items := batchItems(100)
+	done := make(chan struct{})
+	ln := startServer(func(conn *Conn) {
+		receiveAll(conn, false)
+		close(done)
+	})
+	defer ln.Close()
+	client := dial(ln.Addr().String())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := send(client, items); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	client.Close()
+	<-done
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+	benchmarkBatch(b, (*Conn).SendBatch)
+}
+
+// BenchmarkSendOneByOne 以逐个 Send 发送同样的 100 个 key，作为 SendBatch 的对照
+func BenchmarkSendOneByOne(b *testing.B) {
+	benchmarkBatch(b, func(conn *Conn, items []BatchItem) error {
+		for _, item := range items {
+			if err := sendAll(conn, item.Key, item.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
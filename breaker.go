@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCoolDown  = 30 * time.Second
+)
+
+// ErrCircuitOpen 表示 CircuitBreaker 处于打开状态，调用没有执行就失败了
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitState 是 CircuitBreaker 的状态
+type CircuitState uint8
+
+const (
+	CircuitClosed   CircuitState = iota // 正常放行所有调用
+	CircuitOpen                         // 所有调用立即以 ErrCircuitOpen 失败
+	CircuitHalfOpen                     // 冷却结束，放行一个探测调用，由它的结果决定关闭还是重新打开
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("circuit(%d)", uint8(s))
+}
+
+// CircuitBreaker 在下游持续不可用时让拨号与发送快速失败，而不是每次都重新尝试：
+// 连续失败（设置 Window 时为 Window 内累计失败）Threshold 次后打开，此后的调用立即返回 ErrCircuitOpen；
+// 打开 CoolDown 之后的下一个调用作为探测被放行，它成功则关闭，失败则重新打开并再等待 CoolDown；
+// 探测超过 ProbeTimeout 仍没有结果时放行下一个探测；被取消（context.Canceled）的调用不计入成功或失败；
+// 零值即可使用，可以被多个 goroutine 同时使用；Pool.Breaker 可以让 Pool 的拨号经过它
+type CircuitBreaker struct {
+	// Threshold 是打开之前允许的失败次数，为 0 时使用 5
+	Threshold int
+	// Window 大于 0 时统计最近 Window 内的失败次数，其间的成功不会清零；为 0 时只统计连续失败
+	Window time.Duration
+	// CoolDown 是打开后到放行探测调用之前等待的时间，为 0 时使用 30s
+	CoolDown time.Duration
+	// ProbeTimeout 是等待探测结果的最长时间，例如 Send 返回的 writer 一直没有被 Close；超过后放弃该探测，
+	// 它之后的结果被忽略，下一个调用作为新的探测被放行；为 0 时与 CoolDown 相同
+	ProbeTimeout time.Duration
+	// OnStateChange 在状态改变后被调用，它不持有任何锁，但应当很快返回
+	OnStateChange func(from, to CircuitState)
+	// Now 返回当前时间，为 nil 时使用 time.Now；测试可以用它控制冷却
+	Now func() time.Time
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures []time.Time // recent failures while closed, at most Threshold of them
+	openedAt time.Time   // when the circuit last opened
+	probe    uint64      // the half-open probe in flight, 0 when none
+	probeSeq uint64      // numbers the probes so a late result of an abandoned one is ignored
+	probedAt time.Time   // when the probe in flight was let through
+}
+
+// State 返回当前状态；冷却结束后直到下一个调用到来之前仍报告 CircuitOpen
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Do 在 CircuitBreaker 放行时调用 fn 并记录其结果，否则不调用 fn，直接返回 ErrCircuitOpen
+func (b *CircuitBreaker) Do(fn func() error) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	b.record(probe, err)
+	return err
+}
+
+// Dial 经过 CircuitBreaker 调用 Dial
+func (b *CircuitBreaker) Dial(ctx context.Context, addr string, opts ...Option) (conn *Conn, err error) {
+	err = b.Do(func() error {
+		conn, err = Dial(ctx, addr, opts...)
+		return err
+	})
+	return conn, err
+}
+
+// Send 经过 CircuitBreaker 在 conn 上发送 key：发送 key 与返回的 writer 的 Close 合起来算作一次调用，
+// 写入失败后 Close 同样会失败，因此也会被记录
+func (b *CircuitBreaker) Send(conn *Conn, key string) (io.WriteCloser, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	w, err := conn.Send(key)
+	if err != nil {
+		b.record(probe, err)
+		return nil, err
+	}
+	return &breakerWriter{WriteCloser: w, b: b, probe: probe}, nil
+}
+
+// allow 报告是否放行一个调用；半开状态下放行的探测调用得到非 0 的 probe
+func (b *CircuitBreaker) allow() (probe uint64, err error) {
+	b.mu.Lock()
+	from := b.state
+	now := b.now()
+	switch b.state {
+	case CircuitOpen:
+		if now.Sub(b.openedAt) < b.coolDown() {
+			b.mu.Unlock()
+			return 0, ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probe != 0 && now.Sub(b.probedAt) < b.probeTimeout() {
+			b.mu.Unlock()
+			return 0, ErrCircuitOpen
+		}
+		// an abandoned probe is replaced, whatever it reports later no longer matters
+		b.probeSeq++
+		b.probe, b.probedAt = b.probeSeq, now
+		probe = b.probe
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+	return probe, nil
+}
+
+// record 记录一个被放行的调用的结果；状态在调用期间已经改变时，非探测调用以及被放弃的探测调用的结果被忽略
+func (b *CircuitBreaker) record(probe uint64, err error) {
+	canceled := errors.Is(err, context.Canceled)
+	b.mu.Lock()
+	from := b.state
+	switch {
+	case b.state == CircuitClosed && err == nil:
+		if b.Window <= 0 {
+			b.failures = b.failures[:0]
+		}
+	case b.state == CircuitClosed && !canceled:
+		if b.failedLocked() >= b.threshold() {
+			b.openLocked()
+		}
+	case b.state == CircuitHalfOpen && probe != 0 && probe == b.probe:
+		b.probe = 0
+		switch {
+		case err == nil:
+			b.state, b.failures = CircuitClosed, b.failures[:0]
+		case !canceled:
+			b.openLocked()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.changed(from, to)
+}
+
+// failedLocked 记录一次失败并返回计入的失败次数：设置 Window 时只计最近 Window 内的失败，调用者需持有 mu
+func (b *CircuitBreaker) failedLocked() int {
+	now := b.now()
+	if b.Window > 0 {
+		i := 0
+		for i < len(b.failures) && now.Sub(b.failures[i]) >= b.Window {
+			i++
+		}
+		b.failures = append(b.failures[:0], b.failures[i:]...)
+	}
+	if len(b.failures) == b.threshold() {
+		// only the most recent Threshold failures can matter
+		b.failures = append(b.failures[:0], b.failures[1:]...)
+	}
+	b.failures = append(b.failures, now)
+	return len(b.failures)
+}
+
+// openLocked 打开电路并开始冷却，调用者需持有 mu
+func (b *CircuitBreaker) openLocked() {
+	b.state, b.openedAt, b.failures = CircuitOpen, b.now(), b.failures[:0]
+}
+
+// changed 在状态确实改变时调用 OnStateChange
+func (b *CircuitBreaker) changed(from, to CircuitState) {
+	if from != to && b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
+
+func (b *CircuitBreaker) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+func (b *CircuitBreaker) threshold() int {
+	if b.Threshold <= 0 {
+		return defaultBreakerThreshold
+	}
+	return b.Threshold
+}
+
+func (b *CircuitBreaker) coolDown() time.Duration {
+	if b.CoolDown <= 0 {
+		return defaultBreakerCoolDown
+	}
+	return b.CoolDown
+}
+
+func (b *CircuitBreaker) probeTimeout() time.Duration {
+	if b.ProbeTimeout <= 0 {
+		return b.coolDown()
+	}
+	return b.ProbeTimeout
+}
+
+// breakerWriter 在 Close 时把发送的结果记录到 CircuitBreaker
+type breakerWriter struct {
+	io.WriteCloser
+	b     *CircuitBreaker
+	probe uint64
+	done  atomic.Bool
+}
+
+func (w *breakerWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if w.done.CompareAndSwap(false, true) {
+		w.b.record(w.probe, err)
+	}
+	return err
+}
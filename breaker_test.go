@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("down")
+
+// fakeClock 是测试用的可控时钟
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestBreaker 返回一个使用 clock 的 CircuitBreaker，并记录它的状态变化
+func newTestBreaker(clock *fakeClock, changes *[]string) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: 3,
+		CoolDown:  time.Minute,
+		Now:       clock.now,
+		OnStateChange: func(from, to CircuitState) {
+			*changes = append(*changes, from.String()+"->"+to.String())
+		},
+	}
+}
+
+func fail() error    { return errDown }
+func succeed() error { return nil }
+
+func TestCircuitBreakerCycle(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var changes []string
+	b := newTestBreaker(clock, &changes)
+	for i := 0; i < 3; i++ {
+		if err := b.Do(fail); err != errDown {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("state %v after 3 failures", b.State())
+	}
+	called := false
+	if err := b.Do(func() error { called = true; return nil }); err != ErrCircuitOpen || called {
+		t.Fatalf("open circuit let a call through: %v", err)
+	}
+	clock.advance(time.Minute)
+	if err := b.Do(succeed); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("state %v after a successful probe", b.State())
+	}
+	want := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if !slices.Equal(changes, want) {
+		t.Fatalf("changes %v, want %v", changes, want)
+	}
+}
+
+func TestCircuitBreakerFailedProbeReopens(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var changes []string
+	b := newTestBreaker(clock, &changes)
+	for i := 0; i < 3; i++ {
+		b.Do(fail)
+	}
+	clock.advance(time.Minute)
+	b.Do(fail)
+	if b.State() != CircuitOpen {
+		t.Fatalf("state %v after a failed probe", b.State())
+	}
+	if err := b.Do(succeed); err != ErrCircuitOpen {
+		t.Fatalf("got %v during the new cool-down", err)
+	}
+}
+
+func TestCircuitBreakerConsecutive(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var changes []string
+	b := newTestBreaker(clock, &changes)
+	for i := 0; i < 5; i++ {
+		b.Do(fail)
+		b.Do(succeed)
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("state %v, successes in between must reset the count", b.State())
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var changes []string
+	b := newTestBreaker(clock, &changes)
+	b.Window = time.Minute
+
+	// failures spread wider than the window never add up
+	for i := 0; i < 6; i++ {
+		b.Do(fail)
+		b.Do(succeed)
+		clock.advance(40 * time.Second)
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("state %v with failures outside the window", b.State())
+	}
+	// interleaved successes don't reset the count inside the window
+	for i := 0; i < 3; i++ {
+		b.Do(fail)
+		b.Do(succeed)
+		clock.advance(10 * time.Second)
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("state %v after 3 failures within the window", b.State())
+	}
+}
+
+func TestCircuitBreakerAbandonedProbe(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var changes []string
+	b := newTestBreaker(clock, &changes)
+	b.ProbeTimeout = 10 * time.Second
+	client, server := pipeConns(t)
+	go receiveAll(server, false)
+	for i := 0; i < 3; i++ {
+		b.Do(fail)
+	}
+	clock.advance(time.Minute)
+
+	// the probe's writer is never closed in time
+	w, err := b.Send(client, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Do(succeed); err != ErrCircuitOpen {
+		t.Fatalf("got %v while the probe is in flight", err)
+	}
+	clock.advance(10 * time.Second)
+	if err = b.Do(fail); err != errDown {
+		t.Fatalf("got %v, the abandoned probe should have been replaced", err)
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("state %v after the replacement probe failed", b.State())
+	}
+	// the late result of the abandoned probe changes nothing
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != CircuitOpen {
+		t.Fatalf("state %v after the abandoned probe finished", b.State())
+	}
+}
+
+func TestPoolBreaker(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	var changes []string
+	dials := 0
+	p := &Pool{
+		Dial: func(ctx context.Context) (*Conn, error) {
+			dials++
+			return nil, errDown
+		},
+		Breaker: newTestBreaker(clock, &changes),
+	}
+	defer p.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get(context.Background()); err != errDown {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.Get(context.Background()); err != ErrCircuitOpen {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+	if dials != 3 {
+		t.Fatalf("dialed %d times", dials)
+	}
+}
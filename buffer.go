@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrBufferTooSmall 表示 ReceiveInto 的 buf 装不下该 key 的全部数据
+var ErrBufferTooSmall = errors.New("buffer too small for stream")
+
+// ReceiveInto 接收下一个 key，并将其数据直接读入 buf，返回 key 与读入的字节数，适合已知数据大小的调用者；
+// 数据超过 len(buf) 时 buf 中为前 len(buf) 字节，剩余的数据被丢弃，返回 ErrBufferTooSmall，连接仍可继续接收下一个 key；
+func (conn *Conn) ReceiveInto(buf []byte) (key string, n int, err error) {
+	key, reader, err := conn.Receive()
+	if err != nil {
+		return "", 0, err
+	}
+	n, err = io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the stream ended before filling buf
+		return key, n, nil
+	}
+	if err != nil {
+		return key, n, err
+	}
+	// buf is full, the stream must end right here
+	var probe [1]byte
+	switch _, err = io.ReadFull(reader, probe[:]); err {
+	case io.EOF:
+		return key, n, nil
+	case nil:
+		return key, n, discardRest(reader, ErrBufferTooSmall)
+	}
+	return key, n, err
+}
+
+// ReceiveTo 接收下一个 key，并将其完整的数据写入 w，返回 key 与写入的字节数；数据逐帧写入 w，
+// 不会在内存中积攒整个数据流，配置了 ReadChunkSize 时每次最多缓冲 ReadChunkSize 字节，适合写入 mmap 等区域；
+// 出错时该 key 剩余的数据会被丢弃，连接仍可继续接收下一个 key；
+func (conn *Conn) ReceiveTo(w io.Writer) (key string, n int64, err error) {
+	key, reader, err := conn.Receive()
+	if err != nil {
+		return "", 0, err
+	}
+	if n, err = reader.(*ConnReader).WriteTo(w); err != nil {
+		return key, n, discardRest(reader, err)
+	}
+	return key, n, nil
+}
+
+// WriteTo 将该 key 剩余的数据逐帧写入 w，直到数据结束，返回写入的字节数；数据正常结束时返回 nil，
+// 发送者以非 StatusOK 结束时返回对应的 *StreamError；实现了 io.WriterTo，io.Copy 会自动使用它
+func (c *ConnReader) WriteTo(w io.Writer) (n int64, err error) {
+	c.conn.rdmu.Lock()
+	defer c.conn.rdmu.Unlock()
+	if c.codec != CompressionNone {
+		// inflated bytes don't line up with frames, copy through the decompressor
+		return io.Copy(w, unlockedReader{c})
+	}
+	for {
+		switch {
+		case len(c.pending) > 0:
+			chunk := c.pending
+			m, err := w.Write(chunk)
+			c.pending = chunk[m:]
+			c.account(chunk[:m])
+			n += int64(m)
+			if err == nil && m < len(chunk) {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return n, err
+			}
+		case c.remaining > 0:
+			m, err := io.CopyN(w, remainingReader{c}, int64(c.remaining))
+			n += m
+			if err != nil {
+				return n, c.streamError(err)
+			}
+		case c.finished:
+			if err = c.streamError(c.finErr); err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		default:
+			if err = c.fill(); err == io.EOF {
+				// FIN, or the peer closed the connection between frames
+				c.streamError(err)
+				return n, nil
+			}
+			if err != nil {
+				return n, c.streamError(err)
+			}
+		}
+	}
+}
+
+// remainingReader 读取当前数据帧尚未读取的部分，调用者需持有 rdmu
+type remainingReader struct {
+	c *ConnReader
+}
+
+func (r remainingReader) Read(p []byte) (int, error) {
+	return r.c.readRemaining(p)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReceiveInto(t *testing.T) {
+	data := patterned(100000)
+	tests := []struct {
+		name    string
+		bufSize int
+		want    int
+		err     error
+	}{
+		{"exact", len(data), len(data), nil},
+		{"larger", len(data) + 10, len(data), nil},
+		{"too small", len(data) - 1, len(data) - 1, ErrBufferTooSmall},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pipeConns(t)
+			go func() {
+				sendAll(client, "k", data)
+				sendAll(client, "next", []byte("data"))
+			}()
+			buf := make([]byte, tt.bufSize)
+			key, n, err := server.ReceiveInto(buf)
+			if key != "k" || n != tt.want || !errors.Is(err, tt.err) {
+				t.Fatalf("got %q %d %v, want %d bytes and %v", key, n, err, tt.want, tt.err)
+			}
+			if !bytes.Equal(buf[:n], data[:n]) {
+				t.Fatal("buf doesn't hold the start of the data")
+			}
+			// the rest was drained, the next key is framed correctly
+			key, n, err = server.ReceiveInto(buf)
+			if err != nil || key != "next" || string(buf[:n]) != "data" {
+				t.Fatalf("next key: got %q %q %v", key, buf[:n], err)
+			}
+		})
+	}
+}
+
+func TestReceiveIntoEmpty(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		sendAll(client, "empty", nil)
+		sendAll(client, "one", []byte("x"))
+	}()
+	if key, n, err := server.ReceiveInto(nil); err != nil || key != "empty" || n != 0 {
+		t.Fatalf("got %q %d %v for an empty key", key, n, err)
+	}
+	if _, _, err := server.ReceiveInto(nil); !errors.Is(err, ErrBufferTooSmall) {
+		t.Fatalf("got %v, want ErrBufferTooSmall", err)
+	}
+}
+
+func TestReceiveIntoAborted(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		w, err := client.Send("k")
+		if err == nil {
+			w.Write([]byte("part"))
+			w.(*ConnWriter).Abort("gave up")
+		}
+	}()
+	buf := make([]byte, 100)
+	_, n, err := server.ReceiveInto(buf)
+	var se *StreamError
+	if !errors.As(err, &se) || se.Status != StatusAborted || string(buf[:n]) != "part" {
+		t.Fatalf("got %q %v, want the data so far and a StreamError", buf[:n], err)
+	}
+}
+
+// largestWriter 记录写入的数据与最大的一次写入
+type largestWriter struct {
+	bytes.Buffer
+	largest int
+}
+
+func (w *largestWriter) Write(p []byte) (int, error) {
+	w.largest = max(w.largest, len(p))
+	return w.Buffer.Write(p)
+}
+
+// failingWriter 在写入 limit 字节后失败
+type failingWriter struct {
+	limit int
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errDiskFull
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestReceiveTo(t *testing.T) {
+	data := patterned(1 << 20)
+	for _, tt := range []struct {
+		name    string
+		opts    []Option
+		largest int
+	}{
+		{"buffered", nil, priorityChunk},
+		// never more than a chunk in memory
+		{"chunked", []Option{WithReadChunkSize(4096)}, 4096},
+		{"compressed", []Option{WithCompression(CompressionGzip)}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pipeConns(t, tt.opts...)
+			go sendAll(client, "k", data)
+			var w largestWriter
+			key, n, err := server.ReceiveTo(&w)
+			if err != nil || key != "k" || n != int64(len(data)) {
+				t.Fatalf("got %q %d %v", key, n, err)
+			}
+			if !bytes.Equal(w.Bytes(), data) {
+				t.Fatal("the writer got different data")
+			}
+			if tt.largest > 0 && w.largest > tt.largest {
+				t.Fatalf("a single write of %d bytes, want at most %d", w.largest, tt.largest)
+			}
+		})
+	}
+}
+
+func TestReceiveToWriterFails(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		sendAll(client, "k", patterned(1<<20))
+		sendAll(client, "next", []byte("data"))
+	}()
+	key, n, err := server.ReceiveTo(&failingWriter{limit: 100000})
+	if key != "k" || n != 100000 || !errors.Is(err, errDiskFull) {
+		t.Fatalf("got %q %d %v, want 100000 bytes and errDiskFull", key, n, err)
+	}
+	// the rest of the key was dropped
+	var w largestWriter
+	if key, _, err = server.ReceiveTo(&w); err != nil || key != "next" || w.String() != "data" {
+		t.Fatalf("next key: got %q %q %v", key, w.String(), err)
+	}
+}
+
+func TestWriteToViaCopy(t *testing.T) {
+	client, server := pipeConns(t)
+	data := patterned(300000)
+	go sendAll(client, "k", data)
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// io.Copy picks up WriterTo
+	var w largestWriter
+	if n, err := io.Copy(&w, r); err != nil || n != int64(len(data)) || !bytes.Equal(w.Bytes(), data) {
+		t.Fatalf("copied %d bytes, %v", n, err)
+	}
+}
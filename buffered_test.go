@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// bufferedPair 返回以 writeSize 缓冲写出的客户端与读完每一个 key 的服务端，客户端的底层连接由 cc 统计
+func bufferedPair(tb testing.TB, writeSize int) (client *Conn, cc *countingConn, received chan []BatchItem) {
+	a, b := net.Pipe()
+	cc = &countingConn{Conn: a}
+	client, server := NewBufferedConn(cc, 0, writeSize), NewConn(b)
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	handshakeBoth(tb, client, server)
+	received = make(chan []BatchItem, 1)
+	go func() {
+		var got []BatchItem
+		defer func() { received <- got }()
+		for {
+			key, r, err := server.Receive()
+			if err != nil {
+				return
+			}
+			data := make([]byte, 64)
+			n, _ := r.Read(data)
+			r.(*ConnReader).Drain()
+			got = append(got, BatchItem{Key: key, Data: data[:n]})
+		}
+	}()
+	return client, cc, received
+}
+
+func TestBufferedConnHoldsUntilFlush(t *testing.T) {
+	client, cc, received := bufferedPair(t, 64<<10)
+	before := cc.writes.Load()
+	items := batchItems(10)
+	for _, item := range items {
+		if err := sendAll(client, item.Key, item.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := cc.writes.Load() - before; n != 0 {
+		t.Fatalf("%d writes before Flush, want the frames held in the buffer", n)
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := cc.writes.Load() - before; n != 1 {
+		t.Fatalf("Flush wrote %d times, want 1", n)
+	}
+	client.Close()
+	if got := <-received; fmt.Sprint(got) != fmt.Sprint(items) {
+		t.Fatalf("received %v", got)
+	}
+}
+
+func TestBufferedConnCloseFlushes(t *testing.T) {
+	client, _, received := bufferedPair(t, 64<<10)
+	items := batchItems(3)
+	for _, item := range items {
+		if err := sendAll(client, item.Key, item.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no Flush, Close writes what is still buffered
+	client.Close()
+	if got := <-received; fmt.Sprint(got) != fmt.Sprint(items) {
+		t.Fatalf("received %v", got)
+	}
+}
+
+func BenchmarkBufferedSmallMessages(b *testing.B) {
+	payload := patterned(32)
+	for _, size := range []int{0, 512, 4 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("write=%d", size), func(b *testing.B) {
+			client, cc, _ := bufferedPair(b, size)
+			before := cc.writes.Load()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := sendAll(client, "k", payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			client.Flush()
+			b.StopTimer()
+			b.ReportMetric(float64(cc.writes.Load()-before)/float64(b.N), "writes/msg")
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn 统计对底层连接的 Read、Write 调用次数与写出的字节数，每次调用对应一次系统调用
+type countingConn struct {
+	net.Conn
+	reads   atomic.Int64
+	writes  atomic.Int64
+	written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	c.reads.Add(1)
+	return c.Conn.Read(p)
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// readsForBatch 经由 TCP 发送 items，等全部到达接收方的内核缓冲后再以 readBuffer 大小的缓冲读完，返回 Read 的次数
+func readsForBatch(tb testing.TB, items []BatchItem, readBuffer int) int64 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	sent := make(chan error, 1)
+	go func() {
+		client := dial(ln.Addr().String())
+		defer client.Close()
+		sent <- client.SendBatch(items)
+		// hold the connection open until the server is done reading
+		client.Receive()
+	}()
+	raw, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cc := &countingConn{Conn: raw}
+	server := NewConn(cc, WithBufferSizes(readBuffer, 0))
+	defer server.Close()
+	if err = server.Handshake(); err != nil {
+		tb.Fatal(err)
+	}
+	if err = <-sent; err != nil {
+		tb.Fatal(err)
+	}
+	before := cc.reads.Load()
+	if err = checkBatch(server, items); err != nil {
+		tb.Fatal(err)
+	}
+	return cc.reads.Load() - before
+}
+
+func TestBufferedReadsCoalesceSmallFrames(t *testing.T) {
+	items := batchItems(100)
+	// a key, a data frame and a FIN per item, each read in two or three parts without the buffer
+	frames := int64(3 * len(items))
+	if reads := readsForBatch(t, items, 0); reads > frames/10 {
+		t.Fatalf("%d reads for %d frames", reads, frames)
+	}
+	if reads := readsForBatch(t, items, 16); reads < frames {
+		t.Fatalf("a 16 byte buffer still needed only %d reads for %d frames", reads, frames)
+	}
+}
+
+func benchmarkReads(b *testing.B, readBuffer int) {
+	items := batchItems(100)
+	var reads int64
+	for i := 0; i < b.N; i++ {
+		reads += readsForBatch(b, items, readBuffer)
+	}
+	b.ReportMetric(float64(reads)/float64(b.N*3*len(items)), "reads/frame")
+}
+
+// BenchmarkReadsUnbuffered 以 bufio 允许的最小缓冲读取小帧，相当于加上 bufio 之前逐个字段读取连接
+func BenchmarkReadsUnbuffered(b *testing.B) {
+	benchmarkReads(b, 16)
+}
+
+func BenchmarkReadsBuffered(b *testing.B) {
+	benchmarkReads(b, 0)
+}
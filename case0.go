@@ -1,156 +1,969 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Conn 是你需要实现的一种连接类型，它支持下面描述的若干接口；
 // 为了实现这些接口，你需要设计一个基于 TCP 的简单协议；
 type Conn struct {
-	n *net.TCPConn
+	n    net.Conn
+	r    *bufio.Reader // buffers n so frame headers don't cost a syscall each
+	cfg  Config
+	seen *LRUTransferStore // completed transfer ids when no TransferStore is configured
+
+	wmu    sync.Mutex // serializes frames written to n
+	umu    sync.Mutex
+	urgent [][]byte // urgent payloads waiting for the next frame boundary
+
+	mmu      sync.Mutex
+	manifest []Entry // most recently received manifest
+
+	rdmu   sync.Mutex  // serializes Receive, PeekKey and ConnReader reads
+	peeked *ConnReader // stream whose key was read by PeekKey but not yet by Receive
+	active *ConnReader // most recently received stream
+
+	qmu      sync.Mutex
+	messages []*ConnReader  // priority messages not yet taken by Receive or ReceiveMessage
+	wake     chan struct{}  // closed when a message arrives or the active stream finishes
+	sched    writeScheduler // orders the frames of the sending stream and priority messages
+	turns    writeScheduler // hands the connection to one stream at a time, by priority
+
+	smu         sync.Mutex
+	sendSession string       // session opened by BeginSession
+	recvSession *recvSession // session announced by the peer
+
+	hmu          sync.Mutex
+	handshaked   atomic.Bool
+	handshakeErr error
+	compact      bool                // negotiated compact frame headers, fixed once the handshake is done
+	negotiated   Negotiation         // outcome of the hello exchange, fixed once the handshake is done
+	peerLimits   Limits              // limits the peer advertised in its hello
+	stats        connStats           // counters behind Stats
+	streams      atomic.Int64        // writers handed out and not closed yet or waiting for their turn, bounded by the peer's MaxConcurrentStreams
+	closed       atomic.Bool         // Close was called, Send/Receive/Write fail with ErrConnClosed
+	upgrading    bool                // a tls upgrade was requested and isn't done yet, guarded by wmu
+	peerTokenID  string              // name of the credential the peer proved it holds
+	transcript   []byte              // key exchange transcript hash, binds authentication to this connection
+	sendKey      []byte              // base key for outgoing frame ciphers, nil when frames go out in the clear
+	recvKey      []byte              // base key for incoming frame ciphers
+	sealer       *frameCipher        // encrypts outgoing frames, guarded by wmu
+	opener       *frameCipher        // decrypts incoming frames
+	salts        map[string]struct{} // salts of the key frames received so far, never accepted twice
+	macOut       *frameMAC           // authenticates outgoing frames, guarded by wmu
+	macIn        *frameMAC           // verifies incoming frames
+	readErr      error               // fatal read error, the connection can't be read any more
+
+	pmu     sync.Mutex
+	pingSeq uint64
+	pings   map[uint64]chan struct{} // outstanding pings by sequence number
+
+	ymu     sync.Mutex
+	replies map[string][]chan []byte // callers waiting for a reply frame, per tag in the order they asked
+
+	rmu      sync.Mutex
+	rejected map[string]*RejectedError // keys the peer refused to receive
+
+	omu     sync.Mutex
+	writers []*ConnWriter // writers not closed yet, in the order they were handed out
+
+	emu   sync.Mutex
+	cause error // first error that broke the connection, reported by ConnectionClosed
+
+	amu      sync.Mutex
+	awaiting []*ConnWriter   // writers waiting for an ACK in the order they finished, at most maxAwaitingAcks
+	lost     chan struct{}   // closed once nothing more can arrive, created on first use
+	lostErr  error           // why lost was closed
+	life     context.Context // canceled together with lost, bounds SendLimiter waits
+	endLife  context.CancelFunc
+
+	wbuf       []byte      // frames held back by CoalesceDelay, guarded by wmu
+	flushTimer *time.Timer // writes wbuf out once CoalesceDelay has passed, guarded by wmu
+	flushErr   error       // error of a flush nobody was waiting for, returned by the next write, guarded by wmu
+
+	readEpoch atomic.Int64 // bumped for every frame read other than WAIT
+	stalledAt atomic.Int64 // readEpoch+1 of the read that announced a stall with WAIT, 0 when none
+
+	interrupted atomic.Bool  // Serve's ctx is done, reads must keep failing whatever deadline IdleTimeout sets
+	deadline    atomic.Int64 // UnixNano of the deadline set by SetDeadline, 0 when none
+
+	frameDeadline time.Time // when the payload of the frame being read must be complete, zero without FrameTimeout
 }
 
 type ConnWriter struct {
-	conn *Conn
+	conn    *Conn
+	key     string
+	digest  hash.Hash // running digest of the payload, nil unless Config.Digest is set
+	closed  bool      // FIN already sent, e.g. by Close or because the receiver holds everything on resume
+	discard bool      // the receiver already completed this transfer, drop the payload
+
+	prio    Priority      // decides when it gets the connection and when its frames go out against messages
+	turn    bool          // holds conn.turns until finish, false for messages
+	message *bytes.Buffer // payload of a PriorityHigh key sent as one PRI frame on Close, nil for a regular stream
+
+	compressor io.WriteCloser // compresses the payload into data frames, nil for uncompressed streams
+
+	adaptive *AdaptiveCompression // set until the writer decided whether to compress, the key frame waits for it
+	held     []byte               // payload buffered while the decision is pending
+
+	start   time.Time     // when the key frame went out
+	written atomic.Int64  // bytes the application wrote, read by Close for the audit event
+	audited atomic.Bool   // StreamSent was emitted
+	acked   chan struct{} // closed when the receiver acknowledges the stream, nil unless it finished with StatusOK
+	ackErr  error         // why acked was closed without an ACK, set before it is closed
 }
 
 const HED = "HEAD"
-const size = 12 // head is total 12 bytes, we use 8 bytes to mark size
+
+// every frame starts with a 4-byte tag followed by an 8-byte little-endian payload length
+const (
+	magicLen    = 4
+	lenFieldLen = 8
+	headerLen   = magicLen + lenFieldLen
+)
 
 const FIN = "END0"
 
+// ErrStreamTooLarge 表示一个 key 的数据超过了 MaxStreamSize
+var ErrStreamTooLarge = errors.New("stream exceeds max stream size")
+
+// ErrConcurrentReceive 表示上一次 Receive 得到的 key 的数据尚未读完，又调用了 Receive
+var ErrConcurrentReceive = errors.New("previous stream is still being received")
+
+// ErrCloseWriteUnsupported 表示底层连接不支持只关闭写方向，例如 net.Pipe
+var ErrCloseWriteUnsupported = errors.New("connection does not support CloseWrite")
+
+// ErrWriteAfterClose 表示在 ConnWriter 已经 Close 或 Abort 之后继续写入
+var ErrWriteAfterClose = errors.New("write after close")
+
 func (c *ConnWriter) Write(p []byte) (n int, err error) {
-	buf := bytes.Buffer{}
-	buf.Grow(12 + len(p))
-	buf.Write([]byte(HED))
-	buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(p))))
-	buf.Write(p)
-	if n, err = c.conn.n.Write(buf.Bytes()); err != nil {
-		log.Println("write data error:", err)
-		return
+	if l := c.conn.cfg.SendLimiter; l != nil && !c.closed && !c.discard {
+		return c.writeLimited(p, l)
+	}
+	return c.write(p)
+}
+
+// write 实现 Write，不经过 SendLimiter
+func (c *ConnWriter) write(p []byte) (n int, err error) {
+	if c.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if err = c.conn.rejection(c.key); err != nil {
+		return 0, err
+	}
+	if c.discard {
+		return len(p), nil
+	}
+	switch {
+	case c.message != nil:
+		n, err = c.buffer(p)
+	case c.adaptive != nil:
+		n, err = c.hold(p)
+	case c.compressor != nil:
+		n, err = c.compressor.Write(p)
+	default:
+		n, err = c.writeFrames(p)
+	}
+	if c.digest != nil {
+		c.digest.Write(p[:n])
 	}
-	n = len(p)
+	c.sent(int64(n), err)
 	return
 }
+
+// writeFrames 将 p 写成数据帧，超过对端 MaxFrameSize 的部分拆成多个帧，返回已经写出的字节数
+func (c *ConnWriter) writeFrames(p []byte) (n int, err error) {
+	// frames larger than the peer's limit would be refused, split them up front
+	for _, chunk := range c.conn.splitData(p) {
+		if err = c.writeFrame(c.conn.dataFrame(chunk)); err != nil {
+			err = fmt.Errorf("write key %q: %w", c.key, err)
+			log.Println(c.conn, "write data error:", err)
+			return
+		}
+		n += len(chunk)
+		c.conn.stats.wireBytesSent.Add(uint64(len(chunk)))
+	}
+	return
+}
+
+// WriteBuffers 将 bufs 的拼接作为一个数据帧写出，相当于先拼接再 Write，但不拷贝各个 buf；
+// 返回写入的总字节数；
+func (c *ConnWriter) WriteBuffers(bufs ...[]byte) (n int, err error) {
+	if c.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if err = c.conn.rejection(c.key); err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, b := range bufs {
+		total += len(b)
+	}
+	if c.discard {
+		return total, nil
+	}
+	if max := c.conn.maxDataLen(); c.compressor != nil || c.adaptive != nil || c.message != nil || c.conn.cfg.SendLimiter != nil || max > 0 && total > max {
+		return c.Write(bytes.Join(bufs, nil))
+	}
+	if c.conn.cfg.Padding != nil {
+		// padding rewrites the payload anyway
+		err = c.writeFrame(c.conn.dataFrame(bytes.Join(bufs, nil)))
+	} else {
+		err = c.conn.scheduled(c.prio, func() error {
+			return c.conn.writeFrameBuffers(HED, bufs)
+		})
+	}
+	if err != nil {
+		err = fmt.Errorf("write key %q: %w", c.key, err)
+		log.Println(c.conn, "write data error:", err)
+		c.sent(0, err)
+		return
+	}
+	if c.digest != nil {
+		for _, b := range bufs {
+			c.digest.Write(b)
+		}
+	}
+	c.conn.stats.wireBytesSent.Add(uint64(total))
+	c.sent(int64(total), nil)
+	return total, nil
+}
+
 func (c *ConnWriter) Close() error {
-	buf := bytes.Buffer{}
-	buf.Grow(4)
-	buf.Write([]byte(FIN))
-	if _, err := c.conn.n.Write(buf.Bytes()); err != nil {
+	return c.CloseWithError(StatusOK, "")
+}
+
+// CloseWithError 结束该 key 的数据传输，并通过 FIN 告知接收者结束的原因；
+// 接收者的 reader 在读到该 FIN 时会返回携带 status 和 msg 的 *StreamError；
+func (c *ConnWriter) CloseWithError(status FinStatus, msg string) error {
+	return c.finish(status, msg, nil)
+}
+
+// CloseWithTrailers 结束该 key 的数据传输，并在 FIN 中附带只有在写完数据后才知道的元数据，
+// 例如总长度或内容摘要；接收者在读到 io.EOF 后可通过 ConnReader.Trailers 获取；
+func (c *ConnWriter) CloseWithTrailers(trailers map[string]string) error {
+	return c.finish(StatusOK, "", trailers)
+}
+
+func (c *ConnWriter) finish(status FinStatus, msg string, trailers map[string]string) (err error) {
+	if c.closed {
+		return nil
+	}
+	// whatever happens to the FIN, the stream is over for this writer
+	c.closed = true
+	c.conn.releaseStream()
+	c.conn.trackWriter(c, false)
+	defer func() {
+		if c.turn {
+			c.conn.endStream()
+		}
+		switch {
+		case err != nil:
+			c.writeFailed(err)
+			// a rejected stream ends here as well
+			c.audit(err)
+		case status != StatusOK:
+			c.audit(&StreamError{Status: status, Message: msg})
+		default:
+			c.audit(nil)
+		}
+	}()
+	if c.message != nil {
+		if status != StatusOK {
+			// the receiver never saw the key, there is nothing to abort
+			return nil
+		}
+		c.expectAck()
+		if err := c.sendMessage(); err != nil {
+			return err
+		}
+		return c.conn.rejection(c.key)
+	}
+	if c.adaptive != nil {
+		// the key frame hasn't gone out yet
+		if err := c.decide(); err != nil {
+			return err
+		}
+	}
+	if c.compressor != nil && status == StatusOK {
+		// flush what the compressor still holds, an aborted stream doesn't need it
+		if err := c.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	fin := &finFrame{
+		status:   status,
+		msg:      msg,
+		trailers: trailers,
+	}
+	if c.digest != nil {
+		fin.digest = c.digest.Sum(nil)
+	}
+	if status == StatusOK {
+		// the ACK may come back before writeFrame returns
+		c.expectAck()
+	}
+	if err := c.writeFrame(FIN, fin.append(nil)); err != nil {
 		return err
 	}
-	return nil
+	// the receiver needs the FIN to skip a rejected stream, but the sender should still hear about it
+	return c.conn.rejection(c.key)
+}
+
+// Abort 以 StatusAborted 结束该 key 的数据传输
+func (c *ConnWriter) Abort(reason string) error {
+	return c.CloseWithError(StatusAborted, reason)
 }
 
 type ConnReader struct {
-	conn *Conn
+	conn   *Conn
+	key    string
+	id     string // transfer id, recorded as completed once FIN arrives
+	offset int64  // bytes the receiver already held before this stream started
+	read   int64  // bytes delivered to the application by this reader
+
+	session  *recvSession // session the stream belongs to, if any
+	finished bool         // FIN has been read
+	finErr   error        // what Read returns once finished
+	trailers map[string]string
+	pending  []byte    // rest of the current data frame not yet returned to the caller
+	digest   hash.Hash // digest of the bytes delivered so far, nil unless Config.Digest is set
+
+	remaining uint64 // bytes of the current data frame still on the wire when it is streamed instead of buffered
+	message   bool   // arrived whole in a PRI frame, outside the sequence of streams
+
+	codec   Compression // compression of the data frames, the caller sees the inflated bytes
+	inflate io.Reader   // decompressor fed by the data frames, created on first Read
+
+	params map[string]string // named parameters of the ServeMux pattern the key matched
+
+	start   time.Time // when the key frame arrived
+	audited bool      // StreamReceived was emitted
+	acked   bool      // Ack already sent
+}
+
+// Trailers 返回发送者通过 CloseWithTrailers 附带的元数据，只有在 reader 返回 io.EOF 之后才可用
+func (c *ConnReader) Trailers() map[string]string {
+	return c.trailers
+}
+
+// Param 返回 ServeMux 从匹配的模式中提取的命名参数 name，没有该参数时返回空字符串
+func (c *ConnReader) Param(name string) string {
+	return c.params[name]
+}
+
+// Params 返回 ServeMux 从匹配的模式中提取的全部命名参数，不经过 ServeMux 时为 nil
+func (c *ConnReader) Params() map[string]string {
+	return c.params
+}
+
+// Announced 报告该 key 是否出现在对端最近一次发送的清单中
+func (c *ConnReader) Announced() bool {
+	return c.conn.announced(c.key)
 }
 
+// Offset 返回该 key 的数据在断点续传时的起始偏移，接收者可据此 seek 自己的存储；
+// 普通传输时恒为 0；
+func (c *ConnReader) Offset() int64 {
+	return c.offset
+}
+
+// Read 读取该 key 的数据；同一个 Conn 上的 Read、Receive 与 PeekKey 由读锁串行化，可以在不同的 goroutine 中调用
 func (c *ConnReader) Read(p []byte) (n int, err error) {
-	r := io.LimitReader(c.conn.n, 4)
-	buf, err := io.ReadAll(r)
+	c.conn.rdmu.Lock()
+	defer c.conn.rdmu.Unlock()
+	return c.readLocked(p)
+}
+
+// unlockedReader 在已经持有读锁时读取 r
+type unlockedReader struct {
+	r *ConnReader
+}
+
+func (u unlockedReader) Read(p []byte) (int, error) {
+	return u.r.readLocked(p)
+}
+
+// readLocked 与 Read 相同，调用者需持有 rdmu
+func (c *ConnReader) readLocked(p []byte) (n int, err error) {
+	if c.codec != CompressionNone {
+		n, err = c.readInflated(p)
+	} else {
+		n, err = c.readData(p)
+	}
+	return n, c.streamError(err)
+}
+
+// streamError 处理读取该 key 时遇到的错误：数据尚未读完就出错时中止其所在的会话，并为错误附上 key；
+// 数据流至此结束，因此同时产生它的 StreamReceived
+func (c *ConnReader) streamError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if c.finished {
+		c.audit(err)
+		return err
+	}
+	c.conn.abortSession(err)
+	if err == io.EOF {
+		// keep io.EOF bare, callers compare it directly, but the stream was cut short
+		c.conn.fail(io.ErrUnexpectedEOF)
+		c.audit(io.ErrUnexpectedEOF)
+		return err
+	}
+	err = fmt.Errorf("read key %q: %w", c.key, err)
+	c.conn.fail(err)
+	c.audit(err)
+	return err
+}
+
+func (c *ConnReader) readData(p []byte) (n int, err error) {
+	// an empty data frame carries nothing, read on instead of returning 0, nil
+	for len(c.pending) == 0 && c.remaining == 0 {
+		if c.finished {
+			// FIN was already consumed, anything that follows belongs to the next key
+			return 0, c.finErr
+		}
+		if err = c.fill(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		return c.deliver(p), nil
+	}
+	return c.readRemaining(p)
+}
+
+// fill 读取下一个数据帧：整帧读入 pending，或者只读帧头、把 payload 的长度记在 remaining；
+// 读到 FIN 时返回该 key 结束的原因
+func (c *ConnReader) fill() (err error) {
+	var (
+		tag  string
+		size uint64
+	)
+	for {
+		if tag, size, err = c.conn.readHeader(); err != nil {
+			// a peer closing the connection between frames also ends the stream
+			if err != io.EOF {
+				log.Println(c.conn, "read data error:", err)
+			}
+			return err
+		}
+		if !isControl(tag) {
+			break
+		}
+		// control frames may sit between data frames, handle them and move on
+		payload, err := c.conn.readPayload(tag, size)
+		if err != nil {
+			return err
+		}
+		if err = c.conn.handleControl(tag, payload); err != nil {
+			return err
+		}
+	}
+	if tag == FIN {
+		body, err := c.conn.readPayload(FIN, size)
+		if err != nil {
+			return err
+		}
+		fin, err := parseFin(body)
+		if err != nil {
+			return err
+		}
+		c.finished = true
+		c.conn.wakeReceivers()
+		c.trailers = fin.trailers
+		if err = fin.err(); err == io.EOF && c.digest != nil {
+			if derr := checkDigest(c.digest, fin); derr != nil {
+				err = derr
+			}
+		}
+		c.finErr = err
+		if c.id != "" {
+			c.conn.transfers().Complete(c.id)
+		}
+		if c.session != nil {
+			if err == io.EOF {
+				c.conn.sessionStreamDone(c.session, nil)
+			} else {
+				c.conn.sessionStreamDone(c.session, err)
+			}
+		}
+		return err
+	}
+	if tag == PAD {
+		payload, err := c.conn.readPayload(PAD, size)
+		if err != nil {
+			log.Println(c.conn, "read data error:", err)
+			return err
+		}
+		if c.pending, err = c.conn.unpad(payload); err != nil {
+			return err
+		}
+		if err = c.checkSize(uint64(len(c.pending))); err != nil {
+			c.pending = nil
+			return err
+		}
+		return nil
+	}
+	if tag != HED {
+		return fmt.Errorf("unexpected frame %q in data stream", tag)
+	}
+	if err = c.checkSize(size); err != nil {
+		return err
+	}
+	if c.conn.streamable(size) {
+		c.remaining = size
+		return nil
+	}
+	data, err := c.conn.readPayload(HED, size)
 	if err != nil {
-		log.Println("read data error:", err)
-		return 0, err
+		log.Println(c.conn, "read data error:", err)
+		return err
 	}
-	if string(buf) == FIN {
-		return 0, io.EOF
+	c.pending = data
+	return nil
+}
+
+// checkSize 在配置了 MaxStreamSize 时检查再收到 n 字节后该 key 的数据是否超过上限；
+// 超过上限时剩余的数据仍在连接上，连接不再可用
+func (c *ConnReader) checkSize(n uint64) error {
+	max := c.conn.cfg.MaxStreamSize
+	if max <= 0 || uint64(c.read)+n <= uint64(max) {
+		return nil
+	}
+	c.conn.readErr = ErrStreamTooLarge
+	return ErrStreamTooLarge
+}
+
+// readRemaining 将当前数据帧尚未读取的部分直接读入 p，每次最多 ReadChunkSize 字节
+func (c *ConnReader) readRemaining(p []byte) (int, error) {
+	n := len(p)
+	if uint64(n) > c.remaining {
+		n = int(c.remaining)
+	}
+	if chunk := c.conn.cfg.ReadChunkSize; n > chunk {
+		n = chunk
 	}
-	// read 8 more
-	r2 := io.LimitReader(c.conn.n, 8)
-	b, err := io.ReadAll(r2)
+	n, err := c.conn.r.Read(p[:n])
+	c.remaining -= uint64(n)
+	c.account(p[:n])
 	if err != nil {
-		log.Println("read data error:", err)
-		return 0, err
+		log.Println(c.conn, "read data error:", err)
+		return n, c.conn.payloadError(err)
 	}
-	num := checkHeader(append(buf, b...))
-	io.LimitReader(c.conn.n, int64(num))
-	w := &bytes.Buffer{}
-	w.Grow(int(num))
-	_, err = io.CopyN(w, c.conn.n, int64(num))
-	n = int(num)
-	copy(p, w.Bytes())
 	return n, nil
 }
 
+// Drain 读取并丢弃该 key 剩余的数据直到 FIN，使连接停在下一个 key 的开头；
+// 发送者以非 StatusOK 结束传输时同样视为成功，其余错误原样返回；
+func (c *ConnReader) Drain() error {
+	c.conn.rdmu.Lock()
+	defer c.conn.rdmu.Unlock()
+	return c.drainLocked()
+}
+
+// drainLocked 与 Drain 相同，调用者需持有 rdmu
+func (c *ConnReader) drainLocked() error {
+	_, err := io.Copy(io.Discard, unlockedReader{c})
+	var se *StreamError
+	if errors.As(err, &se) {
+		return nil
+	}
+	return err
+}
+
+// deliver 将当前帧中尚未交付的数据复制到 p
+func (c *ConnReader) deliver(p []byte) int {
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	c.account(p[:n])
+	return n
+}
+
+// account 记录从数据帧中读出了 b，未压缩时 b 即交付给应用的数据
+func (c *ConnReader) account(b []byte) {
+	c.conn.stats.wireBytesReceived.Add(uint64(len(b)))
+	if c.codec == CompressionNone {
+		c.consume(b)
+	}
+}
+
+// consume 记录 b 已经交付给应用
+func (c *ConnReader) consume(b []byte) {
+	c.conn.stats.bytesReceived.Add(uint64(len(b)))
+	if c.digest != nil {
+		c.digest.Write(b)
+	}
+	c.read += int64(len(b))
+	if store := c.conn.cfg.ResumeStore; store != nil {
+		store.Store(c.key, c.offset+c.read)
+	}
+}
+
+// newWriter 创建一个以 prio 写出的 ConnWriter，启用摘要时为其准备好 hash
+func (conn *Conn) newWriter(key string, prio Priority) *ConnWriter {
+	w := &ConnWriter{
+		conn:  conn,
+		key:   key,
+		prio:  prio,
+		start: time.Now(),
+	}
+	if conn.cfg.Digest != nil {
+		w.digest = conn.cfg.Digest()
+	}
+	conn.trackWriter(w, true)
+	return w
+}
+
 // Send 传入一个 key 表示发送者将要传输的数据对应的标识；
 // 返回 writer 可供发送者分多次写入大量该 key 对应的数据；
 // 当发送者已将该 key 对应的所有数据写入后，调用 writer.Close 告知接收者：该 key 的数据已经完全写入；
+// 同一时刻只能有一个 key 在发送，另一个 writer 尚未 Close 时 Send 等待它 Close，连接关闭时返回 ErrConnClosed；
+// 尚未 Close 与等待中的 writer 已经达到对端的 MaxConcurrentStreams 时返回 ErrTooManyStreams，Close 其中之一后可重试；
 func (conn *Conn) Send(key string) (writer io.WriteCloser, err error) {
+	return conn.send(key, conn.cfg.Compression, conn.cfg.Adaptive, conn.cfg.Priority)
+}
+
+// send 发送 key 帧并创建以 prio 写出的 writer，对端支持时该 key 的数据以 codec 压缩；
+// adaptive 不为 nil 时改由 writer 根据数据决定是否压缩，codec 被忽略；对端支持时 PriorityHigh 的 key 作为消息发送，不压缩
+func (conn *Conn) send(key string, codec Compression, adaptive *AdaptiveCompression, prio Priority) (writer io.WriteCloser, err error) {
+	if err = conn.authorize(key, DirectionOut); err != nil {
+		return nil, err
+	}
+	// the peer's limits are only known once the handshake is done
+	if err = conn.Handshake(); err != nil {
+		return nil, err
+	}
+	if err = conn.checkKey(key); err != nil {
+		return nil, err
+	}
+	if err = conn.reserveStream(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.releaseStream()
+		}
+	}()
+	conn.clearRejection(key)
+	if prio > PriorityNormal && conn.prioritized() {
+		// nothing goes out before Close, the whole message is one frame
+		w := conn.newWriter(key, prio)
+		w.message = &bytes.Buffer{}
+		return w, nil
+	}
+	if err = conn.beginStream(prio); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.endStream()
+		}
+	}()
+	if adaptive != nil && conn.streamCodec(adaptive.Codec) != CompressionNone {
+		// the key frame goes out once the writer has seen enough data to decide
+		w := conn.newWriter(key, prio)
+		w.turn = true
+		w.adaptive = adaptive
+		return w, nil
+	}
 	// send key to receiver
-	buf := bytes.Buffer{}
-	buf.Grow(12 + len(key))
-	buf.Write([]byte(HED))
-	buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(key))))
-	buf.Write([]byte(key))
-
-	if _, err = conn.n.Write(buf.Bytes()); err != nil {
-		log.Println("send key to receiver error:", err)
+	codec = conn.streamCodec(codec)
+	if codec != CompressionNone {
+		conn.stats.compressedStreams.Add(1)
+	}
+	err = conn.scheduled(prio, func() error {
+		return conn.writeFrame(keyFrame(key, codec))
+	})
+	if err != nil {
+		err = fmt.Errorf("send key %q: %w", key, err)
+		log.Println(conn, "send key to receiver error:", err)
 		return
 	}
 	log.Println("send key success key:", key)
 	// make writer
-	w := &ConnWriter{
-		conn: conn,
+	w := conn.newWriter(key, prio)
+	w.turn = true
+	if codec != CompressionNone {
+		w.compressor = conn.newCompressor(codec, frameSink{w})
 	}
-
 	return w, nil
 }
 
 // Receive 返回一个 key 表示接收者将要接收到的数据对应的标识；
 // 返回的 reader 可供接收者多次读取该 key 对应的数据；
 // 当 reader 返回 io.EOF 错误时，表示接收者已经完整接收该 key 对应的数据；
+// 同一时刻只能有一个 key 在接收：上一个 key 的数据尚未读到结尾时返回 ErrConcurrentReceive，
+// 需要跳过其剩余数据时先调用其 Drain；对端以 PriorityHigh 发送、已经读到的消息不受此限制，会先于下一个 key 返回；
+// 返回值只有两种状态：收到 key 时为 (key, reader, nil)，即使该 key 没有数据，reader 也不为 nil，只是第一次读取就返回 io.EOF；
+// 出错时为 ("", nil, err)，其中 err 为 io.EOF 当且仅当对端在两个 key 之间正常关闭了连接，帧读到一半时为 io.ErrUnexpectedEOF；
 func (conn *Conn) Receive() (key string, reader io.Reader, err error) {
-	// read key
-	r := io.LimitReader(conn.n, 12)
-	bufs, err := io.ReadAll(r)
-	if err != nil {
-		return "", nil, err
+	conn.rdmu.Lock()
+	defer conn.rdmu.Unlock()
+	if cr := conn.peeked; cr != nil {
+		conn.peeked = nil
+		return cr.key, cr, nil
+	}
+	// messages don't wait for the current key to be read up
+	if cr := conn.popMessage(); cr != nil {
+		return cr.key, cr, nil
 	}
-	// no more data, all is done
-	if len(bufs) < 12 {
-		return "", nil, io.EOF
+	if err = conn.checkActive(); err != nil {
+		return "", nil, err
 	}
-	keySize := checkHeader(bufs)
-	keyReader := io.LimitReader(conn.n, int64(keySize))
-	data, err := io.ReadAll(keyReader)
+	cr, err := conn.nextStream()
 	if err != nil {
 		return "", nil, err
 	}
-	key = string(data)
-	log.Println("read key success key:", string(data))
+	return cr.key, cr, nil
+}
+
+// PeekKey 返回下一个将要接收的 key 但不消费它，随后的 Receive 会返回相同的 key 及其 reader；
+// 多次调用 PeekKey 返回同一个 key；
+func (conn *Conn) PeekKey() (string, error) {
+	conn.rdmu.Lock()
+	defer conn.rdmu.Unlock()
+	if conn.peeked == nil {
+		if err := conn.checkActive(); err != nil {
+			return "", err
+		}
+		cr, err := conn.nextStream()
+		if err != nil {
+			return "", err
+		}
+		conn.peeked = cr
+	}
+	return conn.peeked.key, nil
+}
+
+// checkActive 确认上一个 key 的数据已经读完，否则下一个帧仍属于它，不能当作新的 key 读取；调用者需持有 rdmu
+func (conn *Conn) checkActive() error {
+	if cr := conn.active; cr != nil && !cr.finished && conn.readErr == nil {
+		return ErrConcurrentReceive
+	}
+	return nil
+}
 
-	return key, &ConnReader{
-		conn: conn,
-	}, nil
+// nextStream 读取下一个需要交给应用的 key 帧，重复的传输会被跳过
+func (conn *Conn) nextStream() (*ConnReader, error) {
+	for {
+		if cr := conn.popMessage(); cr != nil {
+			return cr, nil
+		}
+		_, cr, err := conn.receive()
+		if err != nil {
+			conn.abortSession(err)
+			return nil, err
+		}
+		if cr != nil {
+			return cr, nil
+		}
+	}
 }
 
-func checkHeader(buf []byte) uint64 {
-	if len(buf) != 12 {
-		panic("invalid header length")
+// receive 读取一个 key 帧；若该传输是已完成传输的重复，则跳过其数据并返回 nil reader
+func (conn *Conn) receive() (key string, cr *ConnReader, err error) {
+	var (
+		tag      string
+		data     []byte
+		codecErr error // the peer compressed the stream with something we can't inflate
+	)
+	if err = conn.Handshake(); err != nil {
+		return "", nil, err
+	}
+	for {
+		// read key
+		var keySize uint64
+		if tag, keySize, err = conn.readHeader(); err != nil {
+			return "", nil, err
+		}
+		data, err = conn.readPayload(tag, keySize)
+		if err != nil {
+			return "", nil, err
+		}
+		if !isControl(tag) {
+			break
+		}
+		if err = conn.handleControl(tag, data); err != nil {
+			return "", nil, err
+		}
+		if tag == PRI {
+			// the message is queued, let the caller hand it out
+			return "", nil, nil
+		}
+	}
+	cr = &ConnReader{
+		conn:  conn,
+		start: time.Now(),
 	}
-	if string(buf[:4]) != "HEAD" {
-		panic("invalid header content")
+	if conn.cfg.Digest != nil {
+		cr.digest = conn.cfg.Digest()
 	}
-	return binary.LittleEndian.Uint64(buf[4:])
+	switch tag {
+	case HED:
+		key = string(data)
+	case CMP:
+		key, cr.codec, codecErr = conn.parseCompressedKey(data)
+	case RSM:
+		if key, cr.offset, err = conn.acceptResume(data); err != nil {
+			return "", nil, err
+		}
+	case TID:
+		var duplicate bool
+		if key, cr.id, duplicate, err = conn.acceptTransfer(data); err != nil {
+			return "", nil, err
+		}
+		if duplicate {
+			log.Println("skip duplicate transfer key:", key)
+			cr.id = ""
+			if _, err = io.Copy(io.Discard, unlockedReader{cr}); err != nil {
+				return "", nil, err
+			}
+			return key, nil, nil
+		}
+	default:
+		return "", nil, fmt.Errorf("unexpected frame %q while waiting for key", tag)
+	}
+	if err = codecErr; err == nil {
+		err = conn.acceptKeyLength(key)
+	}
+	if err == nil {
+		err = conn.authorize(key, DirectionIn)
+	}
+	if err == nil {
+		err = conn.streamOpen(key, cr)
+	}
+	if err != nil {
+		log.Println("reject key:", key, err)
+		if err = conn.reject(key, err); err != nil {
+			return "", nil, err
+		}
+		// the sender still finishes the stream, skip it up to its FIN
+		cr.id = ""
+		cr.codec = CompressionNone
+		if err = cr.drainLocked(); err != nil {
+			return "", nil, err
+		}
+		return key, nil, nil
+	}
+	cr.key = key
+	cr.session = conn.sessionStreamOpened(key)
+	conn.active = cr
+	log.Println("read key success key:", key)
+
+	return key, cr, nil
+}
+
+// String 返回连接两端的地址，便于在日志中区分不同的连接
+func (conn *Conn) String() string {
+	return fmt.Sprintf("conn %v->%v", conn.n.LocalAddr(), conn.n.RemoteAddr())
+}
+
+// RemoteAddr 返回对端的地址；Server 启用 ProxyProtocol 时为 PROXY 头中记录的原始客户端地址
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.n.RemoteAddr()
 }
 
-// Close 关闭你实现的连接对象及其底层的 TCP 连接
+// LocalAddr 返回本端的地址
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.n.LocalAddr()
+}
+
+// ErrConnClosed 表示连接已经被本端 Close，之后的 Send、Receive 与写入都返回该错误
+var ErrConnClosed = errors.New("connection closed")
+
+// Close 关闭你实现的连接对象及其底层的 TCP 连接；启用 CoalesceDelay 或 WriteBufferSize 时若没有写入正在进行，先写出缓冲中的帧
 func (conn *Conn) Close() {
+	first := !conn.closed.Swap(true)
+	// a writer stuck on a peer that stopped reading must not keep Close from returning
+	if conn.coalescing() && conn.wmu.TryLock() {
+		conn.flushLocked()
+		conn.wmu.Unlock()
+	}
 	conn.n.Close()
+	conn.lose(ErrConnClosed)
+	// Sends waiting for the open writer would wait forever
+	conn.turns.close()
+	if first {
+		conn.auditClose()
+	}
+}
+
+// CloseWrite 关闭底层连接的写方向，对端读完已发送的数据后会读到 io.EOF，本端仍可继续读取；
+// 底层连接不支持半关闭时返回 ErrCloseWriteUnsupported；
+func (conn *Conn) CloseWrite() error {
+	cw, ok := conn.n.(interface{ CloseWrite() error })
+	if !ok {
+		return ErrCloseWriteUnsupported
+	}
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	if err := conn.flushLocked(); err != nil {
+		return err
+	}
+	return cw.CloseWrite()
+}
+
+// Unwrap 返回底层连接，可用于设置 socket 选项等高级用途；UpgradeTLS 之后返回的是 *tls.Conn；
+// 在 Send/Receive 等读写进行的同时直接读写该连接会破坏帧的边界，是不安全的；
+func (conn *Conn) Unwrap() net.Conn {
+	return conn.n
+}
+
+// DrainAndClose 丢弃最近一次 Receive 得到的 key 尚未读取的数据，然后关闭连接
+func (conn *Conn) DrainAndClose() error {
+	var err error
+	if cr := conn.active; cr != nil {
+		err = cr.Drain()
+	}
+	conn.Close()
+	return err
+}
+
+// Reset 将 Conn 绑定到一个新的底层连接并重置其内部状态，已有的配置保持不变；
+// 便于借助 sync.Pool 复用 Conn 对象，原先的底层连接需由调用者自行关闭；
+func (conn *Conn) Reset(raw net.Conn) {
+	r := conn.r
+	if r == nil {
+		r = conn.newReader(raw)
+	} else {
+		r.Reset(conn.readSource(raw))
+	}
+	*conn = Conn{
+		n:   raw,
+		r:   r,
+		cfg: conn.cfg,
+	}
 }
 
-// NewConn 从一个 TCP 连接得到一个你实现的连接对象
-func NewConn(conn net.Conn) *Conn {
-	tcpConn := conn.(*net.TCPConn)
+// NewConn 从一个 TCP 连接得到一个你实现的连接对象，其 Config 为 DefaultConfig 的副本再依次应用 opts
+func NewConn(conn net.Conn, opts ...Option) *Conn {
+	cfg := DefaultConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return NewConnWithConfig(conn, cfg)
+}
+
+// NewConnWithConfig 与 NewConn 相同，但直接使用 cfg，不经过 DefaultConfig
+func NewConnWithConfig(conn net.Conn, cfg Config) *Conn {
 	newConn := &Conn{
-		n: tcpConn,
+		n:   conn,
+		cfg: cfg,
 	}
+	newConn.r = newConn.newReader(conn)
 	return newConn
 }
 
@@ -171,20 +984,13 @@ func dial(serverAddr string) *Conn {
 
 // 启动测试服务器
 func startServer(handle func(*Conn)) net.Listener {
-	ln, err := net.Listen("tcp", ":5566")
+	// port 0 lets the os pick a free port, callers dial ln.Addr()
+	ln, err := net.Listen("tcp", ":0")
 	if err != nil {
 		panic(err)
 	}
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				fmt.Println("[WARNING] ln.Accept", err)
-				return
-			}
-			go handle(NewConn(conn))
-		}
-	}()
+	srv := &Server{Handler: handle}
+	go srv.Serve(ln)
 	return ln
 }
 
@@ -198,13 +1004,22 @@ func assertEqual(actual string, expected string) {
 
 // 简单 case：单连接，双向传输少量数据
 func testCase0() {
+	runCase0(false)
+}
+
+// 与 testCase0 相同，但通过 Pipe 在内存中进行，不占用端口
+func testCase0Pipe() {
+	runCase0(true)
+}
+
+func runCase0(pipe bool) {
 	const (
 		key  = "Bible"
 		data = `Then I heard the voice of the Lord saying, “Whom shall I send? And who will go for us?”
 And I said, “Here am I. Send me!”
 Isaiah 6:8`
 	)
-	ln := startServer(func(conn *Conn) {
+	serve := func(conn *Conn) {
 		// 服务端等待客户端进行传输
 		_key, reader, err := conn.Receive()
 		if err != nil {
@@ -229,11 +1044,18 @@ Isaiah 6:8`
 			panic(n)
 		}
 		conn.Close()
-	})
-	//goland:noinspection GoUnhandledErrorResult
-	defer ln.Close()
-
-	conn := dial(ln.Addr().String())
+	}
+	var conn *Conn
+	if pipe {
+		var server *Conn
+		conn, server = Pipe()
+		go serve(server)
+	} else {
+		ln := startServer(serve)
+		//goland:noinspection GoUnhandledErrorResult
+		defer ln.Close()
+		conn = dial(ln.Addr().String())
+	}
 	// 客户端向服务端传输
 	writer, err := conn.Send(key)
 	if err != nil {
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// ErrChecksum 表示帧的 CRC32C 校验和与其 payload 不符
+var ErrChecksum = errors.New("frame checksum mismatch")
+
+// castagnoli 在支持的平台上由 hash/crc32 使用硬件指令加速
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumLen 是启用校验和时紧跟在帧头之后的 CRC32C 的长度
+const checksumLen = 4
+
+// appendChecksum 在启用校验和时将 payload 的 CRC32C 追加到 dst
+func (conn *Conn) appendChecksum(dst []byte, payload []byte) []byte {
+	if !conn.cfg.Checksum {
+		return dst
+	}
+	return binary.LittleEndian.AppendUint32(dst, crc32.Checksum(payload, castagnoli))
+}
+
+// verifyChecksum 校验 payload 是否与帧头之后读到的 CRC32C 一致
+func verifyChecksum(sum []byte, payload []byte) error {
+	if binary.LittleEndian.Uint32(sum) != crc32.Checksum(payload, castagnoli) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// appendChecksumBuffers 与 appendChecksum 相同，但 payload 为 bufs 的拼接
+func (conn *Conn) appendChecksumBuffers(dst []byte, bufs [][]byte) []byte {
+	if !conn.cfg.Checksum {
+		return dst
+	}
+	var sum uint32
+	for _, b := range bufs {
+		sum = crc32.Update(sum, castagnoli, b)
+	}
+	return binary.LittleEndian.AppendUint32(dst, sum)
+}
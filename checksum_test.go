@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestChecksumOnWire(t *testing.T) {
+	a, b := net.Pipe()
+	rc := &recordingConn{Conn: a}
+	client, server := NewConn(rc, WithChecksum()), NewConn(b, WithChecksum())
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "k", []byte("checked payload"))
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "checked payload" {
+		t.Fatalf("got %q %v", data, err)
+	}
+	if !server.Features().Checksum {
+		t.Fatal("Features().Checksum = false")
+	}
+	// header, then the CRC32C of the payload, then the payload
+	sum := binary.LittleEndian.AppendUint32(nil, crc32.Checksum([]byte("checked payload"), castagnoli))
+	if !bytes.Contains(rc.bytes(), append(sum, "checked payload"...)) {
+		t.Fatal("no CRC32C in front of the payload")
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	a, b := net.Pipe()
+	tc := &tamperConn{Conn: a}
+	client, server := NewConn(tc, WithChecksum()), NewConn(b, WithChecksum())
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	tc.armed.Store(true)
+	go sendAll(client, "k", []byte("payload"))
+	if _, _, err := server.Receive(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("got %v, want ErrChecksum", err)
+	}
+}
+
+func benchmarkChecksum(b *testing.B, opts ...Option) {
+	client, server := pipeConns(b, opts...)
+	go receiveAll(server, false)
+	block := patterned(1 << 20)
+	w, err := client.Send("bulk")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(block)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = w.Write(block); err != nil {
+			b.Fatal(err)
+		}
+	}
+	w.Close()
+}
+
+func BenchmarkWithoutChecksum(b *testing.B) {
+	benchmarkChecksum(b)
+}
+
+func BenchmarkWithChecksum(b *testing.B) {
+	benchmarkChecksum(b, WithChecksum())
+}
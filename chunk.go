@@ -0,0 +1,41 @@
+package main
+
+import "errors"
+
+// ErrNoChunkBoundaries 表示压缩的数据流没有保留发送者的写入边界，不能按块读取
+var ErrNoChunkBoundaries = errors.New("compressed stream has no chunk boundaries")
+
+// ReceiveChunk 以消息模式读取该 key 的数据：每次返回一个数据帧的 payload，即发送者一次 Write 写出的数据，
+// 数据读完时返回 io.EOF；一次 Write 超过对端 MaxFrameSize 时会被拆成多个帧，此时也分多次返回；
+// 已经被 Read 读走一部分的帧只返回其剩余部分；压缩的数据流返回 ErrNoChunkBoundaries；
+func (c *ConnReader) ReceiveChunk() ([]byte, error) {
+	c.conn.rdmu.Lock()
+	defer c.conn.rdmu.Unlock()
+	if c.codec != CompressionNone {
+		return nil, ErrNoChunkBoundaries
+	}
+	if len(c.pending) == 0 && c.remaining == 0 {
+		if c.finished {
+			return nil, c.streamError(c.finErr)
+		}
+		if err := c.fill(); err != nil {
+			return nil, c.streamError(err)
+		}
+	}
+	if c.remaining > 0 {
+		// a streamed frame, collect the rest of it
+		chunk := make([]byte, c.remaining)
+		for n := 0; n < len(chunk); {
+			m, err := c.readRemaining(chunk[n:])
+			n += m
+			if err != nil {
+				return nil, c.streamError(err)
+			}
+		}
+		return chunk, nil
+	}
+	chunk := c.pending
+	c.pending = nil
+	c.account(chunk)
+	return chunk, nil
+}
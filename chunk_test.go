@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeOneFrame 以经典格式把 key 与 data 写入 w，data 只占一个数据帧，不论它有多大
+func writeOneFrame(w io.Writer, key string, data []byte) error {
+	header := classicFrame(HED, nil)
+	binary.LittleEndian.PutUint64(header[magicLen:], uint64(len(data)))
+	fin := &finFrame{status: StatusOK}
+	bufs := net.Buffers{classicFrame(HED, []byte(key)), header, data, classicFrame(FIN, fin.append(nil))}
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// readOneFrame 接收 writeOneFrame 写出的 data 并逐块核对，返回接收期间分配的字节数
+func readOneFrame(tb testing.TB, data []byte, opts ...Option) uint64 {
+	a, b := net.Pipe()
+	conn := NewConn(b, append([]Option{WithLegacyMode(), WithMaxFrameSize(0)}, opts...)...)
+	defer conn.Close()
+	defer a.Close()
+	go writeOneFrame(a, "big", data)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, r, err := conn.Receive()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	buf := make([]byte, 32<<10)
+	off := 0
+	for {
+		n, err := r.Read(buf)
+		if !bytes.Equal(buf[:n], data[off:off+n]) {
+			tb.Fatalf("data differs at offset %d", off)
+		}
+		off += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if off != len(data) {
+		tb.Fatalf("read %d of %d bytes", off, len(data))
+	}
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestReadChunkSizeBoundsMemory(t *testing.T) {
+	data := patterned(64 << 20)
+	if whole := readOneFrame(t, data); whole < uint64(len(data)) {
+		t.Fatalf("reading the whole frame allocated only %d bytes", whole)
+	}
+	if chunked := readOneFrame(t, data, WithReadChunkSize(64<<10)); chunked > 8<<20 {
+		t.Fatalf("reading in chunks still allocated %d bytes for a %d byte frame", chunked, len(data))
+	}
+}
+
+func BenchmarkReadFrame64MB(b *testing.B) {
+	data := patterned(64 << 20)
+	for _, chunk := range []int{0, 64 << 10} {
+		b.Run(fmt.Sprintf("chunk=%d", chunk), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			var allocated uint64
+			for i := 0; i < b.N; i++ {
+				allocated += readOneFrame(b, data, WithReadChunkSize(chunk))
+			}
+			b.ReportMetric(float64(allocated)/float64(b.N), "alloc-bytes/op")
+		})
+	}
+}
+
+// receiveChunks 接收下一个 key 并用 ReceiveChunk 读出所有块
+func receiveChunks(t *testing.T, conn *Conn) ([]string, error) {
+	t.Helper()
+	_, r, err := conn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []string
+	for {
+		chunk, err := r.(*ConnReader).ReceiveChunk()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, string(chunk))
+	}
+}
+
+func TestReceiveChunk(t *testing.T) {
+	sent := []string{"first", "the second one", strings.Repeat("3", 1000)}
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"buffered", nil},
+		// frames larger than the chunk size are streamed, ReceiveChunk still returns them whole
+		{"streamed", []Option{WithReadChunkSize(16)}},
+		{"checksum", []Option{WithChecksum()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pipeConns(t, tt.opts...)
+			go func() {
+				w, err := client.Send("k")
+				if err != nil {
+					return
+				}
+				for _, s := range sent {
+					w.Write([]byte(s))
+				}
+				w.Close()
+			}()
+			got, err := receiveChunks(t, server)
+			if err != nil || !slices.Equal(got, sent) {
+				t.Fatalf("got %q %v, want %q", got, err, sent)
+			}
+		})
+	}
+}
+
+func TestReceiveChunkAfterRead(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		w, err := client.Send("k")
+		if err != nil {
+			return
+		}
+		w.Write([]byte("hello"))
+		w.Write([]byte("world"))
+		w.Close()
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	io.ReadFull(r, buf)
+	// only what Read left of the frame
+	for _, want := range []string{"llo", "world"} {
+		if chunk, err := r.(*ConnReader).ReceiveChunk(); err != nil || string(chunk) != want {
+			t.Fatalf("got %q %v, want %q", chunk, err, want)
+		}
+	}
+}
+
+func TestReceiveChunkCompressed(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		w, err := client.SendCompressed("k", CompressionGzip)
+		if err == nil {
+			w.Write([]byte("data"))
+			w.Close()
+		}
+	}()
+	if _, err := receiveChunks(t, server); !errors.Is(err, ErrNoChunkBoundaries) {
+		t.Fatalf("got %v, want ErrNoChunkBoundaries", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSendAfterClose(t *testing.T) {
+	client, _ := pipeConns(t)
+	client.Close()
+	if _, err := client.Send("k"); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Send: got %v, want ErrConnClosed", err)
+	}
+	if _, _, err := client.Receive(); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Receive: got %v, want ErrConnClosed", err)
+	}
+	if err := client.SendBatch(batchItems(1)); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("SendBatch: got %v, want ErrConnClosed", err)
+	}
+	if _, err := client.Ping(context.Background()); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Ping: got %v, want ErrConnClosed", err)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	client, server := pipeConns(t)
+	go receiveAll(server, false)
+	w, err := client.Send("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if _, err = w.Write([]byte("after")); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Write: got %v, want ErrConnClosed", err)
+	}
+	if err = w.Close(); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("writer Close: got %v, want ErrConnClosed", err)
+	}
+}
+
+func TestReceiveAfterPeerClose(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		sendAll(client, "k", []byte("data"))
+		client.Close()
+	}()
+	if _, r, err := server.Receive(); err == nil {
+		r.(*ConnReader).Drain()
+	}
+	// only a Close on our own end is ErrConnClosed, the peer hanging up is a plain EOF
+	if _, _, err := server.Receive(); err != io.EOF {
+		t.Fatalf("got %v after the peer closed, want io.EOF", err)
+	}
+}
+
+func TestWriterWriteAfterClose(t *testing.T) {
+	client, server := pipeConns(t)
+	got := make(chan map[string]string, 1)
+	go func() {
+		streams := map[string]string{}
+		for {
+			key, r, err := server.Receive()
+			if err != nil {
+				got <- streams
+				return
+			}
+			data, _ := io.ReadAll(r)
+			streams[key] = string(data)
+		}
+	}()
+	for _, end := range []func(*ConnWriter) error{(*ConnWriter).Close, func(w *ConnWriter) error { return w.Abort("stop") }} {
+		w, err := client.Send("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cw := w.(*ConnWriter)
+		cw.Write([]byte("data"))
+		end(cw)
+		if _, err = cw.Write([]byte("late")); !errors.Is(err, ErrWriteAfterClose) {
+			t.Fatalf("Write: got %v, want ErrWriteAfterClose", err)
+		}
+		if _, err = cw.WriteBuffers([]byte("late")); !errors.Is(err, ErrWriteAfterClose) {
+			t.Fatalf("WriteBuffers: got %v, want ErrWriteAfterClose", err)
+		}
+	}
+	// the late writes didn't turn into a stream of their own
+	sendAll(client, "next", []byte("data of next"))
+	client.Close()
+	streams := <-got
+	if len(streams) != 2 || streams["next"] != "data of next" {
+		t.Fatalf("the receiver saw %q", streams)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// coalesceBufferSize 是启用 CoalesceDelay 时缓冲的上限，达到后不再等待，立即写出
+const coalesceBufferSize = 64 << 10
+
+// coalescing 报告写出的帧是否需要先合并缓冲
+func (conn *Conn) coalescing() bool {
+	return conn.cfg.CoalesceDelay > 0 || conn.cfg.WriteBufferSize > 0
+}
+
+// bufferLimit 返回合并缓冲的上限，WriteBufferSize 优先
+func (conn *Conn) bufferLimit() int {
+	if n := conn.cfg.WriteBufferSize; n > 0 {
+		return n
+	}
+	return coalesceBufferSize
+}
+
+// bufferLocked 将 bufs 追加到合并缓冲中，缓冲达到上限时立即写出，否则在启用 CoalesceDelay 时确保到期后会写出；调用者需持有 wmu
+func (conn *Conn) bufferLocked(bufs net.Buffers) error {
+	if err := conn.flushErr; err != nil {
+		return err
+	}
+	for _, b := range bufs {
+		conn.wbuf = append(conn.wbuf, b...)
+	}
+	if len(conn.wbuf) >= conn.bufferLimit() {
+		return conn.flushLocked()
+	}
+	if conn.flushTimer == nil && conn.cfg.CoalesceDelay > 0 {
+		conn.flushTimer = time.AfterFunc(conn.cfg.CoalesceDelay, conn.delayedFlush)
+	}
+	return nil
+}
+
+// delayedFlush 在 CoalesceDelay 到期时写出缓冲，出错时由下一次写入返回该错误
+func (conn *Conn) delayedFlush() {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	conn.flushLocked()
+}
+
+// flushLocked 将合并缓冲中的帧写入底层连接；调用者需持有 wmu
+func (conn *Conn) flushLocked() error {
+	if conn.flushTimer != nil {
+		conn.flushTimer.Stop()
+		conn.flushTimer = nil
+	}
+	if conn.flushErr != nil {
+		return conn.flushErr
+	}
+	if len(conn.wbuf) == 0 {
+		return nil
+	}
+	err := writeFull(conn.n, conn.wbuf, conn.cfg.Retry)
+	conn.wbuf = conn.wbuf[:0]
+	if err != nil {
+		// part of the batch may be on the wire, the stream can't continue
+		conn.flushErr = err
+		conn.fail(err)
+	}
+	return err
+}
+
+// Flush 立即写出因 CoalesceDelay 或 WriteBufferSize 尚在缓冲中的帧；两者都未启用时什么都不做
+func (conn *Conn) Flush() error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	return conn.flushLocked()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// coalescedPair 返回以 delay 合并写出的客户端，客户端的底层连接由 cc 统计；服务端依次核对 items，结果从 checked 返回
+func coalescedPair(t *testing.T, delay time.Duration, items []BatchItem) (client *Conn, cc *countingConn, checked chan error) {
+	a, b := net.Pipe()
+	cc = &countingConn{Conn: a}
+	client, server := NewConn(cc, WithCoalesceDelay(delay)), NewConn(b)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	handshakeBoth(t, client, server)
+	checked = make(chan error, 1)
+	go func() { checked <- checkBatch(server, items) }()
+	return client, cc, checked
+}
+
+func TestCoalesceDelayBatchesTinyWrites(t *testing.T) {
+	const delay = 5 * time.Millisecond
+	items := batchItems(50)
+	client, cc, checked := coalescedPair(t, delay, items)
+	before := cc.writes.Load()
+	start := time.Now()
+	for _, item := range items {
+		if err := sendAll(client, item.Key, item.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) >= delay {
+		t.Skipf("sending took %v, longer than the %v delay", time.Since(start), delay)
+	}
+	if n := cc.writes.Load() - before; n != 0 {
+		t.Fatalf("%d writes before the delay passed", n)
+	}
+	eventually(t, "the timer to flush", func() bool { return cc.writes.Load() > before })
+	if err := <-checked; err != nil {
+		t.Fatal(err)
+	}
+	// every tiny write went out in that one batch
+	if n := cc.writes.Load() - before; n != 1 {
+		t.Fatalf("%d writes, want a single flushed batch", n)
+	}
+}
+
+func TestCoalesceDelayBufferLimit(t *testing.T) {
+	items := make([]BatchItem, 80)
+	for i := range items {
+		items[i] = BatchItem{Key: fmt.Sprintf("key-%02d", i), Data: patterned(1 << 10)}
+	}
+	// the timer never fires, only the 64KiB limit does
+	client, cc, checked := coalescedPair(t, time.Hour, items)
+	before := cc.writes.Load()
+	for _, item := range items {
+		if err := sendAll(client, item.Key, item.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := cc.writes.Load() - before; n != 1 {
+		t.Fatalf("%d writes for %d bytes, want one at the 64KiB limit", n, 80<<10)
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-checked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesceDelayFlush(t *testing.T) {
+	items := batchItems(5)
+	client, cc, checked := coalescedPair(t, time.Hour, items)
+	before := cc.writes.Load()
+	for _, item := range items[:3] {
+		if err := sendAll(client, item.Key, item.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := cc.writes.Load() - before; n != 1 {
+		t.Fatalf("Flush wrote %d times, want 1", n)
+	}
+	// nothing left to write
+	if err := client.Flush(); err != nil || cc.writes.Load()-before != 1 {
+		t.Fatalf("a second Flush wrote again: %v", err)
+	}
+	for _, item := range items[3:] {
+		if err := sendAll(client, item.Key, item.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close writes what the timer is still holding
+	client.Close()
+	if err := <-checked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesceDelayLargeWrite(t *testing.T) {
+	data := patterned(100 << 10)
+	client, cc, checked := coalescedPair(t, time.Hour, []BatchItem{{Key: "big", Data: data}})
+	before := cc.writes.Load()
+	if err := sendAll(client, "big", data); err != nil {
+		t.Fatal(err)
+	}
+	// the data frames alone are over the limit and don't wait for the timer
+	if n := cc.writes.Load() - before; n == 0 {
+		t.Fatal("a write larger than the buffer is still held back")
+	}
+	client.Flush()
+	if err := <-checked; err != nil {
+		t.Fatal(err)
+	}
+}
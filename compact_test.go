@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// wireForPayload 在两端都使用 opts 时握手，然后发送一个带 payload 的 key，返回握手之后客户端写出的字节
+func wireForPayload(t *testing.T, payload []byte, opts ...Option) (client *Conn, wire []byte) {
+	t.Helper()
+	a, b := net.Pipe()
+	rc := &recordingConn{Conn: a}
+	client, server := NewConn(rc, opts...), NewConn(b, opts...)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	handshakeBoth(t, client, server)
+	start := len(rc.bytes())
+	go receiveAll(server, false)
+	if err := sendAll(client, "k", payload); err != nil {
+		t.Fatal(err)
+	}
+	return client, rc.bytes()[start:]
+}
+
+func TestCompactHeaderOnWire(t *testing.T) {
+	payload := []byte("0123456789")
+	classicConn, classic := wireForPayload(t, payload)
+	compactConn, compact := wireForPayload(t, payload, WithCompactHeader())
+	if classicConn.Features().CompactHeader || !compactConn.Features().CompactHeader {
+		t.Fatalf("compact header negotiated: classic %v, compact %v",
+			classicConn.Features().CompactHeader, compactConn.Features().CompactHeader)
+	}
+	// the key, the data and the FIN frame each save 12 - 2 bytes
+	if len(classic)-len(compact) != 3*(headerLen-2) {
+		t.Fatalf("classic %d bytes, compact %d bytes", len(classic), len(compact))
+	}
+	typ, _ := frameTypeOf(HED)
+	dataFrame := append([]byte{byte(typ), byte(len(payload))}, payload...)
+	if !bytes.Contains(compact, dataFrame) {
+		t.Fatalf("no 2 byte header before the payload in %x", compact)
+	}
+	if !bytes.Contains(classic, classicFrame(HED, payload)) {
+		t.Fatalf("no 12 byte header before the payload in %x", classic)
+	}
+}
+
+func TestCompactHeaderNeedsBothSides(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithCompactHeader()), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	if client.Features().CompactHeader || server.Features().CompactHeader {
+		t.Fatal("compact header used although only one side proposed it")
+	}
+	go receiveAll(server, false)
+	if err := sendAll(client, "k", []byte("classic frames")); err != nil {
+		t.Fatal(err)
+	}
+}
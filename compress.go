@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CMP 是压缩流的 key 帧，payload 为 1 字节 Compression + key；此后该 key 的数据帧携带的是压缩后的数据，
+// 帧头中的长度均指压缩后的长度；只有对端在 hello 中声明支持该压缩算法时才会发送
+const CMP = "CMP0"
+
+// Compression 是一个 key 的数据使用的压缩算法，记录在该 key 的 CMP 帧中，接收方据此选择解压器；
+// 标准库没有 zstd 的实现，因此只内置 gzip，zstd 需要通过 WithCompressor 提供
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota // 不压缩
+	CompressionGzip                    // gzip，双方都支持时可用
+	CompressionZstd                    // zstd，双方都通过 WithCompressor 提供了实现时可用
+
+	// CompressionAuto 选择双方都支持的最好的算法，zstd 优先于 gzip；它只用于选择，不会出现在 CMP 帧中
+	CompressionAuto Compression = 0xff
+)
+
+// Compressor 是一种压缩算法的实现，通过 WithCompressor 为 Compression 提供，也可以替换内置的 gzip
+type Compressor interface {
+	// NewWriter 返回压缩后写入 w 的 writer，Close 时写出剩余的压缩数据，但不关闭 w
+	NewWriter(w io.Writer) io.WriteCloser
+	// NewReader 返回从 r 读取并解压的 reader；压缩数据结束时返回 io.EOF，不得读取其后的数据
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// gzipCompressor 是内置的 gzip 实现
+type gzipCompressor struct{}
+
+func (gzipCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	// the stream holds exactly one member, what follows it is the FIN
+	z.Multistream(false)
+	return z, nil
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("compression(%d)", uint8(c))
+}
+
+// capability 返回对端需要在 hello 中声明的能力，才能接收以 c 压缩的数据
+func (c Compression) capability() Capability {
+	switch c {
+	case CompressionGzip:
+		return CapGzip
+	case CompressionZstd:
+		return CapZstd
+	}
+	return 0
+}
+
+// errTrailingData 表示压缩数据结束之后、FIN 之前还有多余的数据
+var errTrailingData = errors.New("trailing data after compressed stream")
+
+// SendCompressed 与 Send 相同，但该 key 的数据以 codec 压缩后传输，接收者读到的仍是原始数据；
+// 对端不支持 codec 时（例如对端是旧版本或 Legacy）退回不压缩；codec 为 CompressionAuto 时选择双方都支持的最好的算法；
+func (conn *Conn) SendCompressed(key string, codec Compression) (io.WriteCloser, error) {
+	return conn.send(key, codec, nil, conn.cfg.Priority)
+}
+
+// preferredCompressions 是 CompressionAuto 依次尝试的算法
+var preferredCompressions = []Compression{CompressionZstd, CompressionGzip}
+
+// streamCodec 返回实际用于发送一个 key 的压缩算法，对端不支持 codec 时返回 CompressionNone
+func (conn *Conn) streamCodec(codec Compression) Compression {
+	if codec == CompressionAuto {
+		for _, c := range preferredCompressions {
+			if codec = conn.streamCodec(c); codec != CompressionNone {
+				return codec
+			}
+		}
+		return CompressionNone
+	}
+	if codec == CompressionNone || !conn.Negotiated().Has(codec.capability()) || conn.compressor(codec) == nil {
+		return CompressionNone
+	}
+	return codec
+}
+
+// compressor 返回 codec 的实现，本端没有该算法的实现时返回 nil
+func (conn *Conn) compressor(codec Compression) Compressor {
+	if c := conn.cfg.Compressors[codec]; c != nil {
+		return c
+	}
+	if codec == CompressionGzip {
+		return gzipCompressor{}
+	}
+	return nil
+}
+
+// keyFrame 返回发送 key 时使用的 key 帧
+func keyFrame(key string, codec Compression) (tag string, payload []byte) {
+	if codec == CompressionNone {
+		return HED, []byte(key)
+	}
+	return CMP, append([]byte{byte(codec)}, key...)
+}
+
+// parseCompressedKey 解析 CMP 帧，本端不支持其中的压缩算法时返回错误，该 key 随后会被拒绝
+func (conn *Conn) parseCompressedKey(payload []byte) (key string, codec Compression, err error) {
+	if len(payload) < 1 {
+		return "", 0, errors.New("invalid compressed key frame")
+	}
+	codec = Compression(payload[0])
+	if codec.capability() == 0 || conn.compressor(codec) == nil {
+		err = fmt.Errorf("unsupported compression %v", codec)
+	}
+	return string(payload[1:]), codec, err
+}
+
+// newCompressor 创建以 codec 压缩、将压缩结果写入 w 的 writer，codec 必须是 streamCodec 选出的算法
+func (conn *Conn) newCompressor(codec Compression, w io.Writer) io.WriteCloser {
+	return conn.compressor(codec).NewWriter(w)
+}
+
+// newDecompressor 创建从 r 读取以 codec 压缩的数据并解压的 reader，codec 已经由 parseCompressedKey 检查过
+func (conn *Conn) newDecompressor(codec Compression, r io.Reader) (io.Reader, error) {
+	return conn.compressor(codec).NewReader(r)
+}
+
+// frameSink 将压缩器的输出写成该 key 的数据帧
+type frameSink struct {
+	w *ConnWriter
+}
+
+func (s frameSink) Write(p []byte) (int, error) {
+	return s.w.writeFrames(p)
+}
+
+// streamSource 让解压器从该 key 的数据帧读取压缩数据
+type streamSource struct {
+	r *ConnReader
+}
+
+func (s streamSource) Read(p []byte) (int, error) {
+	return s.r.readData(p)
+}
+
+// readInflated 读取并解压该 key 的数据；压缩数据结束后继续读到 FIN，以得到该 key 最终的结果
+func (c *ConnReader) readInflated(p []byte) (int, error) {
+	if c.inflate == nil {
+		z, err := c.conn.newDecompressor(c.codec, streamSource{c})
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		c.inflate = z
+	}
+	n, err := c.inflate.Read(p)
+	c.consume(p[:n])
+	if max := c.conn.cfg.MaxStreamSize; max > 0 && c.read > max {
+		// a small frame may inflate to anything, the limit applies to what the caller sees
+		c.conn.readErr = ErrStreamTooLarge
+		return n, ErrStreamTooLarge
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	// the compressed data is complete, the FIN that follows decides how the stream ends
+	var rest [1]byte
+	m, ferr := c.readData(rest[:])
+	switch {
+	case m > 0:
+		return n, errTrailingData
+	case n > 0 && ferr == io.EOF:
+		// hand over the data first, the next Read gets io.EOF again from the finished stream
+		return n, nil
+	}
+	return n, ferr
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// jsonLines 返回 n 行高度重复、易于压缩的 JSON
+func jsonLines(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `{"id":%d,"level":"info","msg":"request served","path":"/api/v1/items"}`+"\n", i)
+	}
+	return b.Bytes()
+}
+
+// flateCompressor 是测试用的 Compressor，以 flate 充当 zstd
+type flateCompressor struct{}
+
+func (flateCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	z, _ := flate.NewWriter(w, flate.BestSpeed)
+	return z
+}
+
+func (flateCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	return flate.NewReader(r), nil
+}
+
+func TestCompressedAndPlainStreams(t *testing.T) {
+	client, server := pipeConns(t)
+	streams := []struct {
+		key   string
+		codec Compression
+		data  []byte
+	}{
+		{"log", CompressionGzip, jsonLines(10000)},
+		{"raw", CompressionNone, patterned(100 << 10)},
+		{"empty", CompressionGzip, nil},
+		{"log2", CompressionAuto, jsonLines(100)},
+	}
+	go func() {
+		for _, s := range streams {
+			w, err := client.SendCompressed(s.key, s.codec)
+			if err != nil {
+				return
+			}
+			w.Write(s.data)
+			w.Close()
+		}
+	}()
+	for _, s := range streams {
+		key, r, err := server.Receive()
+		if err != nil || key != s.key {
+			t.Fatalf("got %q %v, want %q", key, err, s.key)
+		}
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, s.data) {
+			t.Fatalf("%s: read %d of %d bytes, %v", key, len(got), len(s.data), err)
+		}
+	}
+	sent, received := client.Stats(), server.Stats()
+	if sent.CompressedStreams != 3 {
+		t.Fatalf("CompressedStreams = %d, want 3", sent.CompressedStreams)
+	}
+	if sent.WireBytesSent*2 > sent.BytesSent || received.WireBytesReceived != sent.WireBytesSent {
+		t.Fatalf("sent %+v, received %+v", sent, received)
+	}
+	if received.BytesReceived != sent.BytesSent {
+		t.Fatalf("delivered %d bytes of %d", received.BytesReceived, sent.BytesSent)
+	}
+}
+
+func TestCompressionWithCustomCompressor(t *testing.T) {
+	client, server := pipeConns(t, WithCompressor(CompressionZstd, flateCompressor{}))
+	data := jsonLines(1000)
+	go func() {
+		w, err := client.SendCompressed("k", CompressionAuto)
+		if err != nil {
+			return
+		}
+		w.Write(data)
+		w.Close()
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.(*ConnReader).codec; got != CompressionZstd {
+		t.Fatalf("CompressionAuto picked %v, want zstd", got)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+}
+
+func TestCompressionPeerWithoutCodec(t *testing.T) {
+	// only the sender can do zstd, so it falls back to sending plain
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithCompressor(CompressionZstd, flateCompressor{})), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	data := jsonLines(100)
+	go func() {
+		w, err := client.SendCompressed("k", CompressionZstd)
+		if err != nil {
+			return
+		}
+		w.Write(data)
+		w.Close()
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if n := client.Stats().CompressedStreams; n != 0 {
+		t.Fatalf("%d streams compressed for a peer that can't inflate them", n)
+	}
+}
+
+func TestCompressedKeyWithUnknownCodec(t *testing.T) {
+	a, b := net.Pipe()
+	server := NewConn(b, WithLegacyMode())
+	defer server.Close()
+	defer a.Close()
+	// a peer that ignores what we support, the RST goes nowhere
+	go io.Copy(io.Discard, a)
+	var wire []byte
+	wire = append(wire, classicFrame(CMP, append([]byte{byte(CompressionZstd)}, "k"...))...)
+	wire = append(wire, classicFrame(HED, []byte("compressed?"))...)
+	wire = append(wire, classicFrame(FIN, (&finFrame{}).append(nil))...)
+	wire = append(wire, classicFrame(HED, []byte("next"))...)
+	wire = append(wire, classicFrame(FIN, (&finFrame{}).append(nil))...)
+	go a.Write(wire)
+	// the zstd stream is rejected and skipped
+	if key, _, err := server.Receive(); err != nil || key != "next" {
+		t.Fatalf("got %q %v, want \"next\"", key, err)
+	}
+}
+
+func TestCompressionPerStreamCodecs(t *testing.T) {
+	client, server := pipeConns(t, WithCompressor(CompressionZstd, flateCompressor{}))
+	data := jsonLines(500)
+	codecs := []Compression{CompressionNone, CompressionGzip, CompressionZstd, CompressionGzip}
+	go func() {
+		for i, codec := range codecs {
+			w, err := client.SendCompressed(fmt.Sprintf("%d-%v", i, codec), codec)
+			if err != nil {
+				return
+			}
+			w.Write(data)
+			w.Close()
+		}
+	}()
+	for i, codec := range codecs {
+		key, r, err := server.Receive()
+		if err != nil || key != fmt.Sprintf("%d-%v", i, codec) {
+			t.Fatalf("got %q %v", key, err)
+		}
+		// the receiver picked the decompressor from the key frame
+		if got := r.(*ConnReader).codec; got != codec {
+			t.Fatalf("%s arrived as %v", key, got)
+		}
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: read %d bytes, %v", key, len(got), err)
+		}
+	}
+}
+
+// countingCompressor 包装 Compressor 并统计创建的 writer 与 reader
+type countingCompressor struct {
+	Compressor
+	writers, readers int
+}
+
+func (c *countingCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	c.writers++
+	return c.Compressor.NewWriter(w)
+}
+
+func (c *countingCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	c.readers++
+	return c.Compressor.NewReader(r)
+}
+
+func TestCompressorReplacesGzip(t *testing.T) {
+	sender, receiver := &countingCompressor{Compressor: gzipCompressor{}}, &countingCompressor{Compressor: gzipCompressor{}}
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithCompressor(CompressionGzip, sender)), NewConn(b, WithCompressor(CompressionGzip, receiver))
+	defer client.Close()
+	defer server.Close()
+	data := jsonLines(100)
+	go func() {
+		w, err := client.SendCompressed("k", CompressionGzip)
+		if err != nil {
+			return
+		}
+		w.Write(data)
+		w.Close()
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if sender.writers != 1 || receiver.readers != 1 {
+		t.Fatalf("the built-in gzip was used: %d writers, %d readers", sender.writers, receiver.readers)
+	}
+	// registering one codec leaves DefaultConfig alone
+	if DefaultConfig.Compressors[CompressionGzip] != nil {
+		t.Fatal("WithCompressor wrote into DefaultConfig")
+	}
+}
+
+func TestWithCompressorPanics(t *testing.T) {
+	for _, codec := range []Compression{CompressionNone, CompressionAuto} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("WithCompressor(%v) didn't panic", codec)
+				}
+			}()
+			WithCompressor(codec, flateCompressor{})
+		}()
+	}
+}
+
+func TestParseCompressedKeyUnsupported(t *testing.T) {
+	a, _ := net.Pipe()
+	conn := NewConn(a)
+	defer conn.Close()
+	tests := []struct {
+		codec Compression
+		ok    bool
+	}{
+		{CompressionGzip, true},
+		// known, but nobody provided an implementation
+		{CompressionZstd, false},
+		{CompressionAuto, false},
+		{Compression(9), false},
+	}
+	for _, tt := range tests {
+		key, codec, err := conn.parseCompressedKey(append([]byte{byte(tt.codec)}, "k"...))
+		if key != "k" || codec != tt.codec || (err == nil) != tt.ok {
+			t.Fatalf("%v: got %q %v %v", tt.codec, key, codec, err)
+		}
+		if !tt.ok && !strings.Contains(err.Error(), "unsupported compression") {
+			t.Fatalf("%v: error %q", tt.codec, err)
+		}
+	}
+	if _, _, err := conn.parseCompressedKey(nil); err == nil {
+		t.Fatal("an empty key frame parsed")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestDefaultConfigValues(t *testing.T) {
+	if DefaultConfig.MaxFrameSize != defaultMaxFrameSize {
+		t.Fatalf("MaxFrameSize = %d", DefaultConfig.MaxFrameSize)
+	}
+	if DefaultConfig.ByteOrder != binary.LittleEndian {
+		t.Fatalf("ByteOrder = %v", DefaultConfig.ByteOrder)
+	}
+}
+
+func TestDefaultConfigInherited(t *testing.T) {
+	saved := DefaultConfig
+	t.Cleanup(func() { DefaultConfig = saved })
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	DefaultConfig.MaxFrameSize = 1234
+	inherited := NewConn(a)
+	explicit := NewConnWithConfig(b, Config{MaxFrameSize: 99})
+	DefaultConfig.MaxFrameSize = 5678
+	if got := inherited.cfg.MaxFrameSize; got != 1234 {
+		t.Fatalf("NewConn: MaxFrameSize = %d, want the default at creation time", got)
+	}
+	if got := explicit.cfg.MaxFrameSize; got != 99 {
+		t.Fatalf("NewConnWithConfig: MaxFrameSize = %d", got)
+	}
+	if got := NewConn(a, WithMaxFrameSize(7)).cfg.MaxFrameSize; got != 7 {
+		t.Fatalf("option: MaxFrameSize = %d", got)
+	}
+}
+
+func TestByteOrderOnWire(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := NewConn(a, WithLegacyMode(), WithByteOrder(binary.BigEndian))
+	defer conn.Close()
+	go sendAll(conn, "key", nil)
+	var head [headerLen]byte
+	if _, err := io.ReadFull(b, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(head[:magicLen]) != HED || binary.BigEndian.Uint64(head[magicLen:]) != 3 {
+		t.Fatalf("header % x", head)
+	}
+}
+
+func TestByteOrderRoundTrip(t *testing.T) {
+	client, server := pipeConns(t, WithByteOrder(binary.BigEndian))
+	go sendAll(client, "big", []byte("endian"))
+	key, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || key != "big" || string(data) != "endian" {
+		t.Fatalf("got %q %q %v", key, data, err)
+	}
+	if server.Features().ByteOrder != binary.BigEndian {
+		t.Fatalf("Features().ByteOrder = %v", server.Features().ByteOrder)
+	}
+}
+
+func TestDefaultMaxFrameSizeRejects(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := NewConn(a, WithLegacyMode())
+	defer conn.Close()
+	go b.Write(binary.LittleEndian.AppendUint64([]byte(HED), defaultMaxFrameSize+1))
+	if _, _, err := conn.Receive(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestHugeFrameHeaderWithoutLimit(t *testing.T) {
+	a, b := net.Pipe()
+	conn := NewConn(a, WithLegacyMode(), WithMaxFrameSize(0))
+	defer conn.Close()
+	go func() {
+		// claims a terabyte, then hangs up after a few bytes
+		b.Write(binary.LittleEndian.AppendUint64([]byte(HED), 1<<40))
+		b.Write([]byte("abc"))
+		b.Close()
+	}()
+	if _, _, err := conn.Receive(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// SetDeadline 设置底层连接的读写截止时间，到期后阻塞中的读写返回满足 errors.Is(err, os.ErrDeadlineExceeded) 的错误，
+// 与 net.Conn 的同名方法相同；握手、IdleTimeout 与 FrameTimeout 临时设置的读截止时间不会晚于它，结束后恢复为它；
+// 写到一半的帧超时后对端无法再找到下一个帧，此后应当关闭连接
+func (conn *Conn) SetDeadline(t time.Time) error {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	conn.deadline.Store(ns)
+	if err := conn.n.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	conn.setReadDeadline(conn.n, t)
+	return nil
+}
+
+// ClearDeadlines 清除 SetDeadline 设置的读写截止时间，之后的读写不再超时
+func (conn *Conn) ClearDeadlines() error {
+	return conn.SetDeadline(time.Time{})
+}
+
+// userDeadline 返回 SetDeadline 设置的截止时间，没有设置时为零值
+func (conn *Conn) userDeadline() time.Time {
+	if ns := conn.deadline.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// earlier 返回 a 与 b 中较早的一个，零值表示没有截止时间
+func earlier(a, b time.Time) time.Time {
+	if a.IsZero() || !b.IsZero() && b.Before(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClearDeadlines(t *testing.T) {
+	client, server := pipeConns(t)
+	if err := server.SetDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ClearDeadlines(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// slower than the deadline that was cleared
+		time.Sleep(100 * time.Millisecond)
+		sendAll(client, "slow", []byte("late"))
+	}()
+	key, _, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "slow" {
+		t.Fatalf("got key %q", key)
+	}
+}
+
+func TestDeadlineSurvivesHandshake(t *testing.T) {
+	client, server := pipeConns(t)
+	// set before the first Send, the handshake runs with its own timeout and must put this one back
+	if err := server.SetDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	go sendAll(client, "first", []byte("x"))
+	if _, r, err := server.Receive(); err != nil {
+		t.Fatal(err)
+	} else if err = r.(*ConnReader).Drain(); err != nil {
+		t.Fatal(err)
+	}
+	// without the deadline the read would block forever, fail instead of hanging
+	guard := time.AfterFunc(2*time.Second, server.Close)
+	defer guard.Stop()
+	start := time.Now()
+	_, _, err := server.Receive()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("deadline hit after %v", d)
+	}
+}
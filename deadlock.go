@@ -0,0 +1,36 @@
+package main
+
+import "errors"
+
+// WAT 表示发送方已经等待下一个帧超过 DeadlockTimeout，payload 为空
+const WAT = "WAIT"
+
+// ErrPossibleDeadlock 表示启用 DeadlockTimeout 时，本端与对端都在等待读取、线路上没有任何数据，
+// 通常是双方都先 Receive 造成的；这只是诊断，连接仍然可用
+var ErrPossibleDeadlock = errors.New("possible deadlock: both peers are waiting to read")
+
+// announceStall 在从 epoch 开始的读取等待超过 DeadlockTimeout 时告知对端；读取期间收到过帧时什么都不做
+func (conn *Conn) announceStall(epoch int64) {
+	if conn.readEpoch.Load() != epoch {
+		return
+	}
+	conn.stalledAt.Store(epoch + 1)
+	// best effort, a failed write shows up on the next real write
+	conn.writeControl(FrameWait, nil)
+}
+
+// acceptWait 处理对端的 WAIT：本端的读取同样已经宣告等待、且此后没有收到任何数据时判定为死锁，
+// 并再回复一个 WAIT，让尚未判定的对端同样得到诊断
+func (conn *Conn) acceptWait() error {
+	if conn.cfg.DeadlockTimeout <= 0 {
+		return nil
+	}
+	epoch := conn.readEpoch.Load()
+	if !conn.stalledAt.CompareAndSwap(epoch+1, 0) {
+		// the peer stalled while we were busy, our next write unblocks it
+		return nil
+	}
+	// the peer may no longer be reading once it got its own diagnostic, never block the read on it
+	go conn.writeControl(FrameWait, nil)
+	return ErrPossibleDeadlock
+}
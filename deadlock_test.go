@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDeadlockBothReceive(t *testing.T) {
+	client, server := pipeConns(t, WithDeadlockDetection(50*time.Millisecond))
+	handshakeBoth(t, client, server)
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := server.Receive()
+		errc <- err
+	}()
+	// both ends read first, like a client that forgot to send its request
+	start := time.Now()
+	if _, _, err := client.Receive(); !errors.Is(err, ErrPossibleDeadlock) {
+		t.Fatalf("client: got %v, want ErrPossibleDeadlock", err)
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrPossibleDeadlock) {
+			t.Fatalf("server: got %v, want ErrPossibleDeadlock", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the server is still blocked in Receive")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("diagnosed after %v, before DeadlockTimeout", d)
+	}
+
+	// the diagnostic leaves the connection usable
+	go sendAll(client, "k", []byte("after the diagnostic"))
+	key, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); key != "k" || string(data) != "after the diagnostic" {
+		t.Fatalf("got %q %q", key, data)
+	}
+}
+
+func TestNoDeadlockWhilePeerIsBusy(t *testing.T) {
+	client, server := pipeConns(t, WithDeadlockDetection(20*time.Millisecond))
+	handshakeBoth(t, client, server)
+	go func() {
+		// busy for a while without reading, then send
+		time.Sleep(200 * time.Millisecond)
+		sendAll(client, "late", []byte("data"))
+	}()
+	key, r, err := server.Receive()
+	if err != nil {
+		t.Fatalf("got %v while the peer was only slow", err)
+	}
+	if data, _ := io.ReadAll(r); key != "late" || string(data) != "data" {
+		t.Fatalf("got %q %q", key, data)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// ErrInvalidConfig 表示 Option 组合出的 Config 不合法，例如 PSK 不是 32 字节
+var ErrInvalidConfig = errors.New("invalid config")
+
+// DialError 表示 Dial 未能建立到 Addr 的连接，例如端口被拒绝或 ctx 在拨号期间结束
+type DialError struct {
+	Addr string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return "dial " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// HandshakeError 表示 Dial 已经建立了连接，但协议握手失败，例如凭证被拒绝或对端不支持要求的能力
+type HandshakeError struct {
+	Addr string
+	Err  error
+}
+
+func (e *HandshakeError) Error() string {
+	return "handshake with " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Dialer 是 DialWith 所需的拨号器，golang.org/x/net/proxy 中的 Dialer 以及 *net.Dialer 均满足该接口
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// Dial 建立到 addr 的 TCP 连接，以 DefaultConfig 与 opts 得到一个你实现的连接对象，并在返回前完成握手；
+// ctx 同时限制拨号（包括代理握手）与握手的时间；Option 组合出的 Config 不合法时返回包装了 ErrInvalidConfig 的错误，此时不会拨号；
+// 拨号失败时返回 *DialError，配置了 Proxy 而代理本身出错时返回 *ProxyError，握手失败时返回 *HandshakeError，
+// ctx 结束导致的失败同样包装了 ctx.Err()；
+func Dial(ctx context.Context, addr string, opts ...Option) (*Conn, error) {
+	cfg := DefaultConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	raw, err := dialThrough(ctx, cfg.Proxy, cfg.ProxyTLS, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := NewConnWithConfig(raw, cfg)
+	// the handshake has its own deadline, ctx ends it by closing the connection
+	stop := context.AfterFunc(ctx, func() {
+		raw.Close()
+	})
+	err = c.Handshake()
+	if !stop() {
+		c.Close()
+		return nil, &HandshakeError{Addr: addr, Err: ctx.Err()}
+	}
+	if err != nil {
+		return nil, &HandshakeError{Addr: addr, Err: err}
+	}
+	return c, nil
+}
+
+// dialThrough 直接或经由 proxy 建立到 addr 的 TCP 连接，失败时返回 *DialError 或 *ProxyError；
+// proxyTLS 是 https 代理的 TLS 配置
+func dialThrough(ctx context.Context, proxy *url.URL, proxyTLS *tls.Config, addr string) (net.Conn, error) {
+	var d net.Dialer
+	switch {
+	case proxy == nil:
+	case proxy.Scheme == "http" || proxy.Scheme == "https":
+		return dialHTTPProxy(ctx, &d, proxy, proxyTLS, addr)
+	default:
+		return dialSOCKS5(ctx, &d, proxy, addr)
+	}
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, &DialError{Addr: addr, Err: err}
+	}
+	return raw, nil
+}
+
+// supportedProxy 报告 Dial 能否使用 scheme 的代理
+func supportedProxy(scheme string) bool {
+	switch scheme {
+	case "socks5", "socks5h", "http", "https":
+		return true
+	}
+	return false
+}
+
+// validate 检查 Config 中无法工作的取值，返回包装了 ErrInvalidConfig 的错误
+func (c *Config) validate() error {
+	switch {
+	case c.PSK != nil && len(c.PSK) != pskLen:
+		return fmt.Errorf("%w: PSK must be %d bytes", ErrInvalidConfig, pskLen)
+	case c.Identity != nil && len(c.Identity) != ed25519.PrivateKeySize:
+		return fmt.Errorf("%w: Identity must be an ed25519 private key", ErrInvalidConfig)
+	case c.PeerIdentity != nil && len(c.PeerIdentity) != ed25519.PublicKeySize:
+		return fmt.Errorf("%w: PeerIdentity must be an ed25519 public key", ErrInvalidConfig)
+	case c.Proxy != nil && !supportedProxy(c.Proxy.Scheme):
+		return fmt.Errorf("%w: unsupported proxy scheme %q", ErrInvalidConfig, c.Proxy.Scheme)
+	}
+	for name, v := range map[string]int64{
+		"MaxBytesPerKey":       c.MaxBytesPerKey,
+		"MaxStreamSize":        c.MaxStreamSize,
+		"MaxFrameSize":         c.MaxFrameSize,
+		"MaxKeyLength":         int64(c.MaxKeyLength),
+		"MaxConcurrentStreams": int64(c.MaxConcurrentStreams),
+		"InitialWindow":        c.InitialWindow,
+		"ReadChunkSize":        int64(c.ReadChunkSize),
+		"ReadBufferSize":       int64(c.ReadBufferSize),
+		"WriteBufferSize":      int64(c.WriteBufferSize),
+	} {
+		if v < 0 {
+			return fmt.Errorf("%w: %s is negative", ErrInvalidConfig, name)
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"HandshakeTimeout": c.HandshakeTimeout,
+		"HelloTimeout":     c.HelloTimeout,
+		"IdleTimeout":      c.IdleTimeout,
+		"FrameTimeout":     c.FrameTimeout,
+		"CoalesceDelay":    c.CoalesceDelay,
+		"DeadlockTimeout":  c.DeadlockTimeout,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%w: %s is negative", ErrInvalidConfig, name)
+		}
+	}
+	return nil
+}
+
+// DialWith 使用调用者提供的拨号器建立连接，并得到一个你实现的连接对象；
+// 可用于经由 SOCKS5 代理或自定义拨号逻辑建立连接；需要握手时（例如配置了凭证）在返回前完成握手；
+func DialWith(d Dialer, network, addr string, opts ...Option) (*Conn, error) {
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := NewConn(conn, opts...)
+	if err = c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialUnix 连接到 path 上的 unix socket，用于不经过 TCP 的本机进程间通信；需要握手时在返回前完成握手；
+func DialUnix(path string, opts ...Option) (*Conn, error) {
+	return DialWith(&net.Dialer{}, "unix", path, opts...)
+}
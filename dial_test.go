@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeDialer 记录每次拨号的地址，并返回一端 net.Pipe，另一端由 serve 处理
+type fakeDialer struct {
+	network, addr string
+	err           error // returned instead of dialing when set
+	serve         func(net.Conn)
+}
+
+func (d *fakeDialer) Dial(network, addr string) (net.Conn, error) {
+	d.network, d.addr = network, addr
+	if d.err != nil {
+		return nil, d.err
+	}
+	a, b := net.Pipe()
+	go d.serve(b)
+	return a, nil
+}
+
+func TestDialWithFakeDialer(t *testing.T) {
+	got := make(chan string, 1)
+	d := &fakeDialer{serve: func(nc net.Conn) {
+		server := NewConn(nc)
+		defer server.Close()
+		key, r, err := server.Receive()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		data, _ := io.ReadAll(r)
+		got <- key + ":" + string(data)
+	}}
+	conn, err := DialWith(d, "tcp", "proxy.example:1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if d.network != "tcp" || d.addr != "proxy.example:1080" {
+		t.Fatalf("dialed %s %s", d.network, d.addr)
+	}
+	if !conn.handshaked.Load() {
+		t.Fatal("DialWith returned before the handshake")
+	}
+	if err = sendAll(conn, "k", []byte("through the dialer")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "k:through the dialer" {
+		t.Fatalf("server got %q", s)
+	}
+}
+
+func TestDialWithDialerError(t *testing.T) {
+	refused := errors.New("proxy refused the connection")
+	d := &fakeDialer{err: refused}
+	conn, err := DialWith(d, "tcp", "unreachable:1")
+	if conn != nil || !errors.Is(err, refused) {
+		t.Fatalf("got %v %v, want the dialer's error", conn, err)
+	}
+	if d.addr != "unreachable:1" {
+		t.Fatalf("dialed %q", d.addr)
+	}
+}
+
+func TestDialWithHandshakeError(t *testing.T) {
+	// the peer hangs up before answering the hello
+	d := &fakeDialer{serve: func(nc net.Conn) { nc.Close() }}
+	conn, err := DialWith(d, "tcp", "closed:1")
+	if conn != nil || err == nil {
+		t.Fatalf("got %v %v, want the handshake to fail", conn, err)
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	// nothing listens there any more
+	ln.Close()
+	conn, err := Dial(context.Background(), addr)
+	var dialErr *DialError
+	if conn != nil || !errors.As(err, &dialErr) || dialErr.Addr != addr {
+		t.Fatalf("got %v %v, want a *DialError for %s", conn, err, addr)
+	}
+}
+
+// silentListener 接受连接但从不回复 hello，返回地址；accepted 收到每一个被接受的连接
+func silentListener(t *testing.T) (addr string, accepted chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted = make(chan net.Conn, 16)
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- nc
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		for nc := range accepted {
+			nc.Close()
+		}
+	})
+	return ln.Addr().String(), accepted
+}
+
+func TestDialCanceled(t *testing.T) {
+	addr, accepted := silentListener(t)
+	t.Run("before the dial", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := Dial(ctx, addr)
+		var dialErr *DialError
+		if !errors.As(err, &dialErr) || !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want a *DialError wrapping context.Canceled", err)
+		}
+	})
+	t.Run("during the handshake", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			// connected and handshaking, but the peer never says hello
+			nc := <-accepted
+			nc.Read(make([]byte, 1))
+			cancel()
+			nc.Close()
+		}()
+		start := time.Now()
+		_, err := Dial(ctx, addr, WithHandshakeTimeout(time.Minute))
+		var handshakeErr *HandshakeError
+		if !errors.As(err, &handshakeErr) || !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want a *HandshakeError wrapping context.Canceled", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("Dial returned %v after the cancel", elapsed)
+		}
+	})
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := Dial(ctx, addr, WithHandshakeTimeout(time.Minute)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want context.DeadlineExceeded", err)
+		}
+	})
+}
+
+func TestDialInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"short psk", WithPSK([]byte("too short"))},
+		{"negative limit", WithMaxFrameSize(-1)},
+		{"negative timeout", WithIdleTimeout(-time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// an address that can't be dialed, validation comes first
+			conn, err := Dial(context.Background(), "127.0.0.1:0", tt.opt)
+			var dialErr *DialError
+			if conn != nil || !errors.Is(err, ErrInvalidConfig) || errors.As(err, &dialErr) {
+				t.Fatalf("got %v %v, want ErrInvalidConfig", conn, err)
+			}
+		})
+	}
+}
+
+func TestDialHandshakeFailure(t *testing.T) {
+	s := &Server{Options: []Option{WithAuthenticator(lookupToken)}, Handler: func(conn *Conn) { conn.Receive() }}
+	addr, _ := serveOn(t, s)
+	conn, err := Dial(context.Background(), addr, WithToken("alice", []byte("wrong")))
+	var handshakeErr *HandshakeError
+	if conn != nil || !errors.As(err, &handshakeErr) || !errors.Is(err, ErrAuthFailed) || handshakeErr.Addr != addr {
+		t.Fatalf("got %v %v, want a *HandshakeError wrapping ErrAuthFailed", conn, err)
+	}
+}
+
+func TestDialSuccess(t *testing.T) {
+	opts := []Option{WithCompactHeader(), WithPSK(testPSK), WithLimits(Limits{MaxKeyLength: 16})}
+	s := &Server{Options: opts, Handler: func(conn *Conn) {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(r)
+		sendAll(conn, key, data)
+	}}
+	addr, _ := serveOn(t, s)
+	conn, err := Dial(context.Background(), addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the handshake is done and the options took effect on both ends
+	n := conn.Negotiated()
+	if !n.Has(CapCompactHeader) || conn.PeerLimits().MaxKeyLength != 16 || !conn.Features().Encryption {
+		t.Fatalf("negotiated %+v, peer limits %+v", n, conn.PeerLimits())
+	}
+	go sendAll(conn, "k", []byte("dialed"))
+	_, r, err := conn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "dialed" {
+		t.Fatalf("echo %q", data)
+	}
+}
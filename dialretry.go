@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// DialRetry 与 Dial 相同，但在服务端尚未就绪时按 policy 以指数退避重试，适合与服务端同时启动的客户端；
+// 只重试连接被拒绝、被重置以及超时，地址错误、认证被拒绝、Config 不合法等永久错误立即返回；
+// policy.MaxAttempts 不大于 0 时不限次数，直到 ctx 结束；policy 为 nil 时从 100ms 开始、最长等待 5s、不限次数；
+// 全部失败时返回最后一次尝试的错误，ctx 在等待期间结束时返回 ctx.Err()；
+func DialRetry(ctx context.Context, addr string, policy *RetryPolicy, opts ...Option) (*Conn, error) {
+	if policy == nil {
+		policy = &RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 5 * time.Second, Jitter: 0.2}
+	}
+	for attempt := 1; ; attempt++ {
+		c, err := Dial(ctx, addr, opts...)
+		if err == nil {
+			return c, nil
+		}
+		if !retryableDial(ctx, err) || policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return nil, err
+		}
+		backoff := policy.backoff(attempt)
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt, err, backoff)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryableDial 判断 Dial 返回的 err 是否可能在服务端就绪后消失
+func retryableDial(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	// the same, reported by a socks5 proxy on our behalf
+	var reply socksReplyError
+	if errors.As(err, &reply) && (reply == 5 || reply == 6) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr 返回一个当前无人监听的本地地址
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// retryLog 记录 OnRetry 的调用
+type retryLog struct {
+	mu       sync.Mutex
+	attempts []int
+	errs     []error
+	backoffs []time.Duration
+}
+
+func (l *retryLog) observe(attempt int, err error, backoff time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attempts = append(l.attempts, attempt)
+	l.errs = append(l.errs, err)
+	l.backoffs = append(l.backoffs, backoff)
+}
+
+func TestDialRetryUntilListening(t *testing.T) {
+	addr := freeAddr(t)
+	var log retryLog
+	policy := &RetryPolicy{Backoff: 20 * time.Millisecond, MaxBackoff: time.Second}
+	policy.OnRetry = func(attempt int, err error, backoff time.Duration) {
+		log.observe(attempt, err, backoff)
+		if attempt != 2 {
+			return
+		}
+		// the server comes up only after the second attempt failed
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s := &Server{Handler: func(conn *Conn) { conn.Receive() }}
+		go s.Serve(ln)
+		t.Cleanup(func() { s.Close() })
+	}
+	conn, err := DialRetry(context.Background(), addr, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(log.attempts) != 2 || log.attempts[0] != 1 || log.attempts[1] != 2 {
+		t.Fatalf("OnRetry saw attempts %v, want [1 2]", log.attempts)
+	}
+	for i, err := range log.errs {
+		var dialErr *DialError
+		if !errors.As(err, &dialErr) || !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("attempt %d failed with %v, want a refused connection", i+1, err)
+		}
+	}
+	// no jitter, so exactly doubled
+	if log.backoffs[0] != 20*time.Millisecond || log.backoffs[1] != 40*time.Millisecond {
+		t.Fatalf("backoffs %v", log.backoffs)
+	}
+}
+
+func TestDialRetryMaxAttempts(t *testing.T) {
+	var log retryLog
+	policy := &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, OnRetry: log.observe}
+	conn, err := DialRetry(context.Background(), freeAddr(t), policy)
+	if conn != nil || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("got %v %v, want the last refusal", conn, err)
+	}
+	// the last attempt isn't followed by a wait
+	if len(log.attempts) != 2 {
+		t.Fatalf("OnRetry called %d times for 3 attempts", len(log.attempts))
+	}
+}
+
+func TestDialRetryPermanentErrors(t *testing.T) {
+	s := &Server{Options: []Option{WithAuthenticator(lookupToken)}, Handler: func(conn *Conn) { conn.Receive() }}
+	authAddr, _ := serveOn(t, s)
+	tests := []struct {
+		name string
+		addr string
+		opts []Option
+		want error
+	}{
+		{"auth rejected", authAddr, []Option{WithToken("alice", []byte("wrong"))}, ErrAuthFailed},
+		{"invalid config", authAddr, []Option{WithPSK([]byte("short"))}, ErrInvalidConfig},
+		{"bad address", "127.0.0.1:no-port", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log retryLog
+			policy := &RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond, OnRetry: log.observe}
+			conn, err := DialRetry(context.Background(), tt.addr, policy, tt.opts...)
+			if conn != nil || err == nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v %v, want %v", conn, err, tt.want)
+			}
+			if len(log.attempts) != 0 {
+				t.Fatalf("retried %d times after %v", len(log.attempts), err)
+			}
+		})
+	}
+}
+
+func TestDialRetryContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var log retryLog
+	// no attempt limit, only the context stops it
+	policy := &RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, OnRetry: log.observe}
+	start := time.Now()
+	_, err := DialRetry(ctx, freeAddr(t), policy)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned %v after the deadline", elapsed)
+	}
+	if len(log.attempts) < 2 {
+		t.Fatalf("only %d retries before the deadline", len(log.attempts))
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		for attempt, full := range map[int]time.Duration{
+			1:  10 * time.Millisecond,
+			2:  20 * time.Millisecond,
+			3:  40 * time.Millisecond,
+			4:  50 * time.Millisecond,
+			70: 50 * time.Millisecond, // the shift overflows, still capped
+		} {
+			if d := p.backoff(attempt); d > full || d < full/2 {
+				t.Fatalf("attempt %d waits %v, want between %v and %v", attempt, d, full/2, full)
+			}
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// ErrDigestMismatch 表示接收者读到的数据与发送者写入的数据摘要不一致
+var ErrDigestMismatch = errors.New("stream digest mismatch")
+
+// checkDigest 在读到 FIN 时比较发送者与接收者各自计算的摘要
+func checkDigest(h hash.Hash, f *finFrame) error {
+	if f.digest == nil {
+		return errors.New("stream digest missing, is digest enabled on the sender?")
+	}
+	if !bytes.Equal(h.Sum(nil), f.digest) {
+		return ErrDigestMismatch
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// flipConn 在第一次写出 marker 时翻转其首字节的最低位，之后原样转发
+type flipConn struct {
+	net.Conn
+	marker  []byte
+	flipped atomic.Bool
+}
+
+func (c *flipConn) Write(p []byte) (int, error) {
+	if i := bytes.Index(p, c.marker); i >= 0 && c.flipped.CompareAndSwap(false, true) {
+		p = bytes.Clone(p)
+		p[i] ^= 1
+	}
+	return c.Conn.Write(p)
+}
+
+func TestDigestRoundTrip(t *testing.T) {
+	client, server := pipeConns(t, WithDigest(sha256.New))
+	data := patterned(256 << 10)
+	go sendAll(client, "k", data)
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+}
+
+func TestDigestDetectsFlippedBit(t *testing.T) {
+	a, b := net.Pipe()
+	data := append(bytes.Repeat([]byte("payload "), 1000), "MARK"...)
+	data = append(data, bytes.Repeat([]byte(" trailer"), 1000)...)
+	fc := &flipConn{Conn: a, marker: []byte("MARK")}
+	client, server := NewConn(fc, WithDigest(sha256.New)), NewConn(b, WithDigest(sha256.New))
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "k", data)
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("got %v, want ErrDigestMismatch", err)
+	}
+	if !fc.flipped.Load() {
+		t.Fatal("the marker never went over the wire")
+	}
+	// the corrupted bytes were delivered, only the end of the stream tells
+	if len(got) != len(data) || bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want %d with one bit flipped", len(got), len(data))
+	}
+}
+
+func TestDigestMissingOnSender(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a), NewConn(b, WithDigest(sha256.New))
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "k", []byte("data"))
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("a stream without a digest was accepted")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestDrainThenNextStream(t *testing.T) {
+	client, server := pipeConns(t, WithMaxFrameSize(4<<10))
+	go func() {
+		sendAll(client, "big", patterned(100<<10))
+		sendAll(client, "next", []byte("data of next"))
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(r, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.(*ConnReader).Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	// draining twice is harmless
+	if err = r.(*ConnReader).Drain(); err != nil {
+		t.Fatalf("second Drain: %v", err)
+	}
+	key, r, err := server.Receive()
+	if err != nil || key != "next" {
+		t.Fatalf("got %q %v, want \"next\"", key, err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "data of next" {
+		t.Fatalf("read %q %v", data, err)
+	}
+}
+
+func TestDrainAndClose(t *testing.T) {
+	client, server := pipeConns(t)
+	errc := make(chan error, 1)
+	go func() {
+		w, err := client.Send("k")
+		if err == nil {
+			_, err = w.Write(patterned(1 << 20))
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		errc <- err
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Read(make([]byte, 10))
+	if err = server.DrainAndClose(); err != nil {
+		t.Fatalf("DrainAndClose: %v", err)
+	}
+	// the whole stream was consumed, so the sender never saw the close
+	if err = <-errc; err != nil {
+		t.Fatalf("sender: %v", err)
+	}
+	if _, _, err = server.Receive(); err == nil {
+		t.Fatal("Receive after DrainAndClose succeeded")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnString(t *testing.T) {
+	ln := startServer(func(conn *Conn) { conn.Receive() })
+	defer ln.Close()
+	client := dial(ln.Addr().String())
+	defer client.Close()
+	s := client.String()
+	if !strings.Contains(s, client.LocalAddr().String()) || !strings.Contains(s, client.RemoteAddr().String()) {
+		t.Fatalf("String() = %q, want both addresses", s)
+	}
+}
+
+func TestWrappedErrors(t *testing.T) {
+	t.Run("send", func(t *testing.T) {
+		client, server := pipeConns(t)
+		handshakeBoth(t, client, server)
+		server.Close()
+		_, err := client.Send("k")
+		if !errors.Is(err, io.ErrClosedPipe) || !strings.Contains(err.Error(), `send key "k"`) {
+			t.Fatalf("got %v, want a wrapped io.ErrClosedPipe", err)
+		}
+	})
+	t.Run("write", func(t *testing.T) {
+		client, server := pipeConns(t)
+		received := make(chan error, 1)
+		go func() {
+			_, _, err := server.Receive()
+			received <- err
+		}()
+		w, err := client.Send("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = <-received; err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		_, err = w.Write([]byte("data"))
+		if !errors.Is(err, io.ErrClosedPipe) || !strings.Contains(err.Error(), `write key "k"`) {
+			t.Fatalf("got %v, want a wrapped io.ErrClosedPipe", err)
+		}
+	})
+	t.Run("read", func(t *testing.T) {
+		a, b := net.Pipe()
+		server := NewConn(b, WithLegacyMode())
+		defer server.Close()
+		go func() {
+			// a frame promising 100 bytes, cut off after 10
+			a.Write(classicFrame(HED, []byte("k")))
+			a.Write(classicFrame(HED, patterned(100))[:headerLen+10])
+			a.Close()
+		}()
+		_, r, err := server.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(r)
+		if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), `read key "k"`) {
+			t.Fatalf("got %v, want a wrapped io.ErrUnexpectedEOF", err)
+		}
+	})
+	t.Run("clean end", func(t *testing.T) {
+		client, server := pipeConns(t)
+		go sendAll(client, "k", []byte("data"))
+		_, r, err := server.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(r)
+		// io.EOF is never wrapped, callers compare it directly
+		if _, err = r.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("got %v at the end of the key, want io.EOF", err)
+		}
+	})
+}
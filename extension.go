@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameExtension 是扩展帧类型的起点：FrameExtension 到 0xFF 之间的类型，以及经典帧头中以 'X' 开头的 tag，
+// 都是为将来的控制帧保留的扩展帧；不认识它们的接收方默认按帧头中的长度跳过，StrictFrames 时则断开连接
+const FrameExtension FrameType = 0xC0
+
+var (
+	// ErrUnknownFrame 表示启用 StrictFrames 时收到了不认识的扩展帧
+	ErrUnknownFrame = errors.New("unknown frame")
+	// ErrUnknownFrameType 表示启用 StrictFrames 时收到了既不属于本版本、也不是扩展帧的帧类型，
+	// 通常来自更新版本的对端
+	ErrUnknownFrameType = errors.New("unknown frame type")
+	// ErrFrameTooLarge 表示对端发来的帧超过了 MaxFrameSize，此后连接不再可用
+	ErrFrameTooLarge = errors.New("frame exceeds max frame size")
+)
+
+// isExtension 判断 tag 是否属于扩展帧
+func isExtension(tag string) bool {
+	return len(tag) == magicLen && tag[0] == 'X'
+}
+
+// isKnown 判断 tag 是否为本版本认识的帧
+func isKnown(tag string) bool {
+	_, ok := tagFrames[tag]
+	return ok
+}
+
+// unknownTag 返回紧凑帧头中不认识的帧类型 b 对应的 tag，仅用于错误信息
+func unknownTag(b byte) string {
+	return fmt.Sprintf("?%03d", b)
+}
+
+// extensionTag 返回紧凑帧头中扩展帧类型 t 对应的 tag
+func extensionTag(t FrameType) string {
+	return fmt.Sprintf("X%03d", uint8(t))
+}
+
+// skipUnknown 跳过一个长度为 size 的扩展帧或不认识的帧的其余部分：未启用 HMAC 与加密时直接丢弃，不会按 size 分配内存；
+// 启用时帧仍需校验以保持双方的序号一致，此时 payload 的大小受 MaxFrameSize 限制
+func (conn *Conn) skipUnknown(tag string, size uint64) error {
+	if conn.cfg.StrictFrames {
+		sentinel := ErrUnknownFrameType
+		if isExtension(tag) {
+			sentinel = ErrUnknownFrame
+		}
+		conn.readErr = fmt.Errorf("%w %q", sentinel, tag)
+		return conn.readErr
+	}
+	if conn.macEnabled() || conn.recvKey != nil {
+		if _, err := conn.readPayload(tag, size); err != nil {
+			return err
+		}
+	} else {
+		if conn.cfg.Checksum {
+			size += checksumLen
+		}
+		if _, err := io.CopyN(io.Discard, conn.r, int64(size)); err != nil {
+			return conn.payloadError(err)
+		}
+	}
+	conn.stats.unknownFrames.Add(1)
+	return nil
+}
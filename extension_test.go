@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestUnknownFramesInsideStream(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		inject []byte
+	}{
+		{"classic extension", []Option{WithLegacyMode()}, classicFrame(extensionTag(FrameExtension+8), []byte("from a newer peer"))},
+		{"classic unknown", []Option{WithLegacyMode()}, classicFrame("ZZZZ", []byte("from a newer peer"))},
+		{"compact extension", []Option{WithCompactHeader()}, []byte{byte(FrameExtension + 8), 3, 'n', 'e', 'w'}},
+		{"compact unknown", []Option{WithCompactHeader()}, []byte{byte(FrameExtension - 1), 3, 'n', 'e', 'w'}},
+	} {
+		for _, before := range []string{"data", "fin"} {
+			t.Run(tc.name+" before "+before, func(t *testing.T) {
+				a, b := net.Pipe()
+				client, server := NewConn(a, tc.opts...), NewConn(b, tc.opts...)
+				defer client.Close()
+				defer server.Close()
+				handshakeBoth(t, client, server)
+				sent := make(chan error, 1)
+				go func() {
+					w, err := client.Send("k")
+					if err != nil {
+						sent <- err
+						return
+					}
+					// net.Pipe hands every write over whole, so the raw frame lands between the writer's frames
+					w.Write([]byte("first"))
+					if before == "data" {
+						a.Write(tc.inject)
+					}
+					w.Write([]byte("second"))
+					if before == "fin" {
+						a.Write(tc.inject)
+					}
+					sent <- w.Close()
+				}()
+				_, r, err := server.Receive()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data, err := io.ReadAll(r); err != nil || string(data) != "firstsecond" {
+					t.Fatalf("got %q %v", data, err)
+				}
+				if err = <-sent; err != nil {
+					t.Fatal(err)
+				}
+				if n := server.Stats().UnknownFrames; n != 1 {
+					t.Fatalf("UnknownFrames = %d", n)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ReceiveToFile 接收下一个 key，并将其完整的数据写入 path，返回 key 与写入的字节数，调用者之后可 os.Open 并随机访问；
+// 数据先写入 path 所在目录的临时文件，完整接收后才重命名为 path，失败时临时文件会被删除，path 保持不变；
+// 写文件失败时该 key 剩余的数据会被丢弃，连接仍可继续接收下一个 key；
+func (conn *Conn) ReceiveToFile(path string) (key string, size int64, err error) {
+	key, reader, err := conn.Receive()
+	if err != nil {
+		return "", 0, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return key, 0, discardRest(reader, err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	written, err := io.Copy(f, reader)
+	if err != nil {
+		return key, 0, discardRest(reader, err)
+	}
+	if err = f.Sync(); err != nil {
+		return key, 0, err
+	}
+	if err = f.Close(); err != nil {
+		return key, 0, err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return key, 0, err
+	}
+	return key, written, nil
+}
+
+// discardRest 在本地出错后丢弃 reader 中剩余的数据，使连接停在下一个 key 的开头，并返回原来的错误 err
+func discardRest(reader io.Reader, err error) error {
+	reader.(*ConnReader).Drain()
+	return err
+}
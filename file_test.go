@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReceiveToFile(t *testing.T) {
+	client, server := pipeConns(t)
+	data := patterned(8 << 20)
+	go sendAll(client, "big", data)
+	path := filepath.Join(t.TempDir(), "big.bin")
+	key, size, err := server.ReceiveToFile(path)
+	if err != nil || key != "big" || size != int64(len(data)) {
+		t.Fatalf("got %q %d %v", key, size, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// random access into the middle
+	buf := make([]byte, 1000)
+	if _, err = f.ReadAt(buf, 5<<20); err != nil || !bytes.Equal(buf, data[5<<20:5<<20+1000]) {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if got, _ := io.ReadAll(f); !bytes.Equal(got, data) {
+		t.Fatal("the file differs from what was sent")
+	}
+}
+
+func TestReceiveToFileAborted(t *testing.T) {
+	client, server := pipeConns(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.bin")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w, err := client.Send("k")
+		if err != nil {
+			return
+		}
+		w.Write(patterned(1 << 20))
+		w.(*ConnWriter).Abort("changed my mind")
+	}()
+	if _, _, err := server.ReceiveToFile(path); err == nil {
+		t.Fatal("an aborted stream was saved")
+	}
+	if old, _ := os.ReadFile(path); string(old) != "old" {
+		t.Fatal("the existing file was replaced")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d files left in the directory, want only the old one", len(entries))
+	}
+}
+
+func TestReceiveToFileLocalFailure(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		sendAll(client, "first", patterned(100<<10))
+		sendAll(client, "second", []byte("data of second"))
+	}()
+	missing := filepath.Join(t.TempDir(), "no such dir", "out.bin")
+	if key, _, err := server.ReceiveToFile(missing); err == nil || key != "first" {
+		t.Fatalf("got %q %v, want the key and an error", key, err)
+	}
+	// the rest of "first" was dropped, the connection goes on
+	path := filepath.Join(t.TempDir(), "second.bin")
+	if key, size, err := server.ReceiveToFile(path); err != nil || key != "second" || size != 14 {
+		t.Fatalf("got %q %d %v", key, size, err)
+	}
+}
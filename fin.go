@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FIN 帧的 payload 为 [opcode][status][msglen][msg][...]，其中 msglen 为 2 字节；
+// opcode 的各个位标明 msg 之后还依次跟随哪些可选部分
+const (
+	finOpStatus   byte = 1 << iota // 携带 status 与 msg，总是置位
+	finOpTrailers                  // 跟随 trailers：2 字节个数，每项为 2 字节 key 长度 + key + 4 字节 value 长度 + value
+	finOpDigest                    // 跟随整个数据流的摘要：1 字节长度 + 摘要
+)
+
+// FinStatus 表示一个 key 的数据传输以何种状态结束
+type FinStatus uint8
+
+const (
+	StatusOK      FinStatus = iota // 数据已完整写入
+	StatusAborted                  // 发送者主动放弃了该传输
+	StatusError                    // 发送者因出错而结束了该传输
+)
+
+func (s FinStatus) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusAborted:
+		return "aborted"
+	case StatusError:
+		return "error"
+	}
+	return fmt.Sprintf("status(%d)", uint8(s))
+}
+
+// StreamError 是发送者以非 StatusOK 结束传输时，reader 在流末尾返回的错误；
+// 它包装了 io.EOF，因此 errors.Is(err, io.EOF) 成立，但 err == io.EOF 不成立；
+type StreamError struct {
+	Status  FinStatus
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	if e.Message == "" {
+		return "stream closed by peer: " + e.Status.String()
+	}
+	return fmt.Sprintf("stream closed by peer: %s: %s", e.Status, e.Message)
+}
+
+func (e *StreamError) Unwrap() error {
+	return io.EOF
+}
+
+// errInvalidFin 表示 FIN 帧的 payload 无法解析
+var errInvalidFin = errors.New("invalid fin frame")
+
+// finFrame 是 FIN 帧 payload 中的各个部分
+type finFrame struct {
+	status   FinStatus
+	msg      string
+	trailers map[string]string
+	digest   []byte // whole-stream digest computed by the writer
+}
+
+// append 将 FIN 帧的 payload 追加到 dst
+func (f *finFrame) append(dst []byte) []byte {
+	msg := f.msg
+	if len(msg) > 0xffff {
+		msg = msg[:0xffff]
+	}
+	op := finOpStatus
+	if len(f.trailers) > 0 {
+		op |= finOpTrailers
+	}
+	if f.digest != nil {
+		op |= finOpDigest
+	}
+	dst = append(dst, op, byte(f.status))
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(len(msg)))
+	dst = append(dst, msg...)
+	if op&finOpTrailers != 0 {
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(len(f.trailers)))
+		for k, v := range f.trailers {
+			dst = binary.LittleEndian.AppendUint16(dst, uint16(len(k)))
+			dst = append(dst, k...)
+			dst = binary.LittleEndian.AppendUint32(dst, uint32(len(v)))
+			dst = append(dst, v...)
+		}
+	}
+	if op&finOpDigest != 0 {
+		dst = append(dst, byte(len(f.digest)))
+		dst = append(dst, f.digest...)
+	}
+	return dst
+}
+
+// err 返回 reader 在读到该 FIN 时应当返回的错误：成功结束时为 io.EOF，否则为 *StreamError
+func (f *finFrame) err() error {
+	if f.status == StatusOK {
+		return io.EOF
+	}
+	return &StreamError{Status: f.status, Message: f.msg}
+}
+
+// parseFin 解析 FIN 帧的 payload
+func parseFin(body []byte) (*finFrame, error) {
+	if len(body) < 4 || body[0]&finOpStatus == 0 {
+		return nil, errInvalidFin
+	}
+	op := body[0]
+	f := &finFrame{status: FinStatus(body[1])}
+	msgLen := int(binary.LittleEndian.Uint16(body[2:]))
+	if len(body) < 4+msgLen {
+		return nil, errInvalidFin
+	}
+	f.msg = string(body[4 : 4+msgLen])
+	rest := body[4+msgLen:]
+	var err error
+	if op&finOpTrailers != 0 {
+		if f.trailers, rest, err = parseTrailers(rest); err != nil {
+			return nil, err
+		}
+	}
+	if op&finOpDigest != 0 {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, errInvalidFin
+		}
+		f.digest = rest[1 : 1+int(rest[0])]
+	}
+	return f, nil
+}
+
+// parseTrailers 解析 FIN 帧中的 trailers 部分，返回剩余未解析的字节
+func parseTrailers(b []byte) (map[string]string, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errInvalidFin
+	}
+	count := int(binary.LittleEndian.Uint16(b))
+	b = b[2:]
+	trailers := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		if len(b) < 2 {
+			return nil, nil, errInvalidFin
+		}
+		kLen := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+kLen+4 {
+			return nil, nil, errInvalidFin
+		}
+		k := string(b[2 : 2+kLen])
+		b = b[2+kLen:]
+		vLen := int(binary.LittleEndian.Uint32(b))
+		if len(b) < 4+vLen {
+			return nil, nil, errInvalidFin
+		}
+		trailers[k] = string(b[4 : 4+vLen])
+		b = b[4+vLen:]
+	}
+	return trailers, b, nil
+}
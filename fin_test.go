@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// closeWith 发送 data 后以 status 与 msg 结束该 key，返回接收者读到的数据与错误
+func closeWith(t *testing.T, status FinStatus, msg string, data []byte) ([]byte, error) {
+	t.Helper()
+	client, server := pipeConns(t)
+	go func() {
+		w, err := client.Send("k")
+		if err != nil {
+			return
+		}
+		w.Write(data)
+		w.(*ConnWriter).CloseWithError(status, msg)
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return io.ReadAll(r)
+}
+
+func TestCloseWithErrorStatus(t *testing.T) {
+	data, err := closeWith(t, StatusError, "disk full", []byte("partial"))
+	if string(data) != "partial" {
+		t.Fatalf("read %q before the FIN", data)
+	}
+	var se *StreamError
+	if !errors.As(err, &se) || se.Status != StatusError || se.Message != "disk full" {
+		t.Fatalf("got %v, want a StreamError with StatusError", err)
+	}
+	// still an end of stream, but not the plain one
+	if !errors.Is(err, io.EOF) || err == io.EOF {
+		t.Fatalf("got %v, want an error wrapping io.EOF", err)
+	}
+}
+
+func TestAbortStatus(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		w, err := client.Send("k")
+		if err == nil {
+			w.(*ConnWriter).Abort("user canceled")
+		}
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	var se *StreamError
+	if !errors.As(err, &se) || se.Status != StatusAborted || se.Message != "user canceled" {
+		t.Fatalf("got %v, want a StreamError with StatusAborted", err)
+	}
+}
+
+func TestCloseWithOKStatus(t *testing.T) {
+	// io.ReadAll hides io.EOF, a nil error means the plain one arrived
+	data, err := closeWith(t, StatusOK, "", []byte("whole"))
+	if err != nil || string(data) != "whole" {
+		t.Fatalf("got %q %v", data, err)
+	}
+}
+
+func TestParseFin(t *testing.T) {
+	in := &finFrame{status: StatusError, msg: "boom", trailers: map[string]string{"size": "42"}, digest: []byte{1, 2, 3}}
+	out, err := parseFin(in.append(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.status != in.status || out.msg != in.msg || out.trailers["size"] != "42" || string(out.digest) != string(in.digest) {
+		t.Fatalf("parsed %+v from %+v", out, in)
+	}
+	for _, body := range [][]byte{nil, {0, 0, 0, 0}, {finOpStatus, 1, 10, 0, 'x'}} {
+		if _, err = parseFin(body); !errors.Is(err, errInvalidFin) {
+			t.Errorf("%x: got %v, want errInvalidFin", body, err)
+		}
+	}
+}
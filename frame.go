@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// writeFrame 按 tag + 8 字节长度 + payload 的格式写出一个帧；
+// 帧的写出由 wmu 串行化，排队中的紧急消息会插在该帧之前；
+func (conn *Conn) writeFrame(tag string, payload []byte) error {
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.putFrame(tag, payload)
+}
+
+// putFrame 与 writeFrame 相同，但不会触发握手，供握手过程本身使用
+func (conn *Conn) putFrame(tag string, payload []byte) error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	buf := bytes.Buffer{}
+	buf.Grow(headerLen + checksumLen + len(payload))
+	if err := conn.appendUrgentLocked(&buf); err != nil {
+		return err
+	}
+	if err := conn.appendFrameLocked(&buf, tag, payload); err != nil {
+		return err
+	}
+	return conn.writeRaw(buf.Bytes())
+}
+
+// writeFrameBuffers 与 writeFrame 相同，但 payload 为 bufs 的拼接；未启用加密或 HMAC 时
+// 帧头与各个 buf 通过 net.Buffers 一并写出，不会拷贝 payload
+func (conn *Conn) writeFrameBuffers(tag string, bufs [][]byte) error {
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	if conn.sendKey != nil || conn.macEnabled() {
+		// sealing and the mac both need the payload in one piece
+		return conn.writeFrame(tag, bytes.Join(bufs, nil))
+	}
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	var urgent bytes.Buffer
+	if err := conn.appendUrgentLocked(&urgent); err != nil {
+		return err
+	}
+	size := 0
+	for _, b := range bufs {
+		size += len(b)
+	}
+	head := conn.appendHeader(urgent.Bytes(), tag, size)
+	head = conn.appendChecksumBuffers(head, bufs)
+	vec := make(net.Buffers, 0, len(bufs)+1)
+	vec = append(vec, head)
+	vec = append(vec, bufs...)
+	return conn.writeBuffersLocked(vec)
+}
+
+// writeBuffersLocked 将 bufs 依次完整写出，调用者需持有 wmu
+func (conn *Conn) writeBuffersLocked(bufs net.Buffers) error {
+	if conn.coalescing() {
+		return conn.bufferLocked(bufs)
+	}
+	// TCP connections write the whole vector themselves, anything else may report short writes
+	var w io.Writer = conn.n
+	if _, ok := w.(*net.TCPConn); !ok || conn.cfg.Retry != nil {
+		w = fullWriter{w: w, policy: conn.cfg.Retry}
+	}
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// writeRaw 将 b 完整写入底层连接，配置了 RetryPolicy 时重试临时错误；启用 CoalesceDelay 时先放入合并缓冲
+func (conn *Conn) writeRaw(b []byte) error {
+	if conn.coalescing() {
+		return conn.bufferLocked(net.Buffers{b})
+	}
+	return writeFull(conn.n, b, conn.cfg.Retry)
+}
+
+// writeFull 将 b 完整写入 w；io.Writer 允许返回少于 len(b) 且 err 为 nil 的写入量，
+// 此时继续写出剩余部分，直到全部写完或出错；policy 不为 nil 时按其重试临时错误
+func writeFull(w io.Writer, b []byte, policy *RetryPolicy) error {
+	attempt := 1
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		b = b[n:]
+		if err != nil {
+			if !policy.retry(attempt, err) {
+				return err
+			}
+			attempt++
+			continue
+		}
+		if n <= 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// fullWriter 让每次 Write 都通过 writeFull 完整写出
+type fullWriter struct {
+	w      io.Writer
+	policy *RetryPolicy
+}
+
+func (f fullWriter) Write(b []byte) (int, error) {
+	if err := writeFull(f.w, b, f.policy); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// appendFrameLocked 将一个完整的帧追加到 buf：启用加密时 payload 先被加密，
+// 启用校验和时帧头之后附上 CRC32C，启用 HMAC 时 payload 之后附上认证码；调用者需持有 wmu
+func (conn *Conn) appendFrameLocked(buf *bytes.Buffer, tag string, payload []byte) error {
+	if conn.upgrading {
+		return ErrUpgradeInProgress
+	}
+	payload, err := conn.sealLocked(buf, tag, payload)
+	if err != nil {
+		return err
+	}
+	buf.Write(conn.frameHeader(nil, tag, payload))
+	buf.Write(payload)
+	buf.Write(conn.appendMACLocked(nil, tag, payload))
+	return nil
+}
+
+// appendHeader 将帧头 tag + 8 字节长度追加到 dst
+func appendHeader(dst []byte, tag string, size int) []byte {
+	dst = append(dst, tag...)
+	return binary.LittleEndian.AppendUint64(dst, uint64(size))
+}
+
+// frameHeader 将 payload 对应的帧头追加到 dst，启用校验和时帧头之后还带有 CRC32C
+func (conn *Conn) frameHeader(dst []byte, tag string, payload []byte) []byte {
+	dst = conn.appendHeader(dst, tag, len(payload))
+	return conn.appendChecksum(dst, payload)
+}
+
+// appendHeader 按协商出的帧头格式将帧头追加到 dst，不含校验和；每个写出的帧都经过这里，因此在此调用 OnFrame
+func (conn *Conn) appendHeader(dst []byte, tag string, size int) []byte {
+	conn.onFrame(DirectionOut, tag, size)
+	if conn.compact {
+		return appendCompactHeader(dst, tag, size)
+	}
+	var n [lenFieldLen]byte
+	conn.byteOrder().PutUint64(n[:], uint64(size))
+	dst = append(dst, tag...)
+	return append(dst, n[:]...)
+}
+
+// byteOrder 返回经典帧头中长度字段的字节序
+func (conn *Conn) byteOrder() binary.ByteOrder {
+	if conn.cfg.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return conn.cfg.ByteOrder
+}
+
+// readPayload 读取 tag 帧帧头之后长度为 size 的 payload，启用校验和或 HMAC 时一并校验，启用加密时将其解密
+func (conn *Conn) readPayload(tag string, size uint64) ([]byte, error) {
+	if conn.readErr != nil {
+		return nil, conn.readErr
+	}
+	var sum [checksumLen]byte
+	if conn.cfg.Checksum {
+		if _, err := io.ReadFull(conn.r, sum[:]); err != nil {
+			return nil, conn.payloadError(err)
+		}
+	}
+	payload, err := readSized(conn.r, size)
+	if err != nil {
+		return nil, conn.payloadError(err)
+	}
+	if conn.cfg.Checksum {
+		if err := verifyChecksum(sum[:], payload); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.verifyMAC(tag, payload); err != nil {
+		return nil, err
+	}
+	return conn.open(tag, payload)
+}
+
+// maxPrealloc 是读取 payload 时按帧头中的长度一次分配的上限，更大的 payload 随着数据实际到达逐步扩容
+const maxPrealloc = 1 << 20
+
+// readSized 从 r 读取恰好 size 字节；帧头中的长度由对端决定，因此即使没有设置 MaxFrameSize，
+// 也不会在数据到达之前为它分配超过 maxPrealloc 的内存
+func readSized(r io.Reader, size uint64) ([]byte, error) {
+	if size <= maxPrealloc {
+		p := make([]byte, size)
+		_, err := io.ReadFull(r, p)
+		return p, err
+	}
+	if size > math.MaxInt64 {
+		return nil, ErrFrameTooLarge
+	}
+	var buf bytes.Buffer
+	buf.Grow(maxPrealloc)
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// streamable 报告长度为 size 的数据帧能否不经缓冲、分块直接读入调用者的 buf；
+// 启用校验和、HMAC 或加密时必须先读完整个帧才能校验，因此总是整帧缓冲
+func (conn *Conn) streamable(size uint64) bool {
+	chunk := conn.cfg.ReadChunkSize
+	return chunk > 0 && size > uint64(chunk) && !conn.cfg.Checksum && !conn.macEnabled() && conn.recvKey == nil
+}
+
+// unexpectedEOF 将帧中途遇到的 io.EOF 转换为 io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readFrame 读取一个 tag + 8 字节长度 + payload 格式的帧，期间遇到的控制帧会被就地处理
+func (conn *Conn) readFrame() (tag string, payload []byte, err error) {
+	if err = conn.Handshake(); err != nil {
+		return "", nil, err
+	}
+	return conn.nextFrame()
+}
+
+// nextFrame 与 readFrame 相同，但不会触发握手，供握手过程本身使用
+func (conn *Conn) nextFrame() (tag string, payload []byte, err error) {
+	for {
+		var size uint64
+		if tag, size, err = conn.readHeader(); err != nil {
+			return "", nil, err
+		}
+		if payload, err = conn.readPayload(tag, size); err != nil {
+			return "", nil, err
+		}
+		if !isControl(tag) {
+			return tag, payload, nil
+		}
+		if err = conn.handleControl(tag, payload); err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// readHeader 读取一个帧头，返回其 tag 与 payload 长度；在帧边界遇到连接关闭时返回 io.EOF，
+// 帧头读到一半时返回 io.ErrUnexpectedEOF；扩展帧与不认识的帧在这里被跳过，调用者不会看到它们
+func (conn *Conn) readHeader() (tag string, size uint64, err error) {
+	// after a fatal read error the next bytes aren't at a frame boundary
+	if conn.readErr != nil {
+		return "", 0, conn.readErr
+	}
+	for {
+		conn.endFrame()
+		if tag, size, err = conn.nextHeader(); err != nil {
+			conn.lose(err)
+			return "", 0, err
+		}
+		conn.onFrame(DirectionIn, tag, int(size))
+		if tag != WAT {
+			// the peer sent something, whatever stall we announced is over
+			conn.readEpoch.Add(1)
+		}
+		if max := conn.cfg.MaxFrameSize; max > 0 && size > uint64(max) {
+			conn.readErr = ErrFrameTooLarge
+			return "", 0, conn.readErr
+		}
+		conn.beginFrame(size)
+		if isKnown(tag) {
+			return tag, size, nil
+		}
+		if err = conn.skipUnknown(tag, size); err != nil {
+			return "", 0, err
+		}
+	}
+}
+
+// nextHeader 按协商出的帧头格式读取一个帧头，读超时返回 ErrIdleTimeout
+func (conn *Conn) nextHeader() (tag string, size uint64, err error) {
+	if conn.cfg.WriteBufferSize > 0 && conn.r.Buffered() == 0 {
+		conn.flushBeforeRead()
+	}
+	if d := conn.cfg.DeadlockTimeout; d > 0 && conn.handshaked.Load() && conn.r.Buffered() == 0 {
+		epoch := conn.readEpoch.Load()
+		stall := time.AfterFunc(d, func() {
+			conn.announceStall(epoch)
+		})
+		defer stall.Stop()
+	}
+	if conn.compact {
+		tag, size, err = conn.readCompactHeader()
+		return tag, size, idleError(err)
+	}
+	var head [headerLen]byte
+	if _, err = io.ReadFull(conn.r, head[:]); err != nil {
+		return "", 0, idleError(err)
+	}
+	return string(head[:magicLen]), conn.byteOrder().Uint64(head[magicLen:]), nil
+}
+
+// onFrame 在配置了 OnFrame 时报告一个读到或写出的帧
+func (conn *Conn) onFrame(dir Direction, tag string, size int) {
+	if conn.cfg.OnFrame == nil {
+		return
+	}
+	typ, _ := frameTypeOf(tag)
+	conn.cfg.OnFrame(dir, typ, size)
+}
+
+// isControl 判断 tag 是否为不属于任何 key 数据流的控制帧
+func isControl(tag string) bool {
+	switch tag {
+	case URG, MAN, SSB, SSE, ENC, PNG, PON, UPG, ACH, AFL, RST, ACK, WAT, OFS, TAK, NON, PRI:
+		return true
+	}
+	return false
+}
+
+// handleControl 处理一个控制帧
+func (conn *Conn) handleControl(tag string, payload []byte) error {
+	switch tag {
+	case URG:
+		if conn.cfg.OnUrgent != nil {
+			conn.cfg.OnUrgent(payload)
+		}
+	case MAN:
+		return conn.acceptManifest(payload)
+	case SSB, SSE:
+		return conn.acceptSession(tag, string(payload))
+	case ENC:
+		return conn.acceptKey(payload)
+	case PNG:
+		return conn.acceptPing(payload)
+	case PON:
+		return conn.acceptPong(payload)
+	case UPG:
+		return conn.acceptUpgrade()
+	case ACH:
+		// the peer wants credentials we were not configured with, its AFL follows
+	case AFL:
+		conn.audit(AuthFailed{Reason: string(payload), ByPeer: true})
+		return authFailed(payload)
+	case RST:
+		return conn.acceptReject(payload)
+	case ACK:
+		conn.acceptAck(string(payload))
+	case WAT:
+		return conn.acceptWait()
+	case OFS, TAK:
+		conn.acceptReply(tag, payload)
+	case PRI:
+		return conn.acceptMessage(payload)
+	case NON:
+		// only sent during the handshake, the peer uses a shared key we don't have
+		if len(payload) == 0 {
+			return errors.New("invalid nonce frame")
+		}
+		return sharedKeyMismatch(payload[0])
+	}
+	return nil
+}
+
+// expectFrame 读取一个帧并要求其 tag 为 want
+func (conn *Conn) expectFrame(want string) ([]byte, error) {
+	tag, payload, err := conn.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if tag != want {
+		return nil, fmt.Errorf("unexpected frame %q, want %q", tag, want)
+	}
+	return payload, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import "fmt"
+
+// FrameType 是帧的类型，在线路上以帧头的 4 字节 tag 表示
+type FrameType uint8
+
+const (
+	FrameData          FrameType = iota + 1 // HEAD：key 帧或数据帧
+	FrameFin                                // END0：一个 key 的数据结束
+	FrameResume                             // RSM0：带续传标记的 key 帧
+	FrameOffset                             // OFS0：续传偏移应答
+	FrameTransfer                           // TID0：带传输 ID 的 key 帧
+	FrameTransferAck                        // TAK0：传输 ID 应答
+	FrameUrgent                             // URG0：紧急消息
+	FrameManifest                           // MAN0：清单
+	FrameSessionBegin                       // SSB0：会话开始
+	FrameSessionEnd                         // SSE0：会话结束
+	FrameKey                                // ENC0：加密密钥帧
+	FramePing                               // PING：探测对端
+	FramePong                               // PONG：对 PING 的应答
+	FrameUpgrade                            // UPG0：请求升级为 TLS
+	FrameUpgradeAck                         // UPA0：对 TLS 升级请求的应答
+	FrameAuth                               // AUT0：认证令牌
+	FrameAuthOK                             // AOK0：认证通过
+	FrameAuthFailed                         // AFL0：认证失败
+	FrameReject                             // RST0：接收方拒绝了一个 key
+	FramePadded                             // PAD0：经过填充的数据帧
+	FrameCompressed                         // CMP0：压缩流的 key 帧
+	FrameHello                              // HLO0：握手时交换的 hello
+	FrameKeyExchange                        // KEX0：握手时交换的临时公钥
+	FrameKeyFinished                        // KFN0：密钥交换的 finished
+	FrameAck                                // ACK0：接收方确认已经完整读取了一个 key
+	FrameWait                               // WAIT：发送方已经等待读取超过 DeadlockTimeout
+	FrameAuthChallenge                      // ACH0：认证挑战
+	FrameNonce                              // NON0：握手时交换的随机数，用于按方向派生共享密钥
+	FramePriority                           // PRI0：高优先级消息
+)
+
+var frameTags = map[FrameType]string{
+	FrameData:          HED,
+	FrameFin:           FIN,
+	FrameResume:        RSM,
+	FrameOffset:        OFS,
+	FrameTransfer:      TID,
+	FrameTransferAck:   TAK,
+	FrameUrgent:        URG,
+	FrameManifest:      MAN,
+	FrameSessionBegin:  SSB,
+	FrameSessionEnd:    SSE,
+	FrameKey:           ENC,
+	FramePing:          PNG,
+	FramePong:          PON,
+	FrameUpgrade:       UPG,
+	FrameUpgradeAck:    UPA,
+	FrameAuth:          AUT,
+	FrameAuthOK:        AOK,
+	FrameAuthFailed:    AFL,
+	FrameReject:        RST,
+	FramePadded:        PAD,
+	FrameCompressed:    CMP,
+	FrameHello:         HLO,
+	FrameKeyExchange:   KEX,
+	FrameKeyFinished:   KFN,
+	FrameAck:           ACK,
+	FrameWait:          WAT,
+	FrameAuthChallenge: ACH,
+	FrameNonce:         NON,
+	FramePriority:      PRI,
+}
+
+var tagFrames = func() map[string]FrameType {
+	m := make(map[string]FrameType, len(frameTags))
+	for typ, tag := range frameTags {
+		m[tag] = typ
+	}
+	return m
+}()
+
+// Tag 返回该类型在线路上使用的 4 字节 tag
+func (t FrameType) Tag() string {
+	if t >= FrameExtension {
+		return extensionTag(t)
+	}
+	return frameTags[t]
+}
+
+func (t FrameType) String() string {
+	if tag := t.Tag(); tag != "" {
+		return tag
+	}
+	return fmt.Sprintf("frame(%d)", uint8(t))
+}
+
+// frameTypeOf 返回 tag 对应的帧类型，未知的 tag 返回 false
+func frameTypeOf(tag string) (FrameType, bool) {
+	if typ, ok := tagFrames[tag]; ok {
+		return typ, true
+	}
+	var n uint8
+	if _, err := fmt.Sscanf(tag, "X%03d", &n); err == nil && FrameType(n) >= FrameExtension && extensionTag(FrameType(n)) == tag {
+		return FrameType(n), true
+	}
+	return 0, false
+}
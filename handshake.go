@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// KEX 是握手时双方同时发送的 hello 帧，payload 为 [version][flags][32 字节 X25519 临时公钥][32 字节身份公钥]，
+// 身份公钥只在 flags 含 kexFlagIdentity 时出现；
+// KFN 是随后的 finished 帧，payload 为 [32 字节 HMAC][64 字节签名]，两部分分别在启用 PSK 和身份密钥时出现；
+const (
+	KEX = "KEX0"
+	KFN = "KFN0"
+)
+
+const (
+	kexVersion = 1
+
+	kexFlagPSK      byte = 1 << 0 // the handshake is authenticated by the pre-shared key
+	kexFlagIdentity byte = 1 << 1 // the hello carries an ed25519 identity key
+
+	defaultHandshakeTimeout = 10 * time.Second
+)
+
+// ErrHandshakeAuth 表示对端未能通过握手认证，可能存在中间人或双方的密钥配置不一致
+var ErrHandshakeAuth = errors.New("peer authentication failed")
+
+// Handshake 与对端协商需要双方同意的能力，并在启用 KeyExchange 时交换 X25519 临时公钥、派生出两个方向上的会话密钥；
+// 首次 Send/Receive 等读写操作会自动调用它，一般无需手动调用；
+// 握手失败后连接被关闭，之后的所有读写都返回同一个错误；连接已被 Close 时返回 ErrConnClosed；
+func (conn *Conn) Handshake() error {
+	if conn.closed.Load() {
+		return ErrConnClosed
+	}
+	if conn.handshaked.Load() {
+		return nil
+	}
+	conn.hmu.Lock()
+	defer conn.hmu.Unlock()
+	if conn.handshaked.Load() {
+		return nil
+	}
+	if conn.handshakeErr != nil {
+		return conn.handshakeErr
+	}
+	if err := conn.handshake(); err != nil {
+		conn.handshakeErr = fmt.Errorf("handshake: %w", err)
+		conn.fail(conn.handshakeErr)
+		conn.n.Close()
+		return conn.handshakeErr
+	}
+	conn.handshaked.Store(true)
+	conn.audit(ConnectionOpened{Peer: conn.Peer()})
+	return nil
+}
+
+// handshake 依次交换 hello 与密钥，然后进行令牌认证；hello 与密钥交换总是使用经典帧头，
+// 协商出的紧凑帧头从认证开始使用；调用者需持有 hmu
+func (conn *Conn) handshake() error {
+	var deadline time.Time
+	if conn.needHello() || conn.cfg.KeyExchange || conn.sharedKeyMode() != 0 || conn.needAuth() {
+		timeout := conn.cfg.HandshakeTimeout
+		if timeout <= 0 {
+			timeout = defaultHandshakeTimeout
+		}
+		// a deadline the caller set beforehand still applies, and is back in force afterwards
+		user := conn.userDeadline()
+		deadline = earlier(time.Now().Add(timeout), user)
+		conn.n.SetDeadline(deadline)
+		defer conn.n.SetDeadline(user)
+	}
+	conn.negotiated = Negotiation{Legacy: true}
+	if conn.needHello() {
+		var err error
+		if conn.negotiated, err = conn.hello(deadline); err != nil {
+			return err
+		}
+	}
+	switch {
+	case conn.cfg.KeyExchange:
+		if err := conn.keyExchange(); err != nil {
+			return err
+		}
+	case conn.sharedKeyMode() != 0:
+		if err := conn.deriveDirectionKeys(); err != nil {
+			return err
+		}
+	}
+	conn.compact = conn.negotiated.Has(CapCompactHeader)
+	return conn.authenticate()
+}
+
+// keyExchange 执行一次完整的握手，调用者需持有 hmu
+func (conn *Conn) keyExchange() error {
+	if psk := conn.cfg.PSK; psk != nil && len(psk) != pskLen {
+		return errors.New("pre-shared key must be 32 bytes")
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hello := []byte{kexVersion, 0}
+	if conn.cfg.PSK != nil {
+		hello[1] |= kexFlagPSK
+	}
+	hello = append(hello, priv.PublicKey().Bytes()...)
+	if id := conn.cfg.Identity; id != nil {
+		hello[1] |= kexFlagIdentity
+		hello = append(hello, id.Public().(ed25519.PublicKey)...)
+	}
+	peerHello, err := conn.exchange(KEX, hello)
+	if err != nil {
+		return err
+	}
+	peerPub, peerID, err := conn.parseHello(hello[1], peerHello)
+	if err != nil {
+		return err
+	}
+	shared, err := priv.ECDH(peerPub)
+	if err != nil {
+		return err
+	}
+	th := transcriptHash(hello, peerHello)
+	conn.transcript = th
+
+	finished := conn.finished(th, hello)
+	peerFinished, err := conn.exchange(KFN, finished)
+	if err != nil {
+		return err
+	}
+	if err = conn.verifyFinished(th, peerHello, peerID, peerFinished); err != nil {
+		return err
+	}
+
+	// HKDF-SHA256 with the PSK (if any) as salt, one key per direction bound to the sender's hello
+	prk := hmacSum(conn.cfg.PSK, shared)
+	conn.sendKey = hmacSum(prk, []byte("zhuozhuo session key"), th, hello, []byte{1})
+	conn.recvKey = hmacSum(prk, []byte("zhuozhuo session key"), th, peerHello, []byte{1})
+	return nil
+}
+
+// exchange 发送一个握手帧并读取对端的同类帧；双方同时发送，因此写出在另一个 goroutine 中进行，
+// 以免在没有缓冲的连接上互相阻塞
+func (conn *Conn) exchange(tag string, payload []byte) ([]byte, error) {
+	errc := conn.sendHandshake(tag, payload)
+	peer, err := conn.readHandshake(tag)
+	if err != nil {
+		return nil, err
+	}
+	if err = <-errc; err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+// sendHandshake 在另一个 goroutine 中写出一个握手帧，写出的结果通过返回的 channel 送达
+func (conn *Conn) sendHandshake(tag string, payload []byte) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		conn.wmu.Lock()
+		defer conn.wmu.Unlock()
+		var buf bytes.Buffer
+		if err := conn.appendFrameLocked(&buf, tag, payload); err != nil {
+			errc <- err
+			return
+		}
+		if err := conn.writeRaw(buf.Bytes()); err != nil {
+			errc <- err
+			return
+		}
+		// the peer answers nothing before it has seen this frame
+		errc <- conn.flushLocked()
+	}()
+	return errc
+}
+
+// errUnexpectedFrame 表示握手时对端发来的帧不是期望的握手帧
+var errUnexpectedFrame = errors.New("unexpected frame")
+
+// readHandshake 读取对端的一个握手帧并要求其 tag 为 tag
+func (conn *Conn) readHandshake(tag string) ([]byte, error) {
+	got, size, err := conn.readHeader()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if got != tag {
+		return nil, fmt.Errorf("%w %q, want %q", errUnexpectedFrame, got, tag)
+	}
+	if size > 1024 {
+		return nil, errors.New("handshake frame too large")
+	}
+	return conn.readPayload(tag, size)
+}
+
+// parseHello 解析对端的 hello，双方的版本和认证方式必须一致
+func (conn *Conn) parseHello(flags byte, hello []byte) (*ecdh.PublicKey, ed25519.PublicKey, error) {
+	if len(hello) < 2 {
+		return nil, nil, errors.New("invalid hello frame")
+	}
+	if hello[0] != kexVersion {
+		return nil, nil, fmt.Errorf("unsupported handshake version %d", hello[0])
+	}
+	if hello[1]&kexFlagPSK != flags&kexFlagPSK {
+		return nil, nil, ErrHandshakeAuth
+	}
+	want := 2 + 32
+	if hello[1]&kexFlagIdentity != 0 {
+		want += ed25519.PublicKeySize
+	}
+	if len(hello) != want {
+		return nil, nil, errors.New("invalid hello frame")
+	}
+	pub, err := ecdh.X25519().NewPublicKey(hello[2:34])
+	if err != nil {
+		return nil, nil, err
+	}
+	var id ed25519.PublicKey
+	if hello[1]&kexFlagIdentity != 0 {
+		id = ed25519.PublicKey(hello[34:])
+	}
+	if peer := conn.cfg.PeerIdentity; peer != nil && !peer.Equal(id) {
+		return nil, nil, ErrHandshakeAuth
+	}
+	return pub, id, nil
+}
+
+// finished 计算本端的 finished 帧，它证明本端持有 PSK 或身份私钥，并且双方看到的 hello 相同
+func (conn *Conn) finished(th, hello []byte) []byte {
+	var out []byte
+	if conn.cfg.PSK != nil {
+		out = append(out, hmacSum(conn.cfg.PSK, []byte("zhuozhuo kex finished"), th, hello)...)
+	}
+	if id := conn.cfg.Identity; id != nil {
+		out = append(out, ed25519.Sign(id, signedFinished(th, hello))...)
+	}
+	return out
+}
+
+// verifyFinished 校验对端的 finished 帧
+func (conn *Conn) verifyFinished(th, peerHello []byte, peerID ed25519.PublicKey, fin []byte) error {
+	want := 0
+	if conn.cfg.PSK != nil {
+		want += sha256.Size
+	}
+	if peerID != nil {
+		want += ed25519.SignatureSize
+	}
+	if len(fin) != want {
+		return ErrHandshakeAuth
+	}
+	if conn.cfg.PSK != nil {
+		mac := hmacSum(conn.cfg.PSK, []byte("zhuozhuo kex finished"), th, peerHello)
+		if !hmac.Equal(mac, fin[:sha256.Size]) {
+			return ErrHandshakeAuth
+		}
+		fin = fin[sha256.Size:]
+	}
+	if peerID != nil && !ed25519.Verify(peerID, signedFinished(th, peerHello), fin) {
+		return ErrHandshakeAuth
+	}
+	return nil
+}
+
+// transcriptHash 对双方的 hello 求摘要，两端按相同的顺序排列，因此得到相同的结果
+func transcriptHash(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha256.New()
+	h.Write([]byte("zhuozhuo kex v1"))
+	for _, hello := range [][]byte{a, b} {
+		h.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(hello))))
+		h.Write(hello)
+	}
+	return h.Sum(nil)
+}
+
+func signedFinished(th, hello []byte) []byte {
+	msg := append([]byte("zhuozhuo kex finished"), th...)
+	return append(msg, hello...)
+}
+
+func hmacSum(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// kexTamperConn 翻转第一个 KEX 帧的最后一个字节，即临时公钥的最后一个字节
+type kexTamperConn struct {
+	net.Conn
+	done bool
+}
+
+func (c *kexTamperConn) Write(p []byte) (int, error) {
+	if !c.done && bytes.HasPrefix(p, []byte(KEX)) {
+		c.done = true
+		p = bytes.Clone(p)
+		p[len(p)-1] ^= 1
+	}
+	return c.Conn.Write(p)
+}
+
+func TestKeyExchangeRoundTrip(t *testing.T) {
+	client, server := pipeConns(t, WithKeyExchange())
+	go sendAll(client, "k", []byte("secret payload"))
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "secret payload" {
+		t.Fatalf("got %q %v", data, err)
+	}
+	if !bytes.Equal(client.sendKey, server.recvKey) || !bytes.Equal(client.recvKey, server.sendKey) {
+		t.Fatal("the two sides derived different keys")
+	}
+	if bytes.Equal(client.sendKey, client.recvKey) {
+		t.Fatal("both directions use the same key")
+	}
+}
+
+func TestKeyExchangeFreshKeysPerConn(t *testing.T) {
+	psk := make([]byte, pskLen)
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		// the same long-term key on both connections
+		client, server := pipeConns(t, WithKeyExchange(), WithPSK(psk))
+		handshakeBoth(t, client, server)
+		for _, key := range [][]byte{client.sendKey, client.recvKey} {
+			if seen[string(key)] {
+				t.Fatal("a session key was reused by another connection")
+			}
+			seen[string(key)] = true
+		}
+	}
+}
+
+func TestKeyExchangeDetectsMITM(t *testing.T) {
+	_, id1, _ := ed25519.GenerateKey(rand.Reader)
+	_, id2, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		name           string
+		client, server []Option
+	}{
+		{"psk", []Option{WithPSK(testPSK)}, []Option{WithPSK(testPSK)}},
+		{"identity",
+			[]Option{WithIdentity(id1, id2.Public().(ed25519.PublicKey))},
+			[]Option{WithIdentity(id2, id1.Public().(ed25519.PublicKey))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			client := NewConn(&kexTamperConn{Conn: a}, append(tt.client, WithKeyExchange())...)
+			server := NewConn(b, append(tt.server, WithKeyExchange())...)
+			defer client.Close()
+			defer server.Close()
+			errc := make(chan error, 1)
+			go func() { errc <- client.Handshake() }()
+			if err := server.Handshake(); !errors.Is(err, ErrHandshakeAuth) {
+				t.Fatalf("server: got %v, want ErrHandshakeAuth", err)
+			}
+			if err := <-errc; err == nil {
+				t.Fatal("client completed a tampered handshake")
+			}
+		})
+	}
+}
+
+func TestKeyExchangeRejectsPlaintextPeer(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewConn(a, WithKeyExchange())
+	defer client.Close()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+	// a peer that skips the key exchange and talks in the clear
+	go b.Write(classicFrame(HED, []byte("k")))
+	if _, _, err := client.Receive(); err == nil {
+		t.Fatal("accepted a plaintext frame")
+	}
+	if _, err := client.Send("k"); err == nil {
+		t.Fatal("Send went through after a failed handshake")
+	}
+}
+
+func TestKeyExchangeTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewConn(a, WithKeyExchange(), WithHandshakeTimeout(100*time.Millisecond))
+	defer client.Close()
+	defer b.Close()
+	// the peer reads but never answers
+	go io.Copy(io.Discard, b)
+	start := time.Now()
+	if err := client.Handshake(); err == nil {
+		t.Fatal("handshake with a silent peer succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("handshake gave up after %v", d)
+	}
+}
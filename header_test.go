@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// classicFrame 按 magicLen、lenFieldLen 与 headerLen 拼出经典格式的一个帧
+func classicFrame(tag string, payload []byte) []byte {
+	frame := make([]byte, headerLen, headerLen+len(payload))
+	copy(frame[:magicLen], tag)
+	binary.LittleEndian.PutUint64(frame[magicLen:magicLen+lenFieldLen], uint64(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestClassicFrameBytes(t *testing.T) {
+	if headerLen != 12 || len(HED) != magicLen || len(FIN) != magicLen {
+		t.Fatalf("headerLen = %d, tags of %d and %d bytes", headerLen, len(HED), len(FIN))
+	}
+	a, b := net.Pipe()
+	rc := &recordingConn{Conn: a}
+	client, server := NewConn(rc, WithLegacyMode()), NewConn(b, WithLegacyMode())
+	defer client.Close()
+	defer server.Close()
+	go receiveAll(server, false)
+	if err := sendAll(client, "key", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	fin := &finFrame{status: StatusOK}
+	want := classicFrame(HED, []byte("key"))
+	want = append(want, classicFrame(HED, []byte("hello"))...)
+	want = append(want, classicFrame(FIN, fin.append(nil))...)
+	if got := rc.bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("wire bytes\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestClassicHeaderRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	conn := NewConn(b, WithLegacyMode())
+	defer conn.Close()
+	payload := bytes.Repeat([]byte{7}, 300)
+	go func() {
+		a.Write(classicFrame(HED, payload))
+		a.Close()
+	}()
+	tag, size, err := conn.readHeader()
+	if err != nil || tag != HED || size != uint64(len(payload)) {
+		t.Fatalf("got %q %d %v", tag, size, err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// HLO 是握手开始时双方同时发送的 hello 帧，payload 为 1 字节版本 + 4 字节本端支持的能力位 + 本端的 Limits；
+// 每项能力只有在双方都支持时才会启用；未启用 Legacy 时每个连接都会交换 hello
+const HLO = "HLO0"
+
+// ProtocolVersion 是本端在 hello 中声明的协议版本，双方的版本必须一致
+const ProtocolVersion = 1
+
+// Capability 是在 hello 中协商的一项可选能力
+type Capability uint32
+
+const (
+	CapCompactHeader Capability = 1 << iota // 1-byte frame type + uvarint length instead of tag + 8-byte length
+	CapGzip                                 // can inflate streams sent with CompressionGzip
+	CapZstd                                 // can inflate streams sent with CompressionZstd
+)
+
+// compactHeaderMaxLen 是紧凑帧头的最大长度：1 字节类型 + 最长 10 字节的 uvarint
+const compactHeaderMaxLen = 1 + binary.MaxVarintLen64
+
+var (
+	// ErrLegacyPeer 表示对端没有在 HelloTimeout 内发送 hello，或者发来的第一个帧不是 hello；
+	// 与这样的对端通信需要启用 WithLegacyMode
+	ErrLegacyPeer = errors.New("peer does not speak the hello handshake")
+	// ErrVersionMismatch 表示对端在 hello 中声明的协议版本与本端不同
+	ErrVersionMismatch = errors.New("protocol version mismatch")
+)
+
+// Negotiation 是握手时与对端协商的结果
+type Negotiation struct {
+	Version      int        // 双方使用的协议版本，Legacy 时为 0
+	Capabilities Capability // 双方都支持并因此启用的能力
+	Legacy       bool       // 没有交换 hello，所有可选能力都未启用
+}
+
+// Has 报告 c 是否在协商中启用
+func (n Negotiation) Has(c Capability) bool {
+	return n.Capabilities&c != 0
+}
+
+// Negotiated 返回握手时与对端协商的结果；握手完成之前返回零值
+func (conn *Conn) Negotiated() Negotiation {
+	if !conn.handshaked.Load() {
+		return Negotiation{}
+	}
+	return conn.negotiated
+}
+
+// Features 是连接在握手后实际启用的特性，便于记录日志或据此调整行为
+type Features struct {
+	Negotiation
+	CompactHeader bool             // 使用紧凑帧头
+	Gzip          bool             // 双方都能解压 CompressionGzip 压缩的数据
+	Zstd          bool             // 双方都能解压 CompressionZstd 压缩的数据
+	Priority      bool             // PriorityHigh 的 key 作为消息插在其他 key 的数据帧之间发送
+	Encryption    bool             // 帧以 AES-256-GCM 加密
+	MAC           bool             // 帧带有 HMAC 认证码
+	Checksum      bool             // 帧头之后带有 CRC32C
+	TLS           bool             // 底层连接为 TLS
+	ByteOrder     binary.ByteOrder // 经典帧头中长度字段的字节序，帧内的其他多字节整数总是 binary.LittleEndian
+}
+
+// Features 返回连接在握手后实际启用的特性；握手完成之前返回零值
+func (conn *Conn) Features() Features {
+	if !conn.handshaked.Load() {
+		return Features{}
+	}
+	// the key and mac state is fixed once the handshake is done
+	n := conn.negotiated
+	_, isTLS := conn.n.(*tls.Conn)
+	return Features{
+		Negotiation:   n,
+		CompactHeader: n.Has(CapCompactHeader),
+		Gzip:          n.Has(CapGzip),
+		Zstd:          n.Has(CapZstd),
+		Priority:      n.Has(CapPriority),
+		Encryption:    conn.sendKey != nil,
+		MAC:           conn.macEnabled(),
+		Checksum:      conn.cfg.Checksum,
+		TLS:           isTLS,
+		ByteOrder:     conn.byteOrder(),
+	}
+}
+
+// needHello 报告是否需要在握手时交换 hello，只有启用 Legacy 时才不发送
+func (conn *Conn) needHello() bool {
+	return !conn.cfg.Legacy
+}
+
+// capabilities 返回本端支持并愿意启用的能力
+func (conn *Conn) capabilities() Capability {
+	// every peer can inflate, whether it compresses its own streams is up to its config
+	caps := CapGzip | CapPriority
+	if conn.compressor(CompressionZstd) != nil {
+		caps |= CapZstd
+	}
+	if conn.cfg.CompactHeader {
+		caps |= CapCompactHeader
+	}
+	return caps
+}
+
+// hello 与对端交换 hello 帧并返回协商结果；deadline 是整个握手的截止时间，调用者需持有 hmu
+func (conn *Conn) hello(deadline time.Time) (Negotiation, error) {
+	caps := conn.capabilities()
+	payload := binary.LittleEndian.AppendUint32([]byte{ProtocolVersion}, uint32(caps))
+	payload = appendLimits(payload, conn.limits())
+	errc := conn.sendHandshake(HLO, payload)
+	if err := conn.awaitHello(deadline); err != nil {
+		return Negotiation{}, err
+	}
+	peer, err := conn.readHandshake(HLO)
+	if err != nil {
+		return Negotiation{}, err
+	}
+	if err = <-errc; err != nil {
+		return Negotiation{}, err
+	}
+	if len(peer) < 5 {
+		return Negotiation{}, errors.New("invalid hello frame")
+	}
+	if peer[0] != ProtocolVersion {
+		return Negotiation{}, fmt.Errorf("%w: peer speaks version %d, want %d", ErrVersionMismatch, peer[0], ProtocolVersion)
+	}
+	if conn.peerLimits, err = parseLimits(peer[5:]); err != nil {
+		return Negotiation{}, err
+	}
+	return Negotiation{
+		Version:      ProtocolVersion,
+		Capabilities: caps & Capability(binary.LittleEndian.Uint32(peer[1:])),
+	}, nil
+}
+
+// awaitHello 在不消费数据的前提下等待对端的第一个帧头，要求它是 hello，
+// 以免把只支持原始帧格式的对端发来的数据当作握手帧解析
+func (conn *Conn) awaitHello(deadline time.Time) error {
+	if d := conn.cfg.HelloTimeout; d > 0 {
+		conn.n.SetReadDeadline(time.Now().Add(d))
+		defer conn.n.SetReadDeadline(deadline)
+	}
+	tag, err := conn.r.Peek(magicLen)
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrLegacyPeer
+	case err != nil:
+		return unexpectedEOF(err)
+	case string(tag) != HLO:
+		return ErrLegacyPeer
+	}
+	return nil
+}
+
+// appendCompactHeader 将紧凑帧头追加到 dst：1 字节帧类型 + uvarint 编码的长度
+func appendCompactHeader(dst []byte, tag string, size int) []byte {
+	typ, _ := frameTypeOf(tag)
+	dst = append(dst, byte(typ))
+	return binary.AppendUvarint(dst, uint64(size))
+}
+
+// readCompactHeader 读取一个紧凑帧头，超过 10 字节、溢出或不是最短编码的 uvarint 会被拒绝
+func (conn *Conn) readCompactHeader() (tag string, size uint64, err error) {
+	b, err := conn.r.ReadByte()
+	if err != nil {
+		return "", 0, err
+	}
+	if tag = FrameType(b).Tag(); tag == "" {
+		// a newer peer's frame, readHeader skips or rejects it
+		tag = unknownTag(b)
+	}
+	if size, err = readMinimalUvarint(conn.r); err != nil {
+		return "", 0, unexpectedEOF(err)
+	}
+	return tag, size, nil
+}
+
+// errOverlongVarint 表示帧长度没有使用最短的 uvarint 编码
+var errOverlongVarint = errors.New("frame length varint is not minimally encoded")
+
+// readMinimalUvarint 与 binary.ReadUvarint 相同，但还拒绝以多余的 0x80 字节补长的编码，
+// 这样每个长度在线路上只有唯一的表示
+func readMinimalUvarint(r io.ByteReader) (uint64, error) {
+	var (
+		x     uint64
+		shift uint
+	)
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				return 0, errors.New("frame length varint overflows a 64-bit integer")
+			}
+			if b == 0 && i > 0 {
+				return 0, errOverlongVarint
+			}
+			return x | uint64(b)<<shift, nil
+		}
+		x |= uint64(b&0x7f) << shift
+		shift += 7
+	}
+	return 0, errors.New("frame length varint overflows a 64-bit integer")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHelloMatched(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithCompactHeader()), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	if n := client.Negotiated(); n != (Negotiation{}) {
+		t.Fatalf("Negotiated() = %+v before the handshake", n)
+	}
+	handshakeBoth(t, client, server)
+	for _, conn := range []*Conn{client, server} {
+		n := conn.Negotiated()
+		if n.Legacy || n.Version != ProtocolVersion || !n.Has(CapGzip) || !n.Has(CapPriority) {
+			t.Fatalf("Negotiated() = %+v", n)
+		}
+		// only one side asked for it
+		if n.Has(CapCompactHeader) {
+			t.Fatal("compact headers negotiated with a peer that doesn't want them")
+		}
+	}
+
+	client, server = pipeConns(t, WithCompactHeader())
+	handshakeBoth(t, client, server)
+	if !client.Negotiated().Has(CapCompactHeader) || !server.Negotiated().Has(CapCompactHeader) {
+		t.Fatal("compact headers not negotiated though both sides support them")
+	}
+}
+
+// rawHello 让没有使用 Conn 的对端 peer 读掉 conn 的 hello 并回复 frame
+func rawHello(peer net.Conn, frame []byte) {
+	go io.Copy(io.Discard, peer)
+	go peer.Write(frame)
+}
+
+func TestHelloVersionMismatch(t *testing.T) {
+	a, b := net.Pipe()
+	conn := NewConn(a)
+	defer conn.Close()
+	defer b.Close()
+	hello := binary.LittleEndian.AppendUint32([]byte{ProtocolVersion + 1}, 0)
+	rawHello(b, classicFrame(HLO, hello))
+	if err := conn.Handshake(); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("got %v, want ErrVersionMismatch", err)
+	}
+}
+
+func TestHelloLegacyPeer(t *testing.T) {
+	t.Run("data first", func(t *testing.T) {
+		a, b := net.Pipe()
+		conn := NewConn(a)
+		defer conn.Close()
+		defer b.Close()
+		rawHello(b, classicFrame(HED, []byte("k")))
+		if _, _, err := conn.Receive(); !errors.Is(err, ErrLegacyPeer) {
+			t.Fatalf("got %v, want ErrLegacyPeer", err)
+		}
+	})
+	t.Run("silent", func(t *testing.T) {
+		a, b := net.Pipe()
+		conn := NewConn(a, WithHelloTimeout(50*time.Millisecond))
+		defer conn.Close()
+		defer b.Close()
+		go io.Copy(io.Discard, b)
+		if err := conn.Handshake(); !errors.Is(err, ErrLegacyPeer) {
+			t.Fatalf("got %v, want ErrLegacyPeer", err)
+		}
+	})
+	t.Run("legacy mode", func(t *testing.T) {
+		a, b := net.Pipe()
+		conn := NewConn(a, WithLegacyMode())
+		defer conn.Close()
+		defer b.Close()
+		go b.Write(append(classicFrame(HED, []byte("k")), classicFrame(FIN, (&finFrame{}).append(nil))...))
+		key, r, err := conn.Receive()
+		if err != nil || key != "k" {
+			t.Fatalf("got %q %v", key, err)
+		}
+		io.ReadAll(r)
+		if n := conn.Negotiated(); !n.Legacy || n.Capabilities != 0 {
+			t.Fatalf("Negotiated() = %+v", n)
+		}
+	})
+}
+
+func TestFeaturesCommonSet(t *testing.T) {
+	zstd := WithCompressor(CompressionZstd, flateCompressor{})
+	tests := []struct {
+		name           string
+		client, server []Option
+		want           Features
+	}{
+		{
+			name: "defaults",
+			want: Features{Gzip: true, Priority: true},
+		},
+		{
+			// each side offers something the other lacks, only the overlap is enabled
+			name:   "subset",
+			client: []Option{WithCompactHeader(), zstd},
+			server: []Option{WithCompactHeader()},
+			want:   Features{CompactHeader: true, Gzip: true, Priority: true},
+		},
+		{
+			name:   "everything",
+			client: []Option{WithCompactHeader(), zstd, WithPSK(testPSK), WithChecksum()},
+			server: []Option{WithCompactHeader(), zstd, WithPSK(testPSK), WithChecksum()},
+			want:   Features{CompactHeader: true, Gzip: true, Zstd: true, Priority: true, Encryption: true, Checksum: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			client, server := NewConn(a, tt.client...), NewConn(b, tt.server...)
+			defer client.Close()
+			defer server.Close()
+			if f := client.Features(); f != (Features{}) {
+				t.Fatalf("Features() = %+v before the handshake", f)
+			}
+			handshakeBoth(t, client, server)
+			for _, conn := range []*Conn{client, server} {
+				got := conn.Features()
+				want := tt.want
+				want.Negotiation, want.ByteOrder = conn.Negotiated(), binary.LittleEndian
+				if got != want {
+					t.Fatalf("Features() = %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+}
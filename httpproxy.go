@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ProxyStatusError 表示 HTTP 代理没有以 200 同意 CONNECT 请求，Body 为回应 body 的开头部分
+type ProxyStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *ProxyStatusError) Error() string {
+	msg := "CONNECT refused: " + e.Status
+	if e.Body != "" {
+		msg += ": " + strconv.Quote(e.Body)
+	}
+	return msg
+}
+
+// Unwrap 在代理要求认证（407）时返回 ErrProxyAuth
+func (e *ProxyStatusError) Unwrap() error {
+	if e.StatusCode == http.StatusProxyAuthRequired {
+		return ErrProxyAuth
+	}
+	return nil
+}
+
+// target 报告该回应是否说明代理正常、只是目标地址无法连接
+func (e *ProxyStatusError) target() bool {
+	return e.StatusCode == http.StatusBadGateway || e.StatusCode == http.StatusGatewayTimeout
+}
+
+// dialHTTPProxy 连接到 HTTP 代理 proxy，并通过 CONNECT 建立到 addr 的隧道；proxy 为 https 时先以 config 与代理完成 TLS 握手，
+// proxy 中的用户信息用于 Basic 认证；代理本身出错时返回 *ProxyError，代理无法连接目标时返回 *DialError
+func dialHTTPProxy(ctx context.Context, d *net.Dialer, proxy *url.URL, config *tls.Config, addr string) (net.Conn, error) {
+	raw, err := d.DialContext(ctx, "tcp", canonicalAddr(proxy))
+	if err != nil {
+		return nil, &ProxyError{Proxy: proxy.Host, Err: err}
+	}
+	if proxy.Scheme == "https" {
+		if raw, err = tlsClient(ctx, raw, config, proxy.Hostname()); err != nil {
+			return nil, &ProxyError{Proxy: proxy.Host, Err: err}
+		}
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+proxyPassword(proxy))))
+	}
+	br, resp, err := roundTrip(ctx, raw, req)
+	if err != nil {
+		raw.Close()
+		return nil, &ProxyError{Proxy: proxy.Host, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		raw.Close()
+		serr := &ProxyStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: bodySnippet(resp)}
+		if serr.target() {
+			return nil, &DialError{Addr: addr, Err: serr}
+		}
+		return nil, &ProxyError{Proxy: proxy.Host, Err: serr}
+	}
+	return &bufferedConn{Conn: raw, r: br}, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectProxy 是只支持 CONNECT 的最小 HTTP 代理，auth 不为空时要求该 Proxy-Authorization；
+// forbidden 中的目标以 403 拒绝，无法连接的目标以 502 回应
+type connectProxy struct {
+	auth      string
+	forbidden string
+	targets   chan string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.auth != "" && r.Header.Get("Proxy-Authorization") != p.auth {
+		http.Error(w, "who are you", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Host == p.forbidden {
+		http.Error(w, "not on the allow list", http.StatusForbidden)
+		return
+	}
+	p.targets <- r.Host
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	nc, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer nc.Close()
+	rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	rw.Flush()
+	go io.Copy(upstream, rw)
+	io.Copy(nc, upstream)
+}
+
+// httpProxy 以 httptest 运行 p，useTLS 时代理本身使用 TLS；返回代理的 URL 与连接它所需的 TLS 配置
+func httpProxy(t *testing.T, p *connectProxy, useTLS bool) (*url.URL, *tls.Config) {
+	p.targets = make(chan string, 16)
+	var srv *httptest.Server
+	if useTLS {
+		srv = httptest.NewTLSServer(p)
+	} else {
+		srv = httptest.NewServer(p)
+	}
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !useTLS {
+		return u, nil
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return u, &tls.Config{RootCAs: pool}
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	target := echoServer(t)
+	tests := []struct {
+		name   string
+		useTLS bool
+		auth   bool
+	}{
+		{"http", false, false},
+		{"http with auth", false, true},
+		{"https with auth", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &connectProxy{}
+			if tt.auth {
+				p.auth = basicAuth("alice", "s3cret")
+			}
+			proxy, config := httpProxy(t, p, tt.useTLS)
+			if tt.auth {
+				proxy.User = url.UserPassword("alice", "s3cret")
+			}
+			conn, err := Dial(context.Background(), target, WithProxy(proxy), WithProxyTLS(config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := <-p.targets; got != target {
+				t.Fatalf("the proxy connected to %s, want %s", got, target)
+			}
+			go sendAll(conn, "k", []byte("through the tunnel"))
+			_, r, err := conn.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := io.ReadAll(r); string(data) != "through the tunnel" {
+				t.Fatalf("echo %q", data)
+			}
+		})
+	}
+}
+
+func TestDialHTTPProxyRefused(t *testing.T) {
+	target, refusing := echoServer(t), freeAddr(t)
+	p := &connectProxy{auth: basicAuth("alice", "s3cret"), forbidden: target}
+	proxy, _ := httpProxy(t, p, false)
+	withUser := func(user *url.Userinfo) *url.URL {
+		u := *proxy
+		u.User = user
+		return &u
+	}
+	tests := []struct {
+		name   string
+		proxy  *url.URL
+		target string
+		status int
+		body   string
+		check  func(error) bool
+	}{
+		{
+			name: "wrong password", proxy: withUser(url.UserPassword("alice", "wrong")), target: target,
+			status: http.StatusProxyAuthRequired, body: "who are you",
+			check: func(err error) bool {
+				var proxyErr *ProxyError
+				return errors.As(err, &proxyErr) && errors.Is(err, ErrProxyAuth)
+			},
+		},
+		{
+			name: "forbidden", proxy: withUser(url.UserPassword("alice", "s3cret")), target: target,
+			status: http.StatusForbidden, body: "not on the allow list",
+			check: func(err error) bool {
+				var proxyErr *ProxyError
+				return errors.As(err, &proxyErr) && !errors.Is(err, ErrProxyAuth)
+			},
+		},
+		{
+			// the proxy is fine, the target isn't
+			name: "bad gateway", proxy: withUser(url.UserPassword("alice", "s3cret")), target: refusing,
+			status: http.StatusBadGateway, body: "connection refused",
+			check: func(err error) bool {
+				var dialErr *DialError
+				return errors.As(err, &dialErr)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := Dial(context.Background(), tt.target, WithProxy(tt.proxy))
+			var statusErr *ProxyStatusError
+			if conn != nil || !errors.As(err, &statusErr) || !tt.check(err) {
+				t.Fatalf("got %v %v", conn, err)
+			}
+			if statusErr.StatusCode != tt.status || !strings.Contains(statusErr.Body, tt.body) {
+				t.Fatalf("got %d %q, want %d %q", statusErr.StatusCode, statusErr.Body, tt.status, tt.body)
+			}
+			// the status and the body both make it into the message
+			if msg := err.Error(); !strings.Contains(msg, http.StatusText(tt.status)) || !strings.Contains(msg, tt.body) {
+				t.Fatalf("error %q", msg)
+			}
+		})
+	}
+}
+
+func TestDialHTTPProxyTimeout(t *testing.T) {
+	// accepts the connection but never answers the CONNECT
+	silent, _ := silentListener(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	proxy := &url.URL{Scheme: "http", Host: silent}
+	conn, err := Dial(ctx, "127.0.0.1:1", WithProxy(proxy))
+	var proxyErr *ProxyError
+	if conn != nil || !errors.As(err, &proxyErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v %v, want a *ProxyError wrapping context.DeadlineExceeded", conn, err)
+	}
+}
+
+func TestDialHTTPSProxyUntrusted(t *testing.T) {
+	proxy, _ := httpProxy(t, &connectProxy{}, true)
+	// no RootCAs for the proxy's self-signed certificate
+	conn, err := Dial(context.Background(), "127.0.0.1:1", WithProxy(proxy))
+	var handshakeErr *TLSHandshakeError
+	if conn != nil || !errors.As(err, &handshakeErr) {
+		t.Fatalf("got %v %v, want a *TLSHandshakeError", conn, err)
+	}
+}
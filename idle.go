@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ErrIdleTimeout 表示读取帧头时超过 IdleTimeout 或读超时仍未收到完整的帧头，
+// 例如对端只发送了一部分帧头就停下；它同时满足 errors.Is(err, os.ErrDeadlineExceeded)
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ErrFrameTimeout 表示收到帧头之后超过 FrameTimeout 仍未读完该帧的 payload，例如对端发出帧头后缓慢地发送 payload；
+// 它同时满足 errors.Is(err, os.ErrDeadlineExceeded)
+var ErrFrameTimeout = errors.New("frame timeout")
+
+// idleReader 在每次读取底层连接之前把读超时推迟 timeout，但不会晚于当前帧的 FrameTimeout 与 SetDeadline 设置的截止时间；
+// 握手完成之前不生效，以免覆盖握手的超时
+type idleReader struct {
+	conn    *Conn
+	raw     net.Conn
+	timeout time.Duration
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	if r.conn.handshaked.Load() {
+		deadline := earlier(time.Now().Add(r.timeout), r.conn.frameDeadline)
+		r.conn.setReadDeadline(r.raw, earlier(deadline, r.conn.userDeadline()))
+	}
+	return r.raw.Read(p)
+}
+
+// interruptedAt 是读取被打断时设置的读超时，早于任何实际时间
+var interruptedAt = time.Unix(1, 0)
+
+// setReadDeadline 设置 raw 的读超时；读取已被 interruptReads 打断时随后再设回过去的时间，
+// 以免 IdleTimeout 或 FrameTimeout 推迟读超时而吞掉这次打断
+func (conn *Conn) setReadDeadline(raw net.Conn, t time.Time) {
+	raw.SetReadDeadline(t)
+	// checked after setting, a concurrent interruptReads either sees our deadline or we see its flag
+	if conn.interrupted.Load() {
+		raw.SetReadDeadline(interruptedAt)
+	}
+}
+
+// interruptReads 打断正在进行以及之后的读取，直到 resumeReads
+func (conn *Conn) interruptReads() {
+	conn.interrupted.Store(true)
+	conn.n.SetReadDeadline(interruptedAt)
+}
+
+// resumeReads 撤销 interruptReads
+func (conn *Conn) resumeReads() {
+	if conn.interrupted.Swap(false) {
+		conn.n.SetReadDeadline(conn.userDeadline())
+	}
+}
+
+// idleError 将读取帧头时遇到的超时转换为 ErrIdleTimeout，其余错误原样返回
+func idleError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrIdleTimeout, err)
+	}
+	return err
+}
+
+// beginFrame 在读到一个帧头后开始计算 FrameTimeout
+func (conn *Conn) beginFrame(size uint64) {
+	if conn.cfg.FrameTimeout <= 0 || size == 0 || !conn.handshaked.Load() {
+		return
+	}
+	conn.frameDeadline = time.Now().Add(conn.cfg.FrameTimeout)
+	conn.setReadDeadline(conn.n, earlier(conn.frameDeadline, conn.userDeadline()))
+}
+
+// endFrame 在开始读取下一个帧头之前取消上一个帧的 FrameTimeout，等待帧头的时间只受 IdleTimeout 约束
+func (conn *Conn) endFrame() {
+	if conn.frameDeadline.IsZero() {
+		return
+	}
+	conn.frameDeadline = time.Time{}
+	if conn.cfg.IdleTimeout <= 0 {
+		conn.setReadDeadline(conn.n, conn.userDeadline())
+	}
+}
+
+// payloadError 转换读取 payload 时遇到的错误：io.EOF 转换为 io.ErrUnexpectedEOF，
+// 超过 FrameTimeout 引起的超时转换为 ErrFrameTimeout
+func (conn *Conn) payloadError(err error) error {
+	err = unexpectedEOF(err)
+	if !conn.frameDeadline.IsZero() && errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrFrameTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPartialHeaderTimesOut(t *testing.T) {
+	const window = 100 * time.Millisecond
+	tests := []struct {
+		name string
+		opts []Option
+		set  func(*Conn)
+	}{
+		{"idle timeout", []Option{WithIdleTimeout(window)}, func(*Conn) {}},
+		{"read deadline", nil, func(c *Conn) { c.SetDeadline(time.Now().Add(window)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			server := NewConn(b, append(tt.opts, WithLegacyMode())...)
+			defer server.Close()
+			defer a.Close()
+			tt.set(server)
+			// the magic, then nothing
+			go a.Write(classicFrame(HED, nil)[:magicLen])
+			start := time.Now()
+			_, _, err := server.Receive()
+			if !errors.Is(err, ErrIdleTimeout) || !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("got %v, want ErrIdleTimeout", err)
+			}
+			if d := time.Since(start); d < window || d > 2*time.Second {
+				t.Fatalf("timed out after %v, want about %v", d, window)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutKeepsBusyConn(t *testing.T) {
+	client, server := pipeConns(t, WithIdleTimeout(100*time.Millisecond))
+	go func() {
+		// slower in total than the idle timeout, but never idle that long
+		for i := 0; i < 10; i++ {
+			sendAll(client, "k", []byte("data"))
+			time.Sleep(30 * time.Millisecond)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		_, r, err := server.Receive()
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		r.(*ConnReader).Drain()
+	}
+	if _, _, err := server.Receive(); !errors.Is(err, ErrIdleTimeout) {
+		t.Fatalf("got %v once the peer went quiet, want ErrIdleTimeout", err)
+	}
+}
+
+func TestFrameTimeout(t *testing.T) {
+	const window = 100 * time.Millisecond
+	a, b := net.Pipe()
+	server := NewConn(b, WithLegacyMode(), WithFrameTimeout(window))
+	defer server.Close()
+	defer a.Close()
+	go func() {
+		a.Write(classicFrame(HED, []byte("k")))
+		// a header promising 100 bytes, then a byte every 20ms
+		frame := classicFrame(HED, patterned(100))
+		if _, err := a.Write(frame[:headerLen]); err != nil {
+			return
+		}
+		for _, c := range frame[headerLen:] {
+			if _, err := a.Write([]byte{c}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = io.ReadAll(r)
+	if !errors.Is(err, ErrFrameTimeout) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want ErrFrameTimeout", err)
+	}
+	if d := time.Since(start); d < window/2 || d > 2*time.Second {
+		t.Fatalf("timed out after %v, want about %v", d, window)
+	}
+}
+
+func TestFrameTimeoutIgnoresIdleGaps(t *testing.T) {
+	client, server := pipeConns(t, WithFrameTimeout(50*time.Millisecond))
+	go func() {
+		for i := 0; i < 3; i++ {
+			// every payload arrives right after its header, the gaps are between frames
+			time.Sleep(150 * time.Millisecond)
+			sendAll(client, "k", patterned(1000))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		_, r, err := server.Receive()
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		if _, err = io.ReadAll(r); err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+	}
+}
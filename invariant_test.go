@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// checkInvariant 确认 Receive 的返回值要么是 (key, reader, nil)，要么是 ("", nil, err)
+func checkInvariant(t *testing.T, name, key string, r io.Reader, err error) {
+	t.Helper()
+	if err == nil && r == nil {
+		t.Fatalf("%s: key %q without a reader and without an error", name, key)
+	}
+	if err != nil && (r != nil || key != "") {
+		t.Fatalf("%s: got key %q and reader %v together with %v", name, key, r, err)
+	}
+}
+
+func TestReceiveReturnsReaderOrError(t *testing.T) {
+	fin := (&finFrame{status: StatusOK}).append(nil)
+	stream := append(classicFrame(HED, []byte("k")), classicFrame(HED, []byte("data"))...)
+	stream = append(stream, classicFrame(FIN, fin)...)
+	empty := append(classicFrame(HED, []byte("empty")), classicFrame(FIN, fin)...)
+	for _, tc := range []struct {
+		name string
+		wire []byte // written by the peer before it closes the connection
+		keys []string
+		err  error // returned by the Receive after the keys
+	}{
+		{"closed before any key", nil, nil, io.EOF},
+		{"stream then close", stream, []string{"k"}, io.EOF},
+		{"empty stream", empty, []string{"empty"}, io.EOF},
+		{"half a header", stream[:5], nil, io.ErrUnexpectedEOF},
+		{"half a key", stream[:headerLen], nil, io.ErrUnexpectedEOF},
+		{"key then half a header", append(stream, stream[:3]...), []string{"k"}, io.ErrUnexpectedEOF},
+	} {
+		a, b := net.Pipe()
+		conn := NewConn(b, WithLegacyMode())
+		go func() {
+			a.Write(tc.wire)
+			a.Close()
+		}()
+		for _, want := range tc.keys {
+			key, r, err := conn.Receive()
+			checkInvariant(t, tc.name, key, r, err)
+			if err != nil || key != want {
+				t.Fatalf("%s: got %q %v, want %q", tc.name, key, err, want)
+			}
+			if _, err = io.ReadAll(r); err != nil {
+				t.Fatalf("%s: reading %q: %v", tc.name, key, err)
+			}
+		}
+		key, r, err := conn.Receive()
+		checkInvariant(t, tc.name, key, r, err)
+		if err != tc.err {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+		conn.Close()
+	}
+}
+
+func TestReceiveEmptyStreamReader(t *testing.T) {
+	client, server := pipeConns(t)
+	go sendAll(client, "empty", nil)
+	key, r, err := server.Receive()
+	checkInvariant(t, "empty stream", key, r, err)
+	if n, err := r.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Fatalf("first read of an empty key: %d %v", n, err)
+	}
+}
+
+func TestReceiveAfterLocalClose(t *testing.T) {
+	_, server := pipeConns(t)
+	server.Close()
+	key, r, err := server.Receive()
+	checkInvariant(t, "closed", key, r, err)
+	if err != ErrConnClosed {
+		t.Fatalf("got %v, want ErrConnClosed", err)
+	}
+}
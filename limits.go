@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// ErrKeyTooLong 表示 key 超过了接收方的 MaxKeyLength
+var ErrKeyTooLong = errors.New("key exceeds peer's max key length")
+
+// ErrTooManyStreams 表示尚未 Close 与等待发送的 writer 已经达到对端的 MaxConcurrentStreams
+var ErrTooManyStreams = errors.New("too many concurrent streams")
+
+// Limits 是一端在握手时告知对端的限制，为 0 的字段表示不限制；
+// 对端据此调整自己的发送，以免发出会被本端拒绝的帧
+type Limits struct {
+	MaxFrameSize         int64 // 单个帧 payload 的最大长度，发送方会把更大的写入拆成多个帧
+	MaxKeyLength         int   // key 的最大长度，发送方 Send 更长的 key 时直接返回 ErrKeyTooLong
+	MaxConcurrentStreams int   // 发送方尚未 Close 与等待发送的 key 的最大数量
+	InitialWindow        int64 // 每个 key 的初始流控窗口
+}
+
+// PeerLimits 返回对端在握手时告知的限制；握手完成之前，或对端没有发送 hello 时返回零值
+func (conn *Conn) PeerLimits() Limits {
+	if !conn.handshaked.Load() {
+		return Limits{}
+	}
+	return conn.peerLimits
+}
+
+// limits 返回本端的限制
+func (conn *Conn) limits() Limits {
+	return Limits{
+		MaxFrameSize:         conn.cfg.MaxFrameSize,
+		MaxKeyLength:         conn.cfg.MaxKeyLength,
+		MaxConcurrentStreams: conn.cfg.MaxConcurrentStreams,
+		InitialWindow:        conn.cfg.InitialWindow,
+	}
+}
+
+// appendLimits 将 l 以 4 个 uvarint 的形式追加到 dst
+func appendLimits(dst []byte, l Limits) []byte {
+	dst = binary.AppendUvarint(dst, uint64(l.MaxFrameSize))
+	dst = binary.AppendUvarint(dst, uint64(l.MaxKeyLength))
+	dst = binary.AppendUvarint(dst, uint64(l.MaxConcurrentStreams))
+	return binary.AppendUvarint(dst, uint64(l.InitialWindow))
+}
+
+// parseLimits 解析 appendLimits 的结果，b 为空时表示对端没有告知任何限制
+func parseLimits(b []byte) (Limits, error) {
+	var v [4]uint64
+	for i := range v {
+		if len(b) == 0 {
+			break
+		}
+		n := 0
+		if v[i], n = binary.Uvarint(b); n <= 0 || v[i] > 1<<62 {
+			return Limits{}, errors.New("invalid limits in hello frame")
+		}
+		b = b[n:]
+	}
+	return Limits{
+		MaxFrameSize:         int64(v[0]),
+		MaxKeyLength:         int(v[1]),
+		MaxConcurrentStreams: int(v[2]),
+		InitialWindow:        int64(v[3]),
+	}, nil
+}
+
+// reserveStream 为一个新的 writer 占用一个名额，尚未 Close 与等待轮到自己的 writer 已达到对端的 MaxConcurrentStreams 时返回 ErrTooManyStreams；
+// 名额在 writer 结束时由 releaseStream 归还；同一时刻只有一个 key 在发送，接收方总是依次读取各个 key，因此只由发送方检查
+func (conn *Conn) reserveStream() error {
+	max := int64(conn.PeerLimits().MaxConcurrentStreams)
+	for {
+		n := conn.streams.Load()
+		if max > 0 && n >= max {
+			return ErrTooManyStreams
+		}
+		if conn.streams.CompareAndSwap(n, n+1) {
+			return nil
+		}
+	}
+}
+
+// releaseStream 归还 reserveStream 占用的名额
+func (conn *Conn) releaseStream() {
+	conn.streams.Add(-1)
+}
+
+// checkKey 检查 key 是否超过对端的 MaxKeyLength
+func (conn *Conn) checkKey(key string) error {
+	if max := conn.PeerLimits().MaxKeyLength; max > 0 && len(key) > max {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// acceptKeyLength 检查对端发来的 key 是否超过本端的 MaxKeyLength
+func (conn *Conn) acceptKeyLength(key string) error {
+	if max := conn.cfg.MaxKeyLength; max > 0 && len(key) > max {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// splitData 按对端与本端 MaxFrameSize 中较小的一个把数据 p 拆成若干段，每段写成一个数据帧后都不会超过该限制；
+// 双方都没有限制时 p 不会被拆分
+func (conn *Conn) splitData(p []byte) [][]byte {
+	chunk := conn.maxDataLen()
+	if chunk <= 0 || len(p) <= chunk {
+		return [][]byte{p}
+	}
+	out := make([][]byte, 0, (len(p)+chunk-1)/chunk)
+	for len(p) > chunk {
+		out = append(out, p[:chunk])
+		p = p[chunk:]
+	}
+	return append(out, p)
+}
+
+// maxDataLen 返回一个数据帧最多能携带的数据长度，不限制时返回 0
+func (conn *Conn) maxDataLen() int {
+	max := int(conn.PeerLimits().MaxFrameSize)
+	if own := int(conn.cfg.MaxFrameSize); own > 0 && (max <= 0 || own < max) {
+		// legacy peers can't tell us their limit, assume they share ours
+		max = own
+	}
+	if conn.prioritized() && (max <= 0 || max > priorityChunk) {
+		// frames of higher priority keys wait for at most one chunk
+		max = priorityChunk
+	}
+	if max <= 0 {
+		return 0
+	}
+	if conn.sendKey != nil {
+		max -= gcmTagLen
+	}
+	if pad := conn.cfg.Padding; pad != nil {
+		// the largest n whose padded frame still fits, assuming padding grows with the size
+		limit := max
+		max = sort.Search(limit, func(n int) bool {
+			size := padLenSize + n + 1
+			return size > limit || pad(size) > limit
+		})
+	}
+	if max <= 0 {
+		// the peer can't take any data with our framing, send minimal frames and let it complain
+		return 1
+	}
+	return max
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPeerLimitsExchanged(t *testing.T) {
+	mine := Limits{MaxFrameSize: 1 << 20, MaxKeyLength: 64, MaxConcurrentStreams: 4, InitialWindow: 1 << 16}
+	theirs := Limits{MaxFrameSize: 4096, MaxKeyLength: 0, MaxConcurrentStreams: 1}
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithLimits(mine)), NewConn(b, WithLimits(theirs))
+	defer client.Close()
+	defer server.Close()
+	if l := client.PeerLimits(); l != (Limits{}) {
+		t.Fatalf("PeerLimits() = %+v before the handshake", l)
+	}
+	handshakeBoth(t, client, server)
+	if l := client.PeerLimits(); l != theirs {
+		t.Fatalf("client sees %+v, want %+v", l, theirs)
+	}
+	if l := server.PeerLimits(); l != mine {
+		t.Fatalf("server sees %+v, want %+v", l, mine)
+	}
+}
+
+func TestSenderRespectsPeerFrameSize(t *testing.T) {
+	const limit = 1000
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"psk", []Option{WithPSK(testPSK)}},
+		{"padding", []Option{WithPadding(PadToMultiple(256))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var largest atomic.Int64
+			a, b := net.Pipe()
+			// only the receiver has a limit, the sender learns it from the hello
+			client := NewConn(a, tt.opts...)
+			server := NewConn(b, append(tt.opts, WithMaxFrameSize(limit),
+				WithFrameObserver(func(dir Direction, typ FrameType, length int) {
+					if dir == DirectionIn && int64(length) > largest.Load() {
+						largest.Store(int64(length))
+					}
+				}))...)
+			defer client.Close()
+			defer server.Close()
+			data := patterned(10 * limit)
+			go func() {
+				w, err := client.Send("k")
+				if err != nil {
+					return
+				}
+				// one write, many frames
+				w.Write(data)
+				w.(*ConnWriter).WriteBuffers(data[:limit], data[limit:2*limit])
+				w.Close()
+			}()
+			_, r, err := server.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, append(data, data[:2*limit]...)) {
+				t.Fatalf("read %d bytes, %v", len(got), err)
+			}
+			if n := largest.Load(); n > limit {
+				t.Fatalf("received a frame of %d bytes, the limit is %d", n, limit)
+			}
+		})
+	}
+}
+
+func TestSendKeyTooLong(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a), NewConn(b, WithMaxKeyLength(8))
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	// fails before anything goes out, so nobody needs to read
+	if _, err := client.Send(strings.Repeat("k", 9)); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("got %v, want ErrKeyTooLong", err)
+	}
+	go sendAll(client, strings.Repeat("k", 8), []byte("data"))
+	if key, _, err := server.Receive(); err != nil || len(key) != 8 {
+		t.Fatalf("got %q %v for a key at the limit", key, err)
+	}
+}
+
+func TestPeerMaxConcurrentStreams(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a), NewConn(b, WithLimits(Limits{MaxConcurrentStreams: 1}))
+	defer client.Close()
+	defer server.Close()
+	go receiveAll(server, false)
+	w, err := client.Send("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Send("second"); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("got %v, want ErrTooManyStreams", err)
+	}
+	w.Close()
+	if err = sendAll(client, "second", nil); err != nil {
+		t.Fatalf("Send once the first stream closed: %v", err)
+	}
+}
+
+func TestWriteSplitAtOwnMaxFrameSize(t *testing.T) {
+	const limit = 1 << 20
+	var frames, largest atomic.Int64
+	a, b := net.Pipe()
+	// no hello, so the sender can only go by its own limit
+	client := NewConn(a, WithLegacyMode(), WithMaxFrameSize(limit))
+	server := NewConn(b, WithLegacyMode(), WithMaxFrameSize(limit),
+		WithFrameObserver(func(dir Direction, typ FrameType, length int) {
+			if dir == DirectionIn && typ == FrameData {
+				frames.Add(1)
+				if int64(length) > largest.Load() {
+					largest.Store(int64(length))
+				}
+			}
+		}))
+	defer client.Close()
+	defer server.Close()
+	data := patterned(10 << 20)
+	go sendAll(client, "k", data)
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	// the key frame and ten data frames
+	if n := frames.Load(); n != 11 || largest.Load() > limit {
+		t.Fatalf("%d frames of at most %d bytes", n, largest.Load())
+	}
+}
+
+func TestMaxConcurrentStreamsReuse(t *testing.T) {
+	const limit = 3
+	a, b := net.Pipe()
+	client, server := NewConn(a), NewConn(b, WithLimits(Limits{MaxConcurrentStreams: limit}))
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	items := batchItems(limit + 2)
+	received := make(chan error, 1)
+	go func() { received <- checkBatch(server, items) }()
+
+	// one writer open, the next two wait for it
+	first, err := client.Send(items[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, limit-1)
+	for i, item := range items[1:limit] {
+		go func() { sent <- sendAll(client, item.Key, item.Data) }()
+		// queued one at a time so they get the connection in this order
+		eventually(t, "the Send to wait for its turn", func() bool { return waitingTurns(client) == i+1 })
+	}
+	if _, err = client.Send(items[limit].Key); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("stream %d: got %v, want ErrTooManyStreams", limit+1, err)
+	}
+	if _, err = first.Write(items[0].Data); err != nil {
+		t.Fatal(err)
+	}
+	if err = first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < limit; i++ {
+		if err = <-sent; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// everything drained, the slots are free again
+	for _, item := range items[limit:] {
+		if err = sendAll(client, item.Key, item.Data); err != nil {
+			t.Fatalf("Send once the streams closed: %v", err)
+		}
+	}
+	// each key arrived whole and in turn
+	if err = <-received; err != nil {
+		t.Fatal(err)
+	}
+}
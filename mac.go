@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ErrFrameMAC 表示帧的 HMAC 与其内容不符，帧可能被伪造或篡改，或者双方的密钥不一致；该错误会使连接不可再用
+var ErrFrameMAC = errors.New("frame mac mismatch")
+
+// macLen 是启用 HMAC 时紧跟在每个帧 payload 之后的认证码长度
+const macLen = sha256.Size
+
+// frameMAC 是一个方向上的帧认证状态
+type frameMAC struct {
+	mac hash.Hash
+	seq uint64 // frames authenticated so far, bound into every mac so frames can't be replayed or reordered
+}
+
+// macEnabled 报告是否为帧附加 HMAC；启用加密时 AEAD 已经认证了每个帧，不再重复计算
+func (conn *Conn) macEnabled() bool {
+	return conn.cfg.MACKey != nil && conn.cfg.PSK == nil && !conn.cfg.KeyExchange
+}
+
+// sum 计算 tag 帧的认证码并追加到 dst，认证范围为帧序号、tag、长度和 payload
+func (m *frameMAC) sum(dst []byte, tag string, payload []byte) []byte {
+	m.mac.Reset()
+	var head [8]byte
+	binary.LittleEndian.PutUint64(head[:], m.seq)
+	m.mac.Write(head[:])
+	m.mac.Write(appendHeader(nil, tag, len(payload)))
+	m.mac.Write(payload)
+	m.seq++
+	return m.mac.Sum(dst)
+}
+
+// appendMACLocked 在启用 HMAC 时将 payload 的认证码追加到 dst，调用者需持有 wmu
+func (conn *Conn) appendMACLocked(dst []byte, tag string, payload []byte) []byte {
+	if !conn.macEnabled() {
+		return dst
+	}
+	if conn.macOut == nil {
+		conn.macOut = &frameMAC{mac: hmac.New(sha256.New, conn.cfg.MACKey)}
+	}
+	return conn.macOut.sum(dst, tag, payload)
+}
+
+// rekeyMAC 在握手交换随机数之后换用按方向派生的密钥，两个方向的帧序号都从 0 重新开始
+func (conn *Conn) rekeyMAC(sendKey, recvKey []byte) {
+	conn.wmu.Lock()
+	conn.macOut = &frameMAC{mac: hmac.New(sha256.New, sendKey)}
+	conn.wmu.Unlock()
+	conn.macIn = &frameMAC{mac: hmac.New(sha256.New, recvKey)}
+}
+
+// verifyMAC 在启用 HMAC 时读取 payload 之后的认证码并校验，失败后连接不再可用
+func (conn *Conn) verifyMAC(tag string, payload []byte) error {
+	if !conn.macEnabled() {
+		return nil
+	}
+	var got [macLen]byte
+	if _, err := io.ReadFull(conn.r, got[:]); err != nil {
+		return conn.payloadError(err)
+	}
+	if conn.macIn == nil {
+		conn.macIn = &frameMAC{mac: hmac.New(sha256.New, conn.cfg.MACKey)}
+	}
+	if !hmac.Equal(conn.macIn.sum(nil, tag, payload), got[:]) {
+		conn.readErr = ErrFrameMAC
+		return conn.readErr
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var testMACKey = []byte("mac key shared by both ends")
+
+// truncateConn 在 armed 置位后丢掉下一次写出的最后一个字节并挂断
+type truncateConn struct {
+	net.Conn
+	armed atomic.Bool
+}
+
+func (c *truncateConn) Write(p []byte) (int, error) {
+	if c.armed.Load() && len(p) > 0 {
+		c.Conn.Write(p[:len(p)-1])
+		c.Conn.Close()
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func TestMACRoundTrip(t *testing.T) {
+	client, server := pipeConns(t, WithFrameMAC(testMACKey))
+	go func() {
+		sendAll(client, "a", []byte("first"))
+		sendAll(client, "b", []byte("second"))
+	}()
+	for _, want := range []string{"a", "b"} {
+		key, r, err := server.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadAll(r); err != nil || key != want {
+			t.Fatalf("got %q %v, want %q", key, err, want)
+		}
+	}
+	if !server.Features().MAC {
+		t.Fatal("Features().MAC = false")
+	}
+}
+
+func TestMACDirectionKeys(t *testing.T) {
+	client, server := pipeConns(t, WithFrameMAC(testMACKey))
+	handshakeBoth(t, client, server)
+	// all counters start over at 0 once the direction keys are in place
+	sent := client.macOut.sum(nil, HED, []byte("x"))
+	if !bytes.Equal(sent, server.macIn.sum(nil, HED, []byte("x"))) {
+		t.Fatal("the receiver derived a different key")
+	}
+	if bytes.Equal(sent, client.macIn.sum(nil, HED, []byte("x"))) {
+		t.Fatal("both directions use the same key, a reflected frame would verify")
+	}
+
+	again, other := pipeConns(t, WithFrameMAC(testMACKey))
+	handshakeBoth(t, again, other)
+	if bytes.Equal(sent, again.macOut.sum(nil, HED, []byte("x"))) {
+		t.Fatal("keys repeat across connections, frames could be replayed")
+	}
+}
+
+func TestMACKeyMismatch(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithFrameMAC(testMACKey)), NewConn(b, WithFrameMAC([]byte("another key")))
+	defer client.Close()
+	defer server.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- sendAll(client, "k", []byte("payload")) }()
+	_, _, err := server.Receive()
+	server.Close()
+	// whichever side checks a hello first hangs up on the other
+	if clientErr := <-errc; !errors.Is(err, ErrFrameMAC) && !errors.Is(clientErr, ErrFrameMAC) {
+		t.Fatalf("server: %v, client: %v, want ErrFrameMAC", err, clientErr)
+	}
+}
+
+func TestMACTamperedFrame(t *testing.T) {
+	a, b := net.Pipe()
+	tc := &tamperConn{Conn: a}
+	client, server := NewConn(tc, WithFrameMAC(testMACKey)), NewConn(b, WithFrameMAC(testMACKey))
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	tc.armed.Store(true)
+	go sendAll(client, "k", []byte("payload"))
+	if _, _, err := server.Receive(); !errors.Is(err, ErrFrameMAC) {
+		t.Fatalf("got %v, want ErrFrameMAC", err)
+	}
+}
+
+func TestMACTruncatedFrame(t *testing.T) {
+	a, b := net.Pipe()
+	tc := &truncateConn{Conn: a}
+	client, server := NewConn(tc, WithFrameMAC(testMACKey)), NewConn(b, WithFrameMAC(testMACKey))
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	tc.armed.Store(true)
+	go sendAll(client, "k", []byte("payload"))
+	if _, _, err := server.Receive(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestMACReflectedHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	conn := NewConn(a, WithLegacyMode(), WithFrameMAC(testMACKey))
+	defer conn.Close()
+	defer b.Close()
+	go io.Copy(b, b)
+	if err := conn.Handshake(); err == nil || !strings.Contains(err.Error(), "reflected") {
+		t.Fatalf("got %v, want the reflection to be detected", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MAN 是清单帧，预告接下来将要发送的 key 及其大小，仅供参考
+const MAN = "MAN0"
+
+// Entry 是清单中的一项
+type Entry struct {
+	Key  string
+	Size int64
+}
+
+// SendManifest 向对端预告接下来将要发送的 key 及其大小，便于对端预分配空间、展示进度或提前拒绝；
+// 清单仅供参考：之后仍可发送清单之外的 key，对端可通过 ConnReader.Announced 识别；
+func (conn *Conn) SendManifest(entries []Entry) error {
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(len(entries)))
+	for _, e := range entries {
+		if len(e.Key) > 0xffff {
+			return errors.New("manifest key too long")
+		}
+		payload = binary.LittleEndian.AppendUint16(payload, uint16(len(e.Key)))
+		payload = append(payload, e.Key...)
+		payload = binary.LittleEndian.AppendUint64(payload, uint64(e.Size))
+	}
+	return conn.writeFrame(MAN, payload)
+}
+
+// Manifest 返回最近一次收到的清单，尚未收到时返回 nil
+func (conn *Conn) Manifest() []Entry {
+	conn.mmu.Lock()
+	defer conn.mmu.Unlock()
+	return conn.manifest
+}
+
+// announced 判断 key 是否出现在最近一次收到的清单中
+func (conn *Conn) announced(key string) bool {
+	conn.mmu.Lock()
+	defer conn.mmu.Unlock()
+	for _, e := range conn.manifest {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptManifest 解析清单帧并记录下来，同时通知 OnManifest
+func (conn *Conn) acceptManifest(payload []byte) error {
+	if len(payload) < 4 {
+		return errors.New("invalid manifest frame")
+	}
+	count := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
+	entries := make([]Entry, 0, min(int(count), len(payload)/10))
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < 2 {
+			return errors.New("invalid manifest frame")
+		}
+		keyLen := int(binary.LittleEndian.Uint16(payload))
+		if len(payload) < 2+keyLen+8 {
+			return errors.New("invalid manifest frame")
+		}
+		entries = append(entries, Entry{
+			Key:  string(payload[2 : 2+keyLen]),
+			Size: int64(binary.LittleEndian.Uint64(payload[2+keyLen:])),
+		})
+		payload = payload[2+keyLen+8:]
+	}
+	conn.mmu.Lock()
+	conn.manifest = entries
+	conn.mmu.Unlock()
+	if conn.cfg.OnManifest != nil {
+		conn.cfg.OnManifest(entries)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestManifestThenStreams(t *testing.T) {
+	entries := []Entry{{Key: "a", Size: 5}, {Key: "b", Size: 1 << 40}}
+	notified := make(chan []Entry, 1)
+	client, server := pipeConns(t, WithManifestHandler(func(e []Entry) { notified <- e }))
+	go func() {
+		if err := client.SendManifest(entries); err != nil {
+			return
+		}
+		sendAll(client, "a", []byte("hello"))
+		// not in the manifest
+		sendAll(client, "extra", []byte("surprise"))
+	}()
+
+	key, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(server.Manifest(), entries) {
+		t.Fatalf("Manifest() = %v", server.Manifest())
+	}
+	if got := <-notified; !reflect.DeepEqual(got, entries) {
+		t.Fatalf("OnManifest got %v", got)
+	}
+	if key != "a" || !r.(*ConnReader).Announced() {
+		t.Fatalf("key %q announced %v", key, r.(*ConnReader).Announced())
+	}
+	io.ReadAll(r)
+
+	key, r, err = server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "extra" || r.(*ConnReader).Announced() {
+		t.Fatalf("key %q outside the manifest reported as announced", key)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "surprise" {
+		t.Fatalf("read %q", data)
+	}
+}
+
+func TestStreamsWithoutManifest(t *testing.T) {
+	client, server := pipeConns(t)
+	go sendAll(client, "k", []byte("data"))
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Manifest() != nil || r.(*ConnReader).Announced() {
+		t.Fatal("a manifest appeared without being sent")
+	}
+}
+
+func TestEmptyManifestReplacesPrevious(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		client.SendManifest([]Entry{{Key: "a", Size: 1}})
+		client.SendManifest(nil)
+		sendAll(client, "a", []byte("x"))
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Manifest()) != 0 || r.(*ConnReader).Announced() {
+		t.Fatalf("the newer empty manifest did not replace the old one: %v", server.Manifest())
+	}
+}
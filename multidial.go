@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// defaultStagger 是 MultiDialer 开始下一次尝试之前等待的默认时间，与 RFC 8305 的建议相同
+const defaultStagger = 250 * time.Millisecond
+
+// MultiDialer 在多个地址之间交错地并行拨号：每隔 Stagger 或在上一次尝试失败时开始下一个地址，
+// 第一个完成协议握手的连接胜出，其余尝试被取消，已经建立的多余连接被关闭；适合同一服务发布了多个数据中心或 v4/v6 地址的情况
+type MultiDialer struct {
+	// Addrs 按优先级排列的地址
+	Addrs []string
+	// Resolve 设置后每次 Dial 时调用它取得地址，代替 Addrs
+	Resolve func(ctx context.Context) ([]string, error)
+	// Stagger 是开始下一次尝试之前等待的时间，为 0 时使用 250ms
+	Stagger time.Duration
+}
+
+// dialResult 是一次尝试的结果
+type dialResult struct {
+	conn *Conn
+	addr string
+	err  error
+}
+
+// Dial 依次尝试各个地址并返回第一个完成握手的连接及其地址；全部失败时返回包含每个地址错误的错误，
+// 其中的每一个错误都与 Dial 的错误相同；ctx 限制整个过程；
+func (d *MultiDialer) Dial(ctx context.Context, opts ...Option) (conn *Conn, addr string, err error) {
+	addrs := d.Addrs
+	if d.Resolve != nil {
+		if addrs, err = d.Resolve(ctx); err != nil {
+			return nil, "", err
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, "", errors.New("no addresses to dial")
+	}
+	stagger := d.Stagger
+	if stagger <= 0 {
+		stagger = defaultStagger
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	start := func(addr string) {
+		go func() {
+			c, err := Dial(ctx, addr, opts...)
+			results <- dialResult{conn: c, addr: addr, err: err}
+		}()
+	}
+	start(addrs[0])
+	next, running := 1, 1
+	timer := time.NewTimer(stagger)
+	defer timer.Stop()
+	var errs []error
+	for running > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				start(addrs[next])
+				next++
+				running++
+				timer.Reset(stagger)
+			}
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// the losers see the cancellation, close whatever still makes it through
+				go closeLosers(results, running)
+				return r.conn, r.addr, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) && ctx.Err() == nil {
+				// a failed attempt doesn't wait for the stagger
+				start(addrs[next])
+				next++
+				running++
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(stagger)
+			}
+		}
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// closeLosers 收集其余 n 次尝试的结果，关闭其中已经建立的连接
+func closeLosers(results <-chan dialResult, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// healthyServer 返回一个完成握手后等待 key 的服务端地址
+func healthyServer(t *testing.T) string {
+	addr, _ := serveOn(t, &Server{Handler: func(conn *Conn) { conn.Receive() }})
+	return addr
+}
+
+func TestMultiDialerFallback(t *testing.T) {
+	const stagger = 100 * time.Millisecond
+	// accepts the connection but never answers the hello
+	blackHole, accepted := silentListener(t)
+	refusing, healthy := freeAddr(t), healthyServer(t)
+	d := &MultiDialer{Addrs: []string{blackHole, refusing, healthy}, Stagger: stagger}
+	start := time.Now()
+	conn, addr, err := d.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	elapsed := time.Since(start)
+	if addr != healthy {
+		t.Fatalf("won by %s, want %s", addr, healthy)
+	}
+	// one stagger for the black hole, the refusal moves on at once
+	if elapsed > 2*stagger+100*time.Millisecond {
+		t.Fatalf("took %v with a %v stagger", elapsed, stagger)
+	}
+	if err = conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	// the attempt stuck on the black hole was given up
+	select {
+	case nc := <-accepted:
+		defer nc.Close()
+		// the hello, then the end of the connection
+		nc.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.Copy(io.Discard, nc); err != nil {
+			t.Fatalf("the black-holed attempt is still connected: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the black hole never saw a connection")
+	}
+}
+
+func TestMultiDialerAllFail(t *testing.T) {
+	d := &MultiDialer{Addrs: []string{freeAddr(t), freeAddr(t)}, Stagger: time.Hour}
+	start := time.Now()
+	conn, _, err := d.Dial(context.Background())
+	if conn != nil || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("got %v %v, want the refusals", conn, err)
+	}
+	// every failure starts the next attempt without waiting for the stagger
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("took %v", elapsed)
+	}
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) || len(err.(interface{ Unwrap() []error }).Unwrap()) != 2 {
+		t.Fatalf("got %v, want one *DialError per address", err)
+	}
+}
+
+func TestMultiDialerResolve(t *testing.T) {
+	healthy := healthyServer(t)
+	d := &MultiDialer{Addrs: []string{"ignored:1"}, Resolve: func(context.Context) ([]string, error) {
+		return []string{freeAddr(t), healthy}, nil
+	}}
+	conn, addr, err := d.Dial(context.Background())
+	if err != nil || addr != healthy {
+		t.Fatalf("got %s %v, want %s", addr, err, healthy)
+	}
+	conn.Close()
+
+	failed := errors.New("no such service")
+	d.Resolve = func(context.Context) ([]string, error) { return nil, failed }
+	if _, _, err = d.Dial(context.Background()); err != failed {
+		t.Fatalf("got %v, want the resolver's error", err)
+	}
+	d.Resolve = func(context.Context) ([]string, error) { return nil, nil }
+	if _, _, err = d.Dial(context.Background()); err == nil {
+		t.Fatal("dialed with no addresses")
+	}
+}
+
+func TestMultiDialerContext(t *testing.T) {
+	blackHole, _ := silentListener(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	d := &MultiDialer{Addrs: []string{blackHole, blackHole}, Stagger: 20 * time.Millisecond}
+	start := time.Now()
+	if _, _, err := d.Dial(ctx, WithHandshakeTimeout(time.Minute)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned %v after the deadline", elapsed)
+	}
+}
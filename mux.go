@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StreamHandler 处理对端发来的一个 key，r 为该 key 的数据；返回后 r 中未读完的数据会被丢弃
+type StreamHandler func(conn *Conn, key string, r io.Reader) error
+
+// Middleware 包装一个 StreamHandler，用于在多个 handler 之间共享的逻辑，例如统计、鉴权或限制数据大小；
+// 它可以检查 key 与 ConnReader 上的参数、以包装后的 reader 调用 next、不调用 next 直接拒绝该 key（见 Conn.Reject），
+// 或者观察 next 返回的错误
+type Middleware func(next StreamHandler) StreamHandler
+
+// ServeMux 按 key 把连接上收到的每一个 key 分派给注册的 StreamHandler；
+// 同一连接上的数据流是依次传输的，因此同一连接上的 handler 逐个运行，不同连接之间互不影响；
+//
+// 注册的模式以 / 分段，每一段可以是：
+//   - 字面量，例如 logs，只匹配相同的段；
+//   - 命名参数，例如 {host}，匹配任意非空的段，匹配到的值可通过 ConnReader.Param 取得；
+//   - glob，例如 *.gz，按 path.Match 匹配该段，* 不会跨越 /；
+//
+// 模式与 key 的段数必须相同；多个模式都能匹配时，从左往右比较第一个不同的段，
+// 字面量优先于含有字面字符的 glob（字面字符多者优先），其次是命名参数，最后是只有通配符的 glob（如 *）；
+// 仍然无法区分时先注册的模式优先；
+//
+// 通过 Use 添加的 middleware 包装每一次分派，包括 NotFound；
+type ServeMux struct {
+	// NotFound 处理没有注册 handler 的 key，为 nil 时拒绝该 key：发送者之后的写入会得到 *RejectedError；
+	// 只想丢弃其数据而不告知发送者时，可设置为一个直接返回 nil 的 handler
+	NotFound StreamHandler
+
+	mu       sync.RWMutex
+	handlers map[string]StreamHandler // patterns without parameters or globs
+	routes   []*route                 // the other patterns, most specific first
+	shapes   map[string]string        // shape -> pattern, to catch conflicting registrations
+	chain    []Middleware
+}
+
+// NewServeMux 创建一个空的 ServeMux
+func NewServeMux() *ServeMux {
+	return &ServeMux{handlers: map[string]StreamHandler{}}
+}
+
+// Handle 为 pattern 注册 handler；pattern 不合法、handler 为 nil，
+// 或者已有模式与 pattern 匹配完全相同的 key 时（例如只有参数名不同）panic
+func (m *ServeMux) Handle(pattern string, handler StreamHandler) {
+	if handler == nil {
+		panic("zhuozhuo: nil handler for pattern " + pattern)
+	}
+	segs, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("zhuozhuo: invalid pattern %q: %v", pattern, err))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handlers == nil {
+		m.handlers = map[string]StreamHandler{}
+	}
+	if m.shapes == nil {
+		m.shapes = map[string]string{}
+	}
+	shape := patternShape(segs)
+	if prev, ok := m.shapes[shape]; ok {
+		panic(fmt.Sprintf("zhuozhuo: pattern %q conflicts with %q", pattern, prev))
+	}
+	m.shapes[shape] = pattern
+	if isExact(segs) {
+		m.handlers[pattern] = handler
+		return
+	}
+	m.routes = append(m.routes, &route{pattern: pattern, segs: segs, handler: handler})
+	// stable, so equally specific patterns keep registration order
+	sort.SliceStable(m.routes, func(i, j int) bool {
+		return moreSpecific(m.routes[i].segs, m.routes[j].segs)
+	})
+}
+
+// Use 添加 middleware；先添加的在外层，即先于后添加的看到 key、后于它们看到 handler 返回的错误；
+// 对之后分派的 key 生效，包括在 Use 之前注册的模式
+func (m *ServeMux) Use(middleware ...Middleware) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chain = append(m.chain, middleware...)
+}
+
+// Handler 返回处理 key 的 handler 及其匹配的模式；没有模式匹配时返回 NotFound 对应的 handler 与空模式
+func (m *ServeMux) Handler(key string) (StreamHandler, string) {
+	h, pattern, _ := m.match(key)
+	return h, pattern
+}
+
+// match 查找处理 key 的 handler，同时返回匹配到的命名参数
+func (m *ServeMux) match(key string) (StreamHandler, string, map[string]string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if h, ok := m.handlers[key]; ok {
+		return h, key, nil
+	}
+	parts := strings.Split(key, "/")
+	for _, r := range m.routes {
+		if params, ok := r.match(parts); ok {
+			return r.handler, r.pattern, params
+		}
+	}
+	if m.NotFound != nil {
+		return m.NotFound, "", nil
+	}
+	return rejectNotFound, "", nil
+}
+
+// Serve 在 conn 上循环接收 key 并分派给对应的 handler，直到连接关闭或 ctx 被取消，返回值与 Conn.Serve 相同
+func (m *ServeMux) Serve(ctx context.Context, conn *Conn) error {
+	return conn.Serve(ctx, func(key string, r io.Reader) error {
+		h, _, params := m.match(key)
+		if cr, ok := r.(*ConnReader); ok {
+			cr.params = params
+		}
+		return m.wrap(h)(conn, key, r)
+	})
+}
+
+// wrap 用已添加的 middleware 包装 h，第一个 middleware 在最外层
+func (m *ServeMux) wrap(h StreamHandler) StreamHandler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := len(m.chain) - 1; i >= 0; i-- {
+		h = m.chain[i](h)
+	}
+	return h
+}
+
+// ServeConn 与 Serve 相同，但不可取消，出错时只记录日志；可直接用作 Server.Handler
+func (m *ServeMux) ServeConn(conn *Conn) {
+	if err := m.Serve(context.Background(), conn); err != nil {
+		log.Println("serve conn error:", err)
+	}
+}
+
+// rejectNotFound 是默认的 NotFound：告知发送者该 key 没有 handler
+func rejectNotFound(conn *Conn, key string, _ io.Reader) error {
+	return conn.reject(key, fmt.Errorf("no handler for key %q", key))
+}
+
+type segmentKind int
+
+const (
+	segLiteral segmentKind = iota
+	segParam
+	segGlob
+)
+
+// segment 是模式中以 / 分隔的一段；对参数段 text 为参数名
+type segment struct {
+	kind segmentKind
+	text string
+}
+
+type route struct {
+	pattern string
+	segs    []segment
+	handler StreamHandler
+}
+
+// match 按段匹配 key，成功时返回命名参数
+func (r *route) match(parts []string) (map[string]string, bool) {
+	if len(parts) != len(r.segs) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, s := range r.segs {
+		part := parts[i]
+		switch s.kind {
+		case segLiteral:
+			if part != s.text {
+				return nil, false
+			}
+		case segParam:
+			if part == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[s.text] = part
+		case segGlob:
+			if ok, _ := path.Match(s.text, part); !ok {
+				return nil, false
+			}
+		}
+	}
+	return params, true
+}
+
+// parsePattern 将模式拆分为段并校验参数名与 glob 语法
+func parsePattern(pattern string) ([]segment, error) {
+	names := map[string]bool{}
+	var segs []segment
+	for _, part := range strings.Split(pattern, "/") {
+		switch {
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" || strings.ContainsAny(name, "{}*?[]") {
+				return nil, fmt.Errorf("bad parameter %q", part)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("duplicate parameter %q", name)
+			}
+			names[name] = true
+			segs = append(segs, segment{kind: segParam, text: name})
+		case strings.ContainsAny(part, "{}"):
+			return nil, fmt.Errorf("parameter %q must span a whole segment", part)
+		case strings.ContainsAny(part, `*?[\`):
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, err
+			}
+			segs = append(segs, segment{kind: segGlob, text: part})
+		default:
+			segs = append(segs, segment{kind: segLiteral, text: part})
+		}
+	}
+	return segs, nil
+}
+
+// isExact 报告模式是否只由字面量组成
+func isExact(segs []segment) bool {
+	for _, s := range segs {
+		if s.kind != segLiteral {
+			return false
+		}
+	}
+	return true
+}
+
+// patternShape 返回模式能匹配的 key 集合的标识：只有参数名不同的模式形状相同
+func patternShape(segs []segment) string {
+	var b strings.Builder
+	for _, s := range segs {
+		switch s.kind {
+		case segLiteral:
+			b.WriteString("L" + s.text)
+		case segParam:
+			b.WriteString("P")
+		case segGlob:
+			b.WriteString("G" + s.text)
+		}
+		b.WriteByte('/')
+	}
+	return b.String()
+}
+
+// moreSpecific 报告段数相同时 a 是否比 b 更具体：从左往右比较第一个优先级不同的段
+func moreSpecific(a, b []segment) bool {
+	if len(a) != len(b) {
+		// never both match the same key, any fixed order will do
+		return len(a) > len(b)
+	}
+	for i := range a {
+		ra, la := a[i].rank()
+		rb, lb := b[i].rank()
+		if ra != rb {
+			return ra > rb
+		}
+		if la != lb {
+			return la > lb
+		}
+	}
+	return false
+}
+
+// rank 返回段的优先级以及 glob 段中字面字符的个数
+func (s segment) rank() (rank, literal int) {
+	switch s.kind {
+	case segLiteral:
+		return 3, len(s.text)
+	case segParam:
+		return 1, 0
+	}
+	literal = globLiterals(s.text)
+	if literal > 0 {
+		return 2, literal
+	}
+	return 0, 0
+}
+
+// globLiterals 统计 glob 中必须逐字匹配的字符个数
+func globLiterals(pattern string) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '[':
+			// a character class matches one character, it isn't literal
+			for i < len(pattern) && pattern[i] != ']' {
+				if pattern[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case '\\':
+			i++
+			n++
+		default:
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// muxResult 是一次 handler 调用看到的内容
+type muxResult struct {
+	handler, key, data string
+}
+
+// serveMux 在 server 上运行 m.Serve，返回 Serve 的结果
+func serveMux(m *ServeMux, server *Conn) <-chan error {
+	served := make(chan error, 1)
+	go func() { served <- m.Serve(context.Background(), server) }()
+	return served
+}
+
+// recordingHandler 把调用记录到 results 中
+func recordingHandler(name string, results chan<- muxResult) StreamHandler {
+	return func(conn *Conn, key string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		results <- muxResult{name, key, string(data)}
+		return err
+	}
+}
+
+func TestServeMuxRouting(t *testing.T) {
+	results := make(chan muxResult, 10)
+	m := NewServeMux()
+	m.Handle("logs", recordingHandler("logs", results))
+	m.Handle("metrics", recordingHandler("metrics", results))
+	m.Handle("traces", recordingHandler("traces", results))
+	client, server := pipeConns(t)
+	served := serveMux(m, server)
+
+	sent := []muxResult{
+		{"metrics", "metrics", "cpu=3"},
+		{"logs", "logs", "started"},
+		{"metrics", "metrics", "cpu=4"},
+		{"traces", "traces", "span"},
+	}
+	for _, s := range sent {
+		if err := sendAll(client, s.key, []byte(s.data)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-results; got != s {
+			t.Fatalf("got %+v, want %+v", got, s)
+		}
+	}
+	client.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	if h, pattern := m.Handler("logs"); h == nil || pattern != "logs" {
+		t.Fatalf("Handler(logs) = %v, %q", h, pattern)
+	}
+}
+
+func TestServeMuxNotFound(t *testing.T) {
+	t.Run("rejected", func(t *testing.T) {
+		results := make(chan muxResult, 10)
+		m := NewServeMux()
+		m.Handle("known", recordingHandler("known", results))
+		if _, pattern := m.Handler("unknown"); pattern != "" {
+			t.Fatalf("Handler(unknown) matched %q", pattern)
+		}
+		client, server := pipeConns(t)
+		// reads the server's RST
+		go client.Receive()
+		serveMux(m, server)
+		w, err := client.Send("unknown")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("lost"))
+		eventually(t, "the rejection to arrive", func() bool { return client.rejection("unknown") != nil })
+		var rejected *RejectedError
+		if err = w.Close(); !errors.As(err, &rejected) {
+			t.Fatalf("got %v, want a *RejectedError", err)
+		}
+		// the next key is routed as usual
+		sendAll(client, "known", []byte("data"))
+		if got := <-results; got != (muxResult{"known", "known", "data"}) {
+			t.Fatalf("got %+v", got)
+		}
+	})
+	t.Run("custom", func(t *testing.T) {
+		results := make(chan muxResult, 10)
+		m := NewServeMux()
+		m.Handle("known", recordingHandler("known", results))
+		m.NotFound = recordingHandler("not found", results)
+		client, server := pipeConns(t)
+		serveMux(m, server)
+		for _, key := range []string{"unknown", "known", "other"} {
+			if err := sendAll(client, key, []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, want := range []muxResult{
+			{"not found", "unknown", "unknown"},
+			{"known", "known", "known"},
+			{"not found", "other", "other"},
+		} {
+			if got := <-results; got != want {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		}
+	})
+}
+
+func TestServeMuxEarlyReturn(t *testing.T) {
+	results := make(chan muxResult, 10)
+	m := NewServeMux()
+	m.Handle("peek", func(conn *Conn, key string, r io.Reader) error {
+		// one byte, then give up on the rest
+		b := make([]byte, 1)
+		io.ReadFull(r, b)
+		results <- muxResult{"peek", key, string(b)}
+		return fmt.Errorf("not interested")
+	})
+	m.Handle("next", recordingHandler("next", results))
+	client, server := pipeConns(t)
+	serveMux(m, server)
+	big := bytes.Repeat([]byte("x"), 200000)
+	go func() {
+		sendAll(client, "peek", big)
+		sendAll(client, "next", []byte("intact"))
+	}()
+	if got := <-results; got != (muxResult{"peek", "peek", "x"}) {
+		t.Fatalf("got %+v", got)
+	}
+	if got := <-results; got != (muxResult{"next", "next", "intact"}) {
+		t.Fatalf("got %+v after an early return", got)
+	}
+}
+
+func TestServeMuxHandlePanics(t *testing.T) {
+	m := NewServeMux()
+	m.Handle("dup", func(*Conn, string, io.Reader) error { return nil })
+	for name, register := range map[string]func(){
+		"nil handler": func() { m.Handle("nil", nil) },
+		"duplicate":   func() { m.Handle("dup", func(*Conn, string, io.Reader) error { return nil }) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s: Handle didn't panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+}
+
+func TestServeMuxPrecedence(t *testing.T) {
+	m := NewServeMux()
+	for _, pattern := range []string{
+		// registered least specific first, registration order mustn't matter here
+		"logs/*/*",
+		"logs/{date}/{file}",
+		"logs/{date}/*.gz",
+		"logs/{date}/host*.gz",
+		"logs/2024-05-01/host42.gz",
+		"metrics/{host}/{series}",
+		"metrics/{host}/cpu",
+		"metrics/host42/{series}",
+	} {
+		m.Handle(pattern, func(*Conn, string, io.Reader) error { return nil })
+	}
+	tests := []struct {
+		key, pattern string
+		params       map[string]string
+	}{
+		{"logs/2024-05-01/host42.gz", "logs/2024-05-01/host42.gz", nil},
+		{"logs/2024-05-02/host42.gz", "logs/{date}/host*.gz", map[string]string{"date": "2024-05-02"}},
+		{"logs/2024-05-02/web1.gz", "logs/{date}/*.gz", map[string]string{"date": "2024-05-02"}},
+		{"logs/2024-05-02/web1.txt", "logs/{date}/{file}", map[string]string{"date": "2024-05-02", "file": "web1.txt"}},
+		// a parameter never matches an empty segment
+		{"logs//web1.txt", "logs/*/*", nil},
+		// the leftmost differing segment decides
+		{"metrics/host42/cpu", "metrics/host42/{series}", map[string]string{"series": "cpu"}},
+		{"metrics/web1/cpu", "metrics/{host}/cpu", map[string]string{"host": "web1"}},
+		{"metrics/web1/mem", "metrics/{host}/{series}", map[string]string{"host": "web1", "series": "mem"}},
+		// * doesn't cross a /, and the segment counts must agree
+		{"logs/2024-05-02/a/b.gz", "", nil},
+		{"metrics/web1", "", nil},
+		{"other", "", nil},
+	}
+	for _, tt := range tests {
+		_, pattern, params := m.match(tt.key)
+		if pattern != tt.pattern || !maps.Equal(params, tt.params) {
+			t.Errorf("%s: matched %q %v, want %q %v", tt.key, pattern, params, tt.pattern, tt.params)
+		}
+	}
+}
+
+func TestServeMuxRegistrationOrder(t *testing.T) {
+	// equally specific, so the first one registered wins
+	for _, order := range [][]string{{"x/a*", "x/*b"}, {"x/*b", "x/a*"}} {
+		m := NewServeMux()
+		for _, pattern := range order {
+			m.Handle(pattern, func(*Conn, string, io.Reader) error { return nil })
+		}
+		if _, pattern := m.Handler("x/ab"); pattern != order[0] {
+			t.Fatalf("registered %q, x/ab matched %q", order, pattern)
+		}
+	}
+}
+
+func TestServeMuxInvalidPatterns(t *testing.T) {
+	m := NewServeMux()
+	m.Handle("metrics/{host}/{series}", func(*Conn, string, io.Reader) error { return nil })
+	for _, pattern := range []string{
+		"metrics/{h}/{s}", // only the names differ
+		"logs/{}/x",
+		"logs/a{b}",
+		"logs/{x}/{x}",
+		"logs/[",
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Handle(%q) didn't panic", pattern)
+				}
+			}()
+			m.Handle(pattern, func(*Conn, string, io.Reader) error { return nil })
+		}()
+	}
+}
+
+func TestServeMuxParams(t *testing.T) {
+	results := make(chan map[string]string, 1)
+	m := NewServeMux()
+	m.Handle("metrics/{host}/{series}", func(conn *Conn, key string, r io.Reader) error {
+		cr := r.(*ConnReader)
+		if cr.Param("host") != cr.Params()["host"] || cr.Param("missing") != "" {
+			t.Errorf("Param and Params disagree: %v", cr.Params())
+		}
+		results <- cr.Params()
+		return nil
+	})
+	client, server := pipeConns(t)
+	serveMux(m, server)
+	sendAll(client, "metrics/host42/cpu", []byte("0.5"))
+	if got := <-results; !maps.Equal(got, map[string]string{"host": "host42", "series": "cpu"}) {
+		t.Fatalf("Params() = %v", got)
+	}
+}
+
+var errTooBig = errors.New("payload over the cap")
+
+// capReader 在读到超过 n 字节时返回 errTooBig
+type capReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *capReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.n -= n; c.n < 0 {
+		return n, errTooBig
+	}
+	return n, err
+}
+
+func TestServeMuxMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	record := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		trace = append(trace, fmt.Sprintf(format, args...))
+	}
+	done := make(chan struct{}, 10)
+	tracing := func(name string) Middleware {
+		return func(next StreamHandler) StreamHandler {
+			return func(conn *Conn, key string, r io.Reader) error {
+				record("%s> %s", name, key)
+				err := next(conn, key, r)
+				record("<%s %v", name, err)
+				return err
+			}
+		}
+	}
+	m := NewServeMux()
+	m.Handle("public/{name}", func(conn *Conn, key string, r io.Reader) error {
+		// r is the capped reader here, not the *ConnReader
+		_, err := io.ReadAll(r)
+		record("handler %s %v", key, err)
+		return err
+	})
+	m.NotFound = func(conn *Conn, key string, r io.Reader) error {
+		record("not found %s", key)
+		return nil
+	}
+	// added after Handle and still applied, the outermost first
+	m.Use(func(next StreamHandler) StreamHandler {
+		return func(conn *Conn, key string, r io.Reader) error {
+			err := tracing("outer")(next)(conn, key, r)
+			done <- struct{}{}
+			return err
+		}
+	}, tracing("auth"))
+	m.Use(func(next StreamHandler) StreamHandler {
+		return func(conn *Conn, key string, r io.Reader) error {
+			if strings.HasPrefix(key, "secret/") {
+				record("rejected %s", key)
+				return conn.Reject(key, errors.New("no secrets"))
+			}
+			return next(conn, key, r)
+		}
+	}, func(next StreamHandler) StreamHandler {
+		return func(conn *Conn, key string, r io.Reader) error {
+			return next(conn, key, &capReader{r: r, n: 100})
+		}
+	})
+
+	client, server := pipeConns(t)
+	// reads the server's RST
+	go client.Receive()
+	serveMux(m, server)
+	tests := []struct {
+		key   string
+		size  int
+		trace []string
+	}{
+		{"public/a", 10, []string{"outer> public/a", "auth> public/a", "handler public/a <nil>", "<auth <nil>", "<outer <nil>"}},
+		// the cap wraps the reader, the error comes back out through every layer
+		{"public/b", 1000, []string{"outer> public/b", "auth> public/b", "handler public/b " + errTooBig.Error(), "<auth " + errTooBig.Error(), "<outer " + errTooBig.Error()}},
+		// rejected before the handler runs
+		{"secret/c", 10, []string{"outer> secret/c", "auth> secret/c", "rejected secret/c", "<auth <nil>", "<outer <nil>"}},
+		// NotFound is wrapped like any other handler
+		{"other", 10, []string{"outer> other", "auth> other", "not found other", "<auth <nil>", "<outer <nil>"}},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		trace = nil
+		mu.Unlock()
+		w, err := client.Send(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(patterned(tt.size))
+		secret := strings.HasPrefix(tt.key, "secret/")
+		if secret {
+			// the chain returns without waiting for the end of the data
+			<-done
+			eventually(t, "the rejection to arrive", func() bool { return client.rejection(tt.key) != nil })
+		}
+		werr := w.Close()
+		if !secret {
+			<-done
+		}
+		var rejected *RejectedError
+		if secret != errors.As(werr, &rejected) {
+			t.Fatalf("%s: writer Close returned %v", tt.key, werr)
+		}
+		mu.Lock()
+		got := slices.Clone(trace)
+		mu.Unlock()
+		if !slices.Equal(got, tt.trace) {
+			t.Fatalf("%s:\n got %q\nwant %q", tt.key, got, tt.trace)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// frameEvent 是 OnFrame 的一次调用
+type frameEvent struct {
+	dir    Direction
+	typ    FrameType
+	length int
+}
+
+// frameTrace 依次记录 OnFrame 看到的帧
+type frameTrace struct {
+	mu     sync.Mutex
+	events []frameEvent
+}
+
+func (tr *frameTrace) observe(dir Direction, typ FrameType, length int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.events = append(tr.events, frameEvent{dir, typ, length})
+}
+
+// get 返回 dir 方向上除 typ 之外的帧
+func (tr *frameTrace) get(dir Direction, skip FrameType) []frameEvent {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var out []frameEvent
+	for _, e := range tr.events {
+		if e.dir == dir && e.typ != skip {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestOnFrameTrace(t *testing.T) {
+	var sent, received frameTrace
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithFrameObserver(sent.observe)), NewConn(b, WithFrameObserver(received.observe))
+	defer client.Close()
+	defer server.Close()
+	done := make(chan error, 1)
+	go func() { done <- sendAll(client, "key", []byte("hello")) }()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	fin := len((&finFrame{}).append(nil))
+	stream := []frameEvent{{0, FrameData, 3}, {0, FrameData, 5}, {0, FrameFin, fin}}
+	for _, side := range []struct {
+		trace *frameTrace
+		dir   Direction
+	}{{&sent, DirectionOut}, {&received, DirectionIn}} {
+		want := slices.Clone(stream)
+		for i := range want {
+			want[i].dir = side.dir
+		}
+		got := side.trace.get(side.dir, FrameHello)
+		if !slices.Equal(got, want) {
+			t.Fatalf("%v: got %v, want %v", side.dir, got, want)
+		}
+		// the handshake is on the wire too
+		if len(side.trace.get(side.dir, 0)) != len(got)+1 {
+			t.Fatalf("%v: no hello in the trace", side.dir)
+		}
+	}
+}
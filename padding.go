@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// PAD 是经过填充的数据帧，payload 为 4 字节数据长度 + 数据 + 填充的 0；
+// 只有启用了 Padding 的接收方才接受它
+const PAD = "PAD0"
+
+// padLenSize 是填充帧中数据长度字段的长度
+const padLenSize = 4
+
+// ErrPaddingMismatch 表示收到了填充帧，但本端没有启用 Padding
+var ErrPaddingMismatch = errors.New("padded frame received but padding is not enabled")
+
+// PadToMultiple 返回一个把帧填充到 n 的整数倍的 Padding 策略
+func PadToMultiple(n int) func(size int) int {
+	return func(size int) int {
+		if n <= 1 {
+			return size
+		}
+		return (size + n - 1) / n * n
+	}
+}
+
+// PadToBuckets 返回一个把帧填充到不小于其长度的最小 bucket 的 Padding 策略，buckets 需从小到大排列；
+// 超过最大 bucket 的帧填充到最大 bucket 的整数倍
+func PadToBuckets(buckets ...int) func(size int) int {
+	return func(size int) int {
+		for _, b := range buckets {
+			if size <= b {
+				return b
+			}
+		}
+		if len(buckets) == 0 {
+			return size
+		}
+		return PadToMultiple(buckets[len(buckets)-1])(size)
+	}
+}
+
+// dataFrame 返回写出数据 p 时使用的帧：未启用 Padding 时为原样的 HED 帧，否则为填充后的 PAD 帧
+func (conn *Conn) dataFrame(p []byte) (tag string, payload []byte) {
+	if conn.cfg.Padding == nil {
+		return HED, p
+	}
+	size := padLenSize + len(p)
+	padded := conn.cfg.Padding(size)
+	if padded < size {
+		padded = size
+	}
+	payload = make([]byte, padded)
+	binary.LittleEndian.PutUint32(payload, uint32(len(p)))
+	copy(payload[padLenSize:], p)
+	return PAD, payload
+}
+
+// unpad 去掉 PAD 帧中的填充，返回其中的数据
+func (conn *Conn) unpad(payload []byte) ([]byte, error) {
+	if conn.cfg.Padding == nil {
+		return nil, ErrPaddingMismatch
+	}
+	if len(payload) < padLenSize {
+		return nil, errors.New("invalid padded frame")
+	}
+	n := binary.LittleEndian.Uint32(payload)
+	if uint64(n) > uint64(len(payload)-padLenSize) {
+		return nil, errors.New("invalid padded frame")
+	}
+	return payload[padLenSize : padLenSize+int(n)], nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestPaddingRoundTrip(t *testing.T) {
+	policies := map[string]func(int) int{
+		"multiple": PadToMultiple(1024),
+		"buckets":  PadToBuckets(256, 4096),
+	}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var padded []int
+			a, b := net.Pipe()
+			client := NewConn(a, WithPadding(policy))
+			server := NewConn(b, WithPadding(policy), WithFrameObserver(func(dir Direction, typ FrameType, length int) {
+				if dir == DirectionIn && typ == FramePadded {
+					mu.Lock()
+					padded = append(padded, length)
+					mu.Unlock()
+				}
+			}))
+			defer client.Close()
+			defer server.Close()
+			for _, size := range []int{0, 1, 252, 253, 5000} {
+				data := patterned(size)
+				go sendAll(client, "k", data)
+				_, r, err := server.Receive()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("size %d: read %d bytes, %v", size, len(got), err)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(padded) == 0 {
+				t.Fatal("no padded frames")
+			}
+			for _, n := range padded {
+				if policy(n) != n {
+					t.Fatalf("a padded frame of %d bytes, the policy pads it to %d", n, policy(n))
+				}
+			}
+		})
+	}
+}
+
+// wireSize 返回以 opts 发送 size 字节的数据时客户端写出的字节数
+func wireSize(t testing.TB, size int, opts ...Option) int {
+	t.Helper()
+	a, b := net.Pipe()
+	rc := &recordingConn{Conn: a}
+	client, server := NewConn(rc, opts...), NewConn(b, opts...)
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "k", patterned(size))
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	return len(rc.bytes())
+}
+
+func TestPaddingHidesSize(t *testing.T) {
+	pad := WithPadding(PadToMultiple(1024))
+	if small, large := wireSize(t, 10, pad), wireSize(t, 900, pad); small != large {
+		t.Fatalf("10 and 900 bytes took %d and %d bytes on the wire", small, large)
+	}
+	if small, large := wireSize(t, 10), wireSize(t, 900); small == large {
+		t.Fatal("sizes are hidden without padding")
+	}
+}
+
+func TestPaddingOnOneSide(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithPadding(PadToMultiple(64))), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "k", []byte("data"))
+	_, r, err := server.Receive()
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if !errors.Is(err, ErrPaddingMismatch) {
+		t.Fatalf("got %v, want ErrPaddingMismatch", err)
+	}
+
+	// a receiver with padding still takes plain frames
+	a, b = net.Pipe()
+	client, server = NewConn(a), NewConn(b, WithPadding(PadToMultiple(64)))
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "k", []byte("data"))
+	_, r, err = server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "data" {
+		t.Fatalf("got %q %v", data, err)
+	}
+}
+
+func TestPadToBuckets(t *testing.T) {
+	pad := PadToBuckets(100, 1000)
+	for size, want := range map[int]int{0: 100, 100: 100, 101: 1000, 1000: 1000, 1001: 2000} {
+		if got := pad(size); got != want {
+			t.Fatalf("pad(%d) = %d, want %d", size, got, want)
+		}
+	}
+}
+
+func BenchmarkPaddingOverhead(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		plain := wireSize(b, 3000)
+		padded := wireSize(b, 3000, WithPadding(PadToMultiple(4096)))
+		b.ReportMetric(float64(padded-plain)/float64(plain)*100, "%overhead")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPeekKeyThenReceive(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		sendAll(client, "first", []byte("data of first"))
+		sendAll(client, "second", []byte("data of second"))
+		client.Close()
+	}()
+	for _, want := range []string{"first", "second"} {
+		for i := 0; i < 2; i++ {
+			key, err := server.PeekKey()
+			if err != nil || key != want {
+				t.Fatalf("PeekKey #%d: got %q %v, want %q", i+1, key, err, want)
+			}
+		}
+		key, r, err := server.Receive()
+		if err != nil || key != want {
+			t.Fatalf("Receive: got %q %v, want %q", key, err, want)
+		}
+		if data, err := io.ReadAll(r); err != nil || string(data) != "data of "+want {
+			t.Fatalf("read %q %v", data, err)
+		}
+	}
+	if _, err := server.PeekKey(); err != io.EOF {
+		t.Fatalf("PeekKey at the end: got %v, want io.EOF", err)
+	}
+}
+
+func TestPeekKeyWhileReceiving(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		sendAll(client, "a", []byte("unread"))
+		sendAll(client, "b", nil)
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the next frame still belongs to "a"
+	if _, err = server.PeekKey(); !errors.Is(err, ErrConcurrentReceive) {
+		t.Fatalf("got %v, want ErrConcurrentReceive", err)
+	}
+	io.ReadAll(r)
+	if key, err := server.PeekKey(); err != nil || key != "b" {
+		t.Fatalf("got %q %v once the previous key was read", key, err)
+	}
+}
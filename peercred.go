@@ -0,0 +1,13 @@
+package main
+
+import "errors"
+
+// ErrPeerCredUnsupported 表示当前平台不支持获取 unix socket 对端的凭证
+var ErrPeerCredUnsupported = errors.New("peer credentials not supported on this platform")
+
+// PeerCred 是 unix socket 对端进程的凭证，由内核提供，对端无法伪造
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// unixPair 通过 socketpair 得到一对相连的 unix socket
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		// FileConn dups the descriptor
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+		t.Cleanup(func() { c.Close() })
+	}
+	return conns[0], conns[1]
+}
+
+func TestPeerCredentials(t *testing.T) {
+	a, _ := unixPair(t)
+	cred, err := PeerCredentials(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.UID != uint32(os.Getuid()) || cred.GID != uint32(os.Getgid()) || cred.PID != int32(os.Getpid()) {
+		t.Fatalf("got %+v, want uid %d gid %d pid %d", cred, os.Getuid(), os.Getgid(), os.Getpid())
+	}
+}
+
+func TestAuthorizeByPeerCred(t *testing.T) {
+	a, b := unixPair(t)
+	seen := make(chan *PeerCred, 1)
+	client := NewConn(a)
+	server := NewConn(b, WithAuthorizer(func(peer Identity, key string, dir Direction) error {
+		seen <- peer.Unix
+		return nil
+	}))
+	defer client.Close()
+	defer server.Close()
+	go sendAll(client, "k", []byte("data"))
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	if cred := <-seen; cred == nil || cred.UID != uint32(os.Getuid()) {
+		t.Fatalf("the authorizer saw %+v", cred)
+	}
+	if cred := server.Peer().Unix; cred == nil || cred.PID != int32(os.Getpid()) {
+		t.Fatalf("Peer().Unix = %+v", cred)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// PeerCredentials 在该平台上总是返回 ErrPeerCredUnsupported
+func PeerCredentials(c *net.UnixConn) (*PeerCred, error) {
+	return nil, ErrPeerCredUnsupported
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCredentialsUnsupported(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = PeerCredentials(c.(*net.UnixConn)); !errors.Is(err, ErrPeerCredUnsupported) {
+		t.Fatalf("got %v, want ErrPeerCredUnsupported", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// PNG 与 PON 分别是探测帧及其应答，payload 为 8 字节的探测序号
+const (
+	PNG = "PING"
+	PON = "PONG"
+)
+
+// Ping 向对端发送一个 PING 并等待其 PONG，返回往返时间；
+// PING 会在帧边界插入，因此可以在其他 goroutine 传输大量数据时调用；
+// PONG 由正在读取该连接的 goroutine（Receive 或读取数据的 reader）处理，
+// 因此调用期间需要有 goroutine 在读取该连接；
+func (conn *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	done, forget, err := conn.sendPing()
+	defer forget()
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// sendPing 写出一个 PING，返回收到对应 PONG 时关闭的 channel；调用者结束等待后需调用 forget
+func (conn *Conn) sendPing() (done <-chan struct{}, forget func(), err error) {
+	ch := make(chan struct{})
+	conn.pmu.Lock()
+	conn.pingSeq++
+	seq := conn.pingSeq
+	if conn.pings == nil {
+		conn.pings = map[uint64]chan struct{}{}
+	}
+	conn.pings[seq] = ch
+	conn.pmu.Unlock()
+	forget = func() {
+		conn.pmu.Lock()
+		delete(conn.pings, seq)
+		conn.pmu.Unlock()
+	}
+	err = conn.writeControl(FramePing, binary.LittleEndian.AppendUint64(nil, seq))
+	return ch, forget, err
+}
+
+// writeControl 在帧边界写出一个控制帧，它与数据帧一样由 wmu 串行化，不会打断正在写出的帧
+func (conn *Conn) writeControl(typ FrameType, payload []byte) error {
+	if err := conn.writeFrame(typ.Tag(), payload); err != nil {
+		return err
+	}
+	if conn.cfg.WriteBufferSize > 0 {
+		// the peer may be waiting on it with nothing else to come, don't leave it in the buffer
+		return conn.Flush()
+	}
+	return nil
+}
+
+// acceptPing 应答对端的 PING
+func (conn *Conn) acceptPing(payload []byte) error {
+	return conn.writeControl(FramePong, payload)
+}
+
+// acceptPong 唤醒等待该 PONG 的 Ping 调用
+func (conn *Conn) acceptPong(payload []byte) error {
+	if len(payload) != 8 {
+		return errors.New("invalid pong frame")
+	}
+	seq := binary.LittleEndian.Uint64(payload)
+	conn.pmu.Lock()
+	defer conn.pmu.Unlock()
+	if done, ok := conn.pings[seq]; ok {
+		close(done)
+		delete(conn.pings, seq)
+	}
+	return nil
+}
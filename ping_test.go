@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// patterned 返回 n 字节内容随位置变化的数据，错位或丢失的帧都会让比较失败
+func patterned(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7 / 3)
+	}
+	return b
+}
+
+// countingWriter 统计写入的字节数
+type countingWriter struct {
+	bytes.Buffer
+	n atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.Buffer.Write(p)
+}
+
+func TestPingDuringLargeTransfer(t *testing.T) {
+	const size = 10 << 20
+	data := patterned(size)
+	client, server := pipeConns(t)
+	// PONGs are handled by whoever reads the client side
+	go client.Receive()
+
+	received := &countingWriter{}
+	readDone := make(chan error, 1)
+	go func() {
+		_, r, err := server.Receive()
+		if err == nil {
+			_, err = io.Copy(received, r)
+		}
+		readDone <- err
+	}()
+	sendDone := make(chan error, 1)
+	go func() {
+		w, err := client.Send("big")
+		if err != nil {
+			sendDone <- err
+			return
+		}
+		for rest := data; len(rest) > 0; rest = rest[min(len(rest), 64<<10):] {
+			if _, err = w.Write(rest[:min(len(rest), 64<<10)]); err != nil {
+				sendDone <- err
+				return
+			}
+		}
+		sendDone <- w.Close()
+	}()
+
+	eventually(t, "the transfer to start", func() bool { return received.n.Load() > 0 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := received.n.Load(); n >= size {
+		t.Fatalf("the PONG only came back after all %d bytes arrived", n)
+	}
+	if err := <-sendDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-readDone; err != nil {
+		t.Fatal(err)
+	}
+	// the PING and the PONG went in between the data frames without corrupting them
+	if !bytes.Equal(received.Bytes(), data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", received.Len(), size)
+	}
+}
+
+func TestPingWithoutReader(t *testing.T) {
+	client, server := pipeConns(t)
+	go server.Receive()
+	// nobody reads the client side, so the PONG is never handled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
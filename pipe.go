@@ -0,0 +1,10 @@
+package main
+
+import "net"
+
+// Pipe 基于 net.Pipe 创建一对相连的内存 Conn，不经过网络，适合在测试中使用；
+// opts 同时作用于两端；net.Pipe 没有缓冲，一端的写入在另一端读取之前会一直阻塞；
+func Pipe(opts ...Option) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	return NewConn(a, opts...), NewConn(b, opts...)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPipePayloadSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"one read buffer", 4096},
+		{"just over a read buffer", 4097},
+		{"1MB", 1 << 20},
+		{"16MB", 16 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := Pipe()
+			defer client.Close()
+			defer server.Close()
+			data := patterned(tt.size)
+			errc := make(chan error, 1)
+			go func() { errc <- sendAll(client, "k", data) }()
+			key, r, err := server.Receive()
+			if err != nil || key != "k" {
+				t.Fatalf("got %q %v", key, err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read %d of %d bytes, %v", len(got), len(data), err)
+			}
+			if err = <-errc; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
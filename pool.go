@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultProbeTimeout 是 Pool 探测空闲连接时等待 PONG 的默认时间
+const defaultProbeTimeout = time.Second
+
+// ErrPoolClosed 表示 Pool 已经被 Close
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool 复用已经完成握手的客户端连接，省去每次传输的拨号与握手；Get 取出一个空闲连接或新建一个，用完后 Put 归还；
+// 取出的连接要么 Put、要么 Close：被 Close 或断开的连接自动让出名额；设置了 LeaseTimeout 时，既不 Put 也不 Close 的连接被视为泄漏并回收，
+// 否则它一直占用名额；
+// 归还时仍有未读完的 key 或未 Close 的 writer 的连接，以及已经断开的连接不会被复用；可以被多个 goroutine 同时使用
+type Pool struct {
+	// Dial 建立一个新连接，例如 func(ctx context.Context) (*Conn, error) { return Dial(ctx, addr) }
+	Dial func(ctx context.Context) (*Conn, error)
+	// MaxSize 限制同时存在的连接数，包括空闲的和已取出的；达到上限时 Get 等待连接被归还或关闭；为 0 时不限制
+	MaxSize int
+	// IdleTimeout 设置后空闲超过该时间的连接被关闭
+	IdleTimeout time.Duration
+	// HealthCheck 设置后空闲超过该时间的连接在交出之前先 Ping 对端，对端在 1s 内（或 ctx 结束前）没有应答时关闭它并换一个；
+	// Legacy 连接无法 Ping，只检查它是否已经断开
+	HealthCheck time.Duration
+	// LeaseTimeout 设置后，取出超过该时间、既没有 Put 也没有 Close、而且没有正在进行的读写的连接被视为泄漏：
+	// Pool 记录日志并在连接上产生 ConnectionLeaked 审计事件，然后关闭它、让出名额；仍在读写的连接推迟到下一个 LeaseTimeout 再检查
+	LeaseTimeout time.Duration
+	// Breaker 设置后 Dial 经过它调用，下游持续不可用时 Get 立即返回 ErrCircuitOpen，而不是每次都重新拨号
+	Breaker *CircuitBreaker
+
+	mu      sync.Mutex
+	conns   map[*Conn]*pooledConn // every connection that holds a slot, idle or handed out
+	idle    []*pooledConn         // idle connections, the most recently returned last
+	wake    chan struct{}         // closed and replaced whenever a slot or an idle connection frees up
+	closed  bool
+	pending int // dials in progress, they hold a slot too
+}
+
+// pooledConn 是 Pool 中的一个连接
+type pooledConn struct {
+	conn    *Conn
+	since   time.Time   // when the connection was returned, zero while it is handed out
+	evict   *time.Timer // closes the connection after IdleTimeout, nil while it is handed out
+	release func() bool // stops watching the connection's lifetime
+	leased  time.Time   // when the connection was handed out, zero while it is idle
+	lease   *time.Timer // reclaims the connection after LeaseTimeout, nil while it is idle or without LeaseTimeout
+	leaseID uint64      // bumped on every hand-out so a stale lease timer does nothing
+}
+
+// Get 返回一个空闲连接，没有空闲连接时新建一个；连接数达到 MaxSize 时等待，直到有连接被归还或关闭，或者 ctx 结束；
+// Pool 已经 Close 时返回 ErrPoolClosed
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if n := len(p.idle); n > 0 {
+			pc := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			pc.evict.Stop()
+			idleFor := time.Since(pc.since)
+			pc.since, pc.evict = time.Time{}, nil
+			p.leaseLocked(pc)
+			p.mu.Unlock()
+			if err := p.check(ctx, pc.conn, idleFor); err != nil {
+				// its lifetime watcher gives the slot back
+				pc.conn.Close()
+				continue
+			}
+			return pc.conn, nil
+		}
+		if p.MaxSize <= 0 || len(p.conns)+p.pending < p.MaxSize {
+			p.pending++
+			p.mu.Unlock()
+			return p.dial(ctx)
+		}
+		wake := p.wakeLocked()
+		p.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dial 新建一个连接并登记到 Pool 中，调用者已经为它占用了 pending 中的一个名额
+func (p *Pool) dial(ctx context.Context) (*Conn, error) {
+	if p.Dial == nil {
+		panic("zhuozhuo: Pool.Dial is nil")
+	}
+	var conn *Conn
+	var err error
+	if p.Breaker != nil {
+		err = p.Breaker.Do(func() (err error) {
+			conn, err = p.Dial(ctx)
+			return err
+		})
+	} else {
+		conn, err = p.Dial(ctx)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending--
+	if err != nil {
+		p.wakeAllLocked()
+		return nil, err
+	}
+	if p.closed {
+		p.wakeAllLocked()
+		conn.Close()
+		return nil, ErrPoolClosed
+	}
+	pc := &pooledConn{conn: conn}
+	if p.conns == nil {
+		p.conns = map[*Conn]*pooledConn{}
+	}
+	p.conns[conn] = pc
+	p.leaseLocked(pc)
+	// a connection closed by its user or lost to the network gives its slot back by itself
+	pc.release = context.AfterFunc(conn.lifetime(), func() {
+		p.forget(pc)
+	})
+	return conn, nil
+}
+
+// Put 归还从 Get 取得的连接，之后调用者不得再使用它；不能复用的连接被关闭；
+// 不是从该 Pool 取得、已经断开或 Pool 已经 Close 时，conn 同样被关闭
+func (p *Pool) Put(conn *Conn) {
+	p.mu.Lock()
+	pc := p.conns[conn]
+	if pc == nil || pc.evict != nil || p.closed || !conn.reusable() {
+		p.mu.Unlock()
+		conn.Close()
+		return
+	}
+	p.endLeaseLocked(pc)
+	pc.since = time.Now()
+	pc.evict = time.AfterFunc(p.idleTimeout(), func() {
+		p.evict(pc)
+	})
+	p.idle = append(p.idle, pc)
+	p.wakeAllLocked()
+	p.mu.Unlock()
+}
+
+// Close 关闭所有空闲连接，此后 Get 返回 ErrPoolClosed，Put 关闭归还的连接；已经取出的连接不受影响
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.wakeAllLocked()
+	p.mu.Unlock()
+	for _, pc := range idle {
+		pc.evict.Stop()
+		pc.conn.Close()
+	}
+}
+
+// Len 返回 Pool 中的连接数，包括空闲的和已取出的，以及其中空闲的连接数
+func (p *Pool) Len() (total, idle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns), len(p.idle)
+}
+
+// check 在交出一个空闲了 idleFor 的连接之前确认它仍然可用
+func (p *Pool) check(ctx context.Context, conn *Conn, idleFor time.Duration) error {
+	if err := conn.lostError(); err != nil {
+		return err
+	}
+	if p.HealthCheck <= 0 || idleFor < p.HealthCheck || conn.Negotiated().Legacy {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultProbeTimeout)
+	defer cancel()
+	return conn.probe(ctx)
+}
+
+// evict 关闭空闲超过 IdleTimeout 的连接，它已经被 Get 取走时什么都不做
+func (p *Pool) evict(pc *pooledConn) {
+	p.mu.Lock()
+	i := slices.Index(p.idle, pc)
+	if i >= 0 {
+		p.idle = slices.Delete(p.idle, i, i+1)
+	}
+	p.mu.Unlock()
+	if i >= 0 {
+		pc.conn.Close()
+	}
+}
+
+// forget 在连接被关闭或断开后让出它的名额
+func (p *Pool) forget(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[pc.conn] != pc {
+		return
+	}
+	delete(p.conns, pc.conn)
+	p.endLeaseLocked(pc)
+	if i := slices.Index(p.idle, pc); i >= 0 {
+		p.idle = slices.Delete(p.idle, i, i+1)
+		pc.evict.Stop()
+	}
+	p.wakeAllLocked()
+}
+
+// leaseLocked 记录 pc 被取出，设置了 LeaseTimeout 时开始计时，调用者需持有 mu
+func (p *Pool) leaseLocked(pc *pooledConn) {
+	pc.leased = time.Now()
+	pc.leaseID++
+	if p.LeaseTimeout > 0 {
+		id := pc.leaseID
+		pc.lease = time.AfterFunc(p.LeaseTimeout, func() {
+			p.reclaim(pc, id)
+		})
+	}
+}
+
+// endLeaseLocked 在 pc 被归还或让出名额时停止计时，调用者需持有 mu
+func (p *Pool) endLeaseLocked(pc *pooledConn) {
+	if pc.lease != nil {
+		pc.lease.Stop()
+		pc.lease = nil
+	}
+	pc.leased = time.Time{}
+	pc.leaseID++
+}
+
+// reclaim 回收取出超过 LeaseTimeout 仍未归还的连接，连接已经归还、再次取出或者仍在读写时什么都不做
+func (p *Pool) reclaim(pc *pooledConn, id uint64) {
+	p.mu.Lock()
+	if p.conns[pc.conn] != pc || pc.leaseID != id {
+		p.mu.Unlock()
+		return
+	}
+	if !pc.conn.reusable() && pc.conn.lostError() == nil && !pc.conn.closed.Load() {
+		// still in use, look again later
+		pc.lease.Reset(p.LeaseTimeout)
+		p.mu.Unlock()
+		return
+	}
+	held := time.Since(pc.leased)
+	p.endLeaseLocked(pc)
+	p.mu.Unlock()
+	log.Println(pc.conn, "pool: connection neither returned nor closed after", held, "reclaiming it")
+	pc.conn.audit(ConnectionLeaked{Held: held})
+	// its lifetime watcher gives the slot back
+	pc.conn.Close()
+}
+
+// idleTimeout 返回空闲连接被关闭之前等待的时间，没有设置 IdleTimeout 时相当于永不
+func (p *Pool) idleTimeout() time.Duration {
+	if p.IdleTimeout <= 0 {
+		return 1<<63 - 1
+	}
+	return p.IdleTimeout
+}
+
+// wakeLocked 返回下一次有名额或空闲连接可用时关闭的 channel，调用者需持有 mu
+func (p *Pool) wakeLocked() <-chan struct{} {
+	if p.wake == nil {
+		p.wake = make(chan struct{})
+	}
+	return p.wake
+}
+
+// wakeAllLocked 唤醒所有等待中的 Get，调用者需持有 mu
+func (p *Pool) wakeAllLocked() {
+	if p.wake != nil {
+		close(p.wake)
+		p.wake = nil
+	}
+}
+
+// reusable 报告连接能否交给下一个使用者：没有断开，没有正在进行的读取、未读完的 key 或未 Close 的 writer
+func (conn *Conn) reusable() bool {
+	if conn.closed.Load() || conn.lostError() != nil {
+		return false
+	}
+	if !conn.rdmu.TryLock() {
+		return false
+	}
+	busy := conn.readErr != nil || conn.active != nil && !conn.active.finished
+	conn.rdmu.Unlock()
+	conn.omu.Lock()
+	busy = busy || len(conn.writers) > 0
+	conn.omu.Unlock()
+	return !busy
+}
+
+// probe 在没有其他 goroutine 读取的空闲连接上 Ping 对端，并在等待期间自行处理读到的控制帧；
+// ctx 结束时读取被打断，连接随之不再可用；期间读到数据帧同样视为失败
+func (conn *Conn) probe(ctx context.Context) error {
+	conn.rdmu.Lock()
+	defer conn.rdmu.Unlock()
+	done, forget, err := conn.sendPing()
+	defer forget()
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.n.SetReadDeadline(interruptedAt)
+	})
+	defer stop()
+	for {
+		tag, size, err := conn.readHeader()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if !isControl(tag) {
+			return fmt.Errorf("unexpected frame %q on idle connection", tag)
+		}
+		payload, err := conn.readPayload(tag, size)
+		if err != nil {
+			return err
+		}
+		if err = conn.handleControl(tag, payload); err != nil {
+			return err
+		}
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDial 返回一个通过 net.Pipe 拨号的 Pool.Dial，对端读完收到的每一个 key
+func pipeDial(t *testing.T, opts ...Option) func(ctx context.Context) (*Conn, error) {
+	return func(ctx context.Context) (*Conn, error) {
+		a, b := net.Pipe()
+		server := NewConn(b)
+		go receiveAll(server, false)
+		t.Cleanup(func() { server.Close() })
+		return NewConn(a, opts...), nil
+	}
+}
+
+// eventually 在 1s 内反复检查 cond，直到它成立
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	p := &Pool{Dial: pipeDial(t)}
+	defer p.Close()
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sendAll(conn, "k", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	p.Put(conn)
+	again, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != conn {
+		t.Fatal("the returned connection was not reused")
+	}
+	if total, idle := p.Len(); total != 1 || idle != 0 {
+		t.Fatalf("Len() = %d, %d", total, idle)
+	}
+}
+
+func TestPoolMaxSizeBlocks(t *testing.T) {
+	p := &Pool{Dial: pipeDial(t), MaxSize: 1}
+	defer p.Close()
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = p.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want to block until the deadline", err)
+	}
+	got := make(chan *Conn, 1)
+	go func() {
+		c, _ := p.Get(context.Background())
+		got <- c
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Put(conn)
+	select {
+	case c := <-got:
+		if c != conn {
+			t.Fatal("the waiting Get did not receive the returned connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get still blocked after Put")
+	}
+}
+
+func TestPoolIdleEviction(t *testing.T) {
+	p := &Pool{Dial: pipeDial(t), IdleTimeout: 20 * time.Millisecond}
+	defer p.Close()
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(conn)
+	eventually(t, "the idle connection to be evicted", func() bool {
+		total, _ := p.Len()
+		return total == 0
+	})
+	if !conn.closed.Load() {
+		t.Fatal("the evicted connection is still open")
+	}
+}
+
+func TestPoolDiscardsBrokenConn(t *testing.T) {
+	p := &Pool{Dial: pipeDial(t)}
+	defer p.Close()
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	eventually(t, "the closed connection to give its slot back", func() bool {
+		total, _ := p.Len()
+		return total == 0
+	})
+	p.Put(conn)
+	if again, _ := p.Get(context.Background()); again == conn {
+		t.Fatal("a closed connection was handed out again")
+	}
+}
+
+func TestPoolReclaimsLeakedConn(t *testing.T) {
+	var mu sync.Mutex
+	var leaked []ConnectionLeaked
+	audit := func(conn *Conn, ev AuditEvent) {
+		if ev, ok := ev.(ConnectionLeaked); ok {
+			mu.Lock()
+			leaked = append(leaked, ev)
+			mu.Unlock()
+		}
+	}
+	p := &Pool{Dial: pipeDial(t, WithAudit(audit)), MaxSize: 1, LeaseTimeout: 30 * time.Millisecond}
+	defer p.Close()
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// never Put nor Closed, the slot comes back anyway
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	next, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == conn || !conn.closed.Load() {
+		t.Fatal("the leaked connection was not reclaimed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) != 1 || leaked[0].Held < p.LeaseTimeout {
+		t.Fatalf("audited %+v", leaked)
+	}
+}
+
+func TestPoolLeaseRenewedWhileBusy(t *testing.T) {
+	p := &Pool{Dial: pipeDial(t), LeaseTimeout: 20 * time.Millisecond}
+	defer p.Close()
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := conn.Send("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if conn.closed.Load() {
+		t.Fatal("a connection with an open writer was reclaimed")
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the idle lease to be reclaimed", conn.closed.Load)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// PRI 是高优先级消息帧，payload 为 uvarint key 长度 + key + 数据；它不属于正在传输的 key 的数据流，
+// 会在下一个帧边界插入，接收者无需读完当前的 key 就能通过 Receive 得到它
+const PRI = "PRI0"
+
+// Priority 是一个 key 的发送优先级，决定多个 key 同时等待发送时谁先得到连接
+type Priority int8
+
+const (
+	PriorityLow    Priority = -1 // bulk transfers that should yield to everything else
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1 // small latency-sensitive messages
+)
+
+// CapPriority 表示能够接收 PRI 帧，在 hello 中协商
+const CapPriority Capability = 1 << 3
+
+// MaxMessageSize 是 PriorityHigh 的 key 作为一条消息发送时数据的最大长度
+const MaxMessageSize = 64 << 10
+
+// priorityChunk 是启用优先级后一个数据帧最多携带的数据长度，消息最多等待这么多数据写完
+const priorityChunk = 64 << 10
+
+// maxQueuedMessages 是收到但尚未被 Receive 取走的消息数上限
+const maxQueuedMessages = 1024
+
+var (
+	// ErrMessageTooLarge 表示 PriorityHigh 的 key 的数据超过了 MaxMessageSize
+	ErrMessageTooLarge = errors.New("priority message too large")
+	// ErrTooManyMessages 表示对端发来的消息超过 maxQueuedMessages 条仍没有被 Receive 取走，连接不再可用
+	ErrTooManyMessages = errors.New("too many priority messages waiting to be received")
+)
+
+// priorityStrides 是每个优先级每写出一个帧后前进的步长，依次为 Low、Normal、High；
+// 同时等待时 High 得到的写出机会是 Normal 的 4 倍、Low 的 16 倍，Low 不会被饿死
+var priorityStrides = [...]uint64{16, 4, 1}
+
+// level 返回 p 在 priorityStrides 中的下标，超出范围的优先级按最近的一级处理
+func (p Priority) level() int {
+	switch {
+	case p < PriorityNormal:
+		return 0
+	case p > PriorityNormal:
+		return 2
+	}
+	return 1
+}
+
+// writeScheduler 是按优先级加权的调度器：同一时刻只有一个持有者，
+// 结束后把机会交给步长累计值最小的优先级中等待最久的一个（stride scheduling）；
+// Conn 用它决定哪个 key 先得到连接，以及正在发送的 key 与消息之间谁先写出下一个帧
+type writeScheduler struct {
+	mu     sync.Mutex
+	busy   bool               // some writer holds the turn
+	closed bool               // the connection is closed, nobody gets a turn any more
+	queues [3][]chan struct{} // writers waiting for a turn, per level in arrival order
+	pass   [3]uint64          // virtual time of each level, the smallest one goes next
+	now    uint64             // pass of the last turn handed out, levels that were idle resume from here
+}
+
+// acquire 等待轮到优先级为 p 的持有者，成功时之后必须调用 release；调度器已经 close 时返回 ErrConnClosed
+func (s *writeScheduler) acquire(p Priority) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrConnClosed
+	}
+	if !s.busy {
+		s.busy = true
+		s.mu.Unlock()
+		return nil
+	}
+	l := p.level()
+	if len(s.queues[l]) == 0 && s.pass[l] < s.now {
+		// an idle level doesn't bank the turns it skipped
+		s.pass[l] = s.now
+	}
+	ch := make(chan struct{})
+	s.queues[l] = append(s.queues[l], ch)
+	s.mu.Unlock()
+	<-ch
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// release 结束当前持有者的这一轮，把机会交给下一个
+func (s *writeScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := -1
+	for l := len(s.queues) - 1; l >= 0; l-- {
+		if len(s.queues[l]) > 0 && (next < 0 || s.pass[l] < s.pass[next]) {
+			next = l
+		}
+	}
+	if next < 0 {
+		s.busy = false
+		return
+	}
+	ch := s.queues[next][0]
+	s.queues[next] = s.queues[next][1:]
+	s.now = s.pass[next]
+	s.pass[next] += priorityStrides[next]
+	close(ch)
+}
+
+// close 让等待中与之后的 acquire 都返回 ErrConnClosed
+func (s *writeScheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l, queue := range s.queues {
+		for _, ch := range queue {
+			close(ch)
+		}
+		s.queues[l] = nil
+	}
+}
+
+// SendPriority 与 Send 相同，但以 prio 而不是 Config.Priority 发送该 key；
+// 数据帧不带 key，同一时刻只能有一个 key 在发送，其余的 Send 等待它 Close；多个 Send 同时等待时按优先级加权轮流得到连接，
+// 优先级越高越先得到，但低优先级的 key 仍会得到一部分机会；
+// 对端支持时 PriorityHigh 的 key 作为一条消息发送：数据在 Close 时以一个带 key 的帧写出，总长度不能超过 MaxMessageSize，
+// 它不必等正在发送的 key 结束，会插在那个 key 的两个数据帧之间，接收者无需读完那个 key 就能 Receive 到它
+func (conn *Conn) SendPriority(key string, prio Priority) (io.WriteCloser, error) {
+	return conn.send(key, conn.cfg.Compression, conn.cfg.Adaptive, prio)
+}
+
+// prioritized 报告对端能否接收 PRI 帧，此时数据帧也按 priorityChunk 拆分
+func (conn *Conn) prioritized() bool {
+	return conn.handshaked.Load() && conn.negotiated.Has(CapPriority)
+}
+
+// scheduled 在轮到优先级 prio 时调用 write 写出一个帧
+func (conn *Conn) scheduled(prio Priority, write func() error) error {
+	if err := conn.sched.acquire(prio); err != nil {
+		return err
+	}
+	defer conn.sched.release()
+	return write()
+}
+
+// beginStream 等待轮到优先级为 prio 的 key 使用连接，之后必须调用 endStream；
+// 接收方把 key 帧之后的数据帧都当作该 key 的数据，因此一个 key 从 key 帧到 FIN 的帧之间只能插入消息，不能插入另一个 key
+func (conn *Conn) beginStream(prio Priority) error {
+	return conn.turns.acquire(prio)
+}
+
+// endStream 把连接交给下一个等待的 key
+func (conn *Conn) endStream() {
+	conn.turns.release()
+}
+
+// writeFrame 按该 writer 的优先级写出一个帧
+func (c *ConnWriter) writeFrame(tag string, payload []byte) error {
+	return c.conn.scheduled(c.prio, func() error {
+		return c.conn.writeFrame(tag, payload)
+	})
+}
+
+// buffer 将 p 追加到尚未发送的消息中
+func (c *ConnWriter) buffer(p []byte) (int, error) {
+	if c.message.Len()+len(p) > MaxMessageSize {
+		return 0, ErrMessageTooLarge
+	}
+	return c.message.Write(p)
+}
+
+// sendMessage 将缓冲的消息以一个 PRI 帧写出
+func (c *ConnWriter) sendMessage() error {
+	payload := binary.AppendUvarint(nil, uint64(len(c.key)))
+	payload = append(payload, c.key...)
+	payload = append(payload, c.message.Bytes()...)
+	return c.writeFrame(PRI, payload)
+}
+
+// acceptMessage 处理对端发来的 PRI 帧，被拒绝的消息直接丢弃并告知对端，其余的留给 Receive 或 ReceiveMessage；调用者需持有 rdmu
+func (conn *Conn) acceptMessage(payload []byte) error {
+	n, size := binary.Uvarint(payload)
+	if size <= 0 || n > uint64(len(payload)-size) {
+		return errors.New("invalid priority message frame")
+	}
+	key := string(payload[size : size+int(n)])
+	err := conn.acceptKeyLength(key)
+	if err == nil {
+		err = conn.authorize(key, DirectionIn)
+	}
+	if err != nil {
+		return conn.reject(key, err)
+	}
+	conn.qmu.Lock()
+	defer conn.qmu.Unlock()
+	if len(conn.messages) == maxQueuedMessages {
+		conn.readErr = ErrTooManyMessages
+		return ErrTooManyMessages
+	}
+	conn.messages = append(conn.messages, &ConnReader{
+		conn:     conn,
+		key:      key,
+		pending:  bytes.Clone(payload[size+int(n):]),
+		finished: true,
+		finErr:   io.EOF,
+		message:  true,
+		start:    time.Now(),
+	})
+	conn.wakeReceiversLocked()
+	return nil
+}
+
+// ReceiveMessage 等待对端以 PriorityHigh 发送的下一条消息并返回其 key 与数据；
+// 其他 goroutine 正在读取某个 key 时由它在读到消息时转交，因此消息不必等那个 key 读完；
+// 没有 key 正在接收时自己读取连接，遇到的新 key 留给下一次 Receive；消息同样可以被 Receive 取走
+func (conn *Conn) ReceiveMessage() (key string, data []byte, err error) {
+	for {
+		conn.qmu.Lock()
+		cr := conn.popMessageLocked()
+		wake := conn.receiverWakeLocked()
+		conn.qmu.Unlock()
+		if cr != nil {
+			return cr.key, cr.take(), nil
+		}
+		locked := make(chan struct{})
+		go func() {
+			conn.rdmu.Lock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-wake:
+			// someone else is reading, give the lock back whenever it comes
+			go func() {
+				<-locked
+				conn.rdmu.Unlock()
+			}()
+			continue
+		case <-conn.lostCh():
+			go func() {
+				<-locked
+				conn.rdmu.Unlock()
+			}()
+			return "", nil, conn.lostError()
+		}
+		if conn.peeked != nil || conn.checkActive() != nil {
+			// whoever reads the current key hands the messages over and wakes us once it is done
+			conn.rdmu.Unlock()
+			select {
+			case <-wake:
+				continue
+			case <-conn.lostCh():
+				return "", nil, conn.lostError()
+			}
+		}
+		// nobody else reads the connection, a message can only arrive through us
+		cr, err = conn.nextStream()
+		if err == nil && !cr.message {
+			conn.peeked = cr
+		}
+		conn.rdmu.Unlock()
+		if err != nil {
+			return "", nil, err
+		}
+		if cr.message {
+			return cr.key, cr.take(), nil
+		}
+	}
+}
+
+// take 交出消息的全部数据，就像它被 Read 读完一样
+func (c *ConnReader) take() []byte {
+	data := c.pending
+	c.pending = nil
+	c.account(data)
+	c.audit(io.EOF)
+	return data
+}
+
+// popMessage 取出最早收到的消息，没有时返回 nil
+func (conn *Conn) popMessage() *ConnReader {
+	conn.qmu.Lock()
+	defer conn.qmu.Unlock()
+	return conn.popMessageLocked()
+}
+
+// popMessageLocked 与 popMessage 相同，调用者需持有 qmu
+func (conn *Conn) popMessageLocked() *ConnReader {
+	if len(conn.messages) == 0 {
+		return nil
+	}
+	cr := conn.messages[0]
+	conn.messages = conn.messages[1:]
+	return cr
+}
+
+// receiverWakeLocked 返回下一次有消息到达或当前的 key 读完时关闭的 channel，调用者需持有 qmu
+func (conn *Conn) receiverWakeLocked() <-chan struct{} {
+	if conn.wake == nil {
+		conn.wake = make(chan struct{})
+	}
+	return conn.wake
+}
+
+// wakeReceivers 唤醒等待消息的 ReceiveMessage
+func (conn *Conn) wakeReceivers() {
+	conn.qmu.Lock()
+	defer conn.qmu.Unlock()
+	conn.wakeReceiversLocked()
+}
+
+// wakeReceiversLocked 与 wakeReceivers 相同，调用者需持有 qmu
+func (conn *Conn) wakeReceiversLocked() {
+	if conn.wake != nil {
+		close(conn.wake)
+		conn.wake = nil
+	}
+}
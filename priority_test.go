@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// sendMessage 以 PriorityHigh 发送一个 key 及其数据
+func sendMessage(conn *Conn, key string, data []byte) error {
+	w, err := conn.SendPriority(key, PriorityHigh)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestWriteSchedulerWeights(t *testing.T) {
+	const turns = 21 * 10
+	s := &writeScheduler{busy: true}
+	var waiters [3][]chan struct{}
+	for l := range s.queues {
+		for i := 0; i < turns; i++ {
+			ch := make(chan struct{})
+			waiters[l] = append(waiters[l], ch)
+			s.queues[l] = append(s.queues[l], ch)
+		}
+	}
+	var got [3]int
+	for i := 0; i < turns; i++ {
+		s.release()
+		for l := range waiters {
+			if n := got[l]; n < turns && isClosed(waiters[l][n]) {
+				got[l]++
+			}
+		}
+	}
+	// 16 : 4 : 1 for High : Normal : Low
+	if got[2] != 160 || got[1] != 40 || got[0] != 10 {
+		t.Fatalf("turns per level (low, normal, high) = %v", got)
+	}
+}
+
+// isClosed 报告 ch 是否已经关闭
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendPriority 以 prio 发送一个 key 及其数据，data 中的每一段分别 Write
+func sendPriority(conn *Conn, key string, prio Priority, data ...[]byte) error {
+	w, err := conn.SendPriority(key, prio)
+	if err != nil {
+		return err
+	}
+	for _, part := range data {
+		if _, err = w.Write(part); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// waiters 返回等待 s 的数量
+func waiters(s *writeScheduler) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, queue := range s.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+func TestPriorityMessagePreemptsBulk(t *testing.T) {
+	var trace frameTrace
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithFrameObserver(trace.observe)), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	handshake := len(trace.get(DirectionOut, 0))
+
+	bulk := patterned(4 * priorityChunk)
+	bulkErr := make(chan error, 1)
+	go func() { bulkErr <- sendPriority(client, "bulk", PriorityLow, bulk) }()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nobody reads the first data frame yet, so the bulk writer is stuck in it and holds the turn
+	eventually(t, "the first data frame to start", func() bool {
+		return len(trace.get(DirectionOut, 0)) == handshake+2
+	})
+	msgErr := make(chan error, 1)
+	go func() { msgErr <- sendMessage(client, "ping", []byte("hi")) }()
+	eventually(t, "the message to wait for the turn", func() bool { return waiters(&client.sched) == 1 })
+
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, bulk) {
+		t.Fatalf("read %d bytes of the bulk key, %v", len(got), err)
+	}
+	if err = <-bulkErr; err != nil {
+		t.Fatal(err)
+	}
+	if err = <-msgErr; err != nil {
+		t.Fatal(err)
+	}
+	if key, data, err := server.ReceiveMessage(); err != nil || key != "ping" || string(data) != "hi" {
+		t.Fatalf("got %q %q %v", key, data, err)
+	}
+	// the message went out right after the data frame it waited for, not after the whole key
+	var tags []string
+	for _, e := range trace.get(DirectionOut, 0)[handshake:] {
+		tags = append(tags, e.typ.String())
+	}
+	if got, want := strings.Join(tags, " "), "HEAD HEAD PRI0 HEAD HEAD HEAD END0"; got != want {
+		t.Fatalf("frames on the wire: %s, want %s", got, want)
+	}
+}
+
+func TestPriorityStreamsTakeTurns(t *testing.T) {
+	client, server := pipeConns(t)
+	items := []BatchItem{
+		{Key: "open", Data: []byte("first come")},
+		{Key: "normal", Data: []byte("overtakes")},
+		{Key: "low", Data: []byte("waits longest")},
+	}
+	received := make(chan error, 1)
+	go func() { received <- checkBatch(server, items) }()
+
+	open, err := client.Send("open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 2)
+	for i, next := range []struct {
+		item BatchItem
+		prio Priority
+	}{{items[2], PriorityLow}, {items[1], PriorityNormal}} {
+		go func() { sent <- sendPriority(client, next.item.Key, next.prio, next.item.Data) }()
+		eventually(t, next.item.Key+" to wait for its turn", func() bool { return waitingTurns(client) == i+1 })
+	}
+	if _, err = open.Write(items[0].Data); err != nil {
+		t.Fatal(err)
+	}
+	if err = open.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-sent; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the waiting keys went out whole, the higher priority first
+	if err = <-received; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPriorityConcurrentWritersKeepTheirData(t *testing.T) {
+	client, server := pipeConns(t)
+	parts := func(name string) [][]byte {
+		var out [][]byte
+		for i := 0; i < 4; i++ {
+			out = append(out, bytes.Repeat([]byte(name), 3*priorityChunk/2))
+		}
+		return out
+	}
+	sent := make(chan error, 2)
+	go func() { sent <- sendPriority(client, "a", PriorityLow, parts("A")...) }()
+	go func() { sent <- sendPriority(client, "b", PriorityNormal, parts("B")...) }()
+	for i := 0; i < 2; i++ {
+		key, r, err := server.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if want := bytes.Join(parts(strings.ToUpper(key)), nil); err != nil || !bytes.Equal(data, want) {
+			t.Fatalf("key %q: read %d bytes, %v", key, len(data), err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-sent; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrioritySendWaitingWhenClosed(t *testing.T) {
+	client, server := pipeConns(t)
+	go receiveAll(server, false)
+	if _, err := client.Send("open"); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- sendAll(client, "waiting", nil) }()
+	eventually(t, "the Send to wait for its turn", func() bool { return waitingTurns(client) == 1 })
+	client.Close()
+	if err := <-sent; !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("got %v, want ErrConnClosed", err)
+	}
+}
+
+func TestPriorityMessageWhileReceiving(t *testing.T) {
+	client, server := pipeConns(t, WithPriority(PriorityHigh))
+	go func() {
+		stream, err := client.SendPriority("stream", PriorityNormal)
+		if err != nil {
+			return
+		}
+		stream.Write([]byte("part"))
+		// Send uses WithPriority
+		sendAll(client, "msg", []byte("hi"))
+		stream.Write([]byte("rest"))
+		stream.Close()
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 4)
+	if _, err = io.ReadFull(r, part); err != nil {
+		t.Fatal(err)
+	}
+	// reading on hands the message over to ReceiveMessage
+	rest := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(r)
+		rest <- string(data)
+	}()
+	key, data, err := server.ReceiveMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "msg" || string(data) != "hi" {
+		t.Fatalf("got %q %q", key, data)
+	}
+	if s := <-rest; s != "rest" {
+		t.Fatalf("rest of the stream: %q", s)
+	}
+}
+
+func TestPriorityMessageQueuedForReceive(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		stream, err := client.Send("stream")
+		if err != nil {
+			return
+		}
+		sendMessage(client, "msg", []byte("hi"))
+		stream.Write([]byte("data"))
+		stream.Close()
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the message sits between the key and its data, reading the data queues it
+	data := make([]byte, 4)
+	if _, err = io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	key, msg, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(msg); key != "msg" || string(b) != "hi" {
+		t.Fatalf("got %q %q", key, b)
+	}
+	if _, _, err = server.Receive(); !errors.Is(err, ErrConcurrentReceive) {
+		t.Fatalf("got %v, want ErrConcurrentReceive", err)
+	}
+}
+
+func TestPriorityMessageTooLarge(t *testing.T) {
+	client, server := pipeConns(t)
+	go receiveAll(server, false)
+	w, err := client.SendPriority("big", PriorityHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(make([]byte, MaxMessageSize+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("got %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestPriorityLegacyPeer(t *testing.T) {
+	client, server := pipeConns(t, WithLegacyMode())
+	got := make(chan string, 1)
+	go func() {
+		key, r, err := server.Receive()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		data, _ := io.ReadAll(r)
+		got <- key + ":" + string(data)
+	}()
+	w, err := client.SendPriority("high", PriorityHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a legacy peer can't take PRI frames, the key goes out as a regular stream
+	if w.(*ConnWriter).message != nil {
+		t.Fatal("sent as a priority message")
+	}
+	w.Write([]byte("data"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "high:data" {
+		t.Fatalf("got %q", s)
+	}
+}
+
+// waitingTurns 返回 conn 上等待轮到自己发送的 Send 数量
+func waitingTurns(conn *Conn) int {
+	return waiters(&conn.turns)
+}
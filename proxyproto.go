@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrProxyHeader 表示启用 Server.ProxyProtocol 时，连接开头不是合法的 PROXY protocol 头
+var ErrProxyHeader = errors.New("invalid proxy protocol header")
+
+const (
+	proxyV1Prefix = "PROXY "
+	proxyV1MaxLen = 107 // longest v1 line allowed by the spec, including CRLF
+	proxyV2Len    = 16  // signature, version/command, family and length
+)
+
+// proxyV2Sig 是 PROXY protocol v2 头的 12 字节签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn 是读完 PROXY protocol 头之后的连接，RemoteAddr 与 LocalAddr 返回头中记录的原始地址
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader // holds whatever the client sent right after the header
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// CloseWrite 在底层连接支持半关闭时关闭写方向
+func (c *proxyConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return ErrCloseWriteUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+// readProxyHeader 在 deadline 之前读取 raw 开头的 PROXY protocol v1 或 v2 头，返回以原始客户端地址为 RemoteAddr 的连接；
+// LOCAL 命令与 UNKNOWN/UNSPEC 地址族（例如代理自身的健康检查）保留 raw 的地址
+func readProxyHeader(raw net.Conn, deadline time.Time) (net.Conn, error) {
+	raw.SetReadDeadline(deadline)
+	defer raw.SetReadDeadline(time.Time{})
+	c := &proxyConn{
+		Conn:   raw,
+		r:      bufio.NewReader(raw),
+		remote: raw.RemoteAddr(),
+		local:  raw.LocalAddr(),
+	}
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		err = c.readV1()
+	case proxyV2Sig[0]:
+		err = c.readV2()
+	default:
+		err = ErrProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readV1 解析形如 "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n" 的文本头
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) || !bytes.HasPrefix(line, []byte(proxyV1Prefix)) {
+		return ErrProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	src, err := parseProxyAddr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyAddr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+// parseProxyAddr 解析 v1 头中的一个地址，地址族必须与 proto 一致
+func parseProxyAddr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != (proto == "TCP4") {
+		return nil, fmt.Errorf("%w: bad address %q", ErrProxyHeader, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || port[0] == '0' && len(port) > 1 {
+		return nil, fmt.Errorf("%w: bad port %q", ErrProxyHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 解析二进制头：12 字节签名 + 版本与命令 + 地址族与协议 + 2 字节大端长度 + 地址与 TLV
+func (c *proxyConn) readV2() error {
+	var head [proxyV2Len]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if !bytes.Equal(head[:12], proxyV2Sig) || head[12]>>4 != 2 {
+		return ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return unexpectedEOF(err)
+	}
+	switch head[12] & 0x0f {
+	case 0x0:
+		// LOCAL: the proxy talks for itself, keep the real addresses
+		return nil
+	case 0x1:
+	default:
+		return fmt.Errorf("%w: unknown command %#x", ErrProxyHeader, head[12]&0x0f)
+	}
+	var size int
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		size = 4
+	case 0x21: // TCP over IPv6
+		size = 16
+	default:
+		// UNSPEC, datagrams and unix sockets carry nothing we could report as a tcp peer
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return fmt.Errorf("%w: address block too short", ErrProxyHeader)
+	}
+	ports := body[2*size:]
+	c.remote = &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(ports))}
+	c.local = &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// proxyV2 构造一个 PROXY protocol v2 头
+func proxyV2(command, family byte, body []byte) []byte {
+	head := append([]byte(nil), proxyV2Sig...)
+	head = append(head, 0x20|command, family)
+	head = binary.BigEndian.AppendUint16(head, uint16(len(body)))
+	return append(head, body...)
+}
+
+// proxyV2Addrs 构造 v2 头中的地址块
+func proxyV2Addrs(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	body := append(append([]byte(nil), src...), dst...)
+	body = binary.BigEndian.AppendUint16(body, srcPort)
+	return binary.BigEndian.AppendUint16(body, dstPort)
+}
+
+// proxiedAddrs 是 Handler 在经过代理的连接上看到的地址
+type proxiedAddrs struct {
+	remote, local, peer string
+}
+
+// proxyServer 运行一个启用 ProxyProtocol 的 Server，Handler 报告连接的地址并回显数据
+func proxyServer(t *testing.T) (addr string, seen <-chan proxiedAddrs, headerErrs <-chan error) {
+	t.Helper()
+	addrs, errc := make(chan proxiedAddrs, 1), make(chan error, 10)
+	s := &Server{
+		ProxyProtocol:       true,
+		TLSHandshakeTimeout: time.Second,
+		OnAcceptError: func(err error, temporary bool) {
+			if temporary {
+				errc <- err
+			}
+		},
+		Handler: func(conn *Conn) {
+			addrs <- proxiedAddrs{conn.RemoteAddr().String(), conn.LocalAddr().String(), conn.Peer().Addr.String()}
+			key, r, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(r)
+			sendAll(conn, key, data)
+		},
+	}
+	addr, _ = serveOn(t, s)
+	return addr, addrs, errc
+}
+
+// proxiedSession 以 header 开头建立一个连接并完成一次往返
+func proxiedSession(t *testing.T, addr string, header []byte) *Conn {
+	t.Helper()
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = raw.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConn(raw)
+	t.Cleanup(conn.Close)
+	go sendAll(conn, "k", []byte("through the proxy"))
+	_, r, err := conn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "through the proxy" {
+		t.Fatalf("echo %q", data)
+	}
+	return conn
+}
+
+func TestProxyProtocol(t *testing.T) {
+	v4src, v4dst := net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4()
+	v6src, v6dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	tests := []struct {
+		name   string
+		header []byte
+		// empty when the header keeps the real addresses
+		remote, local string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v1 unknown", []byte("PROXY UNKNOWN ignored until the end\r\n"), "", ""},
+		{"v2 tcp4", proxyV2(0x1, 0x11, proxyV2Addrs(v4src, v4dst, 56324, 443)), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 tcp6", proxyV2(0x1, 0x21, proxyV2Addrs(v6src, v6dst, 56324, 443)), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		// TLVs after the addresses are skipped
+		{"v2 tlv", proxyV2(0x1, 0x11, append(proxyV2Addrs(v4src, v4dst, 1, 2), 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:1", "198.51.100.1:2"},
+		{"v2 local", proxyV2(0x0, 0x00, nil), "", ""},
+		{"v2 unspec", proxyV2(0x1, 0x00, nil), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, seen, _ := proxyServer(t)
+			conn := proxiedSession(t, addr, tt.header)
+			want := proxiedAddrs{tt.remote, tt.local, tt.remote}
+			if tt.remote == "" {
+				// the proxy's own connection
+				real := conn.LocalAddr().String()
+				want = proxiedAddrs{real, addr, real}
+			}
+			if got := <-seen; got != want {
+				t.Fatalf("handler saw %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"no header", classicFrame(HED, []byte("k"))},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n")},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n")},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 065535 443\r\n")},
+		{"v1 too few fields", []byte("PROXY TCP4 192.0.2.1\r\n")},
+		{"v2 version 1", append(proxyV2Sig[:12:12], 0x11, 0x11, 0, 0)},
+		{"v2 bad command", proxyV2(0x2, 0x11, nil)},
+		{"v2 short addresses", proxyV2(0x1, 0x11, []byte{1, 2, 3})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, seen, headerErrs := proxyServer(t)
+			raw, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			raw.Write(tt.header)
+			select {
+			case err := <-headerErrs:
+				if !errors.Is(err, ErrProxyHeader) {
+					t.Fatalf("got %v, want ErrProxyHeader", err)
+				}
+			case a := <-seen:
+				t.Fatalf("the handler ran for %+v", a)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the bad header wasn't reported")
+			}
+			// and the connection was dropped, maybe with a reset for the unread bytes
+			raw.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err = io.Copy(io.Discard, raw); errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("got %v, want the server to hang up", err)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolTruncated(t *testing.T) {
+	addr, _, headerErrs := proxyServer(t)
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Write([]byte("PROXY TCP4 192.0.2.1"))
+	raw.Close()
+	if err := <-headerErrs; !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
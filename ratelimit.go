@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limiter 限制发送速率，*rate.Limiter（golang.org/x/time/rate）满足该接口
+type Limiter interface {
+	// WaitN 阻塞到允许发送 n 字节为止，ctx 结束时返回错误；n 不会超过 Burst
+	WaitN(ctx context.Context, n int) error
+	// Burst 是一次 WaitN 最多请求的字节数
+	Burst() int
+}
+
+// RateLimiter 是基于令牌桶的 Limiter，可在多个 Conn 之间共享
+type RateLimiter struct {
+	limit RateLimit
+
+	mu     sync.Mutex
+	bucket tokenBucket
+}
+
+// NewRateLimiter 创建一个平均每秒 bytesPerSec 字节、最多一次突发 burst 字节的 RateLimiter
+func NewRateLimiter(bytesPerSec float64, burst int) *RateLimiter {
+	if bytesPerSec <= 0 || burst <= 0 {
+		panic("zhuozhuo: rate limiter needs a positive rate and burst")
+	}
+	return &RateLimiter{limit: RateLimit{Rate: bytesPerSec, Burst: burst}}
+}
+
+func (l *RateLimiter) Burst() int {
+	return l.limit.Burst
+}
+
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if n > l.limit.Burst {
+		return fmt.Errorf("rate limiter: %d bytes exceed burst %d", n, l.limit.Burst)
+	}
+	l.mu.Lock()
+	l.bucket.refill(&l.limit, time.Now())
+	// take the tokens now, going into debt, so concurrent waiters queue up behind us
+	l.bucket.tokens -= float64(n)
+	wait := time.Duration(-l.bucket.tokens / l.limit.Rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.bucket.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// writeLimited 按 l 限速写入 p，每次写出至多 Burst 字节
+func (c *ConnWriter) writeLimited(p []byte, l Limiter) (n int, err error) {
+	burst := l.Burst()
+	ctx := c.conn.lifetime()
+	for len(p) > 0 {
+		chunk := p
+		if burst > 0 && len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		if err = l.WaitN(ctx, len(chunk)); err != nil {
+			if ctx.Err() != nil {
+				// report why the connection went away, not the internal context
+				err = c.conn.lostError()
+			}
+			return n, err
+		}
+		m, err := c.write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// lifetime 返回连接断开或被关闭时结束的 context
+func (conn *Conn) lifetime() context.Context {
+	conn.amu.Lock()
+	defer conn.amu.Unlock()
+	if conn.life == nil {
+		conn.life, conn.endLife = context.WithCancel(context.Background())
+		if conn.lostErr != nil {
+			conn.endLife()
+		}
+	}
+	return conn.life
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSendLimiterPacesWrites(t *testing.T) {
+	const (
+		size  = 1 << 20
+		rate  = 512 << 10
+		burst = 32 << 10
+	)
+	client, server := pipeConns(t, WithSendLimiter(NewRateLimiter(rate, burst)))
+	received := make(chan int64, 1)
+	go func() {
+		_, r, err := server.Receive()
+		if err != nil {
+			received <- -1
+			return
+		}
+		n, _ := io.Copy(io.Discard, r)
+		received <- n
+	}()
+	start := time.Now()
+	if err := sendAll(client, "k", patterned(size)); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	// at most one burst goes out without waiting, the rest at 512KB/s
+	if min := time.Duration(float64(size-burst) / rate * float64(time.Second)); elapsed < min {
+		t.Fatalf("sent 1MB in %v, want at least %v", elapsed, min)
+	}
+	if elapsed > 4*time.Second {
+		t.Fatalf("sent 1MB in %v, the limiter is too slow", elapsed)
+	}
+	if n := <-received; n != size {
+		t.Fatalf("received %d bytes", n)
+	}
+}
+
+func TestSendLimiterWaitEndsOnClose(t *testing.T) {
+	client, server := pipeConns(t, WithSendLimiter(NewRateLimiter(1024, 1024)))
+	go receiveAll(server, false)
+	w, err := client.Send("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, client.Close)
+	start := time.Now()
+	// a minute's worth of data at 1KB/s
+	if _, err = w.Write(make([]byte, 60<<10)); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("got %v, want ErrConnClosed", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("Write kept waiting for %v after Close", waited)
+	}
+}
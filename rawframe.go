@@ -0,0 +1,31 @@
+package main
+
+// ReadFrame 读取下一个帧并原样交给调用者，包括 PING、RST 等平时由连接自行处理的控制帧，供协议桥接等需要区分帧类型的场景使用；
+// payload 已经过校验和、HMAC 校验与解密，但不做解压或去除填充；扩展帧与不认识的帧仍按配置被跳过，
+// 密钥帧由连接自行处理后跳过，否则之后的帧无法解密；
+// 经 ReadFrame 读到的控制帧不会再被处理，例如不会应答 PING；它与 Receive 共用同一个读取位置，
+// 在某个 key 的数据读到一半时调用会取走属于该 key 的帧；
+func (conn *Conn) ReadFrame() (typ FrameType, payload []byte, err error) {
+	conn.rdmu.Lock()
+	defer conn.rdmu.Unlock()
+	if err = conn.Handshake(); err != nil {
+		return 0, nil, err
+	}
+	for {
+		tag, size, err := conn.readHeader()
+		if err != nil {
+			return 0, nil, err
+		}
+		if payload, err = conn.readPayload(tag, size); err != nil {
+			return 0, nil, err
+		}
+		if tag == ENC {
+			if err = conn.acceptKey(payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		typ, _ = frameTypeOf(tag)
+		return typ, payload, nil
+	}
+}
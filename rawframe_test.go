@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReadFramePing(t *testing.T) {
+	client, server := pipeConns(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	pinged := make(chan error, 1)
+	go func() {
+		_, err := client.Ping(ctx)
+		pinged <- err
+	}()
+	typ, payload, err := server.ReadFrame()
+	if err != nil || typ != FramePing {
+		t.Fatalf("got %v %v, want a PING", typ, err)
+	}
+	// the first ping carries sequence number 1
+	if len(payload) != 8 || binary.LittleEndian.Uint64(payload) != 1 {
+		t.Fatalf("PING payload %x", payload)
+	}
+	// handed to the caller, so nobody answers it
+	if err = <-pinged; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Ping: got %v, want no PONG", err)
+	}
+}
+
+func TestReadFrameStream(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		// the payload comes back decrypted
+		{"psk", []Option{WithPSK(testPSK)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pipeConns(t, tt.opts...)
+			go func() {
+				sendAll(client, "k", []byte("data"))
+				sendAll(client, "next", []byte("more"))
+			}()
+			for _, want := range []struct {
+				typ     FrameType
+				payload string
+			}{{FrameData, "k"}, {FrameData, "data"}, {FrameFin, string((&finFrame{}).append(nil))}} {
+				typ, payload, err := server.ReadFrame()
+				if err != nil || typ != want.typ || string(payload) != want.payload {
+					t.Fatalf("got %v %q %v, want %v %q", typ, payload, err, want.typ, want.payload)
+				}
+			}
+			// Receive picks up at the next frame
+			key, r, err := server.Receive()
+			if err != nil || key != "next" {
+				t.Fatalf("got %q %v", key, err)
+			}
+			if data, _ := io.ReadAll(r); string(data) != "more" {
+				t.Fatalf("read %q", data)
+			}
+		})
+	}
+}
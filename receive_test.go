@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentReceivers(t *testing.T) {
+	const keys = 50
+	client, server := pipeConns(t)
+	go func() {
+		for i := 0; i < keys; i++ {
+			sendAll(client, fmt.Sprint(i), patterned(1000+i*37))
+		}
+		client.Close()
+	}()
+
+	var (
+		mu   sync.Mutex
+		seen = map[string]bool{}
+		wg   sync.WaitGroup
+	)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				key, r, err := server.Receive()
+				if errors.Is(err, ErrConcurrentReceive) {
+					// another receiver still reads its key
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if err != nil {
+					if err != io.EOF {
+						t.Error(err)
+					}
+					return
+				}
+				data, err := io.ReadAll(r)
+				var i int
+				fmt.Sscan(key, &i)
+				if err != nil || string(data) != string(patterned(1000+i*37)) {
+					t.Errorf("key %s: %d bytes, %v", key, len(data), err)
+				}
+				mu.Lock()
+				if seen[key] {
+					t.Errorf("key %s received twice", key)
+				}
+				seen[key] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != keys {
+		t.Fatalf("received %d of %d keys", len(seen), keys)
+	}
+}
+
+func TestConcurrentReadsOfOneStream(t *testing.T) {
+	client, server := pipeConns(t)
+	data := patterned(1 << 20)
+	go sendAll(client, "k", data)
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads from several goroutines are serialized, every byte arrives exactly once
+	var (
+		mu    sync.Mutex
+		total int
+		wg    sync.WaitGroup
+	)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, _ := io.Copy(io.Discard, r)
+			mu.Lock()
+			total += int(n)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if total != len(data) {
+		t.Fatalf("read %d of %d bytes", total, len(data))
+	}
+}
+
+func TestReceiveBeforePreviousStreamEnds(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		sendAll(client, "a", []byte("first"))
+		sendAll(client, "b", []byte("second"))
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.Receive(); !errors.Is(err, ErrConcurrentReceive) {
+		t.Fatalf("got %v, want ErrConcurrentReceive", err)
+	}
+	io.ReadAll(r)
+	if key, _, err := server.Receive(); err != nil || key != "b" {
+		t.Fatalf("got %q %v after reading the first key", key, err)
+	}
+}
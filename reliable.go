@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrStreamInterrupted 表示一次传输因底层连接断开而中断，连接已经（或正在）重新建立
+var ErrStreamInterrupted = errors.New("stream interrupted by connection loss")
+
+// ErrReliableClosed 表示 ReliableConn 已经被关闭
+var ErrReliableClosed = errors.New("reliable conn closed")
+
+// ReconnectError 表示 ReliableConn 在 Budget 内未能恢复连接
+type ReconnectError struct {
+	Attempts int   // 这次恢复中尝试拨号的次数
+	Err      error // 最后一次拨号的错误，拨号成功但连接随即断开时为断开的原因
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("reconnect failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *ReconnectError) Unwrap() error {
+	return e.Err
+}
+
+// ReliableConn 是客户端使用的、底层连接断开后会自动重新拨号的连接；
+// 重连期间 Send/Receive 会阻塞，超过 Budget 仍未成功时返回 *ReconnectError；
+// 只有连接断开、超时等传输错误会触发重连，认证被拒绝、ErrKeyTooLong 等在新连接上同样会发生的错误直接返回；
+type ReliableConn struct {
+	// Backoff 为重连失败后的首次等待时间，此后每次翻倍，直到 MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Budget 为一次恢复允许花费的总时间：从连接断开起，直到新连接上的 Send 或 Receive 成功为止，
+	// 其间的拨号、退避以及拨号成功后连接又随即断开都计算在内
+	Budget time.Duration
+	// OnReconnect 在重新建立连接后被调用，interrupted 为断开时尚未 Close 的发送 key，
+	// 应用可在其中重新 Send（或 SendResume）这些 key；
+	OnReconnect func(interrupted []string)
+
+	dial func() (net.Conn, error)
+	opts []Option
+
+	mu      sync.Mutex
+	conn    *Conn
+	gen     int                 // bumped on every successful (re)dial
+	open    map[string]struct{} // keys being sent on the current conn
+	closed  bool
+	dialing *redialCall   // the redial in progress, nil when none
+	quit    chan struct{} // closed by Close, cuts a backoff wait short
+
+	since    time.Time // when the current recovery started, zero once an operation succeeded on the new conn
+	attempts int       // dials since then, the next one waits the backoff for this many
+	lastErr  error     // what ended the last dial or connection of the current recovery
+}
+
+// redialCall 是一次进行中的重连，同时需要连接的调用者都等待它的结果
+type redialCall struct {
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+// NewReliableConn 创建一个使用 dial 建立底层连接的 ReliableConn，opts 会应用到每个新建的 Conn 上；
+// 首次连接在第一次 Send/Receive 时建立；
+func NewReliableConn(dial func() (net.Conn, error), opts ...Option) *ReliableConn {
+	return &ReliableConn{
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+		Budget:     30 * time.Second,
+		dial:       dial,
+		opts:       opts,
+		open:       map[string]struct{}{},
+		quit:       make(chan struct{}),
+	}
+}
+
+// Send 与 Conn.Send 相同，若当前连接已断开会先重连再发送
+func (rc *ReliableConn) Send(key string) (io.WriteCloser, error) {
+	return rc.send(key, func(conn *Conn) (io.WriteCloser, error) {
+		return conn.Send(key)
+	})
+}
+
+// SendResume 与 Conn.SendResume 相同，若当前连接已断开会先重连再发送
+func (rc *ReliableConn) SendResume(key string, size int64) (writer io.WriteCloser, offset int64, err error) {
+	writer, err = rc.send(key, func(conn *Conn) (io.WriteCloser, error) {
+		var w io.WriteCloser
+		w, offset, err = conn.SendResume(key, size)
+		return w, err
+	})
+	return writer, offset, err
+}
+
+func (rc *ReliableConn) send(key string, open func(*Conn) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	for {
+		conn, gen, err := rc.current()
+		if err != nil {
+			return nil, err
+		}
+		w, err := open(conn)
+		if err != nil {
+			if !transportError(err) {
+				return nil, err
+			}
+			if err = rc.recover(gen, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rc.mu.Lock()
+		rc.open[key] = struct{}{}
+		rc.recovered()
+		rc.mu.Unlock()
+		return &reliableWriter{rc: rc, key: key, gen: gen, w: w}, nil
+	}
+}
+
+// Receive 与 Conn.Receive 相同，若当前连接已断开会先重连再接收；
+// 对端正常关闭连接时返回 io.EOF，不会触发重连；
+func (rc *ReliableConn) Receive() (key string, reader io.Reader, err error) {
+	for {
+		conn, gen, err := rc.current()
+		if err != nil {
+			return "", nil, err
+		}
+		key, r, err := conn.Receive()
+		if err == io.EOF || err != nil && !transportError(err) {
+			return "", nil, err
+		}
+		if err != nil {
+			if err = rc.recover(gen, err); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		rc.mu.Lock()
+		rc.recovered()
+		rc.mu.Unlock()
+		return key, &reliableReader{rc: rc, gen: gen, r: r}, nil
+	}
+}
+
+// Close 关闭 ReliableConn 及其当前的底层连接，之后不会再重连；正在进行的重连随即以 ErrReliableClosed 结束
+func (rc *ReliableConn) Close() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return
+	}
+	rc.closed = true
+	close(rc.quit)
+	if rc.conn != nil {
+		rc.conn.Close()
+		rc.conn = nil
+	}
+}
+
+// current 返回当前可用的连接，必要时建立首个连接
+func (rc *ReliableConn) current() (*Conn, int, error) {
+	for {
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			return nil, 0, ErrReliableClosed
+		}
+		conn, gen := rc.conn, rc.gen
+		rc.mu.Unlock()
+		if conn != nil {
+			return conn, gen, nil
+		}
+		if err := rc.redial(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// recover 在第 gen 代连接出错后重新建立连接，并通知 OnReconnect；
+// 若该代连接已被其他调用者替换，直接返回
+func (rc *ReliableConn) recover(gen int, cause error) error {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return ErrReliableClosed
+	}
+	if gen != rc.gen && rc.conn != nil {
+		rc.mu.Unlock()
+		return nil
+	}
+	var interrupted []string
+	if rc.conn != nil {
+		// the first caller to notice tears the connection down, the others only wait for the new one
+		log.Println("connection lost, reconnecting:", cause)
+		rc.conn.Close()
+		rc.conn = nil
+		interrupted = make([]string, 0, len(rc.open))
+		for key := range rc.open {
+			interrupted = append(interrupted, key)
+		}
+		rc.open = map[string]struct{}{}
+		if rc.since.IsZero() {
+			rc.since = time.Now()
+		}
+		rc.lastErr = cause
+	}
+	onReconnect := rc.OnReconnect
+	rc.mu.Unlock()
+
+	if err := rc.redial(); err != nil {
+		return err
+	}
+	if interrupted != nil && onReconnect != nil {
+		onReconnect(interrupted)
+	}
+	return nil
+}
+
+// redial 在没有连接时重新拨号，已经有调用者在重连时等待它的结果；拨号与退避期间不持有 rc.mu，
+// 因此 Close 不会被阻塞；调用者不得持有 rc.mu
+func (rc *ReliableConn) redial() error {
+	rc.mu.Lock()
+	if call := rc.dialing; call != nil {
+		rc.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	if rc.closed {
+		rc.mu.Unlock()
+		return ErrReliableClosed
+	}
+	if rc.conn != nil {
+		rc.mu.Unlock()
+		return nil
+	}
+	call := &redialCall{done: make(chan struct{})}
+	rc.dialing = call
+	rc.mu.Unlock()
+
+	conn, err := rc.dialWithBackoff()
+	rc.mu.Lock()
+	rc.dialing = nil
+	if err == nil && rc.closed {
+		conn.Close()
+		err = ErrReliableClosed
+	}
+	if err == nil {
+		rc.conn = conn
+		rc.gen++
+	}
+	call.err = err
+	close(call.done)
+	rc.mu.Unlock()
+	return err
+}
+
+// dialWithBackoff 按指数退避重复拨号，直到成功、这次恢复耗尽 Budget 或 ReliableConn 被关闭；
+// 上一次拨号成功但连接随即断开时，这次拨号同样先等待退避
+func (rc *ReliableConn) dialWithBackoff() (*Conn, error) {
+	rc.mu.Lock()
+	if rc.since.IsZero() {
+		rc.since = time.Now()
+	}
+	deadline := rc.since.Add(rc.Budget)
+	rc.mu.Unlock()
+	for {
+		rc.mu.Lock()
+		attempts, lastErr := rc.attempts, rc.lastErr
+		rc.mu.Unlock()
+		if attempts > 0 {
+			backoff := rc.backoff(attempts)
+			if time.Now().Add(backoff).After(deadline) {
+				return nil, &ReconnectError{Attempts: attempts, Err: lastErr}
+			}
+			select {
+			case <-time.After(backoff):
+			case <-rc.quit:
+				return nil, ErrReliableClosed
+			}
+		}
+		raw, err := rc.dial()
+		select {
+		case <-rc.quit:
+			if err == nil {
+				raw.Close()
+			}
+			return nil, ErrReliableClosed
+		default:
+		}
+		rc.mu.Lock()
+		rc.attempts++
+		rc.lastErr = err
+		rc.mu.Unlock()
+		if err == nil {
+			return NewConn(raw, rc.opts...), nil
+		}
+	}
+}
+
+// backoff 返回第 attempts 次拨号之后的等待时间，从 Backoff 开始每次翻倍，直到 MaxBackoff
+func (rc *ReliableConn) backoff(attempts int) time.Duration {
+	backoff := rc.Backoff
+	for i := 1; i < attempts && backoff < rc.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, rc.MaxBackoff)
+}
+
+// recovered 在新连接上的操作成功后结束当前的恢复，调用者需持有 rc.mu
+func (rc *ReliableConn) recovered() {
+	rc.since = time.Time{}
+	rc.attempts = 0
+	rc.lastErr = nil
+}
+
+// done 标记 key 已经发送完毕
+func (rc *ReliableConn) done(key string, gen int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if gen == rc.gen {
+		delete(rc.open, key)
+	}
+}
+
+type reliableWriter struct {
+	rc  *ReliableConn
+	key string
+	gen int
+	w   io.WriteCloser
+}
+
+func (w *reliableWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil && transportError(err) {
+		return n, w.interrupted(err)
+	}
+	return n, err
+}
+
+func (w *reliableWriter) Close() error {
+	if err := w.w.Close(); err != nil && transportError(err) {
+		return w.interrupted(err)
+	} else if err != nil {
+		w.rc.done(w.key, w.gen)
+		return err
+	}
+	w.rc.done(w.key, w.gen)
+	return nil
+}
+
+func (w *reliableWriter) interrupted(err error) error {
+	if rerr := w.rc.recover(w.gen, err); rerr != nil {
+		return rerr
+	}
+	return fmt.Errorf("%w: key %q: %v", ErrStreamInterrupted, w.key, err)
+}
+
+// transportError 报告 err 是否表示底层连接断开或超时，只有这类错误值得重新拨号；
+// 认证或握手被拒绝、key 被对端拒绝、ErrKeyTooLong、ErrTooManyStreams 等错误在新连接上同样会发生，不应触发重连
+func transportError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, ErrConnClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+type reliableReader struct {
+	rc  *ReliableConn
+	gen int
+	r   io.Reader
+}
+
+func (r *reliableReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && transportError(err) {
+		if rerr := r.rc.recover(r.gen, err); rerr != nil {
+			return n, rerr
+		}
+		return n, fmt.Errorf("%w: %v", ErrStreamInterrupted, err)
+	}
+	return n, err
+}
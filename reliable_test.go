@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeDialer 的每次拨号都返回一个 net.Pipe 的一端，另一端交给 accepted
+type pipeDialer struct {
+	accepted chan net.Conn
+}
+
+func (d *pipeDialer) dial() (net.Conn, error) {
+	a, b := net.Pipe()
+	d.accepted <- b
+	return a, nil
+}
+
+func TestReliableConnRecovers(t *testing.T) {
+	d := &pipeDialer{accepted: make(chan net.Conn, 1)}
+	rc := NewReliableConn(d.dial)
+	defer rc.Close()
+	reconnected := make(chan []string, 1)
+	rc.OnReconnect = func(interrupted []string) { reconnected <- interrupted }
+
+	go func() {
+		first := NewConn(<-d.accepted)
+		_, r, err := first.Receive()
+		if err == nil {
+			io.CopyN(io.Discard, r, 5)
+		}
+		// the server goes away in the middle of the stream
+		first.Close()
+	}()
+	w, err := rc.Send("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		_, err = w.Write([]byte("more"))
+	}
+	if !errors.Is(err, ErrStreamInterrupted) {
+		t.Fatalf("got %v, want ErrStreamInterrupted", err)
+	}
+	if got := <-reconnected; !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("interrupted %v", got)
+	}
+
+	// the same ReliableConn sends again over the connection it redialed
+	second := NewConn(<-d.accepted)
+	defer second.Close()
+	go func() {
+		w, err := rc.Send("a")
+		if err == nil {
+			w.Write([]byte("again"))
+			w.Close()
+		}
+	}()
+	_, r, err := second.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "again" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestReliableConnCloseDuringBackoff(t *testing.T) {
+	rc := NewReliableConn(func() (net.Conn, error) {
+		return nil, errors.New("refused")
+	})
+	rc.Backoff, rc.MaxBackoff, rc.Budget = time.Minute, time.Minute, time.Hour
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rc.Send("a")
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		rc.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked behind the redial backoff")
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrReliableClosed) {
+			t.Fatalf("got %v, want ErrReliableClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send kept waiting after Close")
+	}
+}
+
+func TestReliableConnPermanentErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		clientOpts []Option
+		serverOpts []Option
+		key        string
+		want       error
+	}{
+		{"auth rejected", []Option{WithToken("alice", []byte("wrong"))}, []Option{WithAuthenticator(lookupToken)}, "k", ErrAuthFailed},
+		{"key too long", nil, []Option{WithLimits(Limits{MaxKeyLength: 4})}, "too long", ErrKeyTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &pipeDialer{accepted: make(chan net.Conn, 4)}
+			var dials atomic.Int32
+			go func() {
+				for b := range d.accepted {
+					dials.Add(1)
+					server := NewConn(b, tt.serverOpts...)
+					defer server.Close()
+					go receiveAll(server, false)
+				}
+			}()
+			defer close(d.accepted)
+			rc := NewReliableConn(d.dial, tt.clientOpts...)
+			defer rc.Close()
+			rc.Backoff = time.Millisecond
+			if _, err := rc.Send(tt.key); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			// the same error again, still without dialing
+			if _, err := rc.Send(tt.key); !errors.Is(err, tt.want) {
+				t.Fatalf("second Send: got %v, want %v", err, tt.want)
+			}
+			if n := dials.Load(); n != 1 {
+				t.Fatalf("dialed %d times", n)
+			}
+		})
+	}
+}
+
+func TestReliableConnBudgetCoversRecovery(t *testing.T) {
+	var dials atomic.Int32
+	// every dial succeeds, every connection is gone right away
+	rc := NewReliableConn(func() (net.Conn, error) {
+		dials.Add(1)
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	})
+	defer rc.Close()
+	rc.Backoff, rc.MaxBackoff, rc.Budget = 10*time.Millisecond, 20*time.Millisecond, 200*time.Millisecond
+	start := time.Now()
+	_, err := rc.Send("k")
+	var reconnectErr *ReconnectError
+	if !errors.As(err, &reconnectErr) || !transportError(reconnectErr.Err) {
+		t.Fatalf("got %v, want a *ReconnectError with the connection's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("gave up after %v with a %v budget", elapsed, rc.Budget)
+	}
+	if n := int(dials.Load()); n < 3 || n != reconnectErr.Attempts {
+		t.Fatalf("%d dials, %d attempts reported", n, reconnectErr.Attempts)
+	}
+}
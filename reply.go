@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// awaitReply 登记一个等待对端 tag 应答帧（OFS 或 TAK）的调用，需在写出请求之前登记，以免应答先于登记到达；
+// 对端按请求的顺序应答，因此应答交给最早登记的调用；调用者结束等待后需调用 forget
+func (conn *Conn) awaitReply(tag string) (reply <-chan []byte, forget func()) {
+	ch := make(chan []byte, 1)
+	conn.ymu.Lock()
+	if conn.replies == nil {
+		conn.replies = map[string][]chan []byte{}
+	}
+	conn.replies[tag] = append(conn.replies[tag], ch)
+	conn.ymu.Unlock()
+	forget = func() {
+		conn.ymu.Lock()
+		defer conn.ymu.Unlock()
+		if i := slices.Index(conn.replies[tag], ch); i >= 0 {
+			conn.replies[tag] = slices.Delete(conn.replies[tag], i, i+1)
+		}
+	}
+	return ch, forget
+}
+
+// acceptReply 把对端的应答帧交给最早登记的调用，没有调用在等待时丢弃它
+func (conn *Conn) acceptReply(tag string, payload []byte) {
+	conn.ymu.Lock()
+	defer conn.ymu.Unlock()
+	waiting := conn.replies[tag]
+	if len(waiting) == 0 {
+		return
+	}
+	waiting[0] <- payload
+	conn.replies[tag] = waiting[1:]
+}
+
+// waitReply 等待 awaitReply 登记的应答：正在读取该连接的 goroutine（Receive 或读取数据的 reader）会像 ACK 一样分派它，
+// 没有其他 goroutine 读取时自己逐帧读取，期间遇到的控制帧就地处理，遇到数据帧时返回错误；
+func (conn *Conn) waitReply(tag string, reply <-chan []byte) ([]byte, error) {
+	locked := make(chan struct{})
+	go func() {
+		conn.rdmu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case payload := <-reply:
+		// someone else is reading, give the lock back whenever it comes
+		go func() {
+			<-locked
+			conn.rdmu.Unlock()
+		}()
+		return payload, nil
+	}
+	defer conn.rdmu.Unlock()
+	for {
+		select {
+		case payload := <-reply:
+			return payload, nil
+		default:
+		}
+		got, size, err := conn.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		if !isControl(got) {
+			return nil, fmt.Errorf("unexpected frame %q, want %q", got, tag)
+		}
+		payload, err := conn.readPayload(got, size)
+		if err != nil {
+			return nil, err
+		}
+		if err = conn.handleControl(got, payload); err != nil {
+			return nil, err
+		}
+	}
+}
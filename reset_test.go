@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// sendOver 经由 client 发送一个 key，并确认 server 完整收到
+func sendOver(t *testing.T, client, server *Conn, key string, data []byte) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- sendAll(client, key, data) }()
+	got, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil || got != key || string(b) != string(data) {
+		t.Fatalf("got %q %q %v", got, b, err)
+	}
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResetThroughSyncPool(t *testing.T) {
+	pool := sync.Pool{New: func() any { return NewConn(nil, WithMaxKeyLength(32)) }}
+
+	a, b := net.Pipe()
+	conn := pool.Get().(*Conn)
+	conn.Reset(a)
+	server := NewConn(b)
+	sendOver(t, conn, server, "first", []byte("over the first pipe"))
+	a.Close()
+	server.Close()
+	pool.Put(conn)
+
+	a, b = net.Pipe()
+	again := pool.Get().(*Conn)
+	again.Reset(a)
+	server = NewConn(b)
+	defer again.Close()
+	defer server.Close()
+	// nothing of the previous connection is left, the handshake runs again with the new peer
+	if again.handshaked.Load() || again.closed.Load() {
+		t.Fatal("state of the previous connection survived Reset")
+	}
+	if s := again.Stats(); s.BytesSent != 0 {
+		t.Fatalf("stats survived Reset: %+v", s)
+	}
+	sendOver(t, again, server, "second", []byte("over the second pipe"))
+	if again.cfg.MaxKeyLength != 32 {
+		t.Fatalf("Reset dropped the config, MaxKeyLength = %d", again.cfg.MaxKeyLength)
+	}
+}
+
+func TestResetAfterClose(t *testing.T) {
+	client, server := pipeConns(t)
+	sendOver(t, client, server, "k", []byte("data"))
+	client.Close()
+
+	a, b := net.Pipe()
+	client.Reset(a)
+	fresh := NewConn(b)
+	defer client.Close()
+	defer fresh.Close()
+	sendOver(t, client, fresh, "k", []byte("after reset"))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// RSM 表示带续传标记的 key 帧，payload 为 8 字节总长度 + key
+const RSM = "RSM0"
+
+// OFS 是接收方对 RSM 的应答，payload 为 8 字节的已持有偏移
+const OFS = "OFS0"
+
+// ResumeStore 记录接收方已经持有的各 key 的字节数
+type ResumeStore interface {
+	Load(key string) int64
+	Store(key string, offset int64)
+}
+
+// MemResumeStore 是基于内存的 ResumeStore，可在多个 Conn 之间共享以便重连后续传
+type MemResumeStore struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+// NewMemResumeStore 创建一个空的 MemResumeStore
+func NewMemResumeStore() *MemResumeStore {
+	return &MemResumeStore{m: map[string]int64{}}
+}
+
+func (s *MemResumeStore) Load(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[key]
+}
+
+func (s *MemResumeStore) Store(key string, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = offset
+}
+
+// SendResume 以续传方式重新发送 key，size 为该 key 数据的总长度；
+// 接收方会告知其已持有的字节数 offset，发送者应从 offset 处开始向 writer 写入剩余数据；
+// 若接收方已持有全部数据，writer 已经结束，直接 Close 即可；
+func (conn *Conn) SendResume(key string, size int64) (writer io.WriteCloser, offset int64, err error) {
+	if err = conn.authorize(key, DirectionOut); err != nil {
+		return nil, 0, err
+	}
+	if err = conn.reserveStream(); err != nil {
+		return nil, 0, err
+	}
+	var w *ConnWriter
+	defer func() {
+		// once the writer exists, closing it gives the stream back
+		if w == nil {
+			conn.releaseStream()
+		}
+	}()
+	if err = conn.beginStream(conn.cfg.Priority); err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if w == nil {
+			conn.endStream()
+		}
+	}()
+	conn.clearRejection(key)
+	payload := binary.LittleEndian.AppendUint64(nil, uint64(size))
+	payload = append(payload, key...)
+	replyCh, forget := conn.awaitReply(OFS)
+	defer forget()
+	if err = conn.writeFrame(RSM, payload); err != nil {
+		err = fmt.Errorf("send resume key %q: %w", key, err)
+		log.Println(conn, "send resume key to receiver error:", err)
+		return nil, 0, err
+	}
+	reply, err := conn.waitReply(OFS, replyCh)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(reply) != 8 {
+		return nil, 0, errors.New("invalid resume offset frame")
+	}
+	offset = int64(binary.LittleEndian.Uint64(reply))
+	log.Println("resume key success key:", key, "offset:", offset)
+	w = conn.newWriter(key, conn.cfg.Priority)
+	w.turn = true
+	if offset == size {
+		// receiver already holds everything, finish the stream right away
+		if err = w.Close(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return w, offset, nil
+}
+
+// acceptResume 处理 RSM 帧：查询已持有的偏移并应答给发送方
+func (conn *Conn) acceptResume(payload []byte) (key string, offset int64, err error) {
+	if len(payload) < 8 {
+		return "", 0, errors.New("invalid resume key frame")
+	}
+	size := int64(binary.LittleEndian.Uint64(payload))
+	key = string(payload[8:])
+	if store := conn.cfg.ResumeStore; store != nil {
+		offset = store.Load(key)
+	}
+	if offset < 0 || offset > size {
+		// what we hold does not match this content, start over
+		offset = 0
+	}
+	if err = conn.writeFrame(OFS, binary.LittleEndian.AppendUint64(nil, uint64(offset))); err != nil {
+		return "", 0, err
+	}
+	return key, offset, nil
+}
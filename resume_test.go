@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResumeAfterKilledTransfer(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8<<10)
+	half := len(data) / 2
+	store := NewMemResumeStore()
+	var sink bytes.Buffer
+
+	// first attempt dies after half of the content
+	a, b := net.Pipe()
+	client, server := NewConn(a), NewConn(b, WithResumeStore(store))
+	go func() {
+		w, offset, err := client.SendResume("file", int64(len(data)))
+		if err != nil || offset != 0 {
+			t.Errorf("first attempt: offset %d, %v", offset, err)
+			return
+		}
+		w.Write(data[:half])
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.CopyN(&sink, r, int64(half)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	server.Close()
+
+	// the second attempt only carries what the receiver is missing
+	client, server = pipeConns(t, WithResumeStore(store))
+	go func() {
+		w, offset, err := client.SendResume("file", int64(len(data)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if offset != int64(half) {
+			t.Errorf("resumed at %d, want %d", offset, half)
+		}
+		w.Write(data[offset:])
+		w.Close()
+	}()
+	_, r, err = server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.(*ConnReader).Offset(); got != int64(half) {
+		t.Fatalf("reader offset %d, want %d", got, half)
+	}
+	if _, err = io.Copy(&sink, r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sink.Bytes(), data) {
+		t.Fatal("resumed content differs from the original")
+	}
+}
+
+func TestResumeAlreadyComplete(t *testing.T) {
+	store := NewMemResumeStore()
+	store.Store("file", 5)
+	client, server := pipeConns(t, WithResumeStore(store))
+	go func() {
+		_, r, err := server.Receive()
+		if err == nil {
+			io.Copy(io.Discard, r)
+		}
+	}()
+	w, offset, err := client.SendResume("file", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 5 {
+		t.Fatalf("offset %d, want 5", offset)
+	}
+	// the writer is already finished, closing it again is harmless
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeWhileReceiving(t *testing.T) {
+	client, server := pipeConns(t)
+	received := make(chan string, 1)
+	go func() {
+		// holds the read side while SendResume waits for its OFS
+		key, r, err := client.Receive()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		io.Copy(io.Discard, r)
+		received <- key
+	}()
+	go func() {
+		_, r, err := server.Receive()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, r)
+		sendAll(server, "back", nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	w, offset, err := client.SendResume("file", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0 {
+		t.Fatalf("offset %d", offset)
+	}
+	w.Write([]byte("abc"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-received; key != "back" {
+		t.Fatalf("concurrent Receive got %q", key)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+)
+
+// RetryPolicy 描述底层连接读写遇到临时错误时的重试方式；超时（包括 SetDeadline 引起的超时）不会被重试；
+// DialRetry 同样用它描述拨号的重试方式
+type RetryPolicy struct {
+	MaxAttempts int           // 包括首次在内最多尝试的次数
+	Backoff     time.Duration // 首次重试前的等待时间，此后每次翻倍
+	MaxBackoff  time.Duration // 等待时间的上限，为 0 时不设上限
+	Jitter      float64       // 每次等待时间随机缩短至多该比例，取值 0 到 1，避免大量客户端同时重试
+	// OnRetry 在第 attempt 次尝试因 err 失败、即将等待 backoff 后重试时被调用，可用于记录进度
+	OnRetry func(attempt int, err error, backoff time.Duration)
+}
+
+// retry 报告第 attempt 次尝试遇到 err 后是否应当重试，需要重试时先等待退避时间
+func (p *RetryPolicy) retry(attempt int, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts || !isTemporary(err) {
+		return false
+	}
+	backoff := p.backoff(attempt)
+	if p.OnRetry != nil {
+		p.OnRetry(attempt, err, backoff)
+	}
+	time.Sleep(backoff)
+	return true
+}
+
+// backoff 返回第 attempt 次尝试失败后的等待时间
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.Backoff << (attempt - 1)
+	if p.MaxBackoff > 0 && (backoff > p.MaxBackoff || backoff <= 0) {
+		backoff = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		backoff -= time.Duration(rand.Float64() * p.Jitter * float64(backoff))
+	}
+	return backoff
+}
+
+// isTemporary 判断 err 是否为可以重试的临时错误
+func isTemporary(err error) bool {
+	var t interface{ Temporary() bool }
+	if !errors.As(err, &t) || !t.Temporary() {
+		return false
+	}
+	// deadlines are how callers cancel blocked I/O, never retry them
+	return !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// retryReader 在读取遇到临时错误时按 RetryPolicy 重试
+type retryReader struct {
+	r      io.Reader
+	policy *RetryPolicy
+}
+
+func (r retryReader) Read(p []byte) (int, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := r.r.Read(p)
+		if err == nil {
+			return n, nil
+		}
+		if !isTemporary(err) {
+			return n, err
+		}
+		if n > 0 {
+			// hand over what we got, the next Read retries
+			return n, nil
+		}
+		if !r.policy.retry(attempt, err) {
+			return n, err
+		}
+	}
+}
+
+// newReader 为底层连接 raw 创建大小为 ReadBufferSize 的带缓冲的 reader，配置了 RetryPolicy 时读取会重试临时错误，
+// 配置了 IdleTimeout 时每次读取都会推迟读超时
+func (conn *Conn) newReader(raw net.Conn) *bufio.Reader {
+	if n := conn.cfg.ReadBufferSize; n > 0 {
+		return bufio.NewReaderSize(conn.readSource(raw), n)
+	}
+	return bufio.NewReader(conn.readSource(raw))
+}
+
+// readSource 返回从 raw 读取时实际使用的 reader
+func (conn *Conn) readSource(raw net.Conn) io.Reader {
+	var r io.Reader = raw
+	if d := conn.cfg.IdleTimeout; d > 0 {
+		r = idleReader{conn: conn, raw: raw, timeout: d}
+	}
+	if conn.cfg.Retry != nil {
+		r = retryReader{r: r, policy: conn.cfg.Retry}
+	}
+	return r
+}
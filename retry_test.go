@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// temporaryError 是一个可以重试的网络错误
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyConn 让接下来的 failReads 次读取和 failWrites 次写入返回临时错误
+type flakyConn struct {
+	net.Conn
+	failReads, failWrites atomic.Int32
+}
+
+func (c *flakyConn) Read(p []byte) (int, error) {
+	if c.failReads.Add(-1) >= 0 {
+		return 0, temporaryError{}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	if c.failWrites.Add(-1) >= 0 {
+		return 0, temporaryError{}
+	}
+	return c.Conn.Write(p)
+}
+
+// flakySend 在 client 连续两次写入和 server 连续两次读取遇到临时错误的情况下发送一个 key，
+// 返回发送与接收的错误
+func flakySend(t *testing.T, opts ...Option) (sendErr, recvErr error) {
+	t.Helper()
+	a, b := net.Pipe()
+	fa, fb := &flakyConn{Conn: a}, &flakyConn{Conn: b}
+	client, server := NewConn(fa, opts...), NewConn(fb, opts...)
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	fa.failWrites.Store(2)
+	fb.failReads.Store(2)
+	done := make(chan error, 1)
+	go func() { done <- sendAll(client, "k", []byte("data")) }()
+	_, r, err := server.Receive()
+	if err == nil {
+		var data []byte
+		if data, err = io.ReadAll(r); err == nil && string(data) != "data" {
+			t.Fatalf("read %q", data)
+		}
+	}
+	if err != nil {
+		server.Close()
+	}
+	return <-done, err
+}
+
+func TestRetryTemporaryErrors(t *testing.T) {
+	var retries atomic.Int32
+	sendErr, recvErr := flakySend(t, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		OnRetry:     func(int, error, time.Duration) { retries.Add(1) },
+	}))
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	// two failed writes and two failed reads
+	if n := retries.Load(); n != 4 {
+		t.Fatalf("%d retries, want 4", n)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"no policy":     nil,
+		"too few tries": {WithRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sendErr, _ := flakySend(t, opts...)
+			var te temporaryError
+			if !errors.As(sendErr, &te) {
+				t.Fatalf("got %v, want the temporary error", sendErr)
+			}
+		})
+	}
+}
+
+func TestRetryIgnoresDeadlines(t *testing.T) {
+	var retries atomic.Int32
+	client, server := pipeConns(t, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 5,
+		Backoff:     time.Millisecond,
+		OnRetry:     func(int, error, time.Duration) { retries.Add(1) },
+	}))
+	handshakeBoth(t, client, server)
+	client.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := client.Receive(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+	if n := retries.Load(); n != 0 {
+		t.Fatalf("retried a deadline %d times", n)
+	}
+}
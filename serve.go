@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// Serve 循环接收对端发送的每一个 key，并交给 handler 处理，直到连接关闭或 ctx 被取消；
+// 同一连接上的数据流是依次传输的，因此 handler 逐个运行：handler 返回后，
+// 该 key 尚未读取的数据会被丢弃，以便继续接收下一个 key；
+// 连接被对端正常关闭时返回 nil，ctx 被取消时返回 ctx.Err()；
+func (conn *Conn) Serve(ctx context.Context, handler func(key string, r io.Reader) error) error {
+	// unblock a pending read once ctx is done, IdleTimeout must not push the deadline back out
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		conn.interruptReads()
+		close(interrupted)
+	})
+	defer func() {
+		if !stop() {
+			// the interruption is over once Serve returns, later reads work again
+			<-interrupted
+			conn.resumeReads()
+		}
+	}()
+
+	for {
+		key, reader, err := conn.Receive()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err = handler(key, reader); err != nil {
+			log.Println("handle key error:", key, err)
+		}
+		// skip whatever the handler left unread so the next key is framed correctly
+		if err = reader.(*ConnReader).Drain(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// pipeConns 返回通过 net.Pipe 相连的两端，测试结束时关闭
+func pipeConns(t testing.TB, opts ...Option) (client, server *Conn) {
+	t.Helper()
+	client, server = Pipe(opts...)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// sendAll 发送一个 key 及其数据
+func sendAll(conn *Conn, key string, data []byte) error {
+	w, err := conn.Send(key)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func TestServeThreeStreams(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		for _, key := range []string{"a", "b", "c"} {
+			if err := sendAll(client, key, []byte("data of "+key)); err != nil {
+				t.Error(err)
+			}
+		}
+		client.Close()
+	}()
+	var got []string
+	err := server.Serve(context.Background(), func(key string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if string(data) != "data of "+key {
+			t.Errorf("key %s: got %q", key, data)
+		}
+		got = append(got, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Fatalf("handled %v", got)
+	}
+}
+
+func TestServeCancelWithIdleTimeout(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		client, server := pipeConns(t, WithIdleTimeout(time.Hour))
+		go func() {
+			sendAll(client, "k", []byte("x"))
+			// keep frames coming so every read pushes the idle deadline out again
+			go client.Receive()
+			for j := 0; j < 50; j++ {
+				client.Ping(context.Background())
+			}
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() {
+			errc <- server.Serve(ctx, func(key string, r io.Reader) error { return nil })
+		}()
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-errc:
+			if err != context.Canceled {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Serve did not return after ctx was canceled")
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed 表示 Server 已经 Shutdown 或 Close，Serve 不再接受新的连接
+var ErrServerClosed = errors.New("server closed")
+
+const (
+	// shutdownPollInterval 是 Shutdown 检查连接是否都已处理完的间隔
+	shutdownPollInterval = 10 * time.Millisecond
+
+	// Accept 遇到临时错误时的退避时间从 minAcceptBackoff 开始翻倍，最长 maxAcceptBackoff
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// Server 在一个或多个 listener 上接受连接，并为每个连接运行 Handler
+type Server struct {
+	// Handler 处理一个连接，返回后连接被关闭
+	Handler func(conn *Conn)
+	// Options 用于创建每一个连接
+	Options []Option
+	// OnAcceptError 在 Accept 出错时被调用，temporary 报告 Serve 是否会在退避后继续接受连接；
+	// ServeTLS 中单个连接的 TLS 握手失败时同样以 *TLSHandshakeError 调用，此时 temporary 为 true
+	OnAcceptError func(err error, temporary bool)
+	// TLSHandshakeTimeout 是 ServeTLS 中每个连接完成 TLS 握手的最长时间，为 0 时使用 10 秒；
+	// 启用 ProxyProtocol 时同样限制读取 PROXY 头的时间
+	TLSHandshakeTimeout time.Duration
+	// ProxyProtocol 为 true 时每个连接必须以 PROXY protocol v1 或 v2 头开始（例如位于 HAProxy 之后），
+	// 该头在交给 NewConn 之前被读取，Conn.RemoteAddr 与 Peer 返回其中记录的原始客户端地址，
+	// MaxConnsPerIP 等限制也按该地址计算；头不合法的连接被关闭并以 ErrProxyHeader 报告给 OnAcceptError
+	ProxyProtocol bool
+	// AllowPlaintext 为 true 时 ServeTLS 在同一个端口上同时接受 TLS 与明文的客户端：根据连接的第一个字节是否为
+	// TLS 握手记录决定是否进行 TLS 握手，适合迁移期间；迁移完成后设为 false 即拒绝明文客户端；
+	// 只在客户端先发送数据时有效，Legacy 模式下先等待读取的客户端会在 TLSHandshakeTimeout 后被断开
+	AllowPlaintext bool
+	// OnStreamOpen 设置后用于每一个连接的 Config.OnStreamOpen，在 key 的数据交给 Handler 之前决定是否拒绝该 key
+	OnStreamOpen func(conn *Conn, key string, info StreamInfo) error
+	// Audit 设置后用于每一个连接的 Config.Audit，记录谁连接了以及传输了哪些 key
+	Audit func(conn *Conn, ev AuditEvent)
+
+	// MaxConnsPerIP 是同一远端 IP 同时保持的最大连接数，为 0 时不限制
+	MaxConnsPerIP int
+	// AcceptLimit 限制所有 listener 接受连接的总速度，为 nil 时不限制
+	AcceptLimit *RateLimit
+	// PerIPAcceptLimit 限制每个远端 IP 建立连接的速度，为 nil 时不限制
+	PerIPAcceptLimit *RateLimit
+	// OnReject 在连接因上述限制被拒绝时调用，reason 为 ErrTooManyConns 或 ErrAcceptRateLimited；
+	// 被拒绝的连接在 Accept 之后立即关闭
+	OnReject func(addr net.Addr, reason error)
+
+	mu        sync.Mutex
+	closed    bool
+	listeners []net.Listener // in the order Serve started on them
+	conns     map[*Conn]struct{}
+	preparing map[net.Conn]struct{} // accepted connections still reading the PROXY header or doing the TLS handshake
+
+	amu          sync.Mutex // guards the admission state below
+	acceptBucket tokenBucket
+	ips          map[string]*ipState
+	lastSweep    time.Time
+}
+
+// Serve 在 ln 上接受连接，并在各自的 goroutine 中运行 Handler，直到 ln 出错或 Server 被关闭；
+// Accept 遇到临时错误（例如 EMFILE）时退避后继续，遇到其他错误时返回该错误；
+// 因 Shutdown 或 Close 返回时返回 ErrServerClosed，ln 总是在返回前被关闭；
+func (s *Server) Serve(ln net.Listener) error {
+	return s.serve(ln, nil)
+}
+
+// ServeTLS 与 Serve 相同，但每个连接先以 config 完成 TLS 握手再交给 Handler，
+// Handler 可通过 Conn.TLSConnectionState 或 Conn.Peer 取得协商结果；握手在各连接自己的 goroutine 中进行，
+// 受 TLSHandshakeTimeout 限制，失败的连接被关闭并报告给 OnAcceptError；
+func (s *Server) ServeTLS(ln net.Listener, config *tls.Config) error {
+	return s.serve(ln, config)
+}
+
+// serve 实现 Serve 与 ServeTLS，config 为 nil 时不进行 TLS 握手
+func (s *Server) serve(ln net.Listener, config *tls.Config) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+	defer ln.Close()
+	var backoff time.Duration
+	for {
+		raw, err := ln.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			temporary := isTemporary(err)
+			if s.OnAcceptError != nil {
+				s.OnAcceptError(err, temporary)
+			}
+			if !temporary {
+				return err
+			}
+			// e.g. EMFILE, back off like net/http and try again
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else if backoff *= 2; backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		if config != nil || s.ProxyProtocol {
+			// a slow handshake must not hold up the accept loop, Shutdown still waits for it
+			if !s.trackPreparing(raw, true) {
+				raw.Close()
+				return ErrServerClosed
+			}
+			go s.prepare(raw, config)
+			continue
+		}
+		ip, err := s.admit(raw)
+		if err != nil {
+			s.reject(raw, err)
+			continue
+		}
+		conn := NewConn(raw, s.connOptions()...)
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			s.release(ip)
+			return ErrServerClosed
+		}
+		go s.handle(conn, ip)
+	}
+}
+
+// prepare 在 raw 上依次读取 PROXY 头、完成 TLS 握手（config 不为 nil 时），然后像 Serve 一样处理该连接；
+// 调用者已经通过 trackPreparing 记录了 raw
+func (s *Server) prepare(raw net.Conn, config *tls.Config) {
+	defer s.trackPreparing(raw, false)
+	timeout := s.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	fail := func(err error) {
+		raw.Close()
+		if s.OnAcceptError != nil {
+			s.OnAcceptError(err, true)
+		}
+	}
+	if s.ProxyProtocol {
+		deadline, _ := ctx.Deadline()
+		pc, err := readProxyHeader(raw, deadline)
+		if err != nil {
+			fail(err)
+			return
+		}
+		raw = pc
+	}
+	ip, err := s.admit(raw)
+	if err != nil {
+		s.reject(raw, err)
+		return
+	}
+	if config != nil && s.AllowPlaintext {
+		deadline, _ := ctx.Deadline()
+		var isTLS bool
+		if raw, isTLS, err = sniffTLS(raw, deadline); err != nil {
+			s.release(ip)
+			fail(err)
+			return
+		}
+		if !isTLS {
+			config = nil
+		}
+	}
+	var conn *Conn
+	if config == nil {
+		conn = NewConn(raw, s.connOptions()...)
+	} else if conn, err = AcceptTLS(ctx, raw, config, s.connOptions()...); err != nil {
+		s.release(ip)
+		fail(err)
+		return
+	}
+	if !s.trackConn(conn, true) {
+		conn.Close()
+		s.release(ip)
+		return
+	}
+	s.handle(conn, ip)
+}
+
+// connOptions 返回创建连接时使用的 Option，Server 上的回调排在 Options 之后
+func (s *Server) connOptions() []Option {
+	if s.OnStreamOpen == nil && s.Audit == nil {
+		return s.Options
+	}
+	// don't let append write into the caller's backing array
+	opts := s.Options[:len(s.Options):len(s.Options)]
+	if s.OnStreamOpen != nil {
+		opts = append(opts, WithStreamOpenHook(s.OnStreamOpen))
+	}
+	if s.Audit != nil {
+		opts = append(opts, WithAudit(s.Audit))
+	}
+	return opts
+}
+
+// tlsRecordHandshake 是 TLS 握手记录的类型，ClientHello 总是以它开头
+const tlsRecordHandshake = 0x16
+
+// sniffTLS 在 deadline 之前查看 raw 的第一个字节，报告它是否为 TLS 握手；返回的连接仍从第一个字节开始读取
+func sniffTLS(raw net.Conn, deadline time.Time) (net.Conn, bool, error) {
+	raw.SetReadDeadline(deadline)
+	defer raw.SetReadDeadline(time.Time{})
+	r := bufio.NewReader(raw)
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, false, unexpectedEOF(err)
+	}
+	return &bufferedConn{Conn: raw, r: r}, first[0] == tlsRecordHandshake, nil
+}
+
+func (s *Server) handle(conn *Conn, ip string) {
+	defer s.release(ip)
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+	s.Handler(conn)
+}
+
+// ListenAndServe 在 network（"tcp"、"tcp4"、"tcp6" 或 "unix"）的 addr 上监听并 Serve；
+// addr 的端口为 0 时由系统选择空闲端口，实际地址可通过 Addr 获得；
+func (s *Server) ListenAndServe(network, addr string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// ListenAndServeUnix 在 unix socket 文件 path 上监听并 Serve，用于本机进程间通信；
+// perm 不为 0 时将 socket 文件的权限设为 perm，例如 0o600 只允许同一用户连接；
+// Serve 返回时（包括 Shutdown 与 Close）socket 文件被删除；Linux 上以 @ 开头的 path 为抽象命名空间，不产生文件，perm 被忽略；
+func (s *Server) ListenAndServeUnix(path string, perm os.FileMode) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(true)
+	if perm != 0 && !strings.HasPrefix(path, "@") {
+		if err = os.Chmod(path, perm); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	return s.Serve(ln)
+}
+
+// ListenAndServeTLS 在 addr 上监听 TCP 并以 config ServeTLS
+func (s *Server) ListenAndServeTLS(addr string, config *tls.Config) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(ln, config)
+}
+
+// Addr 返回 Server 正在监听的地址，同时在多个 listener 上 Serve 时返回其中最早的一个；没有在监听时返回 nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Shutdown 停止接受新的连接，然后等待所有连接的 Handler 返回；ctx 先结束时关闭所有剩余的连接并返回 ctx.Err()；
+// 之后 Serve 都返回 ErrServerClosed；
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.idle() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close 立即停止接受新的连接并关闭所有连接，不等待 Handler 返回
+func (s *Server) Close() error {
+	err := s.closeListeners()
+	s.closeConns()
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackListener 记录或移除正在 Serve 的 listener，Server 已关闭时拒绝记录
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		for i, l := range s.listeners {
+			if l == ln {
+				s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.listeners = append(s.listeners, ln)
+	return true
+}
+
+// trackConn 记录或移除正在处理的连接，Server 已关闭时拒绝记录
+func (s *Server) trackConn(conn *Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = map[*Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// trackPreparing 记录或移除尚在准备中的连接，Server 已关闭时拒绝记录
+func (s *Server) trackPreparing(raw net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.preparing, raw)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.preparing == nil {
+		s.preparing = map[net.Conn]struct{}{}
+	}
+	s.preparing[raw] = struct{}{}
+	return true
+}
+
+// closeListeners 将 Server 标记为已关闭并关闭所有 listener
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for _, ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	// their handshakes fail and trackConn refuses them
+	for raw := range s.preparing {
+		raw.Close()
+	}
+}
+
+func (s *Server) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns) == 0 && len(s.preparing) == 0
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveOn 在本地的空闲端口上运行 s.Serve，返回监听地址与 Serve 的结果
+func serveOn(t *testing.T, s *Server) (addr string, served <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ln) }()
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String(), errc
+}
+
+func TestServerGracefulDrain(t *testing.T) {
+	received, release := make(chan string, 1), make(chan struct{})
+	s := &Server{Handler: func(conn *Conn) {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		io.ReadAll(r)
+		received <- key
+		// still busy when Shutdown starts
+		<-release
+	}}
+	addr, served := serveOn(t, s)
+	client := dial(addr)
+	defer client.Close()
+	if err := sendAll(client, "k", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	shut := make(chan error, 1)
+	go func() { shut <- s.Shutdown(context.Background()) }()
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve: got %v, want ErrServerClosed", err)
+	}
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Fatal("a new connection was accepted during Shutdown")
+	}
+	select {
+	case err := <-shut:
+		t.Fatalf("Shutdown returned %v with a handler still running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shut; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	handled := make(chan error, 1)
+	s := &Server{Handler: func(conn *Conn) {
+		// the client never sends anything
+		_, _, err := conn.Receive()
+		handled <- err
+	}}
+	addr, _ := serveOn(t, s)
+	client := dial(addr)
+	defer client.Close()
+	go client.Receive()
+	eventually(t, "the connection to be tracked", func() bool { return !s.idle() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	// the leftover connection was closed under the handler
+	if err := <-handled; err == nil {
+		t.Fatal("Receive succeeded on a connection closed by Shutdown")
+	}
+	eventually(t, "the handler to be untracked", s.idle)
+}
+
+func TestServerClose(t *testing.T) {
+	handled := make(chan error, 1)
+	s := &Server{Handler: func(conn *Conn) {
+		_, _, err := conn.Receive()
+		handled <- err
+	}}
+	addr, served := serveOn(t, s)
+	client := dial(addr)
+	defer client.Close()
+	go client.Receive()
+	eventually(t, "the connection to be tracked", func() bool { return !s.idle() })
+	s.Close()
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve: got %v, want ErrServerClosed", err)
+	}
+	select {
+	case err := <-handled:
+		if err == nil {
+			t.Fatal("Receive succeeded after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close didn't close the live connection")
+	}
+}
+
+func TestServerServeAgain(t *testing.T) {
+	echo := func(conn *Conn) {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(r)
+		sendAll(conn, key, data)
+	}
+	old := &Server{Handler: echo}
+	addr, served := serveOn(t, old)
+	if err := old.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Serve closes its listener on the way out
+	<-served
+
+	// a shut down Server refuses new listeners, and closes them
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Serve(ln); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve after Shutdown: got %v, want ErrServerClosed", err)
+	}
+	// a new Server takes over the same address
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: echo}
+	defer s.Close()
+	go s.Serve(ln)
+	client := dial(addr)
+	defer client.Close()
+	go sendAll(client, "k", []byte("again"))
+	_, r, err := client.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "again" {
+		t.Fatalf("echo %q", data)
+	}
+}
+
+// listenAndServe 在 network 的 addr 上运行 s.ListenAndServe，等到 Addr 可用时返回
+func listenAndServe(t *testing.T, s *Server, network, addr string) net.Addr {
+	t.Helper()
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe(network, addr) }()
+	t.Cleanup(func() {
+		s.Close()
+		<-served
+	})
+	var bound net.Addr
+	eventually(t, "the server to listen", func() bool {
+		select {
+		case err := <-served:
+			served <- err
+			t.Fatalf("ListenAndServe(%q, %q): %v", network, addr, err)
+		default:
+		}
+		bound = s.Addr()
+		return bound != nil
+	})
+	return bound
+}
+
+func TestServerEphemeralPorts(t *testing.T) {
+	echo := func(tag string) func(*Conn) {
+		return func(conn *Conn) {
+			key, r, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(r)
+			sendAll(conn, key, append([]byte(tag), data...))
+		}
+	}
+	first, second := &Server{Handler: echo("1:")}, &Server{Handler: echo("2:")}
+	if first.Addr() != nil {
+		t.Fatal("Addr() is set before ListenAndServe")
+	}
+	// both serving at once, neither needs a fixed port
+	addrs := []net.Addr{
+		listenAndServe(t, first, "tcp", "127.0.0.1:0"),
+		listenAndServe(t, second, "tcp", "127.0.0.1:0"),
+	}
+	if addrs[0].String() == addrs[1].String() {
+		t.Fatalf("both servers bound to %v", addrs[0])
+	}
+	for i, addr := range addrs {
+		if port := addr.(*net.TCPAddr).Port; port == 0 {
+			t.Fatalf("Addr() = %v, want the bound port", addr)
+		}
+		client := dial(addr.String())
+		go sendAll(client, "k", []byte("hi"))
+		_, r, err := client.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"1:hi", "2:hi"}[i]
+		if data, _ := io.ReadAll(r); string(data) != want {
+			t.Fatalf("server %d echoed %q, want %q", i+1, data, want)
+		}
+		client.Close()
+	}
+}
+
+func TestServerListenNetworks(t *testing.T) {
+	tests := []struct{ network, addr string }{
+		{"tcp4", "127.0.0.1:0"},
+		{"tcp6", "[::1]:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			if ln, err := net.Listen(tt.network, tt.addr); err != nil {
+				t.Skipf("%s isn't available: %v", tt.network, err)
+			} else {
+				ln.Close()
+			}
+			s := &Server{Handler: func(conn *Conn) { conn.Receive() }}
+			addr := listenAndServe(t, s, tt.network, tt.addr)
+			ip := addr.(*net.TCPAddr).IP
+			if (ip.To4() != nil) != (tt.network == "tcp4") {
+				t.Fatalf("%s server bound to %v", tt.network, addr)
+			}
+			client := dial(addr.String())
+			defer client.Close()
+			if err := client.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	t.Run("bad address", func(t *testing.T) {
+		s := &Server{Handler: func(*Conn) {}}
+		if err := s.ListenAndServe("tcp", "127.0.0.1:-1"); err == nil {
+			t.Fatal("ListenAndServe succeeded on an invalid port")
+		}
+	})
+}
+
+// flakyListener 的 Accept 先返回 burst 次临时错误，然后返回 fail（不为 nil 时）或正常接受连接
+type flakyListener struct {
+	net.Listener
+	burst atomic.Int32
+	fail  error
+}
+
+func (ln *flakyListener) Accept() (net.Conn, error) {
+	if ln.burst.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	if ln.fail != nil {
+		return nil, ln.fail
+	}
+	return ln.Listener.Accept()
+}
+
+// acceptErrors 记录 OnAcceptError 的调用
+type acceptErrors struct {
+	mu        sync.Mutex
+	temporary int
+	permanent []error
+}
+
+func (a *acceptErrors) observe(err error, temporary bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if temporary {
+		a.temporary++
+	} else {
+		a.permanent = append(a.permanent, err)
+	}
+}
+
+func (a *acceptErrors) counts() (int, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.temporary, len(a.permanent)
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+	const burst = 6
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &flakyListener{Listener: tcp}
+	ln.burst.Store(burst)
+	var errs acceptErrors
+	s := &Server{OnAcceptError: errs.observe, Handler: func(conn *Conn) {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		io.ReadAll(r)
+		sendAll(conn, key, nil)
+	}}
+	served := make(chan error, 1)
+	start := time.Now()
+	go func() { served <- s.Serve(ln) }()
+
+	// the burst is over before the first connection gets accepted
+	client := dial(tcp.Addr().String())
+	defer client.Close()
+	go sendAll(client, "k", []byte("data"))
+	if key, _, err := client.Receive(); err != nil || key != "k" {
+		t.Fatalf("got %q %v after the burst", key, err)
+	}
+	// 5+10+20+40+80+160ms
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("accepted after %v, the server didn't back off", elapsed)
+	}
+	if temporary, permanent := errs.counts(); temporary != burst || permanent != 0 {
+		t.Fatalf("OnAcceptError saw %d temporary and %d permanent errors", temporary, permanent)
+	}
+	s.Close()
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("Serve: got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServerAcceptPermanentError(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := errors.New("listener broken")
+	ln := &flakyListener{Listener: tcp, fail: fail}
+	ln.burst.Store(2)
+	var errs acceptErrors
+	s := &Server{OnAcceptError: errs.observe, Handler: func(*Conn) {}}
+	if err = s.Serve(ln); err != fail {
+		t.Fatalf("Serve: got %v, want %v", err, fail)
+	}
+	if temporary, permanent := errs.counts(); temporary != 2 || permanent != 1 || errs.permanent[0] != fail {
+		t.Fatalf("OnAcceptError saw %d temporary and %v permanent errors", temporary, errs.permanent)
+	}
+	// Serve closed the listener on the way out
+	if _, err = tcp.Accept(); err == nil {
+		t.Fatal("the listener is still open")
+	}
+}
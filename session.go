@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SSB 与 SSE 分别标记一个会话的开始与结束，payload 为会话 ID
+const (
+	SSB = "SSB0"
+	SSE = "SSE0"
+)
+
+// ErrSessionActive 表示已有一个会话尚未结束，会话不能嵌套或交叠
+var ErrSessionActive = errors.New("session already active")
+
+// ErrNoSession 表示指定的会话并不是当前活跃的会话
+var ErrNoSession = errors.New("no such active session")
+
+// SessionResult 描述接收方一个会话的最终结果
+type SessionResult struct {
+	ID       string
+	Keys     []string // 会话内收到的 key，按到达顺序排列
+	Complete bool     // 会话已结束且其中每个 key 的数据都已被完整读取
+	Err      error    // 会话未完成的原因
+}
+
+// recvSession 是接收方正在进行的会话
+type recvSession struct {
+	id      string
+	keys    []string
+	pending int  // streams opened in the session but not yet read to FIN
+	ended   bool // SSE received
+}
+
+// BeginSession 开始一个会话，之后到 EndSession 之前发送的所有 key 属于该会话；
+// 对端只有在会话中的所有 key 都被完整读取后才会通过 OnSession 得到完成通知；
+func (conn *Conn) BeginSession(id string) error {
+	conn.smu.Lock()
+	defer conn.smu.Unlock()
+	if conn.sendSession != "" {
+		return fmt.Errorf("%w: %q", ErrSessionActive, conn.sendSession)
+	}
+	if err := conn.writeFrame(SSB, []byte(id)); err != nil {
+		return err
+	}
+	conn.sendSession = id
+	return nil
+}
+
+// EndSession 结束由 BeginSession 开始的会话
+func (conn *Conn) EndSession(id string) error {
+	conn.smu.Lock()
+	defer conn.smu.Unlock()
+	if conn.sendSession != id {
+		return fmt.Errorf("%w: %q", ErrNoSession, id)
+	}
+	if err := conn.writeFrame(SSE, []byte(id)); err != nil {
+		return err
+	}
+	conn.sendSession = ""
+	return nil
+}
+
+// acceptSession 处理对端的 SSB/SSE 帧
+func (conn *Conn) acceptSession(tag string, id string) error {
+	conn.smu.Lock()
+	defer conn.smu.Unlock()
+	s := conn.recvSession
+	switch tag {
+	case SSB:
+		if s != nil {
+			return fmt.Errorf("%w: %q begins inside %q", ErrSessionActive, id, s.id)
+		}
+		conn.recvSession = &recvSession{id: id}
+	case SSE:
+		if s == nil || s.id != id {
+			return fmt.Errorf("%w: %q", ErrNoSession, id)
+		}
+		s.ended = true
+		conn.settleSessionLocked(nil)
+	}
+	return nil
+}
+
+// sessionStreamOpened 将新到达的 key 记入当前会话，返回该会话（没有会话时返回 nil）
+func (conn *Conn) sessionStreamOpened(key string) *recvSession {
+	conn.smu.Lock()
+	defer conn.smu.Unlock()
+	s := conn.recvSession
+	if s != nil {
+		s.keys = append(s.keys, key)
+		s.pending++
+	}
+	return s
+}
+
+// sessionStreamDone 在会话中的某个 key 读到 FIN 时调用，err 非 nil 表示该 key 未成功结束
+func (conn *Conn) sessionStreamDone(s *recvSession, err error) {
+	conn.smu.Lock()
+	defer conn.smu.Unlock()
+	if s != conn.recvSession {
+		return
+	}
+	if err != nil {
+		conn.settleSessionLocked(fmt.Errorf("session %q: %w", s.id, err))
+		return
+	}
+	s.pending--
+	conn.settleSessionLocked(nil)
+}
+
+// abortSession 在连接中断时将当前会话报告为未完成
+func (conn *Conn) abortSession(err error) {
+	conn.smu.Lock()
+	defer conn.smu.Unlock()
+	if s := conn.recvSession; s != nil {
+		conn.settleSessionLocked(fmt.Errorf("session %q interrupted: %w", s.id, err))
+	}
+}
+
+// settleSessionLocked 在会话完成或失败时通知 OnSession 并清除当前会话，调用者需持有 smu
+func (conn *Conn) settleSessionLocked(err error) {
+	s := conn.recvSession
+	if err == nil && !(s.ended && s.pending == 0) {
+		return
+	}
+	conn.recvSession = nil
+	if conn.cfg.OnSession != nil {
+		conn.cfg.OnSession(SessionResult{
+			ID:       s.id,
+			Keys:     s.keys,
+			Complete: err == nil,
+			Err:      err,
+		})
+	}
+}
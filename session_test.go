@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestSessionCompletes(t *testing.T) {
+	results := make(chan SessionResult, 1)
+	client, server := pipeConns(t, WithSessionHandler(func(r SessionResult) { results <- r }))
+	go func() {
+		client.BeginSession("dir")
+		for _, key := range []string{"a", "b", "c"} {
+			sendAll(client, key, []byte("data of "+key))
+		}
+		client.EndSession("dir")
+		client.Close()
+	}()
+	for _, want := range []string{"a", "b", "c"} {
+		key, r, err := server.Receive()
+		if err != nil || key != want {
+			t.Fatalf("got %q %v, want %q", key, err, want)
+		}
+		select {
+		case res := <-results:
+			t.Fatalf("session reported before %q was read: %+v", key, res)
+		default:
+		}
+		io.ReadAll(r)
+	}
+	// the end of the session comes after the last key
+	if _, _, err := server.Receive(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	res := <-results
+	if !res.Complete || res.Err != nil || res.ID != "dir" || !slices.Equal(res.Keys, []string{"a", "b", "c"}) {
+		t.Fatalf("got %+v", res)
+	}
+}
+
+func TestSessionInterrupted(t *testing.T) {
+	results := make(chan SessionResult, 1)
+	client, server := pipeConns(t, WithSessionHandler(func(r SessionResult) { results <- r }))
+	go func() {
+		client.BeginSession("dir")
+		sendAll(client, "a", []byte("data"))
+		// gone before EndSession
+		client.Close()
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	server.Receive()
+	res := <-results
+	if res.Complete || res.Err == nil || !slices.Equal(res.Keys, []string{"a"}) {
+		t.Fatalf("got %+v, want an incomplete session", res)
+	}
+}
+
+func TestSessionsDoNotNest(t *testing.T) {
+	client, server := pipeConns(t)
+	go receiveAll(server, false)
+	if err := client.BeginSession("outer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BeginSession("inner"); !errors.Is(err, ErrSessionActive) {
+		t.Fatalf("nested BeginSession: got %v, want ErrSessionActive", err)
+	}
+	if err := client.EndSession("inner"); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("EndSession of another id: got %v, want ErrNoSession", err)
+	}
+	if err := client.EndSession("outer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BeginSession("next"); err != nil {
+		t.Fatalf("a new session after the previous one ended: %v", err)
+	}
+}
+
+func TestSessionOverlapRejectedByReceiver(t *testing.T) {
+	a, b := net.Pipe()
+	server := NewConn(b, WithLegacyMode())
+	defer server.Close()
+	defer a.Close()
+	// a peer that doesn't check its own sessions
+	go a.Write(append(classicFrame(SSB, []byte("x")), classicFrame(SSB, []byte("y"))...))
+	if _, _, err := server.Receive(); !errors.Is(err, ErrSessionActive) {
+		t.Fatalf("got %v, want ErrSessionActive", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"slices"
+)
+
+// Shutdown 优雅地关闭连接：依次 Close 尚未 Close 的 writer 以向对端发出它们的 FIN，写出 CoalesceDelay 缓冲中的帧，
+// 然后关闭连接；调用时不应再有 goroutine 向这些 writer 写入；ctx 结束时不再等待，立即关闭连接并返回 ctx.Err()，
+// 例如对端停止读取时；否则返回结束 writer 或写出缓冲时遇到的第一个错误，连接总是被关闭；
+func (conn *Conn) Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.drainWrites()
+	}()
+	select {
+	case err := <-done:
+		conn.Close()
+		return err
+	case <-ctx.Done():
+		// closing the connection unblocks the writes still in progress
+		conn.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// drainWrites 结束所有尚未 Close 的 writer 并写出缓冲中的帧
+func (conn *Conn) drainWrites() error {
+	conn.omu.Lock()
+	writers := slices.Clone(conn.writers)
+	conn.omu.Unlock()
+	var first error
+	for _, w := range writers {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	if err := conn.Flush(); err != nil && first == nil {
+		first = err
+	}
+	return first
+}
+
+// trackWriter 记录（add 为 true）或移除一个尚未 Close 的 writer
+func (conn *Conn) trackWriter(w *ConnWriter, add bool) {
+	conn.omu.Lock()
+	defer conn.omu.Unlock()
+	if add {
+		conn.writers = append(conn.writers, w)
+		return
+	}
+	if i := slices.Index(conn.writers, w); i >= 0 {
+		conn.writers = slices.Delete(conn.writers, i, i+1)
+	}
+}
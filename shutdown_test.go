@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnShutdownDrains(t *testing.T) {
+	a, b := net.Pipe()
+	// nothing reaches the wire before Shutdown flushes it
+	client, server := NewConn(a, WithCoalesceDelay(time.Hour)), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	received := make(chan error, 1)
+	go func() {
+		items := append(batchItems(3), BatchItem{Key: "open", Data: []byte("not closed")})
+		if err := checkBatch(server, items); err != nil {
+			received <- err
+			return
+		}
+		_, _, err := server.Receive()
+		received <- err
+	}()
+
+	for _, item := range batchItems(3) {
+		if err := sendAll(client, item.Key, item.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a writer still open when Shutdown is called
+	w, err := client.Send("open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("not closed")); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// every key arrived complete, then the connection ended
+	if err = <-received; err != io.EOF {
+		t.Fatalf("got %v after the last key, want io.EOF", err)
+	}
+	if _, err = client.Send("late"); err == nil {
+		t.Fatal("Send succeeded after Shutdown")
+	}
+}
+
+func TestConnShutdownDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a, WithCoalesceDelay(time.Hour)), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(t, client, server)
+	if err := sendAll(client, "k", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	// the server stops reading, so the flush can't finish
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := client.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Shutdown took %v past its deadline", elapsed)
+	}
+	// closed anyway
+	if _, err := b.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the connection is still open")
+	}
+}
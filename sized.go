@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+)
+
+// SendSized 发送 key，其数据为从 r 中读取的恰好 size 字节；这些数据作为一个长度为 size 的数据帧，
+// 通过 io.CopyN 直接从 r 写入连接，不经过缓冲；
+// 启用了加密、HMAC、校验和、填充、压缩或 SendLimiter，或 size 超过对端的 MaxFrameSize（协商了优先级时为 64KB）时，需要先得到整个 payload 或拆分成多个帧，
+// 此时退回普通的 Send + io.CopyN；
+// r 中不足 size 字节时返回错误：退回的路径以 StatusAborted 结束该 key，直接写帧的路径已写出半个帧，连接会被关闭；
+func (conn *Conn) SendSized(key string, r io.Reader, size int64) error {
+	writer, err := conn.Send(key)
+	if err != nil {
+		return err
+	}
+	w := writer.(*ConnWriter)
+	if !w.streamable(size) {
+		if _, err = io.CopyN(w, r, size); err != nil {
+			w.CloseWithError(StatusAborted, err.Error())
+			return err
+		}
+		return w.Close()
+	}
+	if err = w.writeSized(r, size); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// streamable 报告能否把 size 字节的数据直接从 reader 写成一个数据帧
+func (c *ConnWriter) streamable(size int64) bool {
+	conn := c.conn
+	if c.compressor != nil || c.adaptive != nil || c.discard || c.closed || size <= 0 {
+		return false
+	}
+	if conn.sendKey != nil || conn.macEnabled() || conn.cfg.Checksum || conn.cfg.Padding != nil || conn.cfg.SendLimiter != nil {
+		return false
+	}
+	max := conn.maxDataLen()
+	return max <= 0 || size <= int64(max)
+}
+
+// writeSized 写出一个长度为 size 的数据帧，payload 从 r 中读取
+func (c *ConnWriter) writeSized(r io.Reader, size int64) error {
+	conn := c.conn
+	if err := conn.rejection(c.key); err != nil {
+		return err
+	}
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	if conn.upgrading {
+		return ErrUpgradeInProgress
+	}
+	var head bytes.Buffer
+	if err := conn.appendUrgentLocked(&head); err != nil {
+		return err
+	}
+	head.Write(conn.appendHeader(nil, HED, int(size)))
+	if err := conn.writeRaw(head.Bytes()); err != nil {
+		return err
+	}
+	// the payload goes straight to the connection, the header must not stay behind
+	if err := conn.flushLocked(); err != nil {
+		return err
+	}
+	if c.digest != nil {
+		r = io.TeeReader(r, c.digest)
+	}
+	n, err := io.CopyN(fullWriter{w: conn.n, policy: conn.cfg.Retry}, r, size)
+	conn.stats.wireBytesSent.Add(uint64(n))
+	if err != nil {
+		// the header promised size bytes, the peer can't find the next frame anymore
+		err = fmt.Errorf("send sized key %q: wrote %d of %d bytes: %w", c.key, n, size, err)
+		log.Println(conn, "write data error:", err)
+		conn.n.Close()
+	}
+	c.sent(n, err)
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSendSized(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		size int
+		opts []Option
+	}{
+		// without priorities nothing caps the frame below MaxFrameSize
+		{"1MB legacy", 1 << 20, []Option{WithLegacyMode()}},
+		{"priority chunk", priorityChunk, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) { testSendSized(t, tt.size, tt.opts...) })
+	}
+}
+
+func testSendSized(t *testing.T, size int, opts ...Option) {
+	var frames atomic.Int32
+	var largest atomic.Int64
+	a, b := net.Pipe()
+	client := NewConn(a, opts...)
+	server := NewConn(b, append(opts, WithFrameObserver(func(dir Direction, typ FrameType, length int) {
+		if dir == DirectionIn && typ == FrameData {
+			frames.Add(1)
+			largest.Store(max(largest.Load(), int64(length)))
+		}
+	}))...)
+	defer client.Close()
+	defer server.Close()
+	// a bounded section in the middle of something bigger
+	file := patterned(3 * size)
+	section := io.NewSectionReader(bytes.NewReader(file), int64(size/2), int64(size))
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendSized("section", section, int64(size)) }()
+
+	key, r, err := server.Receive()
+	if err != nil || key != "section" {
+		t.Fatalf("got %q %v", key, err)
+	}
+	got := make([]byte, size)
+	if _, err = io.ReadFull(r, got); err != nil || !bytes.Equal(got, file[size/2:size/2+size]) {
+		t.Fatalf("read %v, the data doesn't match", err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read %d, %v after the section, want EOF", n, err)
+	}
+	if err = <-sent; err != nil {
+		t.Fatal(err)
+	}
+	// the key and one frame for all of the data
+	if n := frames.Load(); n != 2 || largest.Load() != int64(size) {
+		t.Fatalf("%d data frames, the largest %d bytes", n, largest.Load())
+	}
+}
+
+func TestSendSizedFallback(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"psk", []Option{WithPSK(testPSK)}},
+		{"checksum", []Option{WithChecksum()}},
+		{"small frames", []Option{WithMaxFrameSize(4096)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pipeConns(t, tt.opts...)
+			data := patterned(100000)
+			sent := make(chan error, 1)
+			go func() { sent <- client.SendSized("k", bytes.NewReader(data), int64(len(data))) }()
+			_, r, err := server.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes, %v", len(got), err)
+			}
+			if err = <-sent; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSendSizedShortReader(t *testing.T) {
+	t.Run("direct", func(t *testing.T) {
+		client, server := pipeConns(t)
+		sent := make(chan error, 1)
+		go func() { sent <- client.SendSized("k", bytes.NewReader(make([]byte, 10)), 100) }()
+		_, r, err := server.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// half a frame, then the connection goes away
+		if got, err := io.ReadAll(r); err == nil {
+			t.Fatalf("read %d bytes without an error", len(got))
+		}
+		if err = <-sent; !errors.Is(err, io.EOF) {
+			t.Fatalf("got %v, want io.EOF", err)
+		}
+	})
+	t.Run("fallback", func(t *testing.T) {
+		client, server := pipeConns(t, WithChecksum())
+		sent := make(chan error, 1)
+		go func() { sent <- client.SendSized("k", bytes.NewReader(make([]byte, 10)), 100) }()
+		_, r, err := server.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var se *StreamError
+		if _, err = io.ReadAll(r); !errors.As(err, &se) || se.Status != StatusAborted {
+			t.Fatalf("got %v, want a StreamError with StatusAborted", err)
+		}
+		if err = <-sent; !errors.Is(err, io.EOF) {
+			t.Fatalf("got %v, want io.EOF", err)
+		}
+		// only the key was aborted, the connection still works
+		go sendAll(client, "next", []byte("data"))
+		if key, _, err := server.Receive(); err != nil || key != "next" {
+			t.Fatalf("got %q %v after the aborted key", key, err)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrProxyAuth 表示代理拒绝了本端的用户名与密码，或者不接受本端提供的任何认证方式
+var ErrProxyAuth = errors.New("proxy authentication failed")
+
+// ProxyError 表示与代理本身的交互失败，例如代理无法连接、认证失败或代理违反了协议；
+// 代理已经工作、只是目标地址无法连接时 Dial 返回的是 *DialError
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return "proxy " + e.Proxy + ": " + e.Err.Error()
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// socksReplyError 是 SOCKS5 代理对 CONNECT 请求的失败应答
+type socksReplyError byte
+
+func (e socksReplyError) Error() string {
+	switch e {
+	case 1:
+		return "socks5: general server failure"
+	case 2:
+		return "socks5: connection not allowed by ruleset"
+	case 3:
+		return "socks5: network unreachable"
+	case 4:
+		return "socks5: host unreachable"
+	case 5:
+		return "socks5: connection refused"
+	case 6:
+		return "socks5: ttl expired"
+	case 7:
+		return "socks5: command not supported"
+	case 8:
+		return "socks5: address type not supported"
+	}
+	return "socks5: unknown reply " + strconv.Itoa(int(e))
+}
+
+// target 报告该应答是否说明代理正常、只是目标地址无法连接
+func (e socksReplyError) target() bool {
+	return e >= 3 && e <= 6
+}
+
+// dialSOCKS5 经由 SOCKS5 代理 proxy 建立到 addr 的连接；proxy 中的用户信息用于用户名密码认证，
+// ctx 同时限制连接代理与代理握手的时间
+func dialSOCKS5(ctx context.Context, d *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	raw, err := d.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, &ProxyError{Proxy: proxy.Host, Err: err}
+	}
+	// only ctx interrupts the handshake, a deadline of our own could expire before ctx.Err() is set
+	stop := context.AfterFunc(ctx, func() {
+		raw.SetDeadline(time.Now())
+	})
+	defer stop()
+	if err = socksHandshake(raw, proxy, addr); err != nil {
+		raw.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		var reply socksReplyError
+		if errors.As(err, &reply) && reply.target() {
+			return nil, &DialError{Addr: addr, Err: err}
+		}
+		return nil, &ProxyError{Proxy: proxy.Host, Err: err}
+	}
+	return raw, nil
+}
+
+// socksHandshake 在 raw 上完成 SOCKS5 的认证协商与 CONNECT 请求
+func socksHandshake(raw net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	methods := []byte{0x00}
+	if proxy.User != nil {
+		methods = []byte{0x02}
+	}
+	greeting := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err = raw.Write(greeting); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err = io.ReadFull(raw, reply[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("not a socks5 proxy (version %d)", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if proxy.User == nil {
+			return ErrProxyAuth
+		}
+		if err = socksAuth(raw, proxy.User.Username(), proxyPassword(proxy)); err != nil {
+			return err
+		}
+	default:
+		return ErrProxyAuth
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, 0x01), ip4...)
+		} else {
+			req = append(append(req, 0x04), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err = raw.Write(req); err != nil {
+		return err
+	}
+	var head [4]byte
+	if _, err = io.ReadFull(raw, head[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if head[1] != 0x00 {
+		return socksReplyError(head[1])
+	}
+	// skip the bound address, we have no use for it
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		var n [1]byte
+		if _, err = io.ReadFull(raw, n[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("socks5: invalid address type %d", head[3])
+	}
+	_, err = io.CopyN(io.Discard, raw, int64(skip+2))
+	return unexpectedEOF(err)
+}
+
+// socksAuth 完成 RFC 1929 的用户名密码认证
+func socksAuth(raw net.Conn, user, password string) error {
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("socks5: user name or password too long")
+	}
+	req := append([]byte{0x01, byte(len(user))}, user...)
+	req = append(append(req, byte(len(password))), password...)
+	if _, err := raw.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(raw, reply[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if reply[1] != 0x00 {
+		return ErrProxyAuth
+	}
+	return nil
+}
+
+// proxyPassword 返回 proxy 中的密码，没有时为空字符串
+func proxyPassword(proxy *url.URL) string {
+	password, _ := proxy.User.Password()
+	return password
+}
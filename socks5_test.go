@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socks5Server 运行一个最小的 SOCKS5 代理，user 不为空时要求用户名密码认证；返回代理地址与每个 CONNECT 请求的目标
+func socks5Server(t *testing.T, user, password string) (addr string, targets <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	seen := make(chan string, 16)
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				socks5Serve(nc, user, password, seen)
+			}()
+		}
+	}()
+	return ln.Addr().String(), seen
+}
+
+// socks5Serve 处理一个代理连接，把 CONNECT 请求的目标交给 seen，连接成功后在两端之间转发直到任意一端关闭
+func socks5Serve(nc net.Conn, user, password string, seen chan<- string) {
+	var head [2]byte
+	if _, err := io.ReadFull(nc, head[:]); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(nc, methods); err != nil {
+		return
+	}
+	want := byte(0x00)
+	if user != "" {
+		want = 0x02
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		nc.Write([]byte{0x05, 0xff})
+		return
+	}
+	nc.Write([]byte{0x05, want})
+	if user != "" {
+		var b [1]byte
+		read := func() string {
+			io.ReadFull(nc, b[:])
+			s := make([]byte, b[0])
+			io.ReadFull(nc, s)
+			return string(s)
+		}
+		io.ReadFull(nc, b[:])
+		u, p := read(), read()
+		if u != user || p != password {
+			nc.Write([]byte{0x01, 0x01})
+			return
+		}
+		nc.Write([]byte{0x01, 0x00})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(nc, req[:]); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make(net.IP, map[byte]int{0x01: net.IPv4len, 0x04: net.IPv6len}[req[3]])
+		io.ReadFull(nc, ip)
+		host = ip.String()
+	case 0x03:
+		var n [1]byte
+		io.ReadFull(nc, n[:])
+		name := make([]byte, n[0])
+		io.ReadFull(nc, name)
+		host = string(name)
+	}
+	var port [2]byte
+	io.ReadFull(nc, port[:])
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	seen <- target
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		// connection refused
+		nc.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	nc.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	go io.Copy(upstream, nc)
+	io.Copy(nc, upstream)
+}
+
+// proxyURL 返回带有可选用户信息的 socks5 代理地址
+func proxyURL(addr string, user *url.Userinfo) *url.URL {
+	return &url.URL{Scheme: "socks5", Host: addr, User: user}
+}
+
+// echoServer 返回一个回显第一个 key 的服务端地址
+func echoServer(t *testing.T) string {
+	addr, _ := serveOn(t, &Server{Handler: func(conn *Conn) {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(r)
+		sendAll(conn, key, data)
+	}})
+	return addr
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	target := echoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	tests := []struct {
+		name     string
+		user     string
+		userinfo *url.Userinfo
+		addr     string
+	}{
+		{"no auth", "", nil, target},
+		{"password", "alice", url.UserPassword("alice", "s3cret"), target},
+		// resolved by the proxy, not by us
+		{"host name", "", nil, net.JoinHostPort("localhost", port)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, targets := socks5Server(t, tt.user, "s3cret")
+			conn, err := Dial(context.Background(), tt.addr, WithProxy(proxyURL(proxy, tt.userinfo)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := <-targets; got != tt.addr {
+				t.Fatalf("the proxy connected to %s, want %s", got, tt.addr)
+			}
+			go sendAll(conn, "k", []byte("via socks"))
+			_, r, err := conn.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := io.ReadAll(r); string(data) != "via socks" {
+				t.Fatalf("echo %q", data)
+			}
+		})
+	}
+}
+
+func TestDialSOCKS5AuthFailure(t *testing.T) {
+	proxy, _ := socks5Server(t, "alice", "s3cret")
+	target := echoServer(t)
+	for _, userinfo := range []*url.Userinfo{url.UserPassword("alice", "wrong"), nil} {
+		conn, err := Dial(context.Background(), target, WithProxy(proxyURL(proxy, userinfo)))
+		var proxyErr *ProxyError
+		if conn != nil || !errors.As(err, &proxyErr) || !errors.Is(err, ErrProxyAuth) || proxyErr.Proxy != proxy {
+			t.Fatalf("%v: got %v %v, want a *ProxyError wrapping ErrProxyAuth", userinfo, conn, err)
+		}
+	}
+}
+
+func TestDialSOCKS5Failures(t *testing.T) {
+	proxy, _ := socks5Server(t, "", "")
+	blackHole, _ := silentListener(t)
+	tests := []struct {
+		name   string
+		proxy  string
+		target string
+		ctx    time.Duration
+		check  func(error) bool
+	}{
+		{
+			// the proxy works, the server behind it doesn't
+			name: "target refused", proxy: proxy, target: freeAddr(t),
+			check: func(err error) bool {
+				var dialErr *DialError
+				var reply socksReplyError
+				return errors.As(err, &dialErr) && errors.As(err, &reply) && reply == 5
+			},
+		},
+		{
+			name: "proxy down", proxy: freeAddr(t), target: "127.0.0.1:1",
+			check: func(err error) bool {
+				var proxyErr *ProxyError
+				return errors.As(err, &proxyErr)
+			},
+		},
+		{
+			// the deadline covers the proxy handshake too
+			name: "proxy silent", proxy: blackHole, target: "127.0.0.1:1", ctx: 100 * time.Millisecond,
+			check: func(err error) bool {
+				var proxyErr *ProxyError
+				return errors.As(err, &proxyErr) && errors.Is(err, context.DeadlineExceeded)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.ctx > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.ctx)
+				defer cancel()
+			}
+			conn, err := Dial(ctx, tt.target, WithProxy(proxyURL(tt.proxy, nil)))
+			if conn != nil || !tt.check(err) {
+				t.Fatalf("got %v %v", conn, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// UPG 是发起方请求把当前连接升级为 TLS 的控制帧，payload 为空；
+// UPA 是接收方的应答，payload 为 1 字节，非 0 表示同意升级，之后双方立即在同一个连接上进行 TLS 握手
+const (
+	UPG = "UPG0"
+	UPA = "UPA0"
+)
+
+// ErrUpgradeDeclined 表示对端拒绝了 TLS 升级，例如对端没有通过 WithTLSUpgrade 配置证书
+var ErrUpgradeDeclined = errors.New("tls upgrade declined by peer")
+
+// ErrUpgradeInProgress 表示 TLS 升级尚未完成，期间不能写出其他帧
+var ErrUpgradeInProgress = errors.New("tls upgrade in progress")
+
+// UpgradeTLS 请求对端把当前连接升级为 TLS，并以客户端身份完成握手，之后的所有帧都经由 TLS 传输；
+// 对端需通过 WithTLSUpgrade 配置服务端证书，并且正在读取该连接；
+// 从发出请求到握手完成之前，其他 goroutine 写出帧会得到 ErrUpgradeInProgress；
+func (conn *Conn) UpgradeTLS(config *tls.Config) error {
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.wmu.Lock()
+	var buf bytes.Buffer
+	err := conn.appendFrameLocked(&buf, UPG, nil)
+	if err == nil {
+		err = conn.writeRaw(buf.Bytes())
+	}
+	if err != nil {
+		conn.wmu.Unlock()
+		return err
+	}
+	conn.upgrading = true
+	conn.wmu.Unlock()
+
+	reply, err := conn.expectFrame(UPA)
+	if err == nil && len(reply) != 1 {
+		err = errors.New("invalid upgrade ack frame")
+	}
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	conn.upgrading = false
+	if err != nil {
+		return err
+	}
+	if reply[0] == 0 {
+		return ErrUpgradeDeclined
+	}
+	return conn.startTLSLocked(func(raw net.Conn) *tls.Conn {
+		return tls.Client(raw, config)
+	})
+}
+
+// acceptUpgrade 处理对端的 UPG：未配置 TLSUpgrade 时拒绝，否则应答后以服务端身份完成握手
+func (conn *Conn) acceptUpgrade() error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	config := conn.cfg.TLSUpgrade
+	ack := []byte{0}
+	if config != nil {
+		ack[0] = 1
+	}
+	var buf bytes.Buffer
+	if err := conn.appendFrameLocked(&buf, UPA, ack); err != nil {
+		return err
+	}
+	if err := conn.writeRaw(buf.Bytes()); err != nil || config == nil {
+		return err
+	}
+	return conn.startTLSLocked(func(raw net.Conn) *tls.Conn {
+		return tls.Server(raw, config)
+	})
+}
+
+// startTLSLocked 在当前连接上完成 TLS 握手并换用 TLS 连接读写，超时时间与 HandshakeTimeout 相同；
+// 调用者需持有 wmu，并且没有其他 goroutine 在读取该连接
+func (conn *Conn) startTLSLocked(wrap func(net.Conn) *tls.Conn) error {
+	timeout := conn.cfg.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	// frames still held back belong to the plaintext connection
+	if err := conn.flushLocked(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// the peer's first handshake bytes may already sit in our read buffer
+	tc := wrap(&bufferedConn{Conn: conn.n, r: conn.r})
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.n.Close()
+		return &TLSHandshakeError{Addr: conn.n.RemoteAddr().String(), Err: err}
+	}
+	conn.n = tc
+	conn.r = conn.newReader(tc)
+	return nil
+}
+
+// bufferedConn 让读取先经过 r 中已经缓冲的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// keyServer 在本地 TCP 上以 opts 接受一个连接，把收到的每个 key 及其数据依次交给 got，连接结束时关闭 got
+func keyServer(t *testing.T, opts ...Option) (addr string, got <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := make(chan string, 10)
+	go func() {
+		defer close(out)
+		raw, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn := NewConn(raw, opts...)
+		defer conn.Close()
+		for {
+			key, r, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(r)
+			out <- key + "=" + string(data)
+		}
+	}()
+	return ln.Addr().String(), out
+}
+
+func TestUpgradeTLS(t *testing.T) {
+	cert, pool := selfSigned(t, "test server")
+	addr, got := keyServer(t, WithTLSUpgrade(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tee := &recordingConn{Conn: raw}
+	client := NewConn(tee)
+	defer client.Close()
+
+	if err = sendAll(client, "before", []byte("plain words")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "before=plain words" {
+		t.Fatalf("server got %q", s)
+	}
+	if err = client.UpgradeTLS(&tls.Config{RootCAs: pool, ServerName: "localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.TLSConnectionState(); !ok {
+		t.Fatal("not on tls after UpgradeTLS")
+	}
+	if err = sendAll(client, "after", []byte("secret words")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "after=secret words" {
+		t.Fatalf("server got %q", s)
+	}
+	wire := tee.bytes()
+	if !bytes.Contains(wire, []byte("plain words")) {
+		t.Fatal("the tee missed the plaintext stream")
+	}
+	if bytes.Contains(wire, []byte("secret words")) || bytes.Contains(wire, []byte("after")) {
+		t.Fatal("data sent after the upgrade went out in the clear")
+	}
+}
+
+func TestUpgradeTLSDeclined(t *testing.T) {
+	addr, got := keyServer(t)
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewConn(raw)
+	defer client.Close()
+	if err = client.UpgradeTLS(&tls.Config{}); !errors.Is(err, ErrUpgradeDeclined) {
+		t.Fatalf("got %v, want ErrUpgradeDeclined", err)
+	}
+	// still usable in plaintext
+	if err = sendAll(client, "k", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "k=data" {
+		t.Fatalf("server got %q", s)
+	}
+}
+
+func TestWriteDuringUpgrade(t *testing.T) {
+	a, b := net.Pipe()
+	client := NewConn(a, WithLegacyMode())
+	defer client.Close()
+	defer b.Close()
+	upgraded := make(chan error, 1)
+	go func() { upgraded <- client.UpgradeTLS(&tls.Config{}) }()
+	// the request, then no answer yet
+	if _, err := io.ReadFull(b, make([]byte, headerLen)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the upgrade to start", func() bool {
+		client.wmu.Lock()
+		defer client.wmu.Unlock()
+		return client.upgrading
+	})
+	if _, err := client.Send("k"); !errors.Is(err, ErrUpgradeInProgress) {
+		t.Fatalf("Send during the upgrade: got %v, want ErrUpgradeInProgress", err)
+	}
+	b.Write(classicFrame(UPA, []byte{0}))
+	if err := <-upgraded; !errors.Is(err, ErrUpgradeDeclined) {
+		t.Fatalf("got %v, want ErrUpgradeDeclined", err)
+	}
+}
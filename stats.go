@@ -0,0 +1,60 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// expvarMu 让检查名字与发布成为一步，expvar.Publish 遇到重名会 panic
+var expvarMu sync.Mutex
+
+// Stats 是一个连接的统计数据
+type Stats struct {
+	UnknownFrames      uint64 // 被跳过的扩展帧与不认识的帧的数量
+	BytesSent          uint64 // 应用写入的数据字节数
+	BytesReceived      uint64 // 交付给应用的数据字节数
+	WireBytesSent      uint64 // 数据帧实际携带的字节数，压缩的 key 按压缩后的长度计
+	WireBytesReceived  uint64 // 从数据帧中读出的字节数，压缩的 key 按压缩后的长度计
+	CompressedStreams  uint64 // 以压缩方式发送的 key 的数量
+	CompressionSkipped uint64 // AdaptiveCompression 判断压缩无效而不压缩发送的 key 的数量
+}
+
+// connStats 是 Stats 在连接上的实时计数
+type connStats struct {
+	unknownFrames      atomic.Uint64
+	bytesSent          atomic.Uint64
+	bytesReceived      atomic.Uint64
+	wireBytesSent      atomic.Uint64
+	wireBytesReceived  atomic.Uint64
+	compressedStreams  atomic.Uint64
+	compressionSkipped atomic.Uint64
+}
+
+// Stats 返回该连接当前的统计数据
+func (conn *Conn) Stats() Stats {
+	return Stats{
+		UnknownFrames:      conn.stats.unknownFrames.Load(),
+		BytesSent:          conn.stats.bytesSent.Load(),
+		BytesReceived:      conn.stats.bytesReceived.Load(),
+		WireBytesSent:      conn.stats.wireBytesSent.Load(),
+		WireBytesReceived:  conn.stats.wireBytesReceived.Load(),
+		CompressedStreams:  conn.stats.compressedStreams.Load(),
+		CompressionSkipped: conn.stats.compressionSkipped.Load(),
+	}
+}
+
+// PublishExpvar 将该连接的 Stats 以 name 发布到 expvar，每次读取时取当前值，例如经由 /debug/vars 查看；
+// name 已被占用时返回错误，不会 panic；expvar 不支持撤销发布，因此只适合为少量长期存在的连接发布
+func (conn *Conn) PublishExpvar(name string) error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("expvar %q already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() any {
+		return conn.Stats()
+	}))
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// expvarStats 读取 name 下发布的 Stats
+func expvarStats(t *testing.T, name string) Stats {
+	t.Helper()
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatalf("%q isn't published", name)
+	}
+	var s Stats
+	if err := json.Unmarshal([]byte(v.String()), &s); err != nil {
+		t.Fatalf("%q: %v", v.String(), err)
+	}
+	return s
+}
+
+func TestPublishExpvar(t *testing.T) {
+	// expvar is process wide and has no unpublish, -count=N must not collide
+	name := fmt.Sprintf("zhuozhuo-test-%d", time.Now().UnixNano())
+	client, server := pipeConns(t)
+	if err := client.PublishExpvar(name); err != nil {
+		t.Fatal(err)
+	}
+	if s := expvarStats(t, name); s != (Stats{}) {
+		t.Fatalf("a new connection published %+v", s)
+	}
+	data := patterned(100000)
+	go sendAll(client, "k", data)
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	// read live, not a snapshot from publishing time
+	if s := expvarStats(t, name); s.BytesSent != uint64(len(data)) || s != client.Stats() {
+		t.Fatalf("published %+v, Stats() = %+v", s, client.Stats())
+	}
+
+	if err = server.PublishExpvar(name); err == nil {
+		t.Fatal("published a second connection under the same name")
+	}
+	// the first one is still there
+	if s := expvarStats(t, name); s.BytesSent != uint64(len(data)) {
+		t.Fatalf("published %+v after the collision", s)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errOverQuota = errors.New("tenant over quota")
+
+// quotaServer 运行一个拒绝 tenant-b 的所有 key 的 Server，返回地址、Handler 收到的 key 和 OnStreamOpen 看到的信息
+func quotaServer(t *testing.T) (addr string, handled <-chan string, opened func() map[string]StreamInfo) {
+	t.Helper()
+	var mu sync.Mutex
+	infos := map[string]StreamInfo{}
+	keys := make(chan string, 10)
+	s := &Server{
+		OnStreamOpen: func(conn *Conn, key string, info StreamInfo) error {
+			mu.Lock()
+			infos[key] = info
+			mu.Unlock()
+			if strings.HasPrefix(key, "tenant-b/") {
+				return errOverQuota
+			}
+			return nil
+		},
+		Handler: func(conn *Conn) {
+			for {
+				key, r, err := conn.Receive()
+				if err != nil {
+					return
+				}
+				io.ReadAll(r)
+				keys <- key
+			}
+		},
+	}
+	addr, _ = serveOn(t, s)
+	return addr, keys, func() map[string]StreamInfo {
+		mu.Lock()
+		defer mu.Unlock()
+		return infos
+	}
+}
+
+func TestStreamOpenAccepted(t *testing.T) {
+	addr, handled, opened := quotaServer(t)
+	client := dial(addr)
+	defer client.Close()
+	w, err := client.SendCompressed("tenant-a/report", CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(strings.Repeat("row\n", 100)))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-handled; key != "tenant-a/report" {
+		t.Fatalf("handled %q", key)
+	}
+	if info := opened()["tenant-a/report"]; info.Compression != CompressionGzip {
+		t.Fatalf("OnStreamOpen saw %+v", info)
+	}
+}
+
+func TestStreamOpenRejected(t *testing.T) {
+	addr, handled, _ := quotaServer(t)
+	client := dial(addr)
+	defer client.Close()
+	// reads the server's RST
+	go client.Receive()
+	w, err := client.Send("tenant-b/report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key frame alone is enough for the server to refuse
+	eventually(t, "the rejection to arrive", func() bool { return client.rejection("tenant-b/report") != nil })
+	_, err = w.Write([]byte("data"))
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.Reason != errOverQuota.Error() {
+		t.Fatalf("got %v, want a rejection with the hook's reason", err)
+	}
+	w.Close()
+	// the connection goes on, the handler never saw the rejected key
+	if err = sendAll(client, "tenant-a/next", nil); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-handled; key != "tenant-a/next" {
+		t.Fatalf("handled %q", key)
+	}
+}
+
+func TestStreamOpenRejectedMidWrite(t *testing.T) {
+	addr, handled, _ := quotaServer(t)
+	client := dial(addr)
+	defer client.Close()
+	go client.Receive()
+	w, err := client.Send("tenant-b/upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write without waiting for a verdict, until the rejection catches up
+	chunk := patterned(64 << 10)
+	deadline := time.Now().Add(5 * time.Second)
+	for err == nil && time.Now().Before(deadline) {
+		_, err = w.Write(chunk)
+	}
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.Key != "tenant-b/upload" {
+		t.Fatalf("got %v, want a *RejectedError", err)
+	}
+	w.Close()
+	if err = sendAll(client, "tenant-a/next", nil); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-handled; key != "tenant-a/next" {
+		t.Fatalf("handled %q", key)
+	}
+}
+
+func TestStreamOpenInfo(t *testing.T) {
+	var info StreamInfo
+	a, b := net.Pipe()
+	client := NewConn(a)
+	server := NewConn(b, WithStreamOpenHook(func(conn *Conn, key string, i StreamInfo) error {
+		info = i
+		return nil
+	}))
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		w, _, err := client.SendWithID("k", "transfer-1")
+		if err == nil {
+			w.Close()
+		}
+	}()
+	if _, r, err := server.Receive(); err != nil {
+		t.Fatal(err)
+	} else {
+		io.ReadAll(r)
+	}
+	if info.TransferID != "transfer-1" {
+		t.Fatalf("OnStreamOpen saw %+v", info)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sendInPieces 以每次 piece 字节的写入发送 data
+func sendInPieces(conn *Conn, key string, data []byte, piece int) error {
+	w, err := conn.Send(key)
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := min(piece, len(data))
+		if _, err = w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return w.Close()
+}
+
+func TestMaxStreamSize(t *testing.T) {
+	const limit = 5000
+	tests := []struct {
+		name  string
+		size  int
+		piece int
+		fails bool
+	}{
+		{"at the limit", limit, 100, false},
+		{"one byte over", limit + 1, 100, true},
+		{"one large frame", 2 * limit, 2 * limit, true},
+		{"many small frames", 100 * limit, 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pipeConns(t, WithMaxStreamSize(limit))
+			data := patterned(tt.size)
+			go sendInPieces(client, "k", data, tt.piece)
+			_, r, err := server.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if !tt.fails {
+				if err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("read %d bytes, %v", len(got), err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrStreamTooLarge) {
+				t.Fatalf("got %v, want ErrStreamTooLarge", err)
+			}
+			if len(got) > limit {
+				t.Fatalf("delivered %d bytes past a limit of %d", len(got), limit)
+			}
+			// the rest of the stream is still on the wire
+			if _, _, err = server.Receive(); !errors.Is(err, ErrStreamTooLarge) {
+				t.Fatalf("Receive after the limit: got %v, want ErrStreamTooLarge", err)
+			}
+		})
+	}
+}
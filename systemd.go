@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart 是 systemd 传给服务的第一个文件描述符，之后的描述符依次递增
+const listenFDsStart = 3
+
+// ErrListenFDs 表示环境中有 systemd socket 激活的变量，但它们的内容不合法
+var ErrListenFDs = errors.New("invalid systemd socket activation environment")
+
+// ActivationListeners 返回 systemd socket 激活传给本进程的监听 socket，顺序与 socket unit 中的顺序相同；
+// 没有 LISTEN_FDS，或 LISTEN_PID 指向其他进程时返回 nil, nil；变量内容不合法时返回包装了 ErrListenFDs 的错误；
+// 读取后这些变量被清除，不会传给子进程；只能调用一次，之后描述符已经交给返回的 Listener
+func ActivationListeners() ([]net.Listener, error) {
+	fds, names, err := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	if err != nil || fds == 0 {
+		return nil, err
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	lns := make([]net.Listener, 0, fds)
+	for i := 0; i < fds; i++ {
+		fd := listenFDsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		// FileListener dups the descriptor with close-on-exec set, the original can go
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s (fd %d): %w", name, fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// listenFDs 解析 socket 激活的环境变量，返回传给进程 pid 的描述符数量及其名字；没有激活时返回 0
+func listenFDs(pidEnv, fdsEnv, namesEnv string, pid int) (fds int, names []string, err error) {
+	if fdsEnv == "" {
+		if pidEnv != "" {
+			return 0, nil, fmt.Errorf("%w: LISTEN_PID without LISTEN_FDS", ErrListenFDs)
+		}
+		return 0, nil, nil
+	}
+	if pidEnv == "" {
+		return 0, nil, fmt.Errorf("%w: LISTEN_FDS without LISTEN_PID", ErrListenFDs)
+	}
+	target, err := strconv.Atoi(pidEnv)
+	if err != nil || target <= 0 {
+		return 0, nil, fmt.Errorf("%w: LISTEN_PID=%q", ErrListenFDs, pidEnv)
+	}
+	if fds, err = strconv.Atoi(fdsEnv); err != nil || fds < 0 {
+		return 0, nil, fmt.Errorf("%w: LISTEN_FDS=%q", ErrListenFDs, fdsEnv)
+	}
+	if target != pid {
+		// meant for the process that exec'd us, not for us
+		return 0, nil, nil
+	}
+	if namesEnv != "" {
+		if names = strings.Split(namesEnv, ":"); len(names) != fds {
+			return 0, nil, fmt.Errorf("%w: LISTEN_FDNAMES has %d names for %d sockets", ErrListenFDs, len(names), fds)
+		}
+	}
+	return fds, names, nil
+}
+
+// ListenAndServeActivated 在 systemd socket 激活传入的所有 socket 上同时 Serve，TCP 与 unix socket 均可；
+// 没有激活时退回 ListenAndServe(network, addr)；环境变量不合法时返回包装了 ErrListenFDs 的错误，而不是悄悄自行监听；
+// 某个 socket 的 Serve 出错时关闭其余 socket，等它们都返回后返回第一个错误；继承来的 unix socket 文件由 systemd 管理，不会被删除；
+func (s *Server) ListenAndServeActivated(network, addr string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	lns, err := ActivationListeners()
+	if err != nil {
+		return err
+	}
+	if len(lns) == 0 {
+		return s.ListenAndServe(network, addr)
+	}
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) {
+			errc <- s.Serve(ln)
+		}(ln)
+	}
+	first := <-errc
+	if first != ErrServerClosed {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+	for range lns[1:] {
+		<-errc
+	}
+	return first
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestListenFDs(t *testing.T) {
+	const pid = 1234
+	tests := []struct {
+		name              string
+		pidEnv, fds, list string
+		want              int
+		names             []string
+		invalid           bool
+	}{
+		{name: "absent"},
+		{name: "one socket", pidEnv: "1234", fds: "1", want: 1},
+		{name: "named", pidEnv: "1234", fds: "2", list: "web:admin", want: 2, names: []string{"web", "admin"}},
+		{name: "none passed", pidEnv: "1234", fds: "0"},
+		{name: "another process", pidEnv: "99", fds: "2"},
+		{name: "pid without fds", pidEnv: "1234", invalid: true},
+		{name: "fds without pid", fds: "1", invalid: true},
+		{name: "bad pid", pidEnv: "me", fds: "1", invalid: true},
+		{name: "zero pid", pidEnv: "0", fds: "1", invalid: true},
+		{name: "bad fds", pidEnv: "1234", fds: "two", invalid: true},
+		{name: "negative fds", pidEnv: "1234", fds: "-1", invalid: true},
+		{name: "names mismatch", pidEnv: "1234", fds: "2", list: "web", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fds, names, err := listenFDs(tt.pidEnv, tt.fds, tt.list, pid)
+			if tt.invalid {
+				if !errors.Is(err, ErrListenFDs) {
+					t.Fatalf("got %v, want ErrListenFDs", err)
+				}
+				return
+			}
+			if err != nil || fds != tt.want || len(names) != len(tt.names) {
+				t.Fatalf("got %d %q %v, want %d %q", fds, names, err, tt.want, tt.names)
+			}
+			for i := range names {
+				if names[i] != tt.names[i] {
+					t.Fatalf("names %q, want %q", names, tt.names)
+				}
+			}
+		})
+	}
+}
+
+func TestListenAndServeActivatedFallback(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	s := &Server{Handler: func(conn *Conn) { conn.Receive() }}
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServeActivated("tcp", "127.0.0.1:0") }()
+	eventually(t, "the fallback listener", func() bool { return s.Addr() != nil })
+	client := dial(s.Addr().String())
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestListenAndServeActivatedMalformed(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "many")
+	s := &Server{Handler: func(*Conn) {}}
+	defer s.Close()
+	if err := s.ListenAndServeActivated("tcp", "127.0.0.1:0"); !errors.Is(err, ErrListenFDs) {
+		t.Fatalf("got %v, want ErrListenFDs", err)
+	}
+	if s.Addr() != nil {
+		t.Fatalf("listened on %v despite the broken environment", s.Addr())
+	}
+}
+
+// TestActivatedChild 在 ZZ_ACTIVATED_CHILD 设置时作为被 socket 激活的子进程运行：在继承的 socket 上回显，并带上自己读到的 LISTEN_FDS
+func TestActivatedChild(t *testing.T) {
+	if os.Getenv("ZZ_ACTIVATED_CHILD") == "" {
+		t.Skip("only runs as the child of TestListenAndServeActivated")
+	}
+	s := &Server{Handler: func(conn *Conn) {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(r)
+		sendAll(conn, key, append(data, os.Getenv("LISTEN_FDS")...))
+	}}
+	// the parent kills us once it is done
+	t.Fatal(s.ListenAndServeActivated("tcp", "127.0.0.1:0"))
+}
+
+func TestListenAndServeActivated(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no inherited descriptors or sh on windows")
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	path := filepath.Join(t.TempDir(), "zz.sock")
+	unix, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the socket file belongs to the child now, like it would to systemd
+	unix.(*net.UnixListener).SetUnlinkOnClose(false)
+	defer unix.Close()
+	var files []*os.File
+	for _, ln := range []interface{ File() (*os.File, error) }{tcp.(*net.TCPListener), unix.(*net.UnixListener)} {
+		f, err := ln.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	// LISTEN_PID has to name the child itself, which only sh knows before the exec
+	cmd := exec.Command("sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`, os.Args[0], "-test.run=^TestActivatedChild$")
+	cmd.Env = append(os.Environ(), "ZZ_ACTIVATED_CHILD=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=tcp:unix")
+	cmd.ExtraFiles = files
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	for _, target := range []struct{ network, addr string }{{"tcp", tcp.Addr().String()}, {"unix", path}} {
+		raw, err := net.Dial(target.network, target.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewConn(raw)
+		go sendAll(client, "k", []byte(target.network))
+		_, r, err := client.Receive()
+		if err != nil {
+			t.Fatalf("%s: %v", target.network, err)
+		}
+		// the child served the socket, and didn't leave LISTEN_FDS for its own children
+		if data, _ := io.ReadAll(r); string(data) != target.network {
+			t.Fatalf("%s: echoed %q", target.network, data)
+		}
+		client.Close()
+	}
+}
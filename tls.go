@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+)
+
+// ErrNotTLS 表示连接的底层不是 TLS 连接，因此没有对端身份
+var ErrNotTLS = errors.New("connection is not tls")
+
+// ErrNoPeerCertificate 表示 TLS 对端没有出示证书
+var ErrNoPeerCertificate = errors.New("peer presented no certificate")
+
+// TLSHandshakeError 表示 DialTLS 或 AcceptTLS 已建立 TCP 连接，但 TLS 握手失败，例如证书校验未通过
+type TLSHandshakeError struct {
+	Addr string
+	Err  error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return "tls handshake with " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *TLSHandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// DialTLS 建立到 addr 的 TCP 连接并完成 TLS 握手，得到一个你实现的连接对象；
+// config 未设置 ServerName 时使用 addr 中的主机名作为 SNI，ctx 同时限制拨号和握手的时间；
+// TLS 握手失败时返回 *TLSHandshakeError，之后的协议握手（例如凭证认证）失败时返回其错误；
+func DialTLS(ctx context.Context, addr string, config *tls.Config, opts ...Option) (*Conn, error) {
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tc := tls.Client(raw, config)
+	if err = tc.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, &TLSHandshakeError{Addr: addr, Err: err}
+	}
+	c := NewConn(tc, opts...)
+	if err = c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// TLSConnectionState 返回底层 TLS 连接协商出的状态，可用于检查对端证书；
+// 底层连接不是 *tls.Conn 时 ok 为 false；
+func (conn *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tc, ok := conn.n.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tc.ConnectionState(), true
+}
+
+// MutualTLSConfig 返回一个要求并校验客户端证书的服务端 TLS 配置，clientCAs 为签发客户端证书的 CA
+func MutualTLSConfig(cert tls.Certificate, clientCAs *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+}
+
+// AcceptTLS 在服务端已接受的连接 raw 上完成 TLS 握手，得到一个你实现的连接对象；
+// 握手失败时 raw 被关闭并返回 *TLSHandshakeError，例如客户端证书未通过校验；
+func AcceptTLS(ctx context.Context, raw net.Conn, config *tls.Config, opts ...Option) (*Conn, error) {
+	tc := tls.Server(raw, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, &TLSHandshakeError{Addr: raw.RemoteAddr().String(), Err: err}
+	}
+	return NewConn(tc, opts...), nil
+}
+
+// PeerIdentity 是对端经过校验的 TLS 证书及其中的 SAN
+type PeerIdentity struct {
+	Certificate    *x509.Certificate // leaf certificate
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+}
+
+// PeerIdentity 返回对端在 TLS 握手中出示的证书；尚未握手时先完成握手；
+// 底层连接不是 TLS 时返回 ErrNotTLS，对端没有出示证书时返回 ErrNoPeerCertificate；
+func (conn *Conn) PeerIdentity() (*PeerIdentity, error) {
+	tc, ok := conn.n.(*tls.Conn)
+	if !ok {
+		return nil, ErrNotTLS
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+	leaf := certs[0]
+	return &PeerIdentity{
+		Certificate:    leaf,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+	}, nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned 生成一个对 localhost 和 127.0.0.1 有效的自签名证书，以及只信任它的证书池
+func selfSigned(t *testing.T, cn string) (tls.Certificate, *x509.CertPool) {
+	cert := issue(t, cn, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	return cert, pool
+}
+
+// issue 由 parent 签发一个证书，parent 为 nil 时生成自签名的 CA 证书
+func issue(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: cn},
+		DNSNames:       []string{"localhost"},
+		EmailAddresses: []string{cn + "@example.com"},
+		IPAddresses:    []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.BasicConstraintsValid = true
+		tmpl.IsCA = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// tlsServer 在本地监听 TLS，把收到的每个 key 及其数据交给 got
+func tlsServer(t *testing.T, cert tls.Certificate) (addr string, got <-chan string) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := make(chan string, 1)
+	go func() {
+		raw, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn := NewConn(raw)
+		defer conn.Close()
+		key, r, err := conn.Receive()
+		if err != nil {
+			out <- err.Error()
+			return
+		}
+		data, _ := io.ReadAll(r)
+		out <- key + "=" + string(data)
+	}()
+	return ln.Addr().String(), out
+}
+
+func TestDialTLS(t *testing.T) {
+	cert, pool := selfSigned(t, "test server")
+	addr, got := tlsServer(t, cert)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// no ServerName: the SNI comes from addr
+	conn, err := DialTLS(ctx, addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state, ok := conn.TLSConnectionState()
+	if !ok || !state.HandshakeComplete {
+		t.Fatalf("TLSConnectionState() = %v, %v", state.HandshakeComplete, ok)
+	}
+	if cn := state.PeerCertificates[0].Subject.CommonName; cn != "test server" {
+		t.Fatalf("peer certificate for %q", cn)
+	}
+	if err = sendAll(conn, "k", []byte("over tls")); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "k=over tls" {
+		t.Fatalf("server got %q", s)
+	}
+}
+
+func TestDialTLSUntrustedCertificate(t *testing.T) {
+	cert, _ := selfSigned(t, "test server")
+	addr, _ := tlsServer(t, cert)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the system roots don't know the self-signed certificate
+	_, err := DialTLS(ctx, addr, nil)
+	var herr *TLSHandshakeError
+	if !errors.As(err, &herr) {
+		t.Fatalf("got %v, want a *TLSHandshakeError", err)
+	}
+	var verr *tls.CertificateVerificationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %v, want a certificate verification error", err)
+	}
+}
+
+func TestTLSConnectionStateWithoutTLS(t *testing.T) {
+	client, _ := pipeConns(t)
+	if _, ok := client.TLSConnectionState(); ok {
+		t.Fatal("TLSConnectionState() ok over a plain connection")
+	}
+}
+
+// mtlsServer 以 MutualTLSConfig 接受一个连接，把 AcceptTLS 和 PeerIdentity 的结果交给调用者
+func mtlsServer(t *testing.T, cert tls.Certificate, clientCAs *x509.CertPool) (addr string, got <-chan *PeerIdentity, errc <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ids, errs := make(chan *PeerIdentity, 1), make(chan error, 1)
+	go func() {
+		raw, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		conn, err := AcceptTLS(context.Background(), raw, MutualTLSConfig(cert, clientCAs))
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		id, err := conn.PeerIdentity()
+		if err != nil {
+			errs <- err
+			return
+		}
+		ids <- id
+		// keep the connection up until the client is done with the hello
+		conn.Receive()
+	}()
+	return ln.Addr().String(), ids, errs
+}
+
+func TestMutualTLSAccepted(t *testing.T) {
+	serverCert, serverPool := selfSigned(t, "test server")
+	ca := issue(t, "test ca", nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	client := issue(t, "alice", &ca)
+
+	addr, ids, errc := mtlsServer(t, serverCert, clientCAs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialTLS(ctx, addr, &tls.Config{RootCAs: serverPool, Certificates: []tls.Certificate{client}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case id := <-ids:
+		if id.Certificate.Subject.CommonName != "alice" ||
+			len(id.EmailAddresses) != 1 || id.EmailAddresses[0] != "alice@example.com" ||
+			len(id.DNSNames) != 1 || len(id.IPAddresses) != 1 {
+			t.Fatalf("got %+v", id)
+		}
+	case err := <-errc:
+		t.Fatal(err)
+	}
+	// and the client sees the server's identity the same way
+	if id, err := conn.PeerIdentity(); err != nil || id.Certificate.Subject.CommonName != "test server" {
+		t.Fatalf("got %v %v", id, err)
+	}
+}
+
+func TestMutualTLSRejected(t *testing.T) {
+	serverCert, serverPool := selfSigned(t, "test server")
+	ca := issue(t, "test ca", nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	// signed by a CA the server doesn't trust
+	other := issue(t, "other ca", nil)
+	client := issue(t, "mallory", &other)
+
+	for name, certs := range map[string][]tls.Certificate{"untrusted": {client}, "none": nil} {
+		t.Run(name, func(t *testing.T) {
+			addr, _, errc := mtlsServer(t, serverCert, clientCAs)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := DialTLS(ctx, addr, &tls.Config{RootCAs: serverPool, Certificates: certs})
+			if err == nil {
+				conn.Close()
+			}
+			var herr *TLSHandshakeError
+			if err := <-errc; !errors.As(err, &herr) {
+				t.Fatalf("server: got %v, want a *TLSHandshakeError", err)
+			}
+		})
+	}
+}
+
+func TestPeerIdentityWithoutTLS(t *testing.T) {
+	client, _ := pipeConns(t)
+	if _, err := client.PeerIdentity(); !errors.Is(err, ErrNotTLS) {
+		t.Fatalf("got %v, want ErrNotTLS", err)
+	}
+}
+
+// serveTLS 以 cert 在本地的空闲端口上运行 s.ListenAndServeTLS，返回监听地址
+func serveTLS(t *testing.T, s *Server, cert tls.Certificate) string {
+	t.Helper()
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ListenAndServeTLS("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-served
+	})
+	eventually(t, "the server to listen", func() bool { return s.Addr() != nil })
+	return s.Addr().String()
+}
+
+// handshakeErrors 收集 OnAcceptError 报告的 *TLSHandshakeError
+func handshakeErrors(s *Server) <-chan *TLSHandshakeError {
+	errc := make(chan *TLSHandshakeError, 10)
+	s.OnAcceptError = func(err error, temporary bool) {
+		var herr *TLSHandshakeError
+		if errors.As(err, &herr) && temporary {
+			errc <- herr
+		}
+	}
+	return errc
+}
+
+// tlsEcho 回复 key 的数据，并附上握手协商出的 SNI
+func tlsEcho(conn *Conn) {
+	key, r, err := conn.Receive()
+	if err != nil {
+		return
+	}
+	data, _ := io.ReadAll(r)
+	state, ok := conn.TLSConnectionState()
+	if !ok {
+		return
+	}
+	sendAll(conn, key, append(data, " to "+state.ServerName...))
+}
+
+func TestServeTLS(t *testing.T) {
+	cert, pool := selfSigned(t, "test server")
+	addr := serveTLS(t, &Server{Handler: tlsEcho}, cert)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := DialTLS(ctx, addr, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go sendAll(client, "k", []byte("hello"))
+	_, r, err := client.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "hello to localhost" {
+		t.Fatalf("got %q", data)
+	}
+}
+
+func TestServeTLSHandshakeFailure(t *testing.T) {
+	cert, pool := selfSigned(t, "test server")
+	s := &Server{Handler: tlsEcho}
+	errc := handshakeErrors(s)
+	addr := serveTLS(t, s, cert)
+	// a plaintext client
+	client := dial(addr)
+	go sendAll(client, "k", []byte("hello"))
+	select {
+	case herr := <-errc:
+		if herr.Addr != client.LocalAddr().String() {
+			t.Fatalf("handshake error reported for %s, the client is %s", herr.Addr, client.LocalAddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed handshake wasn't reported")
+	}
+	client.Close()
+	// the failure only cost that connection
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	good, err := DialTLS(ctx, addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	good.Close()
+}
+
+func TestServeTLSHandshakeTimeout(t *testing.T) {
+	cert, _ := selfSigned(t, "test server")
+	s := &Server{Handler: tlsEcho, TLSHandshakeTimeout: 100 * time.Millisecond}
+	errc := handshakeErrors(s)
+	addr := serveTLS(t, s, cert)
+	// connects and never says hello
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	start := time.Now()
+	select {
+	case herr := <-errc:
+		if !errors.Is(herr, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want a handshake timeout", herr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake never timed out")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("timed out after %v", d)
+	}
+	// and the server hung up
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = raw.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v reading from the silent client, want io.EOF", err)
+	}
+}
+
+// reportTLS 回复 key 的数据，并注明连接是否为 TLS
+func reportTLS(conn *Conn) {
+	key, r, err := conn.Receive()
+	if err != nil {
+		return
+	}
+	data, _ := io.ReadAll(r)
+	if _, ok := conn.TLSConnectionState(); ok {
+		data = append(data, " over tls"...)
+	} else {
+		data = append(data, " in plaintext"...)
+	}
+	sendAll(conn, key, data)
+}
+
+// echoOnce 在 conn 上发送 data 并返回回复
+func echoOnce(t *testing.T, conn *Conn, data string) string {
+	t.Helper()
+	go sendAll(conn, "k", []byte(data))
+	_, r, err := conn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := io.ReadAll(r)
+	return string(reply)
+}
+
+func TestServeTLSAllowPlaintext(t *testing.T) {
+	cert, pool := selfSigned(t, "test server")
+	addr := serveTLS(t, &Server{Handler: reportTLS, AllowPlaintext: true}, cert)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	secure, err := DialTLS(ctx, addr, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secure.Close()
+	plain := dial(addr)
+	defer plain.Close()
+
+	for _, tt := range []struct {
+		conn *Conn
+		want string
+	}{
+		{secure, "hello over tls"},
+		{plain, "hello in plaintext"},
+	} {
+		if got := echoOnce(t, tt.conn, "hello"); got != tt.want {
+			t.Fatalf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestServeTLSRefusesPlaintext(t *testing.T) {
+	cert, _ := selfSigned(t, "test server")
+	s := &Server{Handler: reportTLS}
+	errc := handshakeErrors(s)
+	addr := serveTLS(t, s, cert)
+	plain := dial(addr)
+	defer plain.Close()
+	go sendAll(plain, "k", []byte("hello"))
+	select {
+	case herr := <-errc:
+		var rerr tls.RecordHeaderError
+		if !errors.As(herr, &rerr) {
+			t.Fatalf("got %v, want a tls.RecordHeaderError", herr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the plaintext client wasn't refused")
+	}
+	if _, _, err := plain.Receive(); err == nil {
+		t.Fatal("the plaintext client got a reply")
+	}
+}
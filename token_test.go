@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+var testSecret = []byte("correct horse battery staple")
+
+// lookupToken 是只认识 alice 的 Authenticate
+func lookupToken(id string) ([]byte, error) {
+	if id != "alice" {
+		return nil, errors.New("unknown id")
+	}
+	return testSecret, nil
+}
+
+// recordingConn 记录写入底层连接的所有字节
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.written.Bytes())
+}
+
+// authenticatedSend 让使用 clientOpts 的一端向使用 serverOpts 的一端发送一个 key，返回双方的错误以及客户端写出的字节
+func authenticatedSend(t *testing.T, clientOpts, serverOpts []Option) (clientErr, serverErr error, server *Conn, wire []byte) {
+	t.Helper()
+	a, b := net.Pipe()
+	rec := &recordingConn{Conn: a}
+	client := NewConn(rec, clientOpts...)
+	server = NewConn(b, serverOpts...)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	done := make(chan error, 1)
+	go func() { done <- sendAll(client, "k", []byte("payload")) }()
+	// reads the server's auth frames, a rejection included
+	go client.Receive()
+	_, r, serverErr := server.Receive()
+	if serverErr == nil {
+		_, serverErr = io.ReadAll(r)
+	} else {
+		server.Close()
+	}
+	return <-done, serverErr, server, rec.bytes()
+}
+
+func TestTokenAuth(t *testing.T) {
+	clientErr, serverErr, server, wire := authenticatedSend(t,
+		[]Option{WithToken("alice", testSecret)},
+		[]Option{WithAuthenticator(lookupToken)})
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+	if id := server.Peer().TokenID; id != "alice" {
+		t.Fatalf("TokenID = %q", id)
+	}
+	if bytes.Contains(wire, testSecret) {
+		t.Fatal("the token was sent on the wire")
+	}
+}
+
+func TestTokenAuthWrongToken(t *testing.T) {
+	clientErr, serverErr, _, _ := authenticatedSend(t,
+		[]Option{WithToken("alice", []byte("wrong"))},
+		[]Option{WithAuthenticator(lookupToken)})
+	if !errors.Is(clientErr, ErrAuthFailed) || !errors.Is(serverErr, ErrBadCredentials) {
+		t.Fatalf("client: %v, server: %v", clientErr, serverErr)
+	}
+}
+
+func TestTokenAuthMissingToken(t *testing.T) {
+	clientErr, serverErr, _, _ := authenticatedSend(t, nil, []Option{WithAuthenticator(lookupToken)})
+	if clientErr == nil || !errors.Is(serverErr, ErrAuthFailed) {
+		t.Fatalf("client: %v, server: %v", clientErr, serverErr)
+	}
+}
+
+func TestMutualTokenAuth(t *testing.T) {
+	opts := []Option{WithToken("alice", testSecret), WithAuthenticator(lookupToken)}
+	clientErr, serverErr, _, _ := authenticatedSend(t, opts, opts)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal(clientErr, serverErr)
+	}
+}
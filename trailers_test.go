@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestTrailersAfterEOF(t *testing.T) {
+	client, server := pipeConns(t)
+	data := patterned(100 << 10)
+	sum := sha256.Sum256(data)
+	trailers := map[string]string{
+		"size":   fmt.Sprint(len(data)),
+		"sha256": hex.EncodeToString(sum[:]),
+		"empty":  "",
+	}
+	go func() {
+		w, err := client.Send("k")
+		if err != nil {
+			return
+		}
+		w.Write(data)
+		w.(*ConnWriter).CloseWithTrailers(trailers)
+	}()
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := r.(*ConnReader)
+	if cr.Trailers() != nil {
+		t.Fatal("trailers available before the end of the stream")
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || len(got) != len(data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if !reflect.DeepEqual(cr.Trailers(), trailers) {
+		t.Fatalf("Trailers() = %v", cr.Trailers())
+	}
+}
+
+func TestNoTrailers(t *testing.T) {
+	client, server := pipeConns(t)
+	go sendAll(client, "k", []byte("data"))
+	_, r, err := server.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	if tr := r.(*ConnReader).Trailers(); len(tr) != 0 {
+		t.Fatalf("Trailers() = %v after a plain Close", tr)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// TID 表示携带传输 ID 的 key 帧，payload 为 2 字节 ID 长度 + ID + key
+const TID = "TID0"
+
+// TAK 是接收方对 TID 的应答，payload 为 1 字节，非 0 表示该传输此前已经完成
+const TAK = "TAK0"
+
+// defaultTransferLRUSize 是每个 Conn 默认记住的已完成传输 ID 数量
+const defaultTransferLRUSize = 1024
+
+// TransferStore 记录已经完成的传输 ID，用于识别重复的传输
+type TransferStore interface {
+	Completed(id string) bool
+	Complete(id string)
+}
+
+// NewTransferID 生成一个随机的传输 ID；重试同一次传输时应复用同一个 ID
+func NewTransferID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// SendWithID 与 Send 相同，但为该传输附带一个传输 ID，id 为空时自动生成；
+// 若接收方已经完成过相同 ID 的传输，duplicate 为 true，此时写入 writer 的数据会被直接丢弃，
+// 接收方也不会再次把该传输交给应用，但仍需调用 writer.Close；
+func (conn *Conn) SendWithID(key, id string) (writer io.WriteCloser, duplicate bool, err error) {
+	if id == "" {
+		id = NewTransferID()
+	}
+	if len(id) > 0xffff {
+		return nil, false, errors.New("transfer id too long")
+	}
+	if err = conn.authorize(key, DirectionOut); err != nil {
+		return nil, false, err
+	}
+	if err = conn.reserveStream(); err != nil {
+		return nil, false, err
+	}
+	var w *ConnWriter
+	defer func() {
+		// once the writer exists, closing it gives the stream back
+		if w == nil {
+			conn.releaseStream()
+		}
+	}()
+	if err = conn.beginStream(conn.cfg.Priority); err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		if w == nil {
+			conn.endStream()
+		}
+	}()
+	conn.clearRejection(key)
+	payload := binary.LittleEndian.AppendUint16(nil, uint16(len(id)))
+	payload = append(payload, id...)
+	payload = append(payload, key...)
+	replyCh, forget := conn.awaitReply(TAK)
+	defer forget()
+	if err = conn.writeFrame(TID, payload); err != nil {
+		err = fmt.Errorf("send key %q: %w", key, err)
+		log.Println(conn, "send key to receiver error:", err)
+		return nil, false, err
+	}
+	reply, err := conn.waitReply(TAK, replyCh)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(reply) != 1 {
+		return nil, false, errors.New("invalid transfer ack frame")
+	}
+	duplicate = reply[0] != 0
+	log.Println("send key success key:", key, "duplicate:", duplicate)
+	w = conn.newWriter(key, conn.cfg.Priority)
+	w.turn = true
+	w.discard = duplicate
+	return w, duplicate, nil
+}
+
+// acceptTransfer 处理 TID 帧并应答发送方是否重复
+func (conn *Conn) acceptTransfer(payload []byte) (key, id string, duplicate bool, err error) {
+	if len(payload) < 2 {
+		return "", "", false, errors.New("invalid transfer key frame")
+	}
+	idLen := int(binary.LittleEndian.Uint16(payload))
+	if len(payload) < 2+idLen {
+		return "", "", false, errors.New("invalid transfer key frame")
+	}
+	id = string(payload[2 : 2+idLen])
+	key = string(payload[2+idLen:])
+	duplicate = conn.transfers().Completed(id)
+	ack := []byte{0}
+	if duplicate {
+		ack[0] = 1
+	}
+	if err = conn.writeFrame(TAK, ack); err != nil {
+		return "", "", false, err
+	}
+	return key, id, duplicate, nil
+}
+
+// transfers 返回该连接使用的 TransferStore，未配置时使用连接自身的 LRU
+func (conn *Conn) transfers() TransferStore {
+	if conn.cfg.TransferStore != nil {
+		return conn.cfg.TransferStore
+	}
+	if conn.seen == nil {
+		conn.seen = NewLRUTransferStore(defaultTransferLRUSize)
+	}
+	return conn.seen
+}
+
+// LRUTransferStore 是容量有限的 TransferStore，超出容量时淘汰最久未使用的 ID
+type LRUTransferStore struct {
+	mu   sync.Mutex
+	size int
+	ll   *list.List
+	m    map[string]*list.Element
+}
+
+// NewLRUTransferStore 创建一个最多记住 size 个 ID 的 LRUTransferStore，可在多个 Conn 之间共享
+func NewLRUTransferStore(size int) *LRUTransferStore {
+	return &LRUTransferStore{
+		size: size,
+		ll:   list.New(),
+		m:    map[string]*list.Element{},
+	}
+}
+
+func (s *LRUTransferStore) Completed(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[id]
+	if ok {
+		s.ll.MoveToFront(e)
+	}
+	return ok
+}
+
+func (s *LRUTransferStore) Complete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.m[id]; ok {
+		s.ll.MoveToFront(e)
+		return
+	}
+	s.m[id] = s.ll.PushFront(id)
+	if s.ll.Len() > s.size {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.m, oldest.Value.(string))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestTransferIDDeduplicates(t *testing.T) {
+	client, server := pipeConns(t)
+	handled := make(chan string, 4)
+	go server.Serve(context.Background(), func(key string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		handled <- key + "=" + string(data)
+		return err
+	})
+	// ACK-like replies are dispatched by whoever reads the client
+	go client.Receive()
+	id := NewTransferID()
+	for i, want := range []bool{false, true} {
+		w, duplicate, err := client.SendWithID("order", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duplicate != want {
+			t.Fatalf("attempt %d: duplicate = %v", i, duplicate)
+		}
+		w.Write([]byte("42"))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a different key after the replay proves the duplicate was consumed and skipped
+	sendAll(client, "next", nil)
+	if got := <-handled; got != "order=42" {
+		t.Fatalf("handled %q", got)
+	}
+	if got := <-handled; got != "next=" {
+		t.Fatalf("handled %q, the duplicate was delivered again", got)
+	}
+}
+
+func TestTransferIDAcrossConnections(t *testing.T) {
+	store := NewLRUTransferStore(16)
+	id := NewTransferID()
+	for i, want := range []bool{false, true} {
+		client, server := pipeConns(t, WithTransferStore(store))
+		read := make(chan struct{})
+		go func() {
+			_, r, err := server.Receive()
+			if err == nil {
+				io.Copy(io.Discard, r)
+			}
+			close(read)
+		}()
+		w, duplicate, err := client.SendWithID("order", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duplicate != want {
+			t.Fatalf("attempt %d: duplicate = %v", i, duplicate)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !duplicate {
+			// the receiver records the ID once it read the FIN
+			<-read
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUnixAbstractSocket(t *testing.T) {
+	name := fmt.Sprintf("@zhuozhuo-test-%d-%d", os.Getpid(), time.Now().UnixNano())
+	s := &Server{Handler: func(conn *Conn) {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(r)
+		sendAll(conn, key, bytes.ToUpper(data))
+	}}
+	served := make(chan error, 1)
+	// perm is ignored, there is no file to chmod
+	go func() { served <- s.ListenAndServeUnix(name, 0o600) }()
+	defer func() {
+		s.Close()
+		<-served
+	}()
+	eventually(t, "the socket to listen", func() bool { return s.Addr() != nil })
+
+	conn, err := DialUnix(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := bytes.Repeat([]byte("abstract "), 100000)
+	go sendAll(conn, "k", data)
+	_, r, err := conn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, bytes.ToUpper(data)) {
+		t.Fatalf("read %d bytes back, the data doesn't match", len(got))
+	}
+}
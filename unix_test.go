@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// unixServer 在临时目录中的 unix socket 上运行 handle，返回 socket 路径与 Server
+func unixServer(t *testing.T, handle func(*Conn)) (string, *Server) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zz.sock")
+	s := &Server{Handler: handle}
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServeUnix(path, 0o600) }()
+	t.Cleanup(func() {
+		s.Close()
+		<-served
+	})
+	eventually(t, "the socket to listen", func() bool { return s.Addr() != nil })
+	return path, s
+}
+
+func TestUnixRoundTrip(t *testing.T) {
+	path, s := unixServer(t, func(conn *Conn) {
+		key, r, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(r)
+		sendAll(conn, key, append(data, " back"...))
+	})
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("socket file: %v %v", fi, err)
+	}
+	conn, err := DialUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go sendAll(conn, "k", []byte("there and"))
+	key, r, err := conn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(r); err != nil || key != "k" || string(data) != "there and back" {
+		t.Fatalf("got %q %q %v", key, data, err)
+	}
+	conn.Close()
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the socket file to be removed", func() bool {
+		_, err := os.Stat(path)
+		return os.IsNotExist(err)
+	})
+}
+
+func TestUnixCloseWrite(t *testing.T) {
+	path, _ := unixServer(t, func(conn *Conn) {
+		var keys []string
+		for {
+			key, r, err := conn.Receive()
+			if err != nil {
+				break
+			}
+			io.ReadAll(r)
+			keys = append(keys, key)
+		}
+		// the client is done writing, but still reading
+		sendAll(conn, "count", []byte{byte(len(keys))})
+	})
+	conn, err := DialUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err = sendAll(conn, key, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := conn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); len(data) != 1 || data[0] != 3 {
+		t.Fatalf("the server counted %v keys", data)
+	}
+}
+
+func TestUnixDeadline(t *testing.T) {
+	path, _ := unixServer(t, func(conn *Conn) {
+		// never sends
+		conn.Receive()
+	})
+	conn, err := DialUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err = conn.Receive(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+}
+
+func TestCloseWriteUnsupported(t *testing.T) {
+	client, _ := pipeConns(t)
+	if err := client.CloseWrite(); !errors.Is(err, ErrCloseWriteUnsupported) {
+		t.Fatalf("got %v, want ErrCloseWriteUnsupported", err)
+	}
+}
+
+func TestUnixListenAfterShutdown(t *testing.T) {
+	s := &Server{Handler: func(*Conn) {}}
+	s.Close()
+	path := filepath.Join(t.TempDir(), "zz.sock")
+	if err := s.ListenAndServeUnix(path, 0); err != ErrServerClosed {
+		t.Fatalf("got %v, want ErrServerClosed", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("a closed Server left a socket file behind: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// receiveAfter 在 inject 写出的原始字节之后发送一个 key，返回接收方 Receive 的结果
+func receiveAfter(t *testing.T, client, server *Conn, raw net.Conn, inject []byte) (string, error) {
+	t.Helper()
+	go func() {
+		if _, err := raw.Write(inject); err == nil {
+			sendAll(client, "after", []byte("data"))
+		}
+	}()
+	key, r, err := server.Receive()
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(r)
+	return key + ":" + string(data), err
+}
+
+func TestUnknownClassicFrames(t *testing.T) {
+	for _, tc := range []struct {
+		tag    string
+		strict error
+	}{
+		{"ZZZZ", ErrUnknownFrameType},
+		{extensionTag(FrameExtension + 8), ErrUnknownFrame},
+	} {
+		for _, strict := range []bool{false, true} {
+			opts := []Option{WithLegacyMode()}
+			if strict {
+				opts = append(opts, WithStrictFrames())
+			}
+			a, b := net.Pipe()
+			client, server := NewConn(a, opts...), NewConn(b, opts...)
+			got, err := receiveAfter(t, client, server, a, classicFrame(tc.tag, []byte("from a newer peer")))
+			switch {
+			case strict && !errors.Is(err, tc.strict):
+				t.Errorf("%s strict: got %q %v, want %v", tc.tag, got, err, tc.strict)
+			case !strict && (err != nil || got != "after:data"):
+				t.Errorf("%s: got %q %v, want the frame to be skipped", tc.tag, got, err)
+			case !strict && server.Stats().UnknownFrames != 1:
+				t.Errorf("%s: UnknownFrames = %d", tc.tag, server.Stats().UnknownFrames)
+			}
+			client.Close()
+			server.Close()
+		}
+	}
+}
+
+func TestUnknownCompactFrameTypes(t *testing.T) {
+	for _, tc := range []struct {
+		typ    FrameType
+		strict error
+	}{
+		{FrameExtension - 1, ErrUnknownFrameType},
+		{FrameExtension + 8, ErrUnknownFrame},
+	} {
+		for _, strict := range []bool{false, true} {
+			opts := []Option{WithCompactHeader()}
+			if strict {
+				opts = append(opts, WithStrictFrames())
+			}
+			a, b := net.Pipe()
+			client, server := NewConn(a, opts...), NewConn(b, opts...)
+			handshakeBoth(t, client, server)
+			got, err := receiveAfter(t, client, server, a, []byte{byte(tc.typ), 3, 'n', 'e', 'w'})
+			switch {
+			case strict && !errors.Is(err, tc.strict):
+				t.Errorf("type %d strict: got %q %v, want %v", tc.typ, got, err, tc.strict)
+			case !strict && (err != nil || got != "after:data"):
+				t.Errorf("type %d: got %q %v, want the frame to be skipped", tc.typ, got, err)
+			}
+			client.Close()
+			server.Close()
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestUnwrap(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := NewConn(a)
+	defer conn.Close()
+	if conn.Unwrap() != a {
+		t.Fatal("Unwrap returned another connection")
+	}
+}
+
+func TestUnwrapRawConn(t *testing.T) {
+	ln := startServer(func(conn *Conn) {})
+	defer ln.Close()
+	conn := dial(ln.Addr().String())
+	defer conn.Close()
+	sc, ok := conn.Unwrap().(syscall.Conn)
+	if !ok {
+		t.Fatalf("%T has no SyscallConn", conn.Unwrap())
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.Control(func(fd uintptr) {}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UpgradeProtocol 是 HTTP/1.1 Upgrade 握手中 Upgrade 头的值
+const UpgradeProtocol = "zhuozhuo"
+
+// ErrUpgradeRefused 表示 HTTP 服务端没有以 101 Switching Protocols 同意升级
+var ErrUpgradeRefused = errors.New("http upgrade refused")
+
+// UpgradeHandler 是一个 http.Handler：收到带有 Connection: Upgrade 与 Upgrade: zhuozhuo 的 GET 请求时回应 101，
+// 接管底层连接，之后双方在该连接上使用本协议，可与已有的 HTTP 服务共用一个端口；
+// 不是 GET 的请求得到 405，没有请求升级的请求得到 426；
+type UpgradeHandler struct {
+	// Handler 处理升级后的连接，返回后连接被关闭
+	Handler func(conn *Conn)
+	// Options 用于创建每一个连接
+	Options []Option
+}
+
+func (h *UpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "upgrade requires GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), UpgradeProtocol) {
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", UpgradeProtocol)
+		http.Error(w, "this endpoint requires Upgrade: "+UpgradeProtocol, http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		// e.g. HTTP/2, which has no connection to hand over
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	raw, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the http server may have left its own timeouts on the connection
+	raw.SetDeadline(time.Time{})
+	resp := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + UpgradeProtocol + "\r\n\r\n"
+	if _, err = raw.Write([]byte(resp)); err != nil {
+		raw.Close()
+		return
+	}
+	// the client may already have sent its first frames
+	conn := NewConn(&bufferedConn{Conn: raw, r: brw.Reader}, h.Options...)
+	defer conn.Close()
+	h.Handler(conn)
+}
+
+// headerHasToken 报告以逗号分隔的头 name 中是否有 token，不区分大小写
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DialHTTPUpgrade 向 http 或 https 地址 rawURL 发送 Upgrade 请求，服务端同意后在该连接上得到一个你实现的连接对象；
+// 按环境变量 HTTPS_PROXY、HTTP_PROXY 与 NO_PROXY 经由 HTTP 代理的 CONNECT 或 SOCKS5 代理连接；https 时以 config 完成 TLS 握手，
+// config 为 nil 时使用默认配置；ctx 限制整个过程的时间；服务端不同意升级时返回包装了 ErrUpgradeRefused 的错误；
+func DialHTTPUpgrade(ctx context.Context, rawURL string, config *tls.Config, opts ...Option) (*Conn, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", UpgradeProtocol)
+	addr := canonicalAddr(req.URL)
+	proxy, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil && !supportedProxy(proxy.Scheme) {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	raw, err := dialThrough(ctx, proxy, nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "https" {
+		if raw, err = tlsClient(ctx, raw, config, req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	br, resp, err := roundTrip(ctx, raw, req)
+	if err == nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		err = fmt.Errorf("%w: %s %q", ErrUpgradeRefused, resp.Status, bodySnippet(resp))
+	} else if err == nil && !strings.EqualFold(resp.Header.Get("Upgrade"), UpgradeProtocol) {
+		err = fmt.Errorf("%w: server switched to %q", ErrUpgradeRefused, resp.Header.Get("Upgrade"))
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	c := NewConn(&bufferedConn{Conn: raw, r: br}, opts...)
+	if err = c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// roundTrip 在 raw 上发送 req 并读取回应的头，ctx 限制这一过程；返回的 reader 可能已经缓冲了回应之后的数据
+func roundTrip(ctx context.Context, raw net.Conn, req *http.Request) (*bufio.Reader, *http.Response, error) {
+	// only ctx interrupts the exchange, a deadline of our own could expire before ctx.Err() is set
+	stop := context.AfterFunc(ctx, func() {
+		raw.SetDeadline(time.Now())
+	})
+	defer stop()
+	if err := req.Write(raw); err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(raw)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, nil, err
+	}
+	return br, resp, nil
+}
+
+// bodySnippet 读取 resp 开头至多 256 字节的 body 用于错误信息，然后关闭它
+func bodySnippet(resp *http.Response) string {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	return strings.TrimSpace(string(b))
+}
+
+// tlsClient 在 raw 上以 config 完成客户端 TLS 握手，config 没有设置 ServerName 时使用 host
+func tlsClient(ctx context.Context, raw net.Conn, config *tls.Config, host string) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tc := tls.Client(raw, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, &TLSHandshakeError{Addr: raw.RemoteAddr().String(), Err: err}
+	}
+	return tc, nil
+}
+
+// canonicalAddr 返回 u 的 host:port，没有端口时按 scheme 使用 80 或 443
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
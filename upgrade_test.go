@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upgradeMux 在 /tunnel 上升级连接并回显收到的数据，其他路径是普通的 HTTP
+func upgradeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/tunnel", &UpgradeHandler{Handler: func(conn *Conn) {
+		for {
+			key, r, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(r)
+			sendAll(conn, key, data)
+		}
+	}})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "plain http")
+	})
+	return mux
+}
+
+// echoThrough 经由 conn 发送 data 并核对回显
+func echoThrough(t *testing.T, conn *Conn, data []byte) {
+	t.Helper()
+	go sendAll(conn, "k", data)
+	_, r, err := conn.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d bytes, sent %d", len(got), len(data))
+	}
+}
+
+func TestHTTPUpgrade(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		name := map[bool]string{false: "http", true: "https"}[secure]
+		t.Run(name, func(t *testing.T) {
+			var srv *httptest.Server
+			var config *tls.Config
+			if secure {
+				srv = httptest.NewTLSServer(upgradeMux())
+				pool := x509.NewCertPool()
+				pool.AddCert(srv.Certificate())
+				config = &tls.Config{RootCAs: pool}
+			} else {
+				srv = httptest.NewServer(upgradeMux())
+			}
+			defer srv.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := DialHTTPUpgrade(ctx, srv.URL+"/tunnel", config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			echoThrough(t, conn, []byte("small"))
+			echoThrough(t, conn, patterned(1<<20))
+
+			// the same port still serves plain requests
+			resp, err := srv.Client().Get(srv.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body := bodySnippet(resp); body != "plain http" {
+				t.Fatalf("GET / = %q", body)
+			}
+		})
+	}
+}
+
+func TestHTTPUpgradeRefused(t *testing.T) {
+	srv := httptest.NewServer(upgradeMux())
+	defer srv.Close()
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		status int
+	}{
+		{"no upgrade", http.MethodGet, nil, http.StatusUpgradeRequired},
+		{"other protocol", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, http.StatusUpgradeRequired},
+		{"post", http.MethodPost, map[string]string{"Connection": "Upgrade", "Upgrade": UpgradeProtocol}, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, srv.URL+"/tunnel", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %s, want %d", resp.Status, tt.status)
+			}
+			if tt.status == http.StatusUpgradeRequired && resp.Header.Get("Upgrade") != UpgradeProtocol {
+				t.Fatalf("a 426 without Upgrade: %s", UpgradeProtocol)
+			}
+		})
+	}
+	t.Run("dial plain endpoint", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := DialHTTPUpgrade(ctx, srv.URL+"/", nil)
+		if !errors.Is(err, ErrUpgradeRefused) || !strings.Contains(err.Error(), "plain http") {
+			t.Fatalf("got %v, want ErrUpgradeRefused with the body", err)
+		}
+	})
+	t.Run("bad scheme", func(t *testing.T) {
+		if _, err := DialHTTPUpgrade(context.Background(), "ftp://example.com/tunnel", nil); err == nil {
+			t.Fatal("dialed an ftp url")
+		}
+	})
+}
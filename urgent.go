@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// URG 是紧急消息帧，它不属于任何 key 的数据流，会在下一个帧边界插队发送
+const URG = "URG0"
+
+// MaxUrgentSize 是单条紧急消息 payload 的最大长度
+const MaxUrgentSize = 4 << 10
+
+// ErrUrgentTooLarge 表示紧急消息超过了 MaxUrgentSize
+var ErrUrgentTooLarge = errors.New("urgent message too large")
+
+// SendUrgent 向对端发送一条紧急消息，可在其他 goroutine 正在传输大量数据时调用；
+// 消息会排在所有尚未写出的数据帧之前，在下一个帧边界发出；
+// 对端通过 WithUrgentHandler 设置的回调接收，而不是通过 Receive；
+func (conn *Conn) SendUrgent(payload []byte) error {
+	if len(payload) > MaxUrgentSize {
+		return ErrUrgentTooLarge
+	}
+	conn.umu.Lock()
+	conn.urgent = append(conn.urgent, append([]byte(nil), payload...))
+	conn.umu.Unlock()
+
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	// a concurrent writer may already have flushed it with its own frame
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	var buf bytes.Buffer
+	if err := conn.appendUrgentLocked(&buf); err != nil || buf.Len() == 0 {
+		return err
+	}
+	return conn.writeRaw(buf.Bytes())
+}
+
+// appendUrgentLocked 将排队中的紧急消息编码为帧追加到 buf，调用者需持有 wmu
+func (conn *Conn) appendUrgentLocked(buf *bytes.Buffer) error {
+	conn.umu.Lock()
+	pending := conn.urgent
+	conn.urgent = nil
+	conn.umu.Unlock()
+	for _, payload := range pending {
+		if err := conn.appendFrameLocked(buf, URG, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
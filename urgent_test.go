@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUrgentDuringLargeTransfer(t *testing.T) {
+	const size = 16 << 20
+	var dataFrames atomic.Int64
+	urgent := make(chan int64, 1)
+	a, b := net.Pipe()
+	client := NewConn(a)
+	server := NewConn(b,
+		WithFrameObserver(func(dir Direction, typ FrameType, length int) {
+			if dir == DirectionIn && typ == FrameData {
+				dataFrames.Add(1)
+			}
+		}),
+		WithUrgentHandler(func(payload []byte) {
+			if string(payload) == "cancel-all" {
+				urgent <- dataFrames.Load()
+			}
+		}),
+		WithMaxFrameSize(64<<10),
+	)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, r, err := server.Receive()
+		if err == nil {
+			_, err = io.Copy(io.Discard, r)
+		}
+		done <- err
+	}()
+	go sendAll(client, "bulk", make([]byte, size))
+
+	eventually(t, "the transfer to start", func() bool { return dataFrames.Load() > 10 })
+	sentAt := dataFrames.Load()
+	if err := client.SendUrgent([]byte("cancel-all")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case at := <-urgent:
+		// the frame on the wire and the one being written may still go first, nothing queued behind them
+		if late := at - sentAt; late > 3 {
+			t.Fatalf("the urgent message arrived %d data frames after it was sent", late)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the urgent message never arrived")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUrgentTooLarge(t *testing.T) {
+	client, _ := pipeConns(t)
+	if err := client.SendUrgent(make([]byte, MaxUrgentSize+1)); !errors.Is(err, ErrUrgentTooLarge) {
+		t.Fatalf("got %v, want ErrUrgentTooLarge", err)
+	}
+}
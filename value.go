@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Codec 将值编码为一个 key 的数据，以及从中解码，例如 JSON 或 protobuf
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec 以 encoding/json 编解码
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// codec 返回该连接编解码值所用的 Codec
+func (conn *Conn) codec() Codec {
+	if conn.cfg.Codec != nil {
+		return conn.cfg.Codec
+	}
+	return JSONCodec{}
+}
+
+// SendValue 以 Codec 编码 v，并将结果作为 key 的全部数据发送
+func (conn *Conn) SendValue(key string, v any) error {
+	data, err := conn.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+	w, err := conn.Send(key)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		// a StatusOK FIN would let the receiver decode the truncated value
+		w.(*ConnWriter).Abort(err.Error())
+		return err
+	}
+	return w.Close()
+}
+
+// ReceiveValue 接收下一个 key，读完其全部数据后以 Codec 解码到 v；解码失败时数据已经读完，连接仍可继续接收下一个 key；
+// 数据会整个读入内存，对端不可信时应配置 MaxStreamSize
+func (conn *Conn) ReceiveValue(v any) (key string, err error) {
+	key, r, err := conn.Receive()
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return key, discardRest(r, err)
+	}
+	return key, conn.codec().Unmarshal(data, v)
+}
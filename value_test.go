@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type order struct {
+	ID       int               `json:"id"`
+	Customer string            `json:"customer"`
+	Items    []string          `json:"items"`
+	Tags     map[string]string `json:"tags"`
+	Placed   time.Time         `json:"placed"`
+	Shipped  *time.Time        `json:"shipped,omitempty"`
+}
+
+func TestSendValueJSON(t *testing.T) {
+	client, server := pipeConns(t)
+	want := order{
+		ID:       42,
+		Customer: "zhuo",
+		Items:    []string{"tea", "cups"},
+		Tags:     map[string]string{"gift": "yes"},
+		Placed:   time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC),
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- client.SendValue("order", want) }()
+	var got order
+	key, err := server.ReceiveValue(&got)
+	if err != nil || key != "order" {
+		t.Fatalf("got %q %v", key, err)
+	}
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReceiveValueDecodeError(t *testing.T) {
+	client, server := pipeConns(t)
+	go func() {
+		sendAll(client, "broken", []byte(`{"id": `))
+		client.SendValue("next", order{ID: 2})
+	}()
+	var got order
+	key, err := server.ReceiveValue(&got)
+	var syntax *json.SyntaxError
+	if key != "broken" || !errors.As(err, &syntax) {
+		t.Fatalf("got %q %v, want a decode error", key, err)
+	}
+	// the bad value was read in full, the next one decodes
+	if key, err = server.ReceiveValue(&got); err != nil || key != "next" || got.ID != 2 {
+		t.Fatalf("got %q %+v %v", key, got, err)
+	}
+}
+
+func TestSendValueMarshalError(t *testing.T) {
+	client, server := pipeConns(t)
+	// nothing goes out for a value that can't be encoded
+	var unsupported *json.UnsupportedTypeError
+	if err := client.SendValue("bad", make(chan int)); !errors.As(err, &unsupported) {
+		t.Fatalf("got %v, want *json.UnsupportedTypeError", err)
+	}
+	go client.SendValue("good", order{ID: 1})
+	var got order
+	if key, err := server.ReceiveValue(&got); err != nil || key != "good" {
+		t.Fatalf("got %q %v", key, err)
+	}
+}
+
+// gobCodec 以 encoding/gob 编解码，用于检验 WithCodec
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func TestSendValueCustomCodec(t *testing.T) {
+	client, server := pipeConns(t, WithCodec(gobCodec{}))
+	want := order{ID: 7, Customer: "gob", Items: []string{"a"}, Placed: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	go client.SendValue("order", want)
+	var got order
+	if _, err := server.ReceiveValue(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != want.ID || got.Customer != want.Customer || !got.Placed.Equal(want.Placed) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	// gob, not JSON, went over the wire
+	go sendAll(client, "json", []byte(`{"id": 1}`))
+	if _, err := server.ReceiveValue(&got); err == nil {
+		t.Fatal("the gob codec decoded JSON")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadMinimalUvarint(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want uint64
+		err  error
+	}{
+		{"zero", []byte{0}, 0, nil},
+		{"one byte", []byte{0x7f}, 127, nil},
+		{"two bytes", []byte{0x80, 0x01}, 128, nil},
+		{"max uint64", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 1<<64 - 1, nil},
+		{"overlong zero", []byte{0x80, 0x00}, 0, errOverlongVarint},
+		{"overlong 1", []byte{0x81, 0x80, 0x00}, 0, errOverlongVarint},
+		{"empty", nil, 0, io.EOF},
+		{"truncated", []byte{0x80}, 0, io.ErrUnexpectedEOF},
+	} {
+		got, err := readMinimalUvarint(bytes.NewReader(tc.in))
+		if got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%s: got %d %v, want %d %v", tc.name, got, err, tc.want, tc.err)
+		}
+	}
+	// one bit too many in the tenth byte, and more than ten bytes
+	for _, in := range [][]byte{
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x81, 0x00},
+	} {
+		if _, err := readMinimalUvarint(bytes.NewReader(in)); err == nil {
+			t.Errorf("%x: overflow not detected", in)
+		}
+	}
+}
+
+func TestCompactHeaderRejectsOverlongLength(t *testing.T) {
+	client, server := pipeConns(t, WithCompactHeader())
+	handshakeBoth(t, client, server)
+	typ, _ := frameTypeOf(HED)
+	go client.n.Write([]byte{byte(typ), 0x81, 0x00, 'k'})
+	if _, _, err := server.Receive(); !errors.Is(err, errOverlongVarint) {
+		t.Fatalf("got %v, want errOverlongVarint", err)
+	}
+}
+
+// benchmarkSmallMessages 发送 b.N 个 32 字节的 key，报告每个 key 在连接上占用的字节数
+func benchmarkSmallMessages(b *testing.B, opts ...Option) {
+	a, c := net.Pipe()
+	cc := &countingConn{Conn: a}
+	client, server := NewConn(cc, opts...), NewConn(c, opts...)
+	defer client.Close()
+	defer server.Close()
+	handshakeBoth(b, client, server)
+	go receiveAll(server, false)
+	payload := patterned(32)
+	start := cc.written.Load()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sendAll(client, "k", payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(cc.written.Load()-start)/float64(b.N), "wire-bytes/msg")
+}
+
+// BenchmarkSmallMessagesClassic 与 BenchmarkSmallMessagesCompact 对照两种帧头，
+// 以 -benchtime=1000000x 运行即为一百万条 32 字节的消息
+func BenchmarkSmallMessagesClassic(b *testing.B) {
+	benchmarkSmallMessages(b)
+}
+
+func BenchmarkSmallMessagesCompact(b *testing.B) {
+	benchmarkSmallMessages(b, WithCompactHeader())
+}
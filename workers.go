@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// ErrBusy 表示所有 worker 都在忙且等待队列已满，该 key 被拒绝
+var ErrBusy = errors.New("server busy")
+
+// OverflowPolicy 决定 WorkerPool 的 worker 与等待队列都已占满时如何处理新的 key
+type OverflowPolicy int
+
+const (
+	// OverflowBlock 让该连接排队等待空闲的 worker，等待期间不再读取该连接，发送者会因 TCP 流量控制而阻塞；
+	// 排队的 key 达到 queue 个后新的 key 同样以 ErrBusy 被拒绝，queue 为 0 时不限制排队的数量
+	OverflowBlock OverflowPolicy = iota
+	// OverflowReject 以 ErrBusy 拒绝该 key，发送者之后的写入会得到 *RejectedError，连接继续接收下一个 key
+	OverflowReject
+)
+
+// WorkerPool 返回一个 Middleware，限制同时运行的 handler 不超过 workers 个，可通过 ServeMux.Use 用于所有连接；
+// 没有空闲 worker 时最多 queue 个 key 排队等待，超出后按 overflow 处理，两种方式都会拒绝超出队列的 key；
+// 同一连接上的 key 依次处理，排队的 key 只阻塞它所在的连接，不会占用 worker，因此不会使其他连接死锁；
+func WorkerPool(workers, queue int, overflow OverflowPolicy) Middleware {
+	if workers <= 0 {
+		panic("zhuozhuo: worker pool needs at least one worker")
+	}
+	slots := make(chan struct{}, workers)
+	var waiting atomic.Int64
+	return func(next StreamHandler) StreamHandler {
+		return func(conn *Conn, key string, r io.Reader) error {
+			select {
+			case slots <- struct{}{}:
+			default:
+				n := waiting.Add(1)
+				// an unbounded queue only makes sense when the caller asked to block
+				if n > int64(queue) && (overflow == OverflowReject || queue > 0) {
+					waiting.Add(-1)
+					conn.Reject(key, ErrBusy)
+					return ErrBusy
+				}
+				slots <- struct{}{}
+				waiting.Add(-1)
+			}
+			defer func() { <-slots }()
+			return next(conn, key, r)
+		}
+	}
+}
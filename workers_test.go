@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolHammer(t *testing.T) {
+	const workers, conns, keys = 3, 20, 10
+	var running, peak, handled atomic.Int64
+	m := NewServeMux()
+	m.Use(WorkerPool(workers, 0, OverflowBlock))
+	m.Handle("job/{n}", func(conn *Conn, key string, r io.Reader) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		io.ReadAll(r)
+		time.Sleep(time.Millisecond)
+		handled.Add(1)
+		return nil
+	})
+	s := &Server{Handler: m.ServeConn}
+	addr, _ := serveOn(t, s)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := Dial(context.Background(), addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+			for j := 0; j < keys; j++ {
+				if err = sendAll(client, "job/"+string(rune('a'+j)), []byte("payload")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	eventually(t, "every key to be handled", func() bool { return handled.Load() == conns*keys })
+	if p := peak.Load(); p > workers {
+		t.Fatalf("%d handlers ran at once with %d workers", p, workers)
+	}
+}
+
+// busyPool 在只有一个 worker 的 ServeMux 上占住这个 worker，返回服务地址、已处理的 key 和释放 worker 的函数
+func busyPool(t *testing.T, queue int, overflow OverflowPolicy) (addr string, handled <-chan string, release func()) {
+	t.Helper()
+	keys, hold := make(chan string, 10), make(chan struct{})
+	m := NewServeMux()
+	m.Use(WorkerPool(1, queue, overflow))
+	m.Handle("hold", func(conn *Conn, key string, r io.Reader) error {
+		io.ReadAll(r)
+		keys <- key
+		<-hold
+		return nil
+	})
+	m.Handle("quick", func(conn *Conn, key string, r io.Reader) error {
+		io.ReadAll(r)
+		keys <- key
+		return nil
+	})
+	addr, _ = serveOn(t, &Server{Handler: m.ServeConn})
+	holder := dial(addr)
+	t.Cleanup(holder.Close)
+	if err := sendAll(holder, "hold", nil); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-keys; key != "hold" {
+		t.Fatalf("handled %q", key)
+	}
+	var once sync.Once
+	release = func() { once.Do(func() { close(hold) }) }
+	t.Cleanup(release)
+	return addr, keys, release
+}
+
+// rejectedSend 发送 key 并等待服务端以 ErrBusy 拒绝它
+func rejectedSend(t *testing.T, client *Conn, key string) {
+	t.Helper()
+	w, err := client.Send(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	eventually(t, "the rejection to arrive", func() bool { return client.rejection(key) != nil })
+	var rejected *RejectedError
+	if err = w.Close(); !errors.As(err, &rejected) || rejected.Reason != ErrBusy.Error() {
+		t.Fatalf("got %v, want a rejection with ErrBusy", err)
+	}
+}
+
+func TestWorkerPoolReject(t *testing.T) {
+	addr, handled, release := busyPool(t, 0, OverflowReject)
+	client := dial(addr)
+	defer client.Close()
+	// reads the server's RST
+	go client.Receive()
+	rejectedSend(t, client, "quick")
+	release()
+	// the connection survived the rejection
+	if err := sendAll(client, "quick", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-handled; key != "quick" {
+		t.Fatalf("handled %q", key)
+	}
+}
+
+func TestWorkerPoolBoundedQueue(t *testing.T) {
+	addr, handled, release := busyPool(t, 1, OverflowBlock)
+	queued := dial(addr)
+	defer queued.Close()
+	if err := sendAll(queued, "quick", []byte("waits")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case key := <-handled:
+		t.Fatalf("%q ran while the only worker was busy", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the queue is full now
+	client := dial(addr)
+	defer client.Close()
+	go client.Receive()
+	rejectedSend(t, client, "quick")
+
+	release()
+	if key := <-handled; key != "quick" {
+		t.Fatalf("handled %q", key)
+	}
+}
+
+func TestWorkerPoolNoWorkers(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("WorkerPool(0, ...) didn't panic")
+		}
+	}()
+	WorkerPool(0, 0, OverflowBlock)
+}
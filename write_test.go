@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// shortConn 每次 Write 最多写出 max 个字节并返回 nil 错误，就像缓冲区已满的非阻塞 socket
+type shortConn struct {
+	net.Conn
+	max int
+}
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	if c.max == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(p[:min(len(p), c.max)])
+}
+
+func TestShortWritesDeliverWholeFrames(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(&shortConn{Conn: a, max: 3}), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+	data := patterned(10 << 10)
+	go func() {
+		sendAll(client, "single", data)
+		w, err := client.Send("vector")
+		if err != nil {
+			return
+		}
+		w.(*ConnWriter).WriteBuffers(data[:100], data[100:])
+		w.Close()
+		client.SendBatch(batchItems(5))
+	}()
+	for _, want := range []string{"single", "vector"} {
+		key, r, err := server.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || key != want || string(got) != string(data) {
+			t.Fatalf("got %q with %d bytes %v, want %q with %d", key, len(got), err, want, len(data))
+		}
+	}
+	if err := checkBatch(server, batchItems(5)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStalledWriteReportsShortWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := NewConn(&shortConn{Conn: a, max: 0}, WithLegacyMode())
+	defer conn.Close()
+	// a Write that makes no progress and reports no error would spin forever
+	if _, err := conn.Send("k"); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("got %v, want io.ErrShortWrite", err)
+	}
+}
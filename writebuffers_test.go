@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestWriteBuffers(t *testing.T) {
+	parts := [][]byte{[]byte("header:"), patterned(10 << 10), []byte(":footer")}
+	want := bytes.Join(parts, nil)
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"checksum", []Option{WithChecksum()}},
+		{"compact", []Option{WithCompactHeader()}},
+		{"digest", []Option{WithDigest(sha256.New)}},
+		// sealed frames take the copying path
+		{"psk", []Option{WithPSK(testPSK)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var lengths []int
+			observe := WithFrameObserver(func(dir Direction, typ FrameType, length int) {
+				if dir == DirectionIn && typ == FrameData {
+					mu.Lock()
+					lengths = append(lengths, length)
+					mu.Unlock()
+				}
+			})
+			a, b := net.Pipe()
+			client, server := NewConn(a, tt.opts...), NewConn(b, append(tt.opts, observe)...)
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				w, err := client.Send("k")
+				if err != nil {
+					return
+				}
+				if n, err := w.(*ConnWriter).WriteBuffers(parts...); err != nil || n != len(want) {
+					t.Errorf("WriteBuffers = %d, %v", n, err)
+				}
+				w.Close()
+			}()
+			_, r, err := server.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("read %d bytes, %v", len(got), err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// the key frame, then the three buffers as one data frame
+			if len(lengths) != 2 || lengths[1] < len(want) {
+				t.Fatalf("data frames of %v bytes, want one of at least %d", lengths, len(want))
+			}
+		})
+	}
+}
+
+func TestWriteBuffersOverTCP(t *testing.T) {
+	parts := [][]byte{[]byte("a"), nil, patterned(1 << 20), []byte("z")}
+	got := make(chan []byte, 1)
+	ln := startServer(func(conn *Conn) {
+		_, r, err := conn.Receive()
+		if err != nil {
+			got <- nil
+			return
+		}
+		data, _ := io.ReadAll(r)
+		got <- data
+	})
+	defer ln.Close()
+	client := dial(ln.Addr().String())
+	defer client.Close()
+	w, err := client.Send("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.(*ConnWriter).WriteBuffers(parts...); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if data := <-got; !slices.Equal(data, bytes.Join(parts, nil)) {
+		t.Fatalf("server read %d bytes", len(data))
+	}
+}